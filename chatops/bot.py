@@ -4,6 +4,7 @@ import discord
 import ops
 import os
 import sqlite3
+import urllib.error
 import urllib.request
 
 bot = commands.Bot(
@@ -39,12 +40,25 @@ async def master_up(ctx: commands.Context):
 
     await ctx.send("Reloading masterdata...")
 
-    req = urllib.request.Request("http://localhost:9880/ops/reload")
-    with urllib.request.urlopen(req) as res:
-        await ctx.send("Reload: " + res.read().decode('utf-8'))
+    await ctx.send("Reload: " + call_ops("reload"))
     await ctx.send("Done")
 
 
+@bot.command()
+@commands.has_any_role("Moderator")
+async def master_rollback(ctx: commands.Context):
+    await ctx.send("Rollback: " + call_ops("rollback"))
+
+
+def call_ops(name: str) -> str:
+    req = urllib.request.Request("http://localhost:9880/ops/" + name)
+    try:
+        with urllib.request.urlopen(req) as res:
+            return res.read().decode('utf-8')
+    except urllib.error.HTTPError as e:
+        return e.read().decode('utf-8')
+
+
 if __name__ == '__main__':
     assert os.getenv("GDXSV_DB_NAME")
     assert os.getenv("GDXSV_DISCORD_TOKEN")
@@ -87,7 +87,8 @@ def insert_sqlite(conn: sqlite3.Connection, tables: Dict[str, List[List[str]]]):
                 for row in rows[1:]:
                     row[i] = int(row[i]) if row[i] else 0
         conn.execute(f"DELETE FROM {table}")
-        conn.executemany(f"INSERT INTO {table} VALUES ({','.join(['?'] * len(columns))})", rows[1:])
+        conn.executemany(
+            f"INSERT INTO {table} ({','.join(columns)}) VALUES ({','.join(['?'] * len(columns))})", rows[1:])
 
 
 if __name__ == '__main__':
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/caarlos0/env"
+	"go.uber.org/zap"
+	"golang.org/x/mod/semver"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the configuration of gdxsv.
+// Values are loaded in the following order, the latter overwrites the former.
+//  1. envDefault
+//  2. config file (-config flag)
+//  3. environment variables
+type Config struct {
+	LobbyAddr        string `env:"GDXSV_LOBBY_ADDR" envDefault:"localhost:3333" yaml:"lobby_addr"`
+	LobbyPublicAddr  string `env:"GDXSV_LOBBY_PUBLIC_ADDR" envDefault:"127.0.0.1:3333" yaml:"lobby_public_addr"`
+	LobbyHttpAddr    string `env:"GDXSV_LOBBY_HTTP_ADDR" envDefault:":3380" yaml:"lobby_http_addr"`
+	BattleAddr       string `env:"GDXSV_BATTLE_ADDR" envDefault:"localhost:3334" yaml:"battle_addr"`
+	BattlePublicAddr string `env:"GDXSV_BATTLE_PUBLIC_ADDR" envDefault:"127.0.0.1:3334" yaml:"battle_public_addr"`
+	BattleRegion     string `env:"GDXSV_BATTLE_REGION" envDefault:"" yaml:"battle_region"`
+	BattleLogPath    string `env:"GDXSV_BATTLE_LOG_PATH" envDefault:"./battlelog" yaml:"battle_log_path"`
+	CapturePath      string `env:"GDXSV_CAPTURE_PATH" envDefault:"./capture" yaml:"capture_path"`
+
+	// The number of games a mcs accepts at a time. 0 means unlimited.
+	// When every mcs in a region is full, another mcs is allocated.
+	McsMaxGames int `env:"GDXSV_MCS_MAX_GAMES" envDefault:"0" yaml:"mcs_max_games"`
+
+	// The IPv6 public address of the battle server e.g. "[2001:db8::1]:3334".
+	// Emulators reporting a public IPv6 address connect to it. Empty means IPv4 only.
+	BattlePublicAddr6 string `env:"GDXSV_BATTLE_PUBLIC_ADDR6" envDefault:"" yaml:"battle_public_addr6"`
+
+	GCPProjectID string `env:"GDXSV_GCP_PROJECT_ID" envDefault:"" yaml:"gcp_project_id"`
+	GCPKeyPath   string `env:"GDXSV_GCP_KEY_PATH" envDefault:"" yaml:"gcp_key_path"`
+	McsFuncURL   string `env:"GDXSV_MCSFUNC_URL" envDefault:"" yaml:"mcsfunc_url"`
+	WebhookUrl   string `env:"GDXSV_WEBHOOK_URL" envDefault:"" yaml:"webhook_url"`
+
+	// Port ranges per pseudo-region to run mcs subprocesses on this machine instead of mcsfunc.
+	// e.g. "asia-northeast1=20010-20019,us-west1=20020-20029"
+	LocalMcsRegions string `env:"GDXSV_LOCAL_MCS_REGIONS" envDefault:"" yaml:"local_mcs_regions"`
+
+	DBName string `env:"GDXSV_DB_NAME" envDefault:"gdxsv.db" yaml:"db_name"`
+
+	// The number of lobbies per platform and disk that are not defined in m_lobby_setting.
+	MaxLobbyCount int `env:"GDXSV_MAX_LOBBY_COUNT" envDefault:"22" yaml:"max_lobby_count"`
+
+	// Reloadable section can be updated while running by sending SIGHUP.
+	// Use getReloadableConfig() instead of referring this directly.
+	Reloadable *ReloadableConfig `yaml:"reloadable"`
+}
+
+// ReloadableConfig is a part of Config that is safe to be changed while running.
+type ReloadableConfig struct {
+	// Minimum required flycast version.
+	RequiredFlycastVersion string `env:"GDXSV_REQUIRED_FLYCAST_VERSION" envDefault:"v1.6.2" yaml:"required_flycast_version"`
+
+	// Released but broken flycast versions.
+	BannedFlycastVersions []string `env:"GDXSV_BANNED_FLYCAST_VERSIONS" envDefault:"v1.7.0,v1.7.1,v1.7.2,v1.8.0" yaml:"banned_flycast_versions"`
+
+	// A lobby peer is kicked when nothing received for this duration.
+	PeerKickTimeout time.Duration `env:"GDXSV_PEER_KICK_TIMEOUT" envDefault:"1m" yaml:"peer_kick_timeout"`
+
+	// A lobby peer is requested line check when nothing received for this duration.
+	LineCheckInterval time.Duration `env:"GDXSV_LINE_CHECK_INTERVAL" envDefault:"10s" yaml:"line_check_interval"`
+
+	// A mcs exits when no one has been connected for this duration.
+	McsIdleExitTimeout time.Duration `env:"GDXSV_MCS_IDLE_EXIT_TIMEOUT" envDefault:"15m" yaml:"mcs_idle_exit_timeout"`
+
+	// A mcs is degraded when its status has not been synced for McsDegradedTimeout
+	// or it reported McsDegradedErrors errors in a status, and dead after McsDeadTimeout.
+	// New battles are not assigned to a degraded or dead mcs.
+	McsDegradedTimeout time.Duration `env:"GDXSV_MCS_DEGRADED_TIMEOUT" envDefault:"10s" yaml:"mcs_degraded_timeout"`
+	McsDeadTimeout     time.Duration `env:"GDXSV_MCS_DEAD_TIMEOUT" envDefault:"30s" yaml:"mcs_dead_timeout"`
+	McsDegradedErrors  int64         `env:"GDXSV_MCS_DEGRADED_ERRORS" envDefault:"10" yaml:"mcs_degraded_errors"`
+
+	// Allowed rating difference from the longest waiting player in the ranked queue.
+	// It is widened by its initial value every RankedWidenInterval up to RankedRatingBandMax.
+	RankedRatingBand    int `env:"GDXSV_RANKED_RATING_BAND" envDefault:"100" yaml:"ranked_rating_band"`
+	RankedRatingBandMax int `env:"GDXSV_RANKED_RATING_BAND_MAX" envDefault:"400" yaml:"ranked_rating_band_max"`
+
+	// Allowed RTT in milliseconds between every player of a ranked match and a common region.
+	// It is widened by its initial value every RankedWidenInterval up to RankedRttLimitMax.
+	RankedRttLimit    int `env:"GDXSV_RANKED_RTT_LIMIT" envDefault:"80" yaml:"ranked_rtt_limit"`
+	RankedRttLimitMax int `env:"GDXSV_RANKED_RTT_LIMIT_MAX" envDefault:"160" yaml:"ranked_rtt_limit_max"`
+
+	RankedWidenInterval time.Duration `env:"GDXSV_RANKED_WIDEN_INTERVAL" envDefault:"30s" yaml:"ranked_widen_interval"`
+}
+
+var reloadableConfig atomic.Pointer[ReloadableConfig]
+
+func getReloadableConfig() *ReloadableConfig {
+	return reloadableConfig.Load()
+}
+
+// readConfig loads Config from envDefault, the config file and environment variables.
+// The config file is skipped when path is empty.
+func readConfig(path string) (*Config, error) {
+	c := &Config{Reloadable: new(ReloadableConfig)}
+	if err := env.Parse(c); err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return c, nil
+	}
+
+	bin, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(bin, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if c.Reloadable == nil {
+		c.Reloadable = new(ReloadableConfig)
+	}
+
+	// Environment variables take precedence over the config file.
+	e := &Config{Reloadable: new(ReloadableConfig)}
+	if err := env.Parse(e); err != nil {
+		return nil, err
+	}
+	overwriteByEnv(reflect.ValueOf(c).Elem(), reflect.ValueOf(e).Elem())
+
+	return c, nil
+}
+
+func overwriteByEnv(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			overwriteByEnv(dst.Field(i).Elem(), src.Field(i).Elem())
+			continue
+		}
+
+		key, ok := field.Tag.Lookup("env")
+		if !ok {
+			continue
+		}
+		if _, ok := os.LookupEnv(key); ok {
+			dst.Field(i).Set(src.Field(i))
+		}
+	}
+}
+
+// Validate returns all invalid values found in the config.
+func (c *Config) Validate() []error {
+	var errs []error
+
+	if c.MaxLobbyCount <= 0 {
+		errs = append(errs, fmt.Errorf("max_lobby_count must be positive: %d", c.MaxLobbyCount))
+	}
+	if c.McsMaxGames < 0 {
+		errs = append(errs, fmt.Errorf("mcs_max_games must not be negative: %d", c.McsMaxGames))
+	}
+	if c.BattlePublicAddr6 != "" {
+		if ip, _, err := toIPPort(c.BattlePublicAddr6); err != nil {
+			errs = append(errs, fmt.Errorf("battle_public_addr6: %w", err))
+		} else if ip.To4() != nil {
+			errs = append(errs, fmt.Errorf("battle_public_addr6 must be an ipv6 address: %q", c.BattlePublicAddr6))
+		}
+	}
+	if c.LocalMcsRegions != "" {
+		if _, err := parseLocalMcsRegions(c.LocalMcsRegions); err != nil {
+			errs = append(errs, fmt.Errorf("local_mcs_regions: %w", err))
+		}
+	}
+
+	r := c.Reloadable
+	if !semver.IsValid(r.RequiredFlycastVersion) {
+		errs = append(errs, fmt.Errorf("required_flycast_version is not a valid version: %q", r.RequiredFlycastVersion))
+	}
+	for _, v := range r.BannedFlycastVersions {
+		if !semver.IsValid(v) {
+			errs = append(errs, fmt.Errorf("banned_flycast_versions has an invalid version: %q", v))
+		}
+	}
+	if r.PeerKickTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("peer_kick_timeout must be positive: %v", r.PeerKickTimeout))
+	}
+	if r.LineCheckInterval <= 0 {
+		errs = append(errs, fmt.Errorf("line_check_interval must be positive: %v", r.LineCheckInterval))
+	}
+	if r.PeerKickTimeout <= r.LineCheckInterval {
+		errs = append(errs, fmt.Errorf("peer_kick_timeout must be longer than line_check_interval"))
+	}
+	if r.McsIdleExitTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("mcs_idle_exit_timeout must be positive: %v", r.McsIdleExitTimeout))
+	}
+	if r.McsDegradedTimeout <= 0 || r.McsDeadTimeout <= r.McsDegradedTimeout {
+		errs = append(errs, fmt.Errorf("mcs_degraded_timeout must be positive and shorter than mcs_dead_timeout"))
+	}
+	if r.McsDegradedErrors <= 0 {
+		errs = append(errs, fmt.Errorf("mcs_degraded_errors must be positive: %v", r.McsDegradedErrors))
+	}
+	if r.RankedRatingBand <= 0 || r.RankedRatingBandMax < r.RankedRatingBand {
+		errs = append(errs, fmt.Errorf("ranked_rating_band must be positive and not greater than ranked_rating_band_max"))
+	}
+	if r.RankedRttLimit <= 0 || r.RankedRttLimitMax < r.RankedRttLimit {
+		errs = append(errs, fmt.Errorf("ranked_rtt_limit must be positive and not greater than ranked_rtt_limit_max"))
+	}
+	if r.RankedWidenInterval <= 0 {
+		errs = append(errs, fmt.Errorf("ranked_widen_interval must be positive: %v", r.RankedWidenInterval))
+	}
+
+	return errs
+}
+
+func loadConfig() {
+	c, err := readConfig(*configPath)
+	if err != nil {
+		logger.Fatal("config load failed", zap.Error(err))
+	}
+	if errs := c.Validate(); 0 < len(errs) {
+		logger.Fatal("invalid config", zap.Errors("errors", errs))
+	}
+
+	logger.Info("config loaded", zap.Any("config", c))
+	conf = *c
+	reloadableConfig.Store(c.Reloadable)
+}
+
+// reloadConfig reads the config again and applies the reloadable section only.
+func reloadConfig() error {
+	c, err := readConfig(*configPath)
+	if err != nil {
+		return err
+	}
+	if errs := c.Validate(); 0 < len(errs) {
+		return fmt.Errorf("invalid config: %v", errs)
+	}
+
+	reloadableConfig.Store(c.Reloadable)
+	logger.Info("config reloaded", zap.Any("reloadable", c.Reloadable))
+	return nil
+}
+
+// watchConfigReload reloads the config whenever SIGHUP is received until ctx is done.
+func watchConfigReload(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if err := reloadConfig(); err != nil {
+				logger.Error("config reload failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// mainConfig runs config subcommands.
+func mainConfig(args []string) int {
+	if len(args) < 1 || args[0] != "check" {
+		printUsage()
+		return 1
+	}
+
+	c, err := readConfig(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	bin, err := yaml.Marshal(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	fmt.Print(string(bin))
+
+	errs := c.Validate()
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, "invalid:", err)
+	}
+	if 0 < len(errs) {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gdxsv.yaml")
+	must(t, os.WriteFile(path, []byte(`
+lobby_addr: "0.0.0.0:3333"
+battle_addr: "0.0.0.0:3334"
+reloadable:
+  required_flycast_version: v1.8.1
+  peer_kick_timeout: 2m
+`), 0644))
+
+	t.Setenv("GDXSV_BATTLE_ADDR", "0.0.0.0:9999")
+
+	c, err := readConfig(path)
+	must(t, err)
+	assertEq(t, 0, len(c.Validate()))
+
+	// from the config file
+	assertEq(t, "0.0.0.0:3333", c.LobbyAddr)
+	assertEq(t, "v1.8.1", c.Reloadable.RequiredFlycastVersion)
+	assertEq(t, 2*time.Minute, c.Reloadable.PeerKickTimeout)
+
+	// environment variables take precedence
+	assertEq(t, "0.0.0.0:9999", c.BattleAddr)
+
+	// envDefault
+	assertEq(t, "gdxsv.db", c.DBName)
+	assertEq(t, 22, c.MaxLobbyCount)
+	assertEq(t, 10*time.Second, c.Reloadable.LineCheckInterval)
+	assertEq(t, []string{"v1.7.0", "v1.7.1", "v1.7.2", "v1.8.0"}, c.Reloadable.BannedFlycastVersions)
+}
+
+func TestConfig_Validate(t *testing.T) {
+	c, err := readConfig("")
+	must(t, err)
+	assertEq(t, 0, len(c.Validate()))
+
+	c.MaxLobbyCount = 0
+	c.Reloadable.RequiredFlycastVersion = "1.6.2"
+	c.Reloadable.LineCheckInterval = 2 * time.Minute
+	assertEq(t, 3, len(c.Validate()))
+
+	c.BattlePublicAddr6 = "192.0.2.1:9877"
+	assertEq(t, 4, len(c.Validate()))
+	c.BattlePublicAddr6 = "[2001:db8::1]:9877"
+	assertEq(t, 3, len(c.Validate()))
+}
@@ -100,6 +100,65 @@ type BattleRecord struct {
 	System  uint32    `db:"system" json:"system,omitempty"`
 }
 
+// BattleConnStats is the connection quality of a user in a battle measured by the mcs.
+type BattleConnStats struct {
+	BattleCode  string    `db:"battle_code" json:"battle_code"`
+	UserID      string    `db:"user_id" json:"user_id"`
+	Pos         int       `db:"pos" json:"pos"`
+	Proto       string    `db:"proto" json:"proto"`
+	RTTMs       int64     `db:"rtt_ms" json:"rtt_ms"`
+	Loss        float64   `db:"loss" json:"loss"`
+	Resent      int64     `db:"resent" json:"resent"`
+	Dropped     int64     `db:"dropped" json:"dropped"`
+	MaxGapMs    int64     `db:"max_gap_ms" json:"max_gap_ms"`
+	BytesIn     int64     `db:"bytes_in" json:"bytes_in"`
+	BytesOut    int64     `db:"bytes_out" json:"bytes_out"`
+	CloseReason string    `db:"close_reason" json:"close_reason"`
+	Created     time.Time `db:"created" json:"created"`
+}
+
+// P2PReport is the P2PMatchingReport sent by a peer of a P2P battle.
+type P2PReport struct {
+	BattleCode         string    `db:"battle_code" json:"battle_code"`
+	PeerID             int       `db:"peer_id" json:"peer_id"`
+	UserID             string    `db:"user_id" json:"user_id"`
+	Flycast            string    `db:"flycast" json:"flycast"`
+	OS                 string    `db:"os" json:"os"`
+	CloseReason        string    `db:"close_reason" json:"close_reason"`
+	PlayerCount        int       `db:"player_count" json:"player_count"`
+	FrameCount         int       `db:"frame_count" json:"frame_count"`
+	DisconnectedPeerID int       `db:"disconnected_peer_id" json:"disconnected_peer_id"`
+	FpsAvg             float64   `db:"fps_avg" json:"fps_avg"`
+	FpsMin             float64   `db:"fps_min" json:"fps_min"`
+	TotalTimesync      int       `db:"total_timesync" json:"total_timesync"`
+	InputBlockCount0   int       `db:"input_block_count_0" json:"input_block_count_0"`
+	InputBlockCount1   int       `db:"input_block_count_1" json:"input_block_count_1"`
+	InputBlockCount2   int       `db:"input_block_count_2" json:"input_block_count_2"`
+	Created            time.Time `db:"created" json:"created"`
+}
+
+// UserDisconnect is a disconnect in the middle of a battle attributed to the user.
+type UserDisconnect struct {
+	BattleCode string    `db:"battle_code" json:"battle_code"`
+	UserID     string    `db:"user_id" json:"user_id"`
+	Reason     string    `db:"reason" json:"reason"`
+	Source     string    `db:"source" json:"source"`     // "p2p" or "mcs"
+	Reporter   string    `db:"reporter" json:"reporter"` // user_id of the P2P peer that reported it
+	Forgiven   bool      `db:"forgiven" json:"forgiven"` // excluded from the penalty by ops
+	Created    time.Time `db:"created" json:"created"`
+}
+
+// P2PReportSummary summarizes the P2P reports of a user or a flycast version.
+type P2PReportSummary struct {
+	Key            string  `db:"key" json:"key"` // user_id or flycast version
+	Reports        int     `db:"reports" json:"reports"`
+	DisconnectRate float64 `db:"disconnect_rate" json:"disconnect_rate"` // the ratio of the battles that did not end normally
+	FpsAvg         float64 `db:"fps_avg" json:"fps_avg"`
+	FpsMin         float64 `db:"fps_min" json:"fps_min"`
+	InputBlocks    float64 `db:"input_blocks" json:"input_blocks"` // input stalls per battle
+	Timesync       float64 `db:"timesync" json:"timesync"`         // timesyncs per battle
+}
+
 type BattleCountResult struct {
 	Battle int `json:"battle,omitempty"`
 	Win    int `json:"win,omitempty"`
@@ -175,6 +234,32 @@ type MLobbySetting struct {
 	PatchNames       string `db:"patch_names" json:"patch_names"`
 	WinRateLimit     int    `db:"win_rate_limit" json:"win_rate_limit"`
 	MinClientVersion string `db:"min_client_version" json:"min_client_version"`
+	Hidden           bool   `db:"hidden" json:"hidden"`
+	RoomCount        int    `db:"room_count" json:"room_count"`
+	RankedQueue      bool   `db:"ranked_queue" json:"ranked_queue"`
+	RegionWeights    string `db:"region_weights" json:"region_weights"`
+	SortOrder        int    `db:"sort_order" json:"sort_order"` // lobbies are listed by sort_order and no
+}
+
+type MLobbySchedule struct {
+	ID         string    `db:"id" json:"id"`
+	Platform   string    `db:"platform" json:"platform"`
+	Disk       string    `db:"disk" json:"disk"`
+	No         int       `db:"no" json:"no"`
+	Name       string    `db:"name" json:"name"`
+	StartAt    time.Time `db:"start_at" json:"start_at"`
+	EndAt      time.Time `db:"end_at" json:"end_at"`
+	RuleID     string    `db:"rule_id" json:"rule_id"`
+	PatchNames string    `db:"patch_names" json:"patch_names"`
+	Comment    string    `db:"comment" json:"comment"`
+}
+
+type MRegion struct {
+	ID       string `db:"id" json:"id"`
+	Name     string `db:"name" json:"name"`
+	Group    string `db:"region_group" json:"region_group"`
+	Provider string `db:"provider" json:"provider"`
+	Enabled  bool   `db:"enabled" json:"enabled"`
 }
 
 type MRule struct {
@@ -277,9 +362,54 @@ type DB interface {
 	// SaveBattleRoundWin updates battle_record to set round_win for all participants.
 	SaveBattleRoundWin(battleCode string, roundWin string) error
 
+	// DisableBattleAggregate updates battle_record to exclude the battle from the results.
+	// This function is used when a battle could not be started.
+	DisableBattleAggregate(battleCode string) error
+
+	// DeleteBattleRecords deletes battle_record of the battle.
+	// This function is used when a battle could not be set up.
+	DeleteBattleRecords(battleCode string) error
+
 	// SaveUserUsedMs updates battle_record to set used_ms_mask and used_ms_list for a specific user.
 	SaveUserUsedMs(battleCode string, userID string, usedMsMask uint64, usedMsList string) error
 
+	// SaveBattleConnStats saves the connection stats of a user in a battle.
+	SaveBattleConnStats(stats *BattleConnStats) error
+
+	// GetBattleConnStats returns the connection stats of all users in the battle.
+	GetBattleConnStats(battleCode string) ([]*BattleConnStats, error)
+
+	// GetUserBattleConnStats returns the connection stats of the user in the recent battles.
+	GetUserBattleConnStats(userID string, limit int) ([]*BattleConnStats, error)
+
+	// SaveP2PReport saves the P2PMatchingReport of a user in a battle.
+	// The report is keyed by the user instead of the peer_id sent by the client,
+	// so that a wrong peer_id can't replace the report of another user.
+	SaveP2PReport(report *P2PReport) error
+
+	// GetP2PReports returns the P2P reports of all peers in the battle.
+	GetP2PReports(battleCode string) ([]*P2PReport, error)
+
+	// GetUserP2PReports returns the P2P reports of the user in the recent battles.
+	GetUserP2PReports(userID string, limit int) ([]*P2PReport, error)
+
+	// GetUserP2PReportSummary summarizes the P2P reports of the user created after since.
+	GetUserP2PReportSummary(userID string, since time.Time) (*P2PReportSummary, error)
+
+	// GetFlycastP2PReportSummary summarizes the P2P reports created after since per flycast version.
+	GetFlycastP2PReportSummary(since time.Time) ([]*P2PReportSummary, error)
+
+	// AddUserDisconnect saves the disconnect attributed to the user.
+	// The disconnect of the same user in the same battle is saved only once.
+	AddUserDisconnect(d *UserDisconnect) error
+
+	// GetUserDisconnects returns the disconnects of the user created after since, including the forgiven ones.
+	GetUserDisconnects(userID string, since time.Time) ([]*UserDisconnect, error)
+
+	// ForgiveUserDisconnects excludes the disconnects of the user from the penalty.
+	// All disconnects of the user are forgiven if battleCode is empty.
+	ForgiveUserDisconnects(userID string, battleCode string) (int64, error)
+
 	// ResetDailyBattleCount clears daily battle count of all users.
 	ResetDailyBattleCount() (err error)
 
@@ -311,6 +441,28 @@ type DB interface {
 	// GetLobbySetting returns lobby setting.
 	GetLobbySetting(platform, disk string, no int) (*MLobbySetting, error)
 
+	// GetLobbySettings returns all lobby settings.
+	GetLobbySettings() ([]*MLobbySetting, error)
+
+	// GetLobbySchedules returns all lobby schedules.
+	GetLobbySchedules() ([]*MLobbySchedule, error)
+
+	// GetRegions returns all battle server regions.
+	GetRegions() ([]*MRegion, error)
+
+	// AddTournament saves new tournament with its entries and matches.
+	AddTournament(t *Tournament) error
+
+	// UpdateTournament updates the state of the tournament and its matches.
+	UpdateTournament(t *Tournament) error
+
+	// GetTournament loads a tournament with its entries and matches.
+	GetTournament(id string) (*Tournament, error)
+
+	// GetTournaments returns tournaments without entries and matches.
+	// All tournaments are returned if state is empty.
+	GetTournaments(state string) ([]*Tournament, error)
+
 	// GetRule returns game rule.
 	GetRule(id string) (*MRule, error)
 
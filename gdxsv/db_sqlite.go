@@ -110,6 +110,54 @@ CREATE TABLE IF NOT EXISTS battle_record
     system        integer default 0,
     PRIMARY KEY (battle_code, user_id)
 );
+CREATE TABLE IF NOT EXISTS battle_conn_stats
+(
+    battle_code  text,
+    user_id      text,
+    pos          integer default 0,
+    proto        text    default '',
+    rtt_ms       integer default 0,
+    loss         real    default 0,
+    resent       integer default 0,
+    dropped      integer default 0,
+    max_gap_ms   integer default 0,
+    bytes_in     integer default 0,
+    bytes_out    integer default 0,
+    close_reason text    default '',
+    created      timestamp,
+    PRIMARY KEY (battle_code, user_id)
+);
+CREATE TABLE IF NOT EXISTS p2p_report
+(
+    battle_code          text,
+    peer_id              integer,
+    user_id              text    default '',
+    flycast              text    default '',
+    os                   text    default '',
+    close_reason         text    default '',
+    player_count         integer default 0,
+    frame_count          integer default 0,
+    disconnected_peer_id integer default 0,
+    fps_avg              real    default 0,
+    fps_min              real    default 0,
+    total_timesync       integer default 0,
+    input_block_count_0  integer default 0,
+    input_block_count_1  integer default 0,
+    input_block_count_2  integer default 0,
+    created              timestamp,
+    PRIMARY KEY (battle_code, user_id)
+);
+CREATE TABLE IF NOT EXISTS user_disconnect
+(
+    battle_code text,
+    user_id     text,
+    reason      text    default '',
+    source      text    default '',
+    reporter    text    default '',
+    forgiven    integer default 0,
+    created     timestamp,
+    PRIMARY KEY (battle_code, user_id)
+);
 CREATE TABLE IF NOT EXISTS m_string
 (
     key   text,
@@ -140,8 +188,36 @@ CREATE TABLE IF NOT EXISTS m_lobby_setting
     patch_names        text default '',
     win_rate_limit     integer default 0,
     min_client_version text default '',
+    hidden             integer default 0,
+    room_count         integer default 5,
+    ranked_queue       integer default 0,
+    region_weights     text default '',
+    sort_order         integer default 0,
     PRIMARY KEY (platform, disk, no)
 );
+CREATE TABLE IF NOT EXISTS m_lobby_schedule
+(
+    id          text,
+    platform    text not null,
+    disk        text not null,
+    no          integer not null,
+    name        text not null,
+    start_at    timestamp not null,
+    end_at      timestamp not null,
+    rule_id     text default '',
+    patch_names text default '',
+    comment     text default '',
+    PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS m_region
+(
+    id           text,
+    name         text not null,
+    region_group text default '',
+    provider     text default '',
+    enabled      integer default 1,
+    PRIMARY KEY (id)
+);
 CREATE TABLE IF NOT EXISTS m_rule
 (
     id             text,
@@ -179,6 +255,48 @@ CREATE TABLE IF NOT EXISTS m_patch
     codes 	 	text not null,
     PRIMARY KEY (platform, disk, name)
 );
+CREATE TABLE IF NOT EXISTS tournament
+(
+    id       text,
+    name     text not null,
+    format   text not null,
+    platform text not null,
+    disk     text not null,
+    lobby_id integer not null,
+    state    text not null,
+    champion integer default 0,
+    created  timestamp,
+    PRIMARY KEY (id)
+);
+CREATE TABLE IF NOT EXISTS tournament_entry
+(
+    tournament_id text,
+    seed          integer,
+    name          text not null,
+    user_id1      text not null,
+    user_id2      text not null,
+    PRIMARY KEY (tournament_id, seed)
+);
+CREATE TABLE IF NOT EXISTS tournament_match
+(
+    tournament_id text,
+    match_no      integer,
+    bracket       text not null,
+    round         integer not null,
+    entry1        integer default 0,
+    entry2        integer default 0,
+    winner_to     integer default 0,
+    winner_slot   integer default 0,
+    loser_to      integer default 0,
+    loser_slot    integer default 0,
+    scheduled_at  timestamp,
+    battle_code   text default '',
+    swapped       integer default 0,
+    winner        integer default 0,
+    state         text not null,
+    updated       timestamp,
+    PRIMARY KEY (tournament_id, match_no)
+);
 `
 
 const indexes = `
@@ -188,6 +306,10 @@ CREATE INDEX IF NOT EXISTS BATTLE_RECORD_USER_ID ON battle_record(user_id);
 CREATE INDEX IF NOT EXISTS BATTLE_RECORD_PLAYERS ON battle_record(players);
 CREATE INDEX IF NOT EXISTS BATTLE_RECORD_CREATED ON battle_record(created);
 CREATE INDEX IF NOT EXISTS BATTLE_RECORD_AGGREGATE ON battle_record(aggregate);
+CREATE INDEX IF NOT EXISTS BATTLE_CONN_STATS_USER_ID ON battle_conn_stats(user_id);
+CREATE INDEX IF NOT EXISTS P2P_REPORT_USER_ID ON p2p_report(user_id);
+CREATE INDEX IF NOT EXISTS P2P_REPORT_CREATED ON p2p_report(created);
+CREATE INDEX IF NOT EXISTS USER_DISCONNECT_USER_ID ON user_disconnect(user_id, created);
 `
 
 func (db SQLiteDB) Init() error {
@@ -198,8 +320,9 @@ func (db SQLiteDB) Init() error {
 func (db SQLiteDB) Migrate() error {
 	ctx := context.Background()
 	tables := []string{
-		"account", "user", "battle_record",
+		"account", "user", "battle_record", "battle_conn_stats", "p2p_report", "user_disconnect",
 		"m_string", "m_ban", "m_lobby_setting", "m_rule",
+		"tournament", "tournament_entry", "tournament_match",
 	}
 
 	// begin tx
@@ -538,6 +661,108 @@ VALUES
 	return err
 }
 
+func (db SQLiteDB) SaveBattleConnStats(stats *BattleConnStats) error {
+	stats.Created = time.Now()
+	_, err := db.NamedExec(`
+INSERT OR REPLACE INTO battle_conn_stats
+	(battle_code, user_id, pos, proto, rtt_ms, loss, resent, dropped, max_gap_ms, bytes_in, bytes_out, close_reason, created)
+VALUES
+	(:battle_code, :user_id, :pos, :proto, :rtt_ms, :loss, :resent, :dropped, :max_gap_ms, :bytes_in, :bytes_out, :close_reason, :created)`,
+		stats)
+	return err
+}
+
+func (db SQLiteDB) GetBattleConnStats(battleCode string) ([]*BattleConnStats, error) {
+	var ret []*BattleConnStats
+	err := db.Select(&ret, `SELECT * FROM battle_conn_stats WHERE battle_code = ? ORDER BY pos`, battleCode)
+	return ret, err
+}
+
+func (db SQLiteDB) GetUserBattleConnStats(userID string, limit int) ([]*BattleConnStats, error) {
+	var ret []*BattleConnStats
+	err := db.Select(&ret, `SELECT * FROM battle_conn_stats WHERE user_id = ? ORDER BY created DESC LIMIT ?`, userID, limit)
+	return ret, err
+}
+
+func (db SQLiteDB) SaveP2PReport(report *P2PReport) error {
+	report.Created = time.Now()
+	_, err := db.NamedExec(`
+INSERT OR REPLACE INTO p2p_report
+	(battle_code, peer_id, user_id, flycast, os, close_reason, player_count, frame_count, disconnected_peer_id,
+	 fps_avg, fps_min, total_timesync, input_block_count_0, input_block_count_1, input_block_count_2, created)
+VALUES
+	(:battle_code, :peer_id, :user_id, :flycast, :os, :close_reason, :player_count, :frame_count, :disconnected_peer_id,
+	 :fps_avg, :fps_min, :total_timesync, :input_block_count_0, :input_block_count_1, :input_block_count_2, :created)`,
+		report)
+	return err
+}
+
+func (db SQLiteDB) GetP2PReports(battleCode string) ([]*P2PReport, error) {
+	var ret []*P2PReport
+	err := db.Select(&ret, `SELECT * FROM p2p_report WHERE battle_code = ? ORDER BY peer_id`, battleCode)
+	return ret, err
+}
+
+func (db SQLiteDB) GetUserP2PReports(userID string, limit int) ([]*P2PReport, error) {
+	var ret []*P2PReport
+	err := db.Select(&ret, `SELECT * FROM p2p_report WHERE user_id = ? ORDER BY created DESC LIMIT ?`, userID, limit)
+	return ret, err
+}
+
+// p2pReportSummaryColumns aggregates p2p_report into P2PReportSummary.
+// Reports without fps history are not counted for fps.
+const p2pReportSummaryColumns = `
+	COUNT(1) AS reports,
+	COALESCE(AVG(close_reason <> 'game_end'), 0) AS disconnect_rate,
+	COALESCE(AVG(NULLIF(fps_avg, 0)), 0) AS fps_avg,
+	COALESCE(MIN(NULLIF(fps_min, 0)), 0) AS fps_min,
+	COALESCE(AVG(input_block_count_0 + input_block_count_1 + input_block_count_2), 0) AS input_blocks,
+	COALESCE(AVG(total_timesync), 0) AS timesync`
+
+func (db SQLiteDB) GetUserP2PReportSummary(userID string, since time.Time) (*P2PReportSummary, error) {
+	ret := new(P2PReportSummary)
+	err := db.Get(ret, `SELECT ? AS key,`+p2pReportSummaryColumns+`
+FROM p2p_report WHERE user_id = ? AND created > ?`, userID, userID, since)
+	return ret, err
+}
+
+func (db SQLiteDB) GetFlycastP2PReportSummary(since time.Time) ([]*P2PReportSummary, error) {
+	var ret []*P2PReportSummary
+	err := db.Select(&ret, `SELECT flycast AS key,`+p2pReportSummaryColumns+`
+FROM p2p_report WHERE created > ? GROUP BY flycast ORDER BY disconnect_rate DESC, flycast`, since)
+	return ret, err
+}
+
+func (db SQLiteDB) AddUserDisconnect(d *UserDisconnect) error {
+	d.Created = time.Now()
+	_, err := db.NamedExec(`
+INSERT OR IGNORE INTO user_disconnect
+	(battle_code, user_id, reason, source, reporter, forgiven, created)
+VALUES
+	(:battle_code, :user_id, :reason, :source, :reporter, :forgiven, :created)`, d)
+	return err
+}
+
+func (db SQLiteDB) GetUserDisconnects(userID string, since time.Time) ([]*UserDisconnect, error) {
+	var ret []*UserDisconnect
+	err := db.Select(&ret, `SELECT * FROM user_disconnect WHERE user_id = ? AND created > ? ORDER BY created DESC`, userID, since)
+	return ret, err
+}
+
+func (db SQLiteDB) ForgiveUserDisconnects(userID string, battleCode string) (int64, error) {
+	var res sql.Result
+	var err error
+	if battleCode == "" {
+		res, err = db.Exec(`UPDATE user_disconnect SET forgiven = 1 WHERE user_id = ? AND forgiven = 0`, userID)
+	} else {
+		res, err = db.Exec(`UPDATE user_disconnect SET forgiven = 1 WHERE user_id = ? AND battle_code = ? AND forgiven = 0`, userID, battleCode)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func (db SQLiteDB) UpdateBattleRecord(battle *BattleRecord) error {
 	battle.Updated = time.Now()
 	_, err := db.NamedExec(`
@@ -572,6 +797,25 @@ WHERE
 	return err
 }
 
+func (db SQLiteDB) DisableBattleAggregate(battleCode string) error {
+	_, err := db.Exec(`
+UPDATE battle_record
+SET
+	aggregate = 0,
+	updated = ?
+WHERE
+	battle_code = ?`, time.Now(), battleCode)
+	if err == nil {
+		db.deleteRankingCache()
+	}
+	return err
+}
+
+func (db SQLiteDB) DeleteBattleRecords(battleCode string) error {
+	_, err := db.Exec(`DELETE FROM battle_record WHERE battle_code = ?`, battleCode)
+	return err
+}
+
 func (db SQLiteDB) SaveUserUsedMs(battleCode string, userID string, usedMsMask uint64, usedMsList string) error {
 	_, err := db.Exec(`
 UPDATE battle_record
@@ -835,6 +1079,150 @@ func (db SQLiteDB) GetLobbySetting(platform, disk string, no int) (*MLobbySettin
 	return m, nil
 }
 
+func (db SQLiteDB) GetLobbySettings() ([]*MLobbySetting, error) {
+	var ret []*MLobbySetting
+	err := db.Select(&ret, "SELECT * FROM m_lobby_setting ORDER BY platform, disk, no")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (db SQLiteDB) GetLobbySchedules() ([]*MLobbySchedule, error) {
+	var ret []*MLobbySchedule
+	err := db.Select(&ret, "SELECT * FROM m_lobby_schedule ORDER BY start_at")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (db SQLiteDB) GetRegions() ([]*MRegion, error) {
+	var ret []*MRegion
+	err := db.Select(&ret, "SELECT * FROM m_region ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (db SQLiteDB) AddTournament(t *Tournament) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Begin failed")
+	}
+
+	_, err = tx.NamedExec(`
+INSERT INTO tournament
+	(id, name, format, platform, disk, lobby_id, state, champion, created)
+VALUES
+	(:id, :name, :format, :platform, :disk, :lobby_id, :state, :champion, :created)`, t)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for _, e := range t.Entries {
+		_, err = tx.NamedExec(`
+INSERT INTO tournament_entry
+	(tournament_id, seed, name, user_id1, user_id2)
+VALUES
+	(:tournament_id, :seed, :name, :user_id1, :user_id2)`, e)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	for _, m := range t.Matches {
+		_, err = tx.NamedExec(`
+INSERT INTO tournament_match
+	(tournament_id, match_no, bracket, round, entry1, entry2, winner_to, winner_slot, loser_to, loser_slot, scheduled_at, battle_code, swapped, winner, state, updated)
+VALUES
+	(:tournament_id, :match_no, :bracket, :round, :entry1, :entry2, :winner_to, :winner_slot, :loser_to, :loser_slot, :scheduled_at, :battle_code, :swapped, :winner, :state, :updated)`, m)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db SQLiteDB) UpdateTournament(t *Tournament) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return errors.Wrap(err, "Begin failed")
+	}
+
+	_, err = tx.NamedExec(`
+UPDATE tournament
+SET
+	state = :state,
+	champion = :champion
+WHERE
+	id = :id`, t)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	for _, m := range t.Matches {
+		_, err = tx.NamedExec(`
+UPDATE tournament_match
+SET
+	entry1 = :entry1,
+	entry2 = :entry2,
+	scheduled_at = :scheduled_at,
+	battle_code = :battle_code,
+	swapped = :swapped,
+	winner = :winner,
+	state = :state,
+	updated = :updated
+WHERE
+	tournament_id = :tournament_id AND match_no = :match_no`, m)
+		if err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (db SQLiteDB) GetTournament(id string) (*Tournament, error) {
+	t := &Tournament{}
+	err := db.QueryRowx("SELECT * FROM tournament WHERE id = ?", id).StructScan(t)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Select(&t.Entries, "SELECT * FROM tournament_entry WHERE tournament_id = ? ORDER BY seed", id)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Select(&t.Matches, "SELECT * FROM tournament_match WHERE tournament_id = ? ORDER BY match_no", id)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (db SQLiteDB) GetTournaments(state string) ([]*Tournament, error) {
+	var ret []*Tournament
+	var err error
+	if state == "" {
+		err = db.Select(&ret, "SELECT * FROM tournament ORDER BY created DESC")
+	} else {
+		err = db.Select(&ret, "SELECT * FROM tournament WHERE state = ? ORDER BY created DESC", state)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
 func (db SQLiteDB) GetRule(id string) (*MRule, error) {
 	m := &MRule{}
 	err := db.QueryRowx("SELECT * FROM m_rule WHERE id = ?", id).StructScan(m)
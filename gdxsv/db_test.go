@@ -206,6 +206,46 @@ func Test203CalculateUserBattleCount(t *testing.T) {
 	assertEq(t, br.Round, rec.Battle)
 }
 
+func Test204DisableBattleAggregate(t *testing.T) {
+	for i, userID := range []string{"22221", "22222"} {
+		must(t, getDB().AddBattleRecord(&BattleRecord{
+			BattleCode: "p2pfailed",
+			UserID:     userID,
+			Players:    4,
+			Aggregate:  1,
+			Pos:        i + 1,
+			Team:       i + 1,
+		}))
+	}
+
+	must(t, getDB().DisableBattleAggregate("p2pfailed"))
+
+	for _, userID := range []string{"22221", "22222"} {
+		actual, err := getDB().GetBattleRecordUser("p2pfailed", userID)
+		must(t, err)
+		assertEq(t, 0, actual.Aggregate)
+	}
+}
+
+func Test205DeleteBattleRecords(t *testing.T) {
+	for i, userID := range []string{"22231", "22232"} {
+		must(t, getDB().AddBattleRecord(&BattleRecord{
+			BattleCode: "setupfailed",
+			UserID:     userID,
+			Players:    4,
+			Aggregate:  1,
+			Pos:        i + 1,
+			Team:       i + 1,
+		}))
+	}
+
+	must(t, getDB().DeleteBattleRecords("setupfailed"))
+
+	records, err := getDB().GetBattleRecordsByCode("setupfailed")
+	must(t, err)
+	assertEq(t, 0, len(records))
+}
+
 func Test300Ranking(t *testing.T) {
 	cleanTables(t, "user")
 
@@ -621,7 +661,43 @@ VALUES (:platform,
         :ping_region,
         :patch_names,
         :win_rate_limit,
-        :min_client_version)`, setting)
+        :min_client_version,
+        :hidden,
+        :room_count,
+        :ranked_queue,
+        :region_weights,
+        :sort_order)`, setting)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func mustInsertMRegion(region MRegion) {
+	db := getDB().(SQLiteDB)
+	_, err := db.NamedExec(`INSERT INTO m_region
+VALUES (:id,
+        :name,
+        :region_group,
+        :provider,
+        :enabled)`, region)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func mustInsertMLobbySchedule(schedule MLobbySchedule) {
+	db := getDB().(SQLiteDB)
+	_, err := db.NamedExec(`INSERT INTO m_lobby_schedule
+VALUES (:id,
+        :platform,
+        :disk,
+        :no,
+        :name,
+        :start_at,
+        :end_at,
+        :rule_id,
+        :patch_names,
+        :comment)`, schedule)
 	if err != nil {
 		panic(err)
 	}
@@ -685,3 +761,145 @@ func TestNewFindReplayQuery(t *testing.T) {
 	assertEq(t, false, x.Reverse)
 	assertEq(t, 0, x.Page)
 }
+
+func TestDB_BattleConnStats(t *testing.T) {
+	cleanTables(t, "battle_conn_stats")
+
+	for _, s := range []*BattleConnStats{
+		{BattleCode: "conntest0", UserID: "USER02", Pos: 2, Proto: "udp", RTTMs: 120, Loss: 0.25, Resent: 300, MaxGapMs: 900, CloseReason: "sv_recv_timeout"},
+		{BattleCode: "conntest0", UserID: "USER01", Pos: 1, Proto: "udp", RTTMs: 30, Resent: 10, MaxGapMs: 50},
+		{BattleCode: "conntest1", UserID: "USER01", Pos: 3, Proto: "tcp", MaxGapMs: 40},
+	} {
+		must(t, getDB().SaveBattleConnStats(s))
+	}
+
+	stats, err := getDB().GetBattleConnStats("conntest0")
+	must(t, err)
+	assertEq(t, 2, len(stats))
+	assertEq(t, "USER01", stats[0].UserID)
+	assertEq(t, "USER02", stats[1].UserID)
+	assertEq(t, int64(120), stats[1].RTTMs)
+	assertEq(t, 0.25, stats[1].Loss)
+	assertEq(t, "sv_recv_timeout", stats[1].CloseReason)
+
+	// Saving again replaces the stats.
+	must(t, getDB().SaveBattleConnStats(&BattleConnStats{BattleCode: "conntest0", UserID: "USER02", Pos: 2, Proto: "udp", RTTMs: 60}))
+	stats, err = getDB().GetBattleConnStats("conntest0")
+	must(t, err)
+	assertEq(t, int64(60), stats[1].RTTMs)
+
+	stats, err = getDB().GetUserBattleConnStats("USER01", 1)
+	must(t, err)
+	assertEq(t, 1, len(stats))
+	stats, err = getDB().GetUserBattleConnStats("USER01", 10)
+	must(t, err)
+	assertEq(t, 2, len(stats))
+}
+
+func TestDB_P2PReport(t *testing.T) {
+	cleanTables(t, "p2p_report")
+
+	for _, r := range []*P2PReport{
+		{BattleCode: "p2ptest0", PeerID: 1, UserID: "USER02", Flycast: "v2.0", CloseReason: "player_disconnect", FpsAvg: 50, FpsMin: 30, InputBlockCount0: 10, InputBlockCount2: 2},
+		{BattleCode: "p2ptest0", PeerID: 0, UserID: "USER01", Flycast: "v1.0", CloseReason: "game_end", FpsAvg: 60, FpsMin: 58},
+		{BattleCode: "p2ptest1", PeerID: 0, UserID: "USER02", Flycast: "v2.0", CloseReason: "game_end", InputBlockCount1: 4},
+	} {
+		must(t, getDB().SaveP2PReport(r))
+	}
+
+	reports, err := getDB().GetP2PReports("p2ptest0")
+	must(t, err)
+	assertEq(t, 2, len(reports))
+	assertEq(t, "USER01", reports[0].UserID)
+	assertEq(t, "USER02", reports[1].UserID)
+	assertEq(t, "player_disconnect", reports[1].CloseReason)
+	assertEq(t, 30.0, reports[1].FpsMin)
+
+	// A report with the peer_id of another user does not replace the report of the user.
+	must(t, getDB().SaveP2PReport(&P2PReport{BattleCode: "p2ptest2", PeerID: 0, UserID: "USER04", Flycast: "v1.0", CloseReason: "game_end"}))
+	must(t, getDB().SaveP2PReport(&P2PReport{BattleCode: "p2ptest2", PeerID: 0, UserID: "USER05", Flycast: "v1.0", CloseReason: "player_disconnect"}))
+	must(t, getDB().SaveP2PReport(&P2PReport{BattleCode: "p2ptest2", PeerID: 1, UserID: "USER05", Flycast: "v1.0", CloseReason: "game_end"}))
+	reports, err = getDB().GetP2PReports("p2ptest2")
+	must(t, err)
+	assertEq(t, 2, len(reports))
+	assertEq(t, "USER04", reports[0].UserID)
+	assertEq(t, "USER05", reports[1].UserID)
+	assertEq(t, "game_end", reports[1].CloseReason)
+
+	reports, err = getDB().GetUserP2PReports("USER02", 1)
+	must(t, err)
+	assertEq(t, 1, len(reports))
+	assertEq(t, "p2ptest1", reports[0].BattleCode)
+
+	// Reports without fps are not counted for fps.
+	since := time.Now().Add(-time.Hour)
+	summary, err := getDB().GetUserP2PReportSummary("USER02", since)
+	must(t, err)
+	assertEq(t, "USER02", summary.Key)
+	assertEq(t, 2, summary.Reports)
+	assertEq(t, 0.5, summary.DisconnectRate)
+	assertEq(t, 50.0, summary.FpsAvg)
+	assertEq(t, 30.0, summary.FpsMin)
+	assertEq(t, 8.0, summary.InputBlocks)
+
+	summary, err = getDB().GetUserP2PReportSummary("USER03", since)
+	must(t, err)
+	assertEq(t, 0, summary.Reports)
+
+	flycast, err := getDB().GetFlycastP2PReportSummary(since)
+	must(t, err)
+	assertEq(t, 2, len(flycast))
+	assertEq(t, "v2.0", flycast[0].Key)
+	assertEq(t, 0.5, flycast[0].DisconnectRate)
+	assertEq(t, "v1.0", flycast[1].Key)
+	assertEq(t, 0.0, flycast[1].DisconnectRate)
+
+	flycast, err = getDB().GetFlycastP2PReportSummary(time.Now().Add(time.Hour))
+	must(t, err)
+	assertEq(t, 0, len(flycast))
+}
+
+func TestDB_UserDisconnect(t *testing.T) {
+	cleanTables(t, "user_disconnect")
+
+	for _, d := range []*UserDisconnect{
+		{BattleCode: "dctest0", UserID: "USER01", Reason: "player_disconnect", Source: "p2p", Reporter: "USER02"},
+		{BattleCode: "dctest0", UserID: "USER01", Reason: "sv_recv_timeout", Source: "mcs"},
+		{BattleCode: "dctest1", UserID: "USER01", Reason: "sv_recv_timeout", Source: "mcs"},
+		{BattleCode: "dctest1", UserID: "USER02", Reason: "sv_recv_timeout", Source: "mcs"},
+	} {
+		must(t, getDB().AddUserDisconnect(d))
+	}
+
+	// The disconnect in the same battle is saved only once.
+	since := time.Now().Add(-time.Hour)
+	disconnects, err := getDB().GetUserDisconnects("USER01", since)
+	must(t, err)
+	assertEq(t, 2, len(disconnects))
+	for _, d := range disconnects {
+		if d.BattleCode == "dctest0" {
+			assertEq(t, "p2p", d.Source)
+			assertEq(t, "USER02", d.Reporter)
+		}
+	}
+
+	n, err := getDB().ForgiveUserDisconnects("USER01", "dctest0")
+	must(t, err)
+	assertEq(t, int64(1), n)
+	n, err = getDB().ForgiveUserDisconnects("USER01", "")
+	must(t, err)
+	assertEq(t, int64(1), n)
+
+	disconnects, err = getDB().GetUserDisconnects("USER01", since)
+	must(t, err)
+	for _, d := range disconnects {
+		assertEq(t, true, d.Forgiven)
+	}
+	disconnects, err = getDB().GetUserDisconnects("USER02", since)
+	must(t, err)
+	assertEq(t, false, disconnects[0].Forgiven)
+
+	disconnects, err = getDB().GetUserDisconnects("USER01", time.Now().Add(time.Hour))
+	must(t, err)
+	assertEq(t, 0, len(disconnects))
+}
@@ -8,15 +8,14 @@ import (
 	"go.uber.org/zap"
 	pb "google.golang.org/protobuf/proto"
 	"net"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	maxLobbyCount = 22
-	maxRoomCount  = 5
+	defaultRoomCount = 5
 
 	PlatformConsole  = "console"    // Real PS2 / Dreamcast
 	PlatformEmuX8664 = "emu-x86/64" // PCSX2 / Flycast on x64 platform
@@ -28,6 +27,88 @@ const (
 	McsAddrP2PGame = "255.255.255.255:255"
 )
 
+var (
+	hostedPlatforms = []string{PlatformConsole, PlatformEmuX8664}
+	hostedDisks     = []string{GameDiskDC1, GameDiskDC2, GameDiskPS2}
+)
+
+func isHostedLobby(platform, disk string) bool {
+	for _, pf := range hostedPlatforms {
+		for _, d := range hostedDisks {
+			if pf == platform && d == disk {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// PlazaMax returns the number of lobbies shown to the peer.
+func (lbs *Lbs) PlazaMax(p *LbsPeer) uint16 {
+	return uint16(len(lbs.plazaLobbyIDs(p.Platform, p.GameDisk)))
+}
+
+// plazaLobbyIDs returns the IDs of the lobbies listed in the lobby select scene, ordered by sort_order and no.
+// The client selects a lobby by its position in the list starting from 1. DC1 and DC2 share the list.
+func (lbs *Lbs) plazaLobbyIDs(platform, disk string) []uint16 {
+	disks := []string{disk}
+	if disk == GameDiskDC1 || disk == GameDiskDC2 {
+		disks = []string{GameDiskDC1, GameDiskDC2}
+	}
+
+	sortOrders := map[uint16]int{}
+	for _, disk := range disks {
+		for id, lobby := range lbs.lobbies[lobbyKey(platform, disk)] {
+			if lobby.retired {
+				continue
+			}
+			if order, ok := sortOrders[id]; !ok || lobby.LobbySetting.SortOrder < order {
+				sortOrders[id] = lobby.LobbySetting.SortOrder
+			}
+		}
+	}
+
+	ids := make([]uint16, 0, len(sortOrders))
+	for id := range sortOrders {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if sortOrders[ids[i]] != sortOrders[ids[j]] {
+			return sortOrders[ids[i]] < sortOrders[ids[j]]
+		}
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// plazaLobbyID returns the ID of the lobby at the position in the lobby select scene.
+func (lbs *Lbs) plazaLobbyID(platform, disk string, pos uint16) (uint16, bool) {
+	ids := lbs.plazaLobbyIDs(platform, disk)
+	if pos < 1 || len(ids) < int(pos) {
+		return 0, false
+	}
+	return ids[pos-1], true
+}
+
+// plazaPos returns the position of the lobby in the lobby select scene, or 0 if it is not listed.
+func (lbs *Lbs) plazaPos(lobby *LbsLobby) uint16 {
+	for i, id := range lbs.plazaLobbyIDs(lobby.Platform, lobby.GameDisk) {
+		if id == lobby.ID {
+			return uint16(i + 1)
+		}
+	}
+	return 0
+}
+
+// GetPlazaLobby returns the lobby at the position in the lobby select scene.
+func (lbs *Lbs) GetPlazaLobby(platform, disk string, pos uint16) *LbsLobby {
+	id, ok := lbs.plazaLobbyID(platform, disk, pos)
+	if !ok {
+		return nil
+	}
+	return lbs.GetLobby(platform, disk, id)
+}
+
 func lobbyKey(platform string, disk string) string {
 	return fmt.Sprintf("%s|%s", platform, disk)
 }
@@ -50,30 +131,50 @@ type Lbs struct {
 	lobbies   map[string]map[uint16]*LbsLobby
 	chEvent   chan interface{}
 	chQuit    chan interface{}
-	reload    bool
+
+	masterHistory []*LobbyMasterData
+	masterVersion int // last issued version of lobby settings, not decremented by rollback
+	tournaments   map[string]*Tournament
+	rankedQueues  map[string]*RankedQueue
+	mcsAllocator  McsAllocator
+	mcsAllocating map[string]time.Time // region -> when battles started to wait for the allocated mcs
+	captures      *LbsCaptures
+	p2pFallbacks  map[string]*P2PFallback
+	p2pBattles    map[string]*P2PBattle // battle_code -> recent P2P battles
 }
 
 func NewLbs() *Lbs {
 	app := &Lbs{
-		handlers:  defaultLbsHandlers,
-		userPeers: make(map[string]*LbsPeer),
-		mcsPeers:  make(map[string]*LbsPeer),
-		lobbies:   make(map[string]map[uint16]*LbsLobby),
-		chEvent:   make(chan interface{}, 64),
-		chQuit:    make(chan interface{}),
+		handlers:      defaultLbsHandlers,
+		userPeers:     make(map[string]*LbsPeer),
+		mcsPeers:      make(map[string]*LbsPeer),
+		lobbies:       make(map[string]map[uint16]*LbsLobby),
+		tournaments:   make(map[string]*Tournament),
+		rankedQueues:  make(map[string]*RankedQueue),
+		mcsAllocator:  newMcsAllocator(),
+		mcsAllocating: make(map[string]time.Time),
+		captures:      NewLbsCaptures(),
+		p2pFallbacks:  make(map[string]*P2PFallback),
+		p2pBattles:    make(map[string]*P2PBattle),
+		chEvent:       make(chan interface{}, 64),
+		chQuit:        make(chan interface{}),
+	}
+
+	for _, pf := range hostedPlatforms {
+		for _, disk := range hostedDisks {
+			app.lobbies[lobbyKey(pf, disk)] = make(map[uint16]*LbsLobby)
+		}
 	}
 
-	for _, pf := range []string{PlatformConsole, PlatformEmuX8664} {
-		for _, disk := range []string{GameDiskDC1, GameDiskDC2, GameDiskPS2} {
-			key := lobbyKey(pf, disk)
-			app.lobbies[key] = make(map[uint16]*LbsLobby)
-
-			for i := 1; i <= maxLobbyCount; i++ {
-				app.lobbies[key][uint16(i)] = NewLobby(app, pf, disk, uint16(i))
-			}
+	for _, pf := range hostedPlatforms {
+		for _, disk := range hostedDisks {
+			app.rankedQueues[lobbyKey(pf, disk)] = NewRankedQueue(pf, disk)
 		}
 	}
 
+	app.initLobbyMasterData()
+	app.loadTournaments()
+
 	return app
 }
 
@@ -215,18 +316,6 @@ func (lbs *Lbs) NewPeer(conn net.Conn) *LbsPeer {
 	}
 }
 
-func (lbs *Lbs) FindMcs(region string) *McsStatus {
-	for _, p := range lbs.mcsPeers {
-		if p.mcsStatus != nil {
-			if strings.HasPrefix(p.mcsStatus.Region, region) &&
-				p.mcsStatus.PublicAddr != "" {
-				return p.mcsStatus
-			}
-		}
-	}
-	return nil
-}
-
 func (lbs *Lbs) FindPeer(userID string) *LbsPeer {
 	p, ok := lbs.userPeers[userID]
 	if !ok {
@@ -256,9 +345,11 @@ func (lbs *Lbs) Quit() {
 		}
 	})
 	time.Sleep(10 * time.Millisecond)
+	lbs.captures.StopAll()
 	close(lbs.chQuit)
 }
 
+// stripHost returns the address with the port only, so that the server listens on both IPv4 and IPv6.
 func stripHost(addr string) string {
 	_, port, err := net.SplitHostPort(addr)
 	if err != nil {
@@ -278,6 +369,7 @@ type eventPeerLeave struct {
 type eventPeerMessage struct {
 	peer *LbsPeer
 	msg  *LbsMessage
+	at   time.Time // when the message was queued
 }
 
 type eventFunc struct {
@@ -314,14 +406,17 @@ func (lbs *Lbs) cleanPeer(p *LbsPeer) {
 	}
 
 	if p.mcsStatus != nil {
+		delete(p.app.mcsPeers, p.mcsStatus.PublicAddr)
+		reassigned := lbs.reassignMcsGames(p.mcsStatus.PublicAddr)
 		if len(p.mcsStatus.Games) != 0 || len(p.mcsStatus.Users) != 0 {
 			logger.Warn("mcs closed during game",
 				zap.Any("games", p.mcsStatus.Games), zap.Any("users", p.mcsStatus.Users))
 			for _, g := range p.mcsStatus.Games {
-				sharedData.UpdateMcsGameState(g.BattleCode, McsGameStateClosed)
+				if !reassigned[g.BattleCode] {
+					sharedData.UpdateMcsGameState(g.BattleCode, McsGameStateClosed)
+				}
 			}
 		}
-		delete(p.app.mcsPeers, p.mcsStatus.PublicAddr)
 		p.mcsStatus = nil
 	}
 
@@ -355,6 +450,10 @@ func (lbs *Lbs) eventLoop() {
 				}
 
 				args.peer.lastRecvTime = time.Now()
+				recordLbsQueueDelay(args.peer.lastRecvTime.Sub(args.at))
+				if c := args.peer.capture(); c != nil {
+					c.Record(CaptureIn, args.peer, args.msg.Serialize(), args.at)
+				}
 				if f, ok := lbs.handlers[args.msg.Command]; ok {
 					f(args.peer, args.msg)
 				} else {
@@ -381,32 +480,37 @@ func (lbs *Lbs) eventLoop() {
 				}()
 			}
 		case <-tick:
+			rconf := getReloadableConfig()
 			for _, p := range peers {
 				lastRecvSince := time.Since(p.lastRecvTime)
-				if 1 <= lastRecvSince.Minutes() {
+				if rconf.PeerKickTimeout <= lastRecvSince {
 					logger.Info("kick peer", zap.String("addr", p.Address()))
 					lbs.cleanPeer(p)
 					delete(peers, p.Address())
-				} else if 10 <= lastRecvSince.Seconds() {
+				} else if rconf.LineCheckInterval <= lastRecvSince {
 					RequestLineCheck(p)
 				}
 			}
 
+			// The users of closed games are removed by RemoveStaleData, so the final stats are taken before.
+			for _, u := range sharedData.TakeLeftMcsUsers() {
+				saveBattleConnStats(u)
+				attributeMcsDisconnect(u, sharedData.GetMcsBattleUsers(u.BattleCode))
+			}
 			sharedData.RemoveStaleData()
+			lbs.checkMcsHealth(time.Now())
 
-			reload := lbs.reload
-			lbs.reload = false
+			lbs.removeRetiredLobbies()
 			for _, pfLobbies := range lbs.lobbies {
 				for _, lobby := range pfLobbies {
-					if reload {
-						err := lobby.LoadLobbySetting()
-						if err != nil {
-							logger.Error("LoadLobbySetting failed", zap.Error(err))
-						}
-					}
 					lobby.Update()
 				}
 			}
+			for _, q := range lbs.rankedQueues {
+				q.Update(lbs, time.Now())
+			}
+			lbs.updateP2PFallbacks(time.Now())
+			lbs.updateTournamentMatches(time.Now())
 
 			cnt := sharedData.GetMcsUserCount()
 			if cnt != battleUserCount {
@@ -427,23 +531,26 @@ func (lbs *Lbs) BroadcastLobbyUserCount(lobby *LbsLobby) {
 	}
 
 	// To lobby select scene.
-	switch lobby.GameDisk {
-	case GameDiskPS2:
+	pos := lbs.plazaPos(lobby)
+	switch {
+	case pos == 0:
+		// Not listed.
+	case lobby.GameDisk == GameDiskPS2:
 		ps2msg := NewServerNotice(lbsPlazaJoin).Writer().
-			Write16(lobby.ID).Write16(uint16(len(lobby.Users))).Msg()
+			Write16(pos).Write16(uint16(len(lobby.Users))).Msg()
 		for _, u := range lbs.userPeers {
 			if u.Platform == lobby.Platform && u.IsPS2() {
 				u.SendMessage(ps2msg)
 			}
 		}
-	case GameDiskDC1, GameDiskDC2:
+	case lobby.GameDisk == GameDiskDC1 || lobby.GameDisk == GameDiskDC2:
 		lobby1 := lbs.GetLobby(lobby.Platform, GameDiskDC1, lobby.ID)
 		lobby2 := lbs.GetLobby(lobby.Platform, GameDiskDC2, lobby.ID)
 		if lobby1 == nil || lobby2 == nil {
 			return
 		}
 		dcmsg := NewServerNotice(lbsPlazaJoin).Writer().
-			Write16(lobby.ID).
+			Write16(pos).
 			Write16(uint16(len(lobby1.Users))).
 			Write16(uint16(len(lobby2.Users))).Msg()
 		for _, u := range lbs.userPeers {
@@ -587,6 +694,8 @@ func (lbs *Lbs) RegisterBattleResult(p *LbsPeer, result *BattleResult) {
 		return
 	}
 
+	lbs.updateTournamentResult(record.BattleCode)
+
 	logger.Info("update battle count",
 		zap.String("user_id", p.UserID),
 		zap.Any("before", p.DBUser))
@@ -667,7 +776,9 @@ type LbsPeer struct {
 	inbuf  []byte
 
 	// used only mcs peer
-	mcsStatus *McsStatus
+	mcsStatus   *McsStatus
+	mcsSyncedAt time.Time
+	mcsHealth   McsHealth
 }
 
 func (p *LbsPeer) InLobbyChat() bool {
@@ -711,8 +822,13 @@ func (p *LbsPeer) SendMessage(msg *LbsMessage) {
 		fmt.Println(msg)
 	}
 
+	data := msg.Serialize()
+	if c := p.capture(); c != nil {
+		c.Record(CaptureOut, p, data, time.Now())
+	}
+
 	p.mOutbuf.Lock()
-	p.outbuf = append(p.outbuf, msg.Serialize()...)
+	p.outbuf = append(p.outbuf, data...)
 	p.mOutbuf.Unlock()
 	select {
 	case p.chWrite <- true:
@@ -720,6 +836,14 @@ func (p *LbsPeer) SendMessage(msg *LbsMessage) {
 	}
 }
 
+// capture returns the recorder if the messages of the user are captured.
+func (p *LbsPeer) capture() *LbsCaptureRecorder {
+	if p.app == nil {
+		return nil
+	}
+	return p.app.captures.Get(p.UserID)
+}
+
 func (p *LbsPeer) Address() string {
 	return p.conn.RemoteAddr().String()
 }
@@ -830,7 +954,7 @@ func (p *LbsPeer) dispatchLoop(ctx context.Context, cancel func()) {
 
 				p.inbuf = p.inbuf[n:]
 				if msg != nil {
-					p.app.chEvent <- eventPeerMessage{peer: p, msg: msg}
+					p.app.chEvent <- eventPeerMessage{peer: p, msg: msg, at: time.Now()}
 				}
 			}
 			p.mInbuf.Unlock()
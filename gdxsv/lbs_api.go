@@ -1,7 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"go.uber.org/zap"
 	"golang.org/x/sync/singleflight"
 	"net/http"
@@ -348,17 +350,543 @@ func (lbs *Lbs) RegisterHTTPHandlers() {
 		}
 	})
 
+	type lobbySettingVersion struct {
+		Version   int       `json:"version"`
+		AppliedAt time.Time `json:"applied_at"`
+		Checksum  string    `json:"checksum"`
+	}
+
+	type reloadResult struct {
+		OK      bool                 `json:"ok"`
+		Current *lobbySettingVersion `json:"current,omitempty"`
+		Errors  []string             `json:"errors,omitempty"`
+	}
+
+	toVersion := func(data *LobbyMasterData) *lobbySettingVersion {
+		if data == nil {
+			return nil
+		}
+		return &lobbySettingVersion{
+			Version:   data.Version,
+			AppliedAt: data.AppliedAt,
+			Checksum:  data.Checksum,
+		}
+	}
+
+	writeReloadResult := func(w http.ResponseWriter, status int, result *reloadResult) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(result)
+		if err != nil {
+			logger.Error("Write response failed", zap.Error(err))
+		}
+	}
+
 	http.HandleFunc("/ops/reload", func(w http.ResponseWriter, r *http.Request) {
-		// Private API: Reloads settings from database
+		// Private API: Reloads lobby settings from database.
+		// Nothing is applied if any of lobby settings is invalid.
 
+		var result reloadResult
 		lbs.Locked(func(lbs *Lbs) {
-			lbs.reload = true
+			data, errs := lbs.ReloadLobbySettings()
+			result.OK = len(errs) == 0
+			result.Current = toVersion(data)
+			for _, err := range errs {
+				result.Errors = append(result.Errors, err.Error())
+			}
 		})
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "text/plain")
-		_, err := w.Write([]byte("OK"))
+
+		status := http.StatusOK
+		if !result.OK {
+			status = http.StatusUnprocessableEntity
+		}
+		writeReloadResult(w, status, &result)
+	})
+
+	http.HandleFunc("/ops/rollback", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Rollbacks lobby settings to the previous version
+
+		var result reloadResult
+		lbs.Locked(func(lbs *Lbs) {
+			data, err := lbs.RollbackLobbySettings()
+			result.OK = err == nil
+			result.Current = toVersion(data)
+			if err != nil {
+				result.Errors = append(result.Errors, err.Error())
+			}
+		})
+
+		status := http.StatusOK
+		if !result.OK {
+			status = http.StatusConflict
+		}
+		writeReloadResult(w, status, &result)
+	})
+
+	http.HandleFunc("/ops/reload_history", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Returns applied versions of lobby settings
+
+		var versions []*lobbySettingVersion
+		lbs.Locked(func(lbs *Lbs) {
+			for _, data := range lbs.LobbyMasterHistory() {
+				versions = append(versions, toVersion(data))
+			}
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(versions)
+		if err != nil {
+			logger.Error("Write response failed", zap.Error(err))
+		}
+	})
+
+	writeJSON := func(w http.ResponseWriter, status int, v interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		err := json.NewEncoder(w).Encode(v)
+		if err != nil {
+			logger.Error("Write response failed", zap.Error(err))
+		}
+	}
+
+	http.HandleFunc("/lbs/tournaments", func(w http.ResponseWriter, r *http.Request) {
+		// Public API: list tournaments
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tournaments, err := getDB().GetTournaments(r.FormValue("state"))
+		if err != nil {
+			logger.Error("GetTournaments failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, tournaments)
+	})
+
+	http.HandleFunc("/lbs/tournament", func(w http.ResponseWriter, r *http.Request) {
+		// Public API: get tournament bracket
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		id := r.FormValue("id")
+		if id == "" {
+			http.Error(w, "missing id", http.StatusBadRequest)
+			return
+		}
+
+		// Encode in the event loop since running tournaments are updated there.
+		var body []byte
+		var err error
+		lbs.Locked(func(lbs *Lbs) {
+			var t *Tournament
+			t, err = lbs.GetTournament(id)
+			if err == nil {
+				body, err = json.Marshal(struct {
+					*Tournament
+					Standings []int `json:"standings"`
+				}{t, t.Standings()})
+			}
+		})
+		if err == sql.ErrNoRows {
+			http.Error(w, "tournament not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			logger.Error("GetTournament failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		_, err = w.Write(body)
+		if err != nil {
+			logger.Error("Write response failed", zap.Error(err))
+		}
+	})
+
+	type tournamentResult struct {
+		OK         bool        `json:"ok"`
+		Error      string      `json:"error,omitempty"`
+		Tournament *Tournament `json:"tournament,omitempty"`
+	}
+
+	// updateTournament calls f in the event loop and writes the tournament.
+	updateTournament := func(w http.ResponseWriter, id string, f func(lbs *Lbs, t *Tournament) error) {
+		status := http.StatusOK
+		var body []byte
+		lbs.Locked(func(lbs *Lbs) {
+			result := tournamentResult{OK: true}
+			t, err := lbs.GetTournament(id)
+			if err == nil && t.State != TournamentStateRunning {
+				err = fmt.Errorf("tournament %s is %s", id, t.State)
+			}
+			if err == nil {
+				err = f(lbs, t)
+			}
+			if err != nil {
+				status = http.StatusUnprocessableEntity
+				result = tournamentResult{Error: err.Error()}
+			} else {
+				result.Tournament = t
+			}
+			body, _ = json.Marshal(result)
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, err := w.Write(body)
 		if err != nil {
 			logger.Error("Write response failed", zap.Error(err))
 		}
+	}
+
+	http.HandleFunc("/ops/tournament/create", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Creates a tournament from JSON body.
+		// The entries are seeded in the given order.
+
+		var req struct {
+			Name     string             `json:"name"`
+			Format   string             `json:"format"`
+			Platform string             `json:"platform"`
+			Disk     string             `json:"disk"`
+			LobbyID  int                `json:"lobby_id"`
+			Entries  []*TournamentEntry `json:"entries"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		t, err := NewTournament(req.Name, req.Format, req.Platform, req.Disk, req.LobbyID, req.Entries)
+		if err == nil {
+			lbs.Locked(func(lbs *Lbs) {
+				err = lbs.CreateTournament(t)
+			})
+		}
+		if err != nil {
+			writeJSON(w, http.StatusUnprocessableEntity, &tournamentResult{Error: err.Error()})
+			return
+		}
+
+		updateTournament(w, t.ID, func(lbs *Lbs, t *Tournament) error { return nil })
+	})
+
+	http.HandleFunc("/ops/tournament/schedule", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Sets the time that the match can start
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		matchNo, err := strconv.Atoi(r.FormValue("match_no"))
+		if err != nil {
+			http.Error(w, "invalid match_no", http.StatusBadRequest)
+			return
+		}
+		at, err := time.Parse(time.RFC3339, r.FormValue("at"))
+		if err != nil {
+			http.Error(w, "invalid at", http.StatusBadRequest)
+			return
+		}
+
+		updateTournament(w, r.FormValue("id"), func(lbs *Lbs, t *Tournament) error {
+			return lbs.ScheduleTournamentMatch(t, matchNo, at)
+		})
+	})
+
+	http.HandleFunc("/ops/tournament/result", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Overrides the result of the match.
+		// winner=0 makes the playing match ready again.
+
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		matchNo, err := strconv.Atoi(r.FormValue("match_no"))
+		if err != nil {
+			http.Error(w, "invalid match_no", http.StatusBadRequest)
+			return
+		}
+		winner, err := strconv.Atoi(r.FormValue("winner"))
+		if err != nil {
+			http.Error(w, "invalid winner", http.StatusBadRequest)
+			return
+		}
+
+		updateTournament(w, r.FormValue("id"), func(lbs *Lbs, t *Tournament) error {
+			return lbs.SetTournamentResult(t, matchNo, winner)
+		})
+	})
+
+	http.HandleFunc("/ops/capture", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Captures lobby messages of a user to a file for `gdxsv dump`.
+		// GET lists active captures.
+		// POST ?user_id=&action=start|stop starts or stops the capture of the user.
+		if r.Method != http.MethodPost {
+			writeJSON(w, http.StatusOK, lbs.captures.List())
+			return
+		}
+
+		var info *LbsCaptureInfo
+		var err error
+		switch r.FormValue("action") {
+		case "start":
+			info, err = lbs.captures.Start(r.FormValue("user_id"))
+		case "stop":
+			info, err = lbs.captures.Stop(r.FormValue("user_id"))
+		default:
+			err = fmt.Errorf("invalid action %q", r.FormValue("action"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	})
+
+	http.HandleFunc("/ops/battle_conn_stats", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Returns the connection stats of battle users measured by the mcs.
+		// ?battle_code= returns all users of the battle.
+		// ?user_id=&limit= returns the recent battles of the user.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var stats []*BattleConnStats
+		var err error
+		if battleCode := r.FormValue("battle_code"); battleCode != "" {
+			stats, err = getDB().GetBattleConnStats(battleCode)
+		} else if userID := r.FormValue("user_id"); userID != "" {
+			limit, _ := strconv.Atoi(r.FormValue("limit"))
+			if limit <= 0 || 100 < limit {
+				limit = 20
+			}
+			stats, err = getDB().GetUserBattleConnStats(userID, limit)
+		} else {
+			http.Error(w, "battle_code or user_id is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Error("GetBattleConnStats failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if stats == nil {
+			stats = []*BattleConnStats{}
+		}
+		writeJSON(w, http.StatusOK, stats)
+	})
+
+	http.HandleFunc("/ops/p2p_reports", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Returns the P2PMatchingReports saved by the lbs.
+		// ?battle_code= returns all peers of the battle.
+		// ?user_id=&limit= returns the recent battles of the user.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var reports []*P2PReport
+		var err error
+		if battleCode := r.FormValue("battle_code"); battleCode != "" {
+			reports, err = getDB().GetP2PReports(battleCode)
+		} else if userID := r.FormValue("user_id"); userID != "" {
+			limit, _ := strconv.Atoi(r.FormValue("limit"))
+			if limit <= 0 || 100 < limit {
+				limit = 20
+			}
+			reports, err = getDB().GetUserP2PReports(userID, limit)
+		} else {
+			http.Error(w, "battle_code or user_id is required", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			logger.Error("GetP2PReports failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if reports == nil {
+			reports = []*P2PReport{}
+		}
+		writeJSON(w, http.StatusOK, reports)
+	})
+
+	http.HandleFunc("/ops/disconnect_penalty", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Shows and overrides the disconnect penalty of a user.
+		// GET ?user_id= returns the penalty and the disconnects of the user.
+		// POST ?user_id=&battle_code= forgives the disconnect of the battle, or all disconnects of the user without battle_code.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userID := r.FormValue("user_id")
+		if userID == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+
+		forgiven := int64(0)
+		if r.Method == http.MethodPost {
+			n, err := getDB().ForgiveUserDisconnects(userID, r.FormValue("battle_code"))
+			if err != nil {
+				logger.Error("ForgiveUserDisconnects failed", zap.Error(err))
+				http.Error(w, "", http.StatusInternalServerError)
+				return
+			}
+			forgiven = n
+			logger.Info("disconnects forgiven",
+				zap.String("user_id", userID),
+				zap.String("battle_code", r.FormValue("battle_code")),
+				zap.Int64("count", n))
+		}
+
+		now := time.Now()
+		disconnects, err := getDB().GetUserDisconnects(userID, now.Add(-reputationWindow))
+		if err != nil {
+			logger.Error("GetUserDisconnects failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if disconnects == nil {
+			disconnects = []*UserDisconnect{}
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Penalty     *DisconnectPenalty `json:"penalty"`
+			Disconnects []*UserDisconnect  `json:"disconnects"`
+			Forgiven    int64              `json:"forgiven"`
+		}{calcDisconnectPenalty(userID, disconnects, now), disconnects, forgiven})
+	})
+
+	http.HandleFunc("/lbs/reputation", func(w http.ResponseWriter, r *http.Request) {
+		// Public API: Returns the reputation and the matching cooldown of the caller.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userID, ok := authUserID(r)
+		if !ok {
+			http.Error(w, "user_id and its login_key are required", http.StatusForbidden)
+			return
+		}
+
+		penalty, err := getDisconnectPenalty(userID, time.Now())
+		if err != nil {
+			logger.Error("getDisconnectPenalty failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, penalty)
 	})
+
+	http.HandleFunc("/ops/p2p_flycast_summary", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Summarizes the P2P battles of the last ?days= per flycast version.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		summary, err := getDB().GetFlycastP2PReportSummary(p2pSummarySince(r))
+		if err != nil {
+			logger.Error("GetFlycastP2PReportSummary failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if summary == nil {
+			summary = []*P2PReportSummary{}
+		}
+		writeJSON(w, http.StatusOK, summary)
+	})
+
+	// writeP2PSummary writes the P2P summary and the recent P2P reports of the user.
+	writeP2PSummary := func(w http.ResponseWriter, r *http.Request, userID string) {
+		summary, err := getDB().GetUserP2PReportSummary(userID, p2pSummarySince(r))
+		if err != nil {
+			logger.Error("GetUserP2PReportSummary failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		reports, err := getDB().GetUserP2PReports(userID, 20)
+		if err != nil {
+			logger.Error("GetUserP2PReports failed", zap.Error(err))
+			http.Error(w, "", http.StatusInternalServerError)
+			return
+		}
+		if reports == nil {
+			reports = []*P2PReport{}
+		}
+		writeJSON(w, http.StatusOK, struct {
+			Summary *P2PReportSummary `json:"summary"`
+			Recent  []*P2PReport      `json:"recent"`
+		}{summary, reports})
+	}
+
+	http.HandleFunc("/ops/p2p_summary", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Summarizes the P2P battles of the user in the last ?days= to diagnose the setup.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userID := r.FormValue("user_id")
+		if userID == "" {
+			http.Error(w, "user_id is required", http.StatusBadRequest)
+			return
+		}
+		writeP2PSummary(w, r, userID)
+	})
+
+	http.HandleFunc("/lbs/p2p_summary", func(w http.ResponseWriter, r *http.Request) {
+		// Public API: Summarizes the P2P battles of the caller in the last ?days= so that players can check their own setup.
+		if err := r.ParseForm(); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		userID, ok := authUserID(r)
+		if !ok {
+			http.Error(w, "user_id and its login_key are required", http.StatusForbidden)
+			return
+		}
+		writeP2PSummary(w, r, userID)
+	})
+}
+
+// authUserID returns ?user_id= if it belongs to the account of ?login_key=.
+// The public APIs about the behavior of a player are served only to the player.
+func authUserID(r *http.Request) (string, bool) {
+	userID, loginKey := r.FormValue("user_id"), r.FormValue("login_key")
+	if userID == "" || loginKey == "" {
+		return "", false
+	}
+	users, err := getDB().GetUserList(loginKey)
+	if err != nil {
+		return "", false
+	}
+	for _, u := range users {
+		if u.UserID == userID {
+			return userID, true
+		}
+	}
+	return "", false
+}
+
+// p2pSummarySince returns the start time of the P2P summary from ?days=, the last 30 days by default.
+func p2pSummarySince(r *http.Request) time.Time {
+	days, _ := strconv.Atoi(r.FormValue("days"))
+	if days <= 0 || 365 < days {
+		days = 30
+	}
+	return time.Now().AddDate(0, 0, -days)
 }
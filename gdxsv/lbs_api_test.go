@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_authUserID(t *testing.T) {
+	mustInsertDBAccount(DBAccount{LoginKey: "AUTHKEY001"})
+	mustInsertDBUser(DBUser{LoginKey: "AUTHKEY001", UserID: "AUTH01", Name: "AUTH01"})
+	mustInsertDBUser(DBUser{LoginKey: "AUTHKEY001", UserID: "AUTH02", Name: "AUTH02"})
+	mustInsertDBAccount(DBAccount{LoginKey: "AUTHKEY002"})
+	mustInsertDBUser(DBUser{LoginKey: "AUTHKEY002", UserID: "AUTH03", Name: "AUTH03"})
+
+	tests := []struct {
+		query  string
+		userID string
+		ok     bool
+	}{
+		{"user_id=AUTH01&login_key=AUTHKEY001", "AUTH01", true},
+		{"user_id=AUTH02&login_key=AUTHKEY001", "AUTH02", true},
+		{"user_id=AUTH03&login_key=AUTHKEY001", "", false}, // a user of another account
+		{"user_id=AUTH01", "", false},
+		{"login_key=AUTHKEY001", "", false},
+		{"user_id=AUTH01&login_key=UNKNOWN", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/lbs/p2p_summary?"+tt.query, nil)
+			must(t, r.ParseForm())
+			userID, ok := authUserID(r)
+			assertEq(t, tt.userID, userID)
+			assertEq(t, tt.ok, ok)
+		})
+	}
+}
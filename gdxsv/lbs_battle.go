@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
 	"fmt"
 	"net"
 	"strconv"
 	"time"
 
+	"gdxsv/gdxsv/proto"
 	"go.uber.org/zap"
 )
 
@@ -15,6 +17,33 @@ func genBattleCode() string {
 	return fmt.Sprintf("%013d", time.Now().UnixNano()/1000000)
 }
 
+// genBattleSessionKey generates a key to authenticate battle udp packets of a session.
+func genBattleSessionKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		logger.Error("failed to generate battle session key", zap.Error(err))
+		return nil
+	}
+	return key
+}
+
+// supportsBattleAuth reports whether the client signs battle udp packets with the session key.
+func supportsBattleAuth(p *LbsPeer) bool {
+	return p.PlatformInfo["udp_hmac"] == "1"
+}
+
+// supportsP2P reports whether the client can join a p2p battle.
+// P2P battles are available only on emulators that have an address other peers can connect to.
+func supportsP2P(p *LbsPeer) bool {
+	return p.Platform == PlatformEmuX8664 && 0 < len(p2pCandidateAddrs(p))
+}
+
+// supportsIPv6 reports whether the client can connect to the battle server with IPv6.
+// Real consoles can only receive IPv4 octets, so only emulators that declare it are given one.
+func supportsIPv6(p *LbsPeer) bool {
+	return p.Platform != PlatformConsole && p.PlatformInfo["mcs_ipv6"] == "1"
+}
+
 type LbsBattle struct {
 	app *Lbs
 
@@ -31,6 +60,17 @@ type LbsBattle struct {
 	LobbyID    uint16
 	StartTime  time.Time
 	TestBattle bool
+
+	// PatchList is the game patches of the battle. The lobby provides them if it is nil.
+	PatchList *proto.GamePatchList
+
+	// ServerIP6 and ServerPort6 are the IPv6 address of the battle server if it has one.
+	ServerIP6   net.IP
+	ServerPort6 uint16
+
+	// RegionDecision is the reason why the battle server region was selected.
+	// It is nil unless the region was selected automatically.
+	RegionDecision *RegionDecision
 }
 
 func toIPPort(addr string) (net.IP, uint16, error) {
@@ -44,37 +84,46 @@ func toIPPort(addr string) (net.IP, uint16, error) {
 		return nil, 0, err
 	}
 
-	ipAddr, err := net.ResolveIPAddr("ip4", host)
+	// IPv4 is preferred when the host has both.
+	ipAddr, err := net.ResolveIPAddr("ip", host)
 	if err != nil {
 		return nil, 0, err
 	}
 
+	if ip4 := ipAddr.IP.To4(); ip4 != nil {
+		return ip4, uint16(portNum), nil
+	}
 	return ipAddr.IP, uint16(portNum), nil
 }
 
+// mcsPublicAddr6 returns the IPv6 public address of the mcs that has the public address.
+func (lbs *Lbs) mcsPublicAddr6(mcsAddr string) string {
+	if lbs != nil {
+		if p := lbs.FindMcsPeer(mcsAddr); p != nil && p.mcsStatus != nil {
+			return p.mcsStatus.PublicAddr6
+		}
+	}
+	if mcsAddr == conf.BattlePublicAddr {
+		return conf.BattlePublicAddr6
+	}
+	return ""
+}
+
 func NewBattle(app *Lbs, lobbyID uint16, rule *Rule, mcsRegion string, mcsAddr string) *LbsBattle {
 	if mcsAddr == "" {
 		mcsRegion = ""
 		mcsAddr = conf.BattlePublicAddr
 	}
 
-	ip, port, err := toIPPort(mcsAddr)
-	if err != nil {
-		logger.Error("failed to parse mcs addr", zap.Error(err))
-		return nil
-	}
-
 	if rule == nil {
 		rule = &DefaultRule
 	}
 
-	return &LbsBattle{
+	b := &LbsBattle{
 		app: app,
 
 		BattleCode: genBattleCode(),
 		McsRegion:  mcsRegion,
-		ServerIP:   ip,
-		ServerPort: port,
 		Users:      make([]*DBUser, 0),
 		UserRanks:  make([]int, 0),
 		GameParams: make([][]byte, 0),
@@ -83,6 +132,12 @@ func NewBattle(app *Lbs, lobbyID uint16, rule *Rule, mcsRegion string, mcsAddr s
 		Rule:       rule,
 		LobbyID:    lobbyID,
 	}
+
+	if err := b.setServerAddr(mcsAddr); err != nil {
+		logger.Error("failed to parse mcs addr", zap.Error(err))
+		return nil
+	}
+	return b
 }
 
 func (b *LbsBattle) SetRule(rule *Rule) {
@@ -106,13 +161,48 @@ func (b *LbsBattle) NumOfEntryUsers() uint16 {
 }
 
 func (b *LbsBattle) SetBattleServer(addr string) {
+	if err := b.setServerAddr(addr); err != nil {
+		logger.Error("failed to set battle server", zap.Error(err))
+	}
+}
+
+func (b *LbsBattle) setServerAddr(addr string) error {
 	ip, port, err := toIPPort(addr)
 	if err != nil {
-		logger.Error("failed to set battle server", zap.Error(err))
-		return
+		return err
 	}
 	b.ServerIP = ip
 	b.ServerPort = port
+	b.ServerIP6 = nil
+	b.ServerPort6 = 0
+	if ip.To4() == nil {
+		b.ServerIP6 = ip
+		b.ServerPort6 = port
+	}
+
+	if addr6 := b.app.mcsPublicAddr6(addr); addr6 != "" {
+		ip6, port6, err := toIPPort(addr6)
+		if err != nil || ip6.To4() != nil {
+			logger.Warn("invalid mcs ipv6 addr", zap.String("addr6", addr6), zap.Error(err))
+			return nil
+		}
+		b.ServerIP6 = ip6
+		b.ServerPort6 = port6
+	}
+	return nil
+}
+
+// ServerAddrFor returns the battle server address the client connects to.
+// IPv6 is preferred for clients that support it and the others get IPv4.
+// A nil ip is returned if the battle server has no address reachable from the client.
+func (b *LbsBattle) ServerAddrFor(p *LbsPeer) (net.IP, uint16) {
+	if supportsIPv6(p) && b.ServerIP6 != nil {
+		return b.ServerIP6, b.ServerPort6
+	}
+	if ip4 := b.ServerIP.To4(); ip4 != nil {
+		return ip4, b.ServerPort
+	}
+	return nil, 0
 }
 
 func (b *LbsBattle) GetPosition(userID string) byte {
@@ -19,6 +19,8 @@ func Test_toIPPort(t *testing.T) {
 	}{
 		{"tcp4 addr", args{"192.168.1.10:1234"}, net.IPv4(192, 168, 1, 10), 1234, false},
 		{"localhost", args{"localhost:1234"}, net.IPv4(127, 0, 0, 1), 1234, false},
+		{"tcp6 addr", args{"[2001:db8::1]:1234"}, net.ParseIP("2001:db8::1"), 1234, false},
+		{"ipv4-mapped addr", args{"[::ffff:192.168.1.10]:1234"}, net.IPv4(192, 168, 1, 10), 1234, false},
 		{"missing port", args{"192.168.1.10"}, nil, 0, true},
 		{"bad port", args{"192.168.1.10:badport"}, nil, 0, true},
 		{"empty string", args{""}, nil, 0, true},
@@ -188,3 +190,43 @@ func Test_genBattleCode(t *testing.T) {
 	code2 := genBattleCode()
 	assertEq(t, BattleCodeLength, len(code2))
 }
+
+func TestLbsBattle_ServerAddrFor(t *testing.T) {
+	console := &LbsPeer{Platform: PlatformConsole, PlatformInfo: map[string]string{}}
+	emu := &LbsPeer{Platform: PlatformEmuX8664, PlatformInfo: map[string]string{}}
+	emu6 := &LbsPeer{Platform: PlatformEmuX8664, PlatformInfo: map[string]string{"mcs_ipv6": "1"}}
+	// A public IPv6 address for p2p does not mean the client can receive the IPv6 address of the mcs.
+	emuBad6 := &LbsPeer{Platform: PlatformEmuX8664, PlatformInfo: map[string]string{"public_ipv6": "2001:db8::2"}}
+
+	b := newTestBattle()
+	must(t, b.setServerAddr("192.0.2.1:3334"))
+	for _, p := range []*LbsPeer{console, emu, emu6, emuBad6} {
+		ip, port := b.ServerAddrFor(p)
+		assertEq(t, "192.0.2.1", ip.String())
+		assertEq(t, uint16(3334), port)
+	}
+
+	// Dual-stack battle server.
+	conf.BattlePublicAddr = "192.0.2.1:3334"
+	conf.BattlePublicAddr6 = "[2001:db8::1]:3335"
+	defer func() { conf.BattlePublicAddr6 = "" }()
+	must(t, b.setServerAddr("192.0.2.1:3334"))
+	for _, p := range []*LbsPeer{console, emu, emuBad6} {
+		ip, port := b.ServerAddrFor(p)
+		assertEq(t, "192.0.2.1", ip.String())
+		assertEq(t, uint16(3334), port)
+	}
+	ip, port := b.ServerAddrFor(emu6)
+	assertEq(t, "2001:db8::1", ip.String())
+	assertEq(t, uint16(3335), port)
+
+	// IPv6-only battle server can't be used by legacy clients.
+	must(t, b.setServerAddr("[2001:db8::3]:3334"))
+	ip, _ = b.ServerAddrFor(console)
+	assertEq(t, net.IP(nil), ip)
+	ip, _ = b.ServerAddrFor(emu)
+	assertEq(t, net.IP(nil), ip)
+	ip, port = b.ServerAddrFor(emu6)
+	assertEq(t, "2001:db8::3", ip.String())
+	assertEq(t, uint16(3334), port)
+}
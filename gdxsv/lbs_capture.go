@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	CaptureIn  = "in"  // client to server
+	CaptureOut = "out" // server to client
+)
+
+// LbsCaptureRecord is a line of a lbs capture file.
+type LbsCaptureRecord struct {
+	Time   int64  `json:"t"`   // unix nano
+	Dir    string `json:"dir"` // CaptureIn or CaptureOut
+	UserID string `json:"user_id"`
+	Addr   string `json:"addr"`
+	Data   []byte `json:"data"` // serialized message
+}
+
+// LbsCaptureRecorder writes raw messages of a user to a capture file as json lines.
+type LbsCaptureRecorder struct {
+	mtx       sync.Mutex
+	path      string
+	startedAt time.Time
+	f         *os.File
+	enc       *json.Encoder
+}
+
+func NewLbsCaptureRecorder(path string) (*LbsCaptureRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &LbsCaptureRecorder{path: path, startedAt: time.Now(), f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record records a serialized message sent or received by the peer.
+func (c *LbsCaptureRecorder) Record(dir string, p *LbsPeer, data []byte, at time.Time) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.enc == nil {
+		return
+	}
+	err := c.enc.Encode(&LbsCaptureRecord{
+		Time:   at.UnixNano(),
+		Dir:    dir,
+		UserID: p.UserID,
+		Addr:   p.Address(),
+		Data:   data,
+	})
+	if err != nil {
+		logger.Error("failed to write lbs capture", zap.Error(err))
+	}
+}
+
+func (c *LbsCaptureRecorder) Close() error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.enc = nil
+	return c.f.Close()
+}
+
+// LbsCaptures holds the capture recorders of users.
+type LbsCaptures struct {
+	mtx       sync.Mutex
+	recorders map[string]*LbsCaptureRecorder
+}
+
+// LbsCaptureInfo is an active capture.
+type LbsCaptureInfo struct {
+	UserID    string    `json:"user_id"`
+	Path      string    `json:"path"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func NewLbsCaptures() *LbsCaptures {
+	return &LbsCaptures{recorders: map[string]*LbsCaptureRecorder{}}
+}
+
+// Get returns the recorder of the user or nil if the user is not captured.
+func (cs *LbsCaptures) Get(userID string) *LbsCaptureRecorder {
+	if userID == "" {
+		return nil
+	}
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	return cs.recorders[userID]
+}
+
+// Start starts capturing messages of the user to a new file in conf.CapturePath.
+func (cs *LbsCaptures) Start(userID string) (*LbsCaptureInfo, error) {
+	if userID == "" || strings.ContainsAny(userID, `/\.`) {
+		return nil, fmt.Errorf("invalid user id %q", userID)
+	}
+
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	if c, ok := cs.recorders[userID]; ok {
+		return &LbsCaptureInfo{UserID: userID, Path: c.path, StartedAt: c.startedAt}, nil
+	}
+
+	err := os.MkdirAll(conf.CapturePath, 0755)
+	if err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("%s-%s.jsonl", userID, time.Now().Format("20060102-150405"))
+	c, err := NewLbsCaptureRecorder(filepath.Join(conf.CapturePath, name))
+	if err != nil {
+		return nil, err
+	}
+	cs.recorders[userID] = c
+	logger.Info("lbs capture started", zap.String("user_id", userID), zap.String("path", c.path))
+	return &LbsCaptureInfo{UserID: userID, Path: c.path, StartedAt: c.startedAt}, nil
+}
+
+// Stop stops capturing messages of the user.
+func (cs *LbsCaptures) Stop(userID string) (*LbsCaptureInfo, error) {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	c, ok := cs.recorders[userID]
+	if !ok {
+		return nil, fmt.Errorf("user %q is not captured", userID)
+	}
+	delete(cs.recorders, userID)
+	logger.Info("lbs capture stopped", zap.String("user_id", userID), zap.String("path", c.path))
+	return &LbsCaptureInfo{UserID: userID, Path: c.path, StartedAt: c.startedAt}, c.Close()
+}
+
+// StopAll stops all captures.
+func (cs *LbsCaptures) StopAll() {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	for userID, c := range cs.recorders {
+		_ = c.Close()
+		delete(cs.recorders, userID)
+	}
+}
+
+// List returns the active captures.
+func (cs *LbsCaptures) List() []*LbsCaptureInfo {
+	cs.mtx.Lock()
+	defer cs.mtx.Unlock()
+	ret := []*LbsCaptureInfo{}
+	for userID, c := range cs.recorders {
+		ret = append(ret, &LbsCaptureInfo{UserID: userID, Path: c.path, StartedAt: c.startedAt})
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].UserID < ret[j].UserID })
+	return ret
+}
+
+// ReadLbsCapture reads all records of a capture file.
+func ReadLbsCapture(r io.Reader) ([]*LbsCaptureRecord, error) {
+	var records []*LbsCaptureRecord
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		rec := new(LbsCaptureRecord)
+		if err := json.Unmarshal(sc.Bytes(), rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
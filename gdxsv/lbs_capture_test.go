@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLbsCaptures(t *testing.T) {
+	conf.CapturePath = t.TempDir()
+
+	lbs := NewLbs()
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	user1, cancel1 := prepareLoggedInUser(t, lbs, PlatformConsole, GameDiskDC2, DBUser{UserID: "CAP01", Name: "NAME01"})
+	defer cancel1()
+	forceEnterLobby(t, lbs, user1, 1, TeamRenpo)
+
+	user2, cancel2 := prepareLoggedInUser(t, lbs, PlatformConsole, GameDiskDC2, DBUser{UserID: "CAP02", Name: "NAME02"})
+	defer cancel2()
+	forceEnterLobby(t, lbs, user2, 1, TeamRenpo)
+
+	_, err := lbs.captures.Start("../CAP01")
+	if err == nil {
+		t.Fatal("user id must not be a path")
+	}
+
+	info, err := lbs.captures.Start("CAP01")
+	must(t, err)
+	assertEq(t, 1, len(lbs.captures.List()))
+
+	user1.MustWriteMessage(NewClientNotice(lbsPostChatMessage).Writer().WriteString("CAPTURED").Msg())
+	user1.MustReadMessageSkipNoticeUntil(lbsChatMessage)
+	user2.MustReadMessageSkipNoticeUntil(lbsChatMessage)
+
+	_, err = lbs.captures.Stop("CAP01")
+	must(t, err)
+	assertEq(t, 0, len(lbs.captures.List()))
+	_, err = lbs.captures.Stop("CAP01")
+	if err == nil {
+		t.Fatal("stop twice must fail")
+	}
+
+	// Not captured after stop.
+	user1.MustWriteMessage(NewClientNotice(lbsPostChatMessage).Writer().WriteString("NOT CAPTURED").Msg())
+	user1.MustReadMessageSkipNoticeUntil(lbsChatMessage)
+
+	f, err := os.Open(info.Path)
+	must(t, err)
+	defer f.Close()
+	records, err := ReadLbsCapture(f)
+	must(t, err)
+
+	var dirs []string
+	var texts []interface{}
+	for _, rec := range records {
+		assertEq(t, "CAP01", rec.UserID)
+		e := DecodeLbsCaptureRecord(rec)
+		if e.Command == "lbsPostChatMessage" || e.Command == "lbsChatMessage" {
+			dirs = append(dirs, rec.Dir)
+			for _, f := range e.Fields {
+				if f.Name == "text" {
+					texts = append(texts, f.Value)
+				}
+			}
+		}
+	}
+	assertEq(t, []string{CaptureIn, CaptureOut}, dirs)
+	assertEq(t, []interface{}{"CAPTURED", "CAPTURED"}, texts)
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// LbsDumpEntry is a decoded message of a capture file.
+type LbsDumpEntry struct {
+	Time      time.Time     `json:"time"`
+	Dir       string        `json:"dir"`
+	UserID    string        `json:"user_id"`
+	Addr      string        `json:"addr"`
+	Command   string        `json:"command"`
+	Direction string        `json:"direction"`
+	Category  string        `json:"category"`
+	Seq       uint16        `json:"seq"`
+	Status    string        `json:"status"`
+	Fields    lbsDumpFields `json:"fields,omitempty"`
+	Body      string        `json:"body,omitempty"` // hex of the body that is not decoded
+	Error     string        `json:"error,omitempty"`
+}
+
+type lbsDumpField struct {
+	Name  string
+	Value interface{}
+}
+
+// lbsDumpFields keeps the order of the fields in the body.
+type lbsDumpFields []lbsDumpField
+
+func (fs lbsDumpFields) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fs {
+		if 0 < i {
+			buf.WriteByte(',')
+		}
+		k, err := json.Marshal(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		v, err := json.Marshal(f.Value)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(k)
+		buf.WriteByte(':')
+		buf.Write(v)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (fs lbsDumpFields) String() string {
+	var sb strings.Builder
+	for i, f := range fs {
+		if 0 < i {
+			sb.WriteByte(' ')
+		}
+		if s, ok := f.Value.(string); ok {
+			fmt.Fprintf(&sb, "%s=%q", f.Name, s)
+		} else {
+			fmt.Fprintf(&sb, "%s=%v", f.Name, f.Value)
+		}
+	}
+	return sb.String()
+}
+
+type lbsDumpKey struct {
+	Direction CmdDirection
+	Command   CmdID
+}
+
+type lbsBodyDecoder func(r *MessageBodyReader) lbsDumpFields
+
+func decodeLobbyID(r *MessageBodyReader) lbsDumpFields {
+	return lbsDumpFields{{"lobby_id", r.Read16()}}
+}
+
+func decodeTeam(r *MessageBodyReader) lbsDumpFields {
+	return lbsDumpFields{{"team", r.Read16()}}
+}
+
+func decodeEnable(r *MessageBodyReader) lbsDumpFields {
+	return lbsDumpFields{{"enable", r.Read8()}}
+}
+
+func decodeRoomID(r *MessageBodyReader) lbsDumpFields {
+	return lbsDumpFields{{"room_id", r.Read16()}}
+}
+
+func decodeUserID(r *MessageBodyReader) lbsDumpFields {
+	return lbsDumpFields{{"user_id", r.ReadString()}}
+}
+
+// lbsBodyDecoders knows the body layouts worth reading when debugging a client.
+var lbsBodyDecoders = map[lbsDumpKey]lbsBodyDecoder{
+	{ClientToServer, lbsAskConnectionID}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"last_session_id", r.ReadString()}}
+	},
+	{ServerToClient, lbsConnectionID}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"session_id", r.ReadString()}}
+	},
+	{ClientToServer, lbsLoginType}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"login_type", r.Read8()}}
+	},
+	{ClientToServer, lbsUserRegist}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"user_id", r.ReadString()}, {"name", r.ReadShiftJISString()}}
+	},
+	{ClientToServer, lbsUserDecide}: decodeUserID,
+	{ServerToClient, lbsUserDecide}: decodeUserID,
+	{ServerToClient, lbsShutDown}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"message", r.ReadShiftJISString()}}
+	},
+
+	{ClientToServer, lbsPostChatMessage}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"text", r.ReadShiftJISString()}}
+	},
+	{ServerToClient, lbsChatMessage}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"user_id", r.ReadString()}, {"name", r.ReadShiftJISString()}, {"text", r.ReadShiftJISString()}}
+	},
+
+	{ClientToServer, lbsPlazaJoin}:    decodeLobbyID,
+	{ClientToServer, lbsPlazaStatus}:  decodeLobbyID,
+	{ClientToServer, lbsPlazaExplain}: decodeLobbyID,
+	{ClientToServer, lbsPlazaEntry}:   decodeLobbyID,
+	{ServerToClient, lbsPlazaStatus}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"lobby_id", r.Read16()}, {"status", r.Read8()}}
+	},
+	{ClientToServer, lbsLobbyEntry}:         decodeTeam,
+	{ClientToServer, lbsLobbyJoin}:          decodeTeam,
+	{ClientToServer, lbsLobbyMatchingJoin}:  decodeTeam,
+	{ClientToServer, lbsLobbyMatchingEntry}: decodeEnable,
+	{ClientToServer, lbsMatchingEntry}:      decodeEnable,
+	{ClientToServer, lbsRoomCreate}:         decodeRoomID,
+	{ClientToServer, lbsRoomStatus}:         decodeRoomID,
+	{ClientToServer, lbsRoomTitle}:          decodeRoomID,
+	{ClientToServer, lbsRoomEntry}:          decodeRoomID,
+	{ClientToServer, lbsPutRoomName}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"room_name", r.ReadShiftJISString()}}
+	},
+
+	{ServerToClient, lbsAskMatchingJoin}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"players", r.Read8()}}
+	},
+	{ServerToClient, lbsAskPlayerSide}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"pos", r.Read8()}}
+	},
+	{ClientToServer, lbsAskPlayerInfo}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"pos", r.Read8()}}
+	},
+	{ServerToClient, lbsAskPlayerInfo}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"pos", r.Read8()}, {"user_id", r.ReadString()}, {"name", r.ReadShiftJISString()}}
+	},
+	{ServerToClient, lbsAskBattleCode}: func(r *MessageBodyReader) lbsDumpFields {
+		return lbsDumpFields{{"battle_code", r.ReadString()}}
+	},
+	{ServerToClient, lbsAskMcsAddress}: func(r *MessageBodyReader) lbsDumpFields {
+		r.Read16() // ip length
+		ip := fmt.Sprintf("%d.%d.%d.%d", r.Read8(), r.Read8(), r.Read8(), r.Read8())
+		r.Read16() // port length
+		return lbsDumpFields{{"mcs_addr", fmt.Sprintf("%s:%d", ip, r.Read16())}}
+	},
+}
+
+// DecodeLbsCaptureRecord decodes the message of the record.
+func DecodeLbsCaptureRecord(rec *LbsCaptureRecord) *LbsDumpEntry {
+	e := &LbsDumpEntry{
+		Time:   time.Unix(0, rec.Time),
+		Dir:    rec.Dir,
+		UserID: rec.UserID,
+		Addr:   rec.Addr,
+	}
+
+	n, m := Deserialize(rec.Data)
+	if m == nil || n != len(rec.Data) {
+		e.Error = "broken message"
+		e.Body = hex.EncodeToString(rec.Data)
+		return e
+	}
+
+	e.Command = m.Command.String()
+	if strings.HasPrefix(e.Command, "CmdID(") {
+		e.Command = fmt.Sprintf("CmdID(0x%04x)", uint16(m.Command))
+	}
+	e.Direction = m.Direction.String()
+	e.Category = m.Category.String()
+	e.Seq = m.Seq
+	e.Status = m.Status.String()
+
+	decode := lbsBodyDecoders[lbsDumpKey{m.Direction, m.Command}]
+	if m.Status == StatusError {
+		decode = func(r *MessageBodyReader) lbsDumpFields {
+			return lbsDumpFields{{"message", r.ReadShiftJISString()}}
+		}
+	}
+	if decode == nil || len(m.Body) == 0 {
+		if 0 < len(m.Body) {
+			e.Body = hex.EncodeToString(m.Body)
+		}
+		return e
+	}
+
+	r := m.Reader()
+	e.Fields = decode(r)
+	if r.Err() != nil {
+		e.Fields = nil
+		e.Error = r.Err().Error()
+		e.Body = hex.EncodeToString(m.Body)
+	}
+	return e
+}
+
+func (e *LbsDumpEntry) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %-3s %s %s %s %s seq=%d",
+		e.Time.Format("2006-01-02T15:04:05.000"), e.Dir, e.UserID, e.Addr, e.Command, e.Category, e.Seq)
+	if e.Status != "" && e.Status != StatusSuccess.String() {
+		sb.WriteString(" " + e.Status)
+	}
+	if 0 < len(e.Fields) {
+		sb.WriteString(" " + e.Fields.String())
+	}
+	if e.Body != "" {
+		sb.WriteString(" body=" + e.Body)
+	}
+	if e.Error != "" {
+		sb.WriteString(" error=" + e.Error)
+	}
+	return sb.String()
+}
+
+// DumpLbsCapture writes decoded messages of a capture file as text or json lines.
+func DumpLbsCapture(w io.Writer, records []*LbsCaptureRecord, asJSON bool) error {
+	enc := json.NewEncoder(w)
+	for _, rec := range records {
+		e := DecodeLbsCaptureRecord(rec)
+		if asJSON {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		} else {
+			if _, err := fmt.Fprintln(w, e); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func mainDump(args []string) int {
+	fs := flag.NewFlagSet("dump", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print json lines instead of text")
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: gdxsv dump [-json] <capture file>")
+		return 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	records, err := ReadLbsCapture(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	if err := DumpLbsCapture(os.Stdout, records, *asJSON); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
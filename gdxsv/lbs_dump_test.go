@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeLbsCaptureRecord(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	tests := []struct {
+		name string
+		msg  *LbsMessage
+		want string
+	}{
+		{
+			name: "lobby id",
+			msg:  NewClientQuestion(lbsPlazaEntry).Writer().Write16(3).Msg(),
+			want: "lbsPlazaEntry CategoryQuestion seq=0 lobby_id=3",
+		},
+		{
+			name: "chat",
+			msg:  NewServerNotice(lbsChatMessage).Writer().WriteString("U1").WriteString("ユーザ").WriteString("こんにちは").Write8(0).Write8(0).Write8(0).Write8(0).Msg(),
+			want: `lbsChatMessage CategoryNotice seq=5 user_id="U1" name="ユーザ" text="こんにちは"`,
+		},
+		{
+			name: "mcs address",
+			msg: NewServerAnswer(&LbsMessage{Command: lbsAskMcsAddress, Seq: 7}).Writer().
+				Write16(4).Write8(192).Write8(168).Write8(0).Write8(1).Write16(2).Write16(3334).Msg(),
+			want: `lbsAskMcsAddress CategoryAnswer seq=7 mcs_addr="192.168.0.1:3334"`,
+		},
+		{
+			name: "error",
+			msg:  NewServerAnswer(&LbsMessage{Command: lbsPlazaEntry, Seq: 8}).SetErr(),
+			want: `lbsPlazaEntry CategoryAnswer seq=8 StatusError message="<LF=6><BODY><CENTER>ERROR: lbsPlazaEntry<END>"`,
+		},
+		{
+			name: "unknown body",
+			msg:  NewClientQuestion(lbsDeviceData).Writer().Write16(1).Msg(),
+			want: "lbsDeviceData CategoryQuestion seq=0 body=0001",
+		},
+		{
+			name: "malformed",
+			msg:  NewClientQuestion(lbsPlazaEntry).Writer().Write8(3).Msg(),
+			want: "lbsPlazaEntry CategoryQuestion seq=0 body=03 error=message body too short: 2 bytes at offset 0",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.msg.Direction == ServerToClient && tt.msg.Category == CategoryNotice {
+				tt.msg.Seq = 5
+			}
+			e := DecodeLbsCaptureRecord(&LbsCaptureRecord{Time: at.UnixNano(), Dir: CaptureOut, UserID: "U1", Addr: "pipe", Data: tt.msg.Serialize()})
+			want := at.Format("2006-01-02T15:04:05.000") + " out U1 pipe " + tt.want
+			assertEq(t, want, e.String())
+		})
+	}
+}
+
+func TestDumpLbsCapture_JSON(t *testing.T) {
+	records := []*LbsCaptureRecord{
+		{Time: 1, Dir: CaptureIn, UserID: "U1", Data: NewClientQuestion(lbsAskPlayerInfo).Writer().Write8(2).Msg().Serialize()},
+		{Time: 2, Dir: CaptureIn, UserID: "U1", Data: []byte{1, 2, 3}},
+	}
+
+	var buf bytes.Buffer
+	must(t, DumpLbsCapture(&buf, records, true))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assertEq(t, 2, len(lines))
+
+	var e map[string]interface{}
+	must(t, json.Unmarshal([]byte(lines[0]), &e))
+	assertEq(t, "lbsAskPlayerInfo", e["command"])
+	assertEq(t, "ClientToServer", e["direction"])
+	assertEq(t, map[string]interface{}{"pos": float64(2)}, e["fields"])
+
+	must(t, json.Unmarshal([]byte(lines[1]), &e))
+	assertEq(t, "broken message", e["error"])
+	assertEq(t, "010203", e["body"])
+}
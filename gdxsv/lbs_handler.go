@@ -15,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	pb "google.golang.org/protobuf/proto"
 
@@ -33,6 +34,20 @@ func register(id CmdID, f LbsHandler) interface{} {
 	return nil
 }
 
+// malformed returns true if the message body could not be read.
+// It replies an error to the question, so that the handler just returns.
+func malformed(p *LbsPeer, m *LbsMessage, err error) bool {
+	if err == nil {
+		return false
+	}
+	lbsMsgMalformed.Add(1)
+	p.logger.Warn("malformed message", zap.Error(err), zap.String("msg", m.String()))
+	if m.Category == CategoryQuestion {
+		p.SendMessage(NewServerAnswer(m).SetErr())
+	}
+	return true
+}
+
 // ===========================================
 //          Lobby Server Commands
 // ===========================================
@@ -167,6 +182,7 @@ const (
 	lbsP2PMatching       CmdID = 0x9961
 	lbsP2PMatchingReport CmdID = 0x9962
 	lbsBattleUserCount   CmdID = 0x9965
+	lbsBattleSessionKey  CmdID = 0x9966
 )
 
 func RequestLineCheck(p *LbsPeer) {
@@ -210,7 +226,13 @@ func StartLoginFlow(p *LbsPeer) {
 }
 
 var _ = register(lbsAskConnectionID, func(p *LbsPeer, m *LbsMessage) {
-	p.lastSessionID = m.Reader().ReadString()
+	r := m.Reader()
+	lastSessionID := r.ReadString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
+
+	p.lastSessionID = lastSessionID
 	p.SessionID = genSessionID()
 	p.logger = p.logger.With(
 		zap.String("last_session_id", p.lastSessionID),
@@ -284,11 +306,20 @@ func isBannedFlycastVersion(userVersion string) bool {
 	if strings.HasPrefix(userVersion, "gdxsv-") {
 		userVersion = "v" + strings.TrimPrefix(userVersion, "gdxsv-")
 	}
-	return bannedFlycastVersions[userVersion]
+	for _, v := range getReloadableConfig().BannedFlycastVersions {
+		if v == userVersion {
+			return true
+		}
+	}
+	return false
 }
 
 var _ = register(lbsLoginType, func(p *LbsPeer, m *LbsMessage) {
-	loginType := m.Reader().Read8()
+	r := m.Reader()
+	loginType := r.Read8()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 
 	// LoginType
 	// 0 : 「ネットワーク接続」
@@ -305,7 +336,7 @@ var _ = register(lbsLoginType, func(p *LbsPeer, m *LbsMessage) {
 	switch loginType {
 	case 0:
 		v := p.PlatformInfo["flycast"]
-		if v != "" && (isOldFlycastVersion(v, requiredFlycastVersion) || isBannedFlycastVersion(v)) {
+		if v != "" && (isOldFlycastVersion(v, getReloadableConfig().RequiredFlycastVersion) || isBannedFlycastVersion(v)) {
 			p.SendMessage(NewServerNotice(lbsShutDown).Writer().
 				WriteString("<LF=5><BODY><CENTER>PLEASE UPDATE Flycast<END>").Msg())
 			return
@@ -356,7 +387,7 @@ var _ = register(lbsLoginType, func(p *LbsPeer, m *LbsMessage) {
 			WriteString("<LF=5><BODY><CENTER>UNSUPPORTED LOGIN TYPE<END>").Msg())
 	case 2:
 		v := p.PlatformInfo["flycast"]
-		if v != "" && (isOldFlycastVersion(v, requiredFlycastVersion) || isBannedFlycastVersion(v)) {
+		if v != "" && (isOldFlycastVersion(v, getReloadableConfig().RequiredFlycastVersion) || isBannedFlycastVersion(v)) {
 			p.SendMessage(NewServerNotice(lbsShutDown).Writer().
 				WriteString("<LF=5><BODY><CENTER>PLEASE UPDATE Flycast<END>").Msg())
 			return
@@ -366,7 +397,7 @@ var _ = register(lbsLoginType, func(p *LbsPeer, m *LbsMessage) {
 		p.SendMessage(NewServerQuestion(lbsUserInfo1))
 	case 3:
 		v := p.PlatformInfo["flycast"]
-		if v != "" && (isOldFlycastVersion(v, requiredFlycastVersion) || isBannedFlycastVersion(v)) {
+		if v != "" && (isOldFlycastVersion(v, getReloadableConfig().RequiredFlycastVersion) || isBannedFlycastVersion(v)) {
 			p.SendMessage(NewServerNotice(lbsShutDown).Writer().
 				WriteString("<LF=5><BODY><CENTER>PLEASE UPDATE Flycast<END>").Msg())
 			return
@@ -411,8 +442,14 @@ var _ = register(lbsUserInfo1, func(p *LbsPeer, m *LbsMessage) {
 	// Calculate hash value of telephone number that has been treated simple encryption,
 	// and use it as login_key.
 	// If user send same telephone number same login key must be generated.
+	r := m.Reader()
+	data := r.ReadBytes()
+	if malformed(p, m, r.Err()) {
+		return
+	}
+
 	hasher := fnv.New32()
-	hasher.Write(m.Reader().ReadBytes())
+	hasher.Write(data)
 	loginKey := hex.EncodeToString(hasher.Sum(nil))
 
 	if p.app.IsBannedAccount(loginKey) {
@@ -462,6 +499,9 @@ var _ = register(lbsUserRegist, func(p *LbsPeer, m *LbsMessage) {
 	r := m.Reader()
 	userID := r.ReadString()
 	handleName := r.ReadShiftJISString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	logger.Info("create new user", zap.String("user_id", userID), zap.String("handle_name", handleName))
 
 	account, err := getDB().GetAccountBySessionID(p.SessionID)
@@ -513,7 +553,11 @@ var _ = register(lbsUserRegist, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsUserDecide, func(p *LbsPeer, m *LbsMessage) {
-	userID := m.Reader().ReadString()
+	r := m.Reader()
+	userID := r.ReadString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 
 	u, err := getDB().GetUser(userID)
 	if err != nil {
@@ -547,10 +591,14 @@ var _ = register(lbsUserDecide, func(p *LbsPeer, m *LbsMessage) {
 
 var _ = register(lbsAskGameCode, func(p *LbsPeer, m *LbsMessage) {
 	code := 0
-	if m.BodySize == 1 {
-		code = int(m.Reader().Read8())
+	r := m.Reader()
+	if len(m.Body) == 1 {
+		code = int(r.Read8())
 	} else {
-		code = int(m.Reader().Read16())
+		code = int(r.Read16())
+	}
+	if malformed(p, m, r.Err()) {
+		return
 	}
 
 	switch code {
@@ -600,6 +648,9 @@ var _ = register(lbsAskBattleResult, func(p *LbsPeer, m *LbsMessage) {
 	unk26 := r.Read16()
 	unk27 := r.Read16()
 	unk28 := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	result := &BattleResult{
 		unk1, unk2, unk3, unk4, unk5, unk6,
 		unk7, unk8, unk9, unk10, unk11, unk12,
@@ -618,19 +669,20 @@ var _ = register(lbsAskBattleResult, func(p *LbsPeer, m *LbsMessage) {
 var _ = register(lbsPostGameParameter, func(p *LbsPeer, m *LbsMessage) {
 	// Client sends length-prefixed 640 bytes binary data.
 	// This is used when goto battle scene.
-	p.GameParam = m.Reader().ReadBytes()
-
-	// The data consists of keyconfig and pilot name.
-	// Pick pilot name.
 	r := m.Reader()
-	var buf []byte
-	for i := 0; i < 18; i++ {
-		r.Read8()
+	param := r.ReadBytes()
+	err := r.Err()
+	if err == nil && len(param) < 32 {
+		err = fmt.Errorf("game parameter too short: %d bytes", len(param))
 	}
-	for i := 0; i < 16; i++ {
-		buf = append(buf, r.Read8())
+	if malformed(p, m, err) {
+		return
 	}
+	p.GameParam = param
 
+	// The data consists of keyconfig and pilot name.
+	// Pick pilot name.
+	buf := param[16:32]
 	if bin, err := japanese.ShiftJIS.NewDecoder().Bytes(buf); err != nil {
 		logger.Error("failed to read pilot name", zap.Error(err))
 	} else {
@@ -683,6 +735,9 @@ var _ = register(lbsAskPatchData, func(p *LbsPeer, m *LbsMessage) {
 	platform := r.Read8()
 	crule := r.Read8()
 	data := r.ReadString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	_, _, _ = platform, crule, data
 
 	a := NewServerAnswer(m)
@@ -721,7 +776,11 @@ func decideGrade(winCount, rank int) uint8 {
 }
 
 var _ = register(lbsRankRanking, func(p *LbsPeer, m *LbsMessage) {
-	nowTopRank := m.Reader().Read8()
+	r := m.Reader()
+	nowTopRank := r.Read8()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	ranking, err := getDB().GetWinCountRanking(0)
 	if nowTopRank == 0 && err == nil {
 		maxRank := len(ranking)
@@ -747,7 +806,11 @@ var _ = register(lbsRankRanking, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsWinLose, func(p *LbsPeer, m *LbsMessage) {
-	nowTopRank := m.Reader().Read8()
+	r := m.Reader()
+	nowTopRank := r.Read8()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	if nowTopRank == 0 {
 		grade := decideGrade(p.WinCount, p.Rank)
 		userWin := r16(p.WinCount)
@@ -814,23 +877,28 @@ var _ = register(lbsInvitationTag, func(p *LbsPeer, m *LbsMessage) {
 
 var _ = register(lbsPlazaMax, func(p *LbsPeer, m *LbsMessage) {
 	p.SendMessage(NewServerAnswer(m).Writer().
-		Write16(maxLobbyCount).Msg())
+		Write16(p.app.PlazaMax(p)).Msg())
 })
 
 var _ = register(lbsPlazaJoin, func(p *LbsPeer, m *LbsMessage) {
-	lobbyID := m.Reader().Read16()
-	// PS2: LobbyID, UserCount
-	// DC : LobbyID, DC1UserCount, DC2UserCount
+	r := m.Reader()
+	pos := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
+	// PS2: Position, UserCount
+	// DC : Position, DC1UserCount, DC2UserCount
 	if p.IsPS2() {
-		lobby := p.app.GetLobby(p.Platform, p.GameDisk, lobbyID)
+		lobby := p.app.GetPlazaLobby(p.Platform, p.GameDisk, pos)
 		if lobby == nil {
 			p.SendMessage(NewServerAnswer(m).SetErr())
 			return
 		}
 		p.SendMessage(NewServerAnswer(m).Writer().
-			Write16(lobbyID).
+			Write16(pos).
 			Write16(uint16(len(lobby.Users))).Msg())
 	} else if p.IsDC() {
+		lobbyID, _ := p.app.plazaLobbyID(p.Platform, p.GameDisk, pos)
 		lobby1 := p.app.GetLobby(p.Platform, GameDiskDC1, lobbyID)
 		lobby2 := p.app.GetLobby(p.Platform, GameDiskDC2, lobbyID)
 		if lobby1 == nil || lobby2 == nil {
@@ -838,7 +906,7 @@ var _ = register(lbsPlazaJoin, func(p *LbsPeer, m *LbsMessage) {
 			return
 		}
 		p.SendMessage(NewServerAnswer(m).Writer().
-			Write16(lobbyID).
+			Write16(pos).
 			Write16(uint16(len(lobby1.Users))).
 			Write16(uint16(len(lobby2.Users))).Msg())
 	} else {
@@ -847,11 +915,15 @@ var _ = register(lbsPlazaJoin, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsPlazaStatus, func(p *LbsPeer, m *LbsMessage) {
-	lobbyID := m.Reader().Read16()
-	lobby := p.app.GetLobby(p.Platform, p.GameDisk, lobbyID)
-	if lobby == nil {
+	r := m.Reader()
+	pos := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
+	lobby := p.app.GetPlazaLobby(p.Platform, p.GameDisk, pos)
+	if lobby == nil || !lobby.IsOpen() {
 		p.SendMessage(NewServerAnswer(m).Writer().
-			Write16(lobbyID).
+			Write16(pos).
 			Write8(uint8(0)).Msg())
 		return
 	}
@@ -885,13 +957,17 @@ var _ = register(lbsPlazaStatus, func(p *LbsPeer, m *LbsMessage) {
 	}
 
 	p.SendMessage(NewServerAnswer(m).Writer().
-		Write16(lobbyID).
+		Write16(pos).
 		Write8(uint8(status)).Msg())
 })
 
 var _ = register(lbsPlazaExplain, func(p *LbsPeer, m *LbsMessage) {
-	lobbyID := m.Reader().Read16()
-	lobby := p.app.GetLobby(p.Platform, p.GameDisk, lobbyID)
+	r := m.Reader()
+	pos := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
+	lobby := p.app.GetPlazaLobby(p.Platform, p.GameDisk, pos)
 	if lobby == nil {
 		p.SendMessage(NewServerAnswer(m).SetErr())
 		return
@@ -899,15 +975,19 @@ var _ = register(lbsPlazaExplain, func(p *LbsPeer, m *LbsMessage) {
 
 	rtt := p.PlatformInfo[lobby.LobbySetting.PingTestRegion()]
 	p.SendMessage(NewServerAnswer(m).Writer().
-		Write16(lobbyID).
+		Write16(pos).
 		WriteString(lobby.buildDescription(rtt)).
 		Msg())
 })
 
 var _ = register(lbsPlazaEntry, func(p *LbsPeer, m *LbsMessage) {
-	lobbyID := m.Reader().Read16()
-	lobby := p.app.GetLobby(p.Platform, p.GameDisk, lobbyID)
-	if lobby == nil {
+	r := m.Reader()
+	pos := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
+	lobby := p.app.GetPlazaLobby(p.Platform, p.GameDisk, pos)
+	if lobby == nil || !lobby.IsOpen() {
 		p.SendMessage(NewServerAnswer(m).SetErr())
 		return
 	}
@@ -942,7 +1022,11 @@ var _ = register(lbsLobbyEntry, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	team := m.Reader().Read16()
+	r := m.Reader()
+	team := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	p.Team = team
 	p.SendMessage(NewServerAnswer(m))
 	p.app.BroadcastLobbyUserCount(p.Lobby)
@@ -971,7 +1055,11 @@ var _ = register(lbsLobbyJoin, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	team := m.Reader().Read16()
+	r := m.Reader()
+	team := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	switch p.Lobby.GameDisk {
 	case GameDiskPS2:
 		renpo, zeon := p.Lobby.GetUserCountByTeam()
@@ -1024,7 +1112,11 @@ var _ = register(lbsLobbyMatchingJoin, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	team := m.Reader().Read16()
+	r := m.Reader()
+	team := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	renpo, zeon := p.Lobby.GetLobbyMatchEntryUserCount()
 	if team == 1 {
 		p.SendMessage(NewServerAnswer(m).Writer().
@@ -1041,8 +1133,16 @@ var _ = register(lbsLobbyMatchingEntry, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	enable := m.Reader().Read8()
+	r := m.Reader()
+	enable := r.Read8()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	if enable == 1 {
+		if !checkDisconnectPenalty(p) {
+			p.SendMessage(NewServerAnswer(m).SetErr())
+			return
+		}
 		p.Lobby.Entry(p)
 	} else {
 		p.Lobby.EntryCancel(p)
@@ -1057,7 +1157,11 @@ var _ = register(lbsRoomStatus, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	roomID := m.Reader().Read16()
+	r := m.Reader()
+	roomID := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	room := p.Lobby.FindRoom(p.Team, roomID)
 	if room == nil {
 		p.SendMessage(NewServerAnswer(m).SetErr())
@@ -1074,7 +1178,7 @@ var _ = register(lbsRoomMax, func(p *LbsPeer, m *LbsMessage) {
 		p.SendMessage(NewServerAnswer(m).SetErr())
 		return
 	}
-	p.SendMessage(NewServerAnswer(m).Writer().Write16(maxRoomCount).Msg())
+	p.SendMessage(NewServerAnswer(m).Writer().Write16(uint16(p.Lobby.LobbySetting.RoomCount)).Msg())
 })
 
 var _ = register(lbsRoomTitle, func(p *LbsPeer, m *LbsMessage) {
@@ -1083,7 +1187,11 @@ var _ = register(lbsRoomTitle, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	roomID := m.Reader().Read16()
+	r := m.Reader()
+	roomID := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	room := p.Lobby.FindRoom(p.Team, roomID)
 	if room == nil {
 		p.SendMessage(NewServerAnswer(m).SetErr())
@@ -1101,7 +1209,11 @@ var _ = register(lbsRoomCreate, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	roomID := m.Reader().Read16()
+	r := m.Reader()
+	roomID := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	room := p.Lobby.FindRoom(p.Team, roomID)
 	if room == nil {
 		p.SendMessage(NewServerAnswer(m).SetErr())
@@ -1127,7 +1239,11 @@ var _ = register(lbsPutRoomName, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	roomName := m.Reader().ReadShiftJISString()
+	r := m.Reader()
+	roomName := r.ReadShiftJISString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	p.Room.Name = roomName
 	p.SendMessage(NewServerAnswer(m))
 	p.app.BroadcastRoomState(p.Room)
@@ -1150,6 +1266,9 @@ var _ = register(lbsSendMail, func(p *LbsPeer, m *LbsMessage) {
 	userID := r.ReadString()
 	comment1 := r.ReadShiftJISString()
 	comment2 := r.ReadShiftJISString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 
 	logger.Info("send mail",
 		zap.String("to_user_id", userID),
@@ -1172,7 +1291,11 @@ var _ = register(lbsSendMail, func(p *LbsPeer, m *LbsMessage) {
 
 var _ = register(lbsUserSite, func(p *LbsPeer, m *LbsMessage) {
 	// TODO: Implement
-	userID := m.Reader().ReadString()
+	r := m.Reader()
+	userID := r.ReadString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	_ = userID
 	logger.Warn("not implemented lbsUserSite")
 	p.SendMessage(NewServerAnswer(m).Writer().
@@ -1205,6 +1328,9 @@ var _ = register(lbsRoomEntry, func(p *LbsPeer, m *LbsMessage) {
 	r := m.Reader()
 	roomID := r.Read16()
 	_ = r.Read16() // unknown
+	if malformed(p, m, r.Err()) {
+		return
+	}
 
 	room := p.Lobby.FindRoom(p.Team, roomID)
 	if room == nil {
@@ -1217,6 +1343,11 @@ var _ = register(lbsRoomEntry, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
+	if !checkDisconnectPenalty(p) {
+		p.SendMessage(NewServerAnswer(m).SetErr())
+		return
+	}
+
 	room.Enter(&p.DBUser)
 	p.Room = room
 	for _, u := range room.Users {
@@ -1231,7 +1362,11 @@ var _ = register(lbsRoomEntry, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsRoomUserReject, func(p *LbsPeer, m *LbsMessage) {
-	userID := m.Reader().ReadString()
+	r := m.Reader()
+	userID := r.ReadString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	p.SendMessage(NewServerAnswer(m))
 
 	if p.Room == nil {
@@ -1300,10 +1435,18 @@ var _ = register(lbsMatchingEntry, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	r := p.Room
-	enable := m.Reader().Read8()
+	reader := m.Reader()
+	enable := reader.Read8()
+	if malformed(p, m, reader.Err()) {
+		return
+	}
 
+	r := p.Room
 	if r.Owner == p.UserID {
+		if enable == 1 && !checkRoomDisconnectPenalty(p, r) {
+			p.SendMessage(NewServerAnswer(m).SetErr())
+			return
+		}
 		r.Ready(p, enable)
 	} else if enable == 0 {
 		for _, u := range r.Users {
@@ -1322,7 +1465,11 @@ var _ = register(lbsMatchingEntry, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsPostChatMessage, func(p *LbsPeer, m *LbsMessage) {
-	text := m.Reader().ReadShiftJISString()
+	r := m.Reader()
+	text := r.ReadShiftJISString()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	msg := NewServerNotice(lbsChatMessage).Writer().
 		WriteString(p.UserID).
 		WriteString(p.Name).
@@ -1401,7 +1548,11 @@ var _ = register(lbsTopRankingTag, func(p *LbsPeer, m *LbsMessage) {
 var _ = register(lbsTopRankingSuu, func(p *LbsPeer, m *LbsMessage) {
 	// How many userPeers there is in the ranking
 	// page: ranking kind?
-	page := m.Reader().Read8()
+	r := m.Reader()
+	page := r.Read8()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	p.logger.Info("lbsTopRankingSuu", zap.Any("page", page))
 
 	n := 0
@@ -1416,6 +1567,9 @@ var _ = register(lbsTopRanking, func(p *LbsPeer, m *LbsMessage) {
 	num1 := r.Read8()
 	num2 := r.Read16()
 	num3 := r.Read16()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	p.logger.Sugar().Info("TopRanking", num1, num2, num3)
 
 	ranking, err := getDB().GetWinCountRanking(0)
@@ -1504,7 +1658,11 @@ var _ = register(lbsAskPlayerInfo, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	pos := m.Reader().Read8()
+	r := m.Reader()
+	pos := r.Read8()
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	u := p.Battle.GetUserByPos(pos)
 	param := p.Battle.GetGameParamByPos(pos)
 	team := p.Battle.GetUserTeam(u.UserID)
@@ -1558,11 +1716,16 @@ var _ = register(lbsAskMcsAddress, func(p *LbsPeer, m *LbsMessage) {
 		return
 	}
 
-	ip := p.Battle.ServerIP
-	port := p.Battle.ServerPort
-
-	if ip == nil || ip.To4() == nil || port == 0 {
-		logger.Error("invalid mcs address", zap.Any("ip", ip), zap.Any("port", port))
+	ip, port := p.Battle.ServerAddrFor(p)
+	if ip == nil || port == 0 {
+		// Legacy clients can only receive IPv4 octets.
+		if p.Battle.ServerIP6 != nil {
+			lbsMcsAddrNoIPv4.Add(1)
+		}
+		p.logger.Error("no mcs address for the client",
+			zap.String("platform", p.Platform),
+			zap.Any("ip", p.Battle.ServerIP), zap.Any("port", p.Battle.ServerPort),
+			zap.Any("ip6", p.Battle.ServerIP6), zap.Any("port6", p.Battle.ServerPort6))
 		p.SendMessage(NewServerAnswer(m).SetErr())
 		return
 	}
@@ -1570,17 +1733,15 @@ var _ = register(lbsAskMcsAddress, func(p *LbsPeer, m *LbsMessage) {
 	a := NewServerAnswer(m)
 	w := a.Writer()
 
-	bits := strings.Split(ip.String(), ".")
-	b0, _ := strconv.Atoi(bits[0])
-	b1, _ := strconv.Atoi(bits[1])
-	b2, _ := strconv.Atoi(bits[2])
-	b3, _ := strconv.Atoi(bits[3])
-
-	w.Write16(4)
-	w.Write8(byte(b0))
-	w.Write8(byte(b1))
-	w.Write8(byte(b2))
-	w.Write8(byte(b3))
+	// The address is length-prefixed, so 16 octets are sent to IPv6 capable clients.
+	if ip4 := ip.To4(); ip4 != nil {
+		w.Write16(4)
+		w.Write(ip4)
+	} else {
+		lbsMcsAddrIPv6.Add(1)
+		w.Write16(16)
+		w.Write(ip.To16())
+	}
 	w.Write16(2)
 	w.Write16(port)
 
@@ -1592,7 +1753,11 @@ var _ = register(lbsAskMcsVersion, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsExtSyncSharedData, func(p *LbsPeer, m *LbsMessage) {
-	body := m.Reader().ReadBytes() // gzipped json
+	r := m.Reader()
+	body := r.ReadBytes() // gzipped json
+	if malformed(p, m, r.Err()) {
+		return
+	}
 	gr, err := gzip.NewReader(bytes.NewReader(body))
 	if err != nil {
 		p.logger.Error("gzip.NewReader", zap.Error(err), zap.Binary("body", body))
@@ -1610,32 +1775,84 @@ var _ = register(lbsExtSyncSharedData, func(p *LbsPeer, m *LbsMessage) {
 	p.logger.Debug("update mcs status", zap.Any("mcs_status", mcsStatus))
 	p.app.mcsPeers[mcsStatus.PublicAddr] = p
 	p.mcsStatus = &mcsStatus
+	p.mcsSyncedAt = time.Now()
+	p.app.updateMcsHealth(p, p.mcsSyncedAt)
 	sharedData.SyncMcsToLbs(&mcsStatus)
 })
 
+// saveBattleConnStats saves the final connection stats of the battle user.
+func saveBattleConnStats(u *McsUser) {
+	s := u.ConnStats
+	err := getDB().SaveBattleConnStats(&BattleConnStats{
+		BattleCode:  u.BattleCode,
+		UserID:      u.UserID,
+		Pos:         u.Pos,
+		Proto:       s.Proto,
+		RTTMs:       s.RTTMs,
+		Loss:        s.Loss,
+		Resent:      s.Resent,
+		Dropped:     s.Dropped,
+		MaxGapMs:    s.MaxGapMs,
+		BytesIn:     s.BytesIn,
+		BytesOut:    s.BytesOut,
+		CloseReason: u.CloseReason,
+	})
+	if err != nil {
+		logger.Error("failed to save battle conn stats", zap.Error(err),
+			zap.String("battle_code", u.BattleCode), zap.String("user_id", u.UserID))
+	}
+}
+
 func unzipIfCompressed(input []byte) []byte {
 	gr, err := zlib.NewReader(bytes.NewReader(input))
 	if err != nil {
 		return input
 	}
 	defer gr.Close()
-	unzipped, _ := io.ReadAll(gr)
+	unzipped, _ := io.ReadAll(io.LimitReader(gr, maxUnzippedSize))
 	return unzipped
 }
 
-var _ = register(lbsPlatformInfo, func(p *LbsPeer, m *LbsMessage) {
-	// patched client sends client-platform information
+// maxUnzippedSize limits the size of compressed data from a client.
+const maxUnzippedSize = 1 << 20
+
+// parsePlatformInfo reads "key=value" lines of the platform info and the optional login key.
+func parsePlatformInfo(m *LbsMessage) (info map[string]string, loginKey []byte, err error) {
 	r := m.Reader()
-	platformInfo := string(unzipIfCompressed(r.ReadBytes()))
-	isFirstTime := len(p.PlatformInfo) == 0
+	data := r.ReadBytes()
+	if r.Err() != nil {
+		return nil, nil, r.Err()
+	}
 
-	for _, line := range strings.Split(strings.TrimSuffix(platformInfo, "\n"), "\n") {
+	info = map[string]string{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(unzipIfCompressed(data)), "\n"), "\n") {
 		kv := strings.SplitN(line, "=", 2)
 		if len(kv) == 2 {
-			p.PlatformInfo[kv[0]] = kv[1]
+			info[kv[0]] = kv[1]
 		}
 	}
 
+	if 0 < r.Remaining() {
+		loginKey = r.ReadBytes()
+		if r.Err() != nil {
+			return nil, nil, r.Err()
+		}
+	}
+	return info, loginKey, nil
+}
+
+var _ = register(lbsPlatformInfo, func(p *LbsPeer, m *LbsMessage) {
+	// patched client sends client-platform information
+	info, loginKey, err := parsePlatformInfo(m)
+	if malformed(p, m, err) {
+		return
+	}
+
+	isFirstTime := len(p.PlatformInfo) == 0
+	for k, v := range info {
+		p.PlatformInfo[k] = v
+	}
+
 	if isFirstTime && len(p.PlatformInfo) != 0 {
 		p.logger = p.logger.With(
 			zap.String("flycast", p.PlatformInfo["flycast"]),
@@ -1649,7 +1866,7 @@ var _ = register(lbsPlatformInfo, func(p *LbsPeer, m *LbsMessage) {
 	}
 
 	minRtt := 999
-	for region := range gcpLocationName {
+	for _, region := range getRegionCatalog().IDs() {
 		rtt, err := strconv.Atoi(p.PlatformInfo[region])
 		if err != nil {
 			continue
@@ -1661,9 +1878,9 @@ var _ = register(lbsPlatformInfo, func(p *LbsPeer, m *LbsMessage) {
 	}
 
 	// pre-sent loginkey
-	if 0 < r.Remaining() {
+	if loginKey != nil {
 		hasher := fnv.New32()
-		hasher.Write(r.ReadBytes())
+		hasher.Write(loginKey)
 		loginKey := hex.EncodeToString(hasher.Sum(nil))
 		if p.LoginKey == "" {
 			p.LoginKey = loginKey
@@ -1672,24 +1889,9 @@ var _ = register(lbsPlatformInfo, func(p *LbsPeer, m *LbsMessage) {
 })
 
 var _ = register(lbsP2PMatchingReport, func(p *LbsPeer, m *LbsMessage) {
-	if 0 < m.BodySize {
-		buf := bytes.NewBuffer(nil)
-		zr, err := zlib.NewReader(bytes.NewReader(m.Body))
-		if err != nil {
-			p.logger.Warn("zlib.NewReader", zap.Error(err))
-			return
-		}
-
-		_, err = io.Copy(buf, zr)
-		if err != nil {
-			p.logger.Warn("io.Copy", zap.Error(err))
-			return
-		}
-
-		var report proto.P2PMatchingReport
-		err = pb.Unmarshal(buf.Bytes(), &report)
-		if err != nil {
-			p.logger.Warn("pb.Unmarshal", zap.Error(err))
+	if 0 < len(m.Body) {
+		report, err := decodeP2PMatchingReport(m.Body)
+		if malformed(p, m, err) {
 			return
 		}
 
@@ -1728,10 +1930,26 @@ var _ = register(lbsP2PMatchingReport, func(p *LbsPeer, m *LbsMessage) {
 
 			if strings.HasPrefix(report.CloseReason, "player_disconnect") && report.PlayerCount == 4 {
 				WebhookPostSimpleText(fmt.Sprintf(":oncoming_police_car: battle_code:%v %v", report.BattleCode, report.CloseReason))
-			} else if strings.HasPrefix(report.CloseReason, "unreachable") ||
-				strings.HasPrefix(report.CloseReason, "ggpo_start_failure") ||
-				strings.HasPrefix(report.CloseReason, "ggpo_start_timeout") {
-				WebhookPostSimpleText(fmt.Sprintf(":warning: battle_code:%v %v peer_id:%v", report.BattleCode, report.CloseReason, report.PeerId))
+			}
+			if strings.HasPrefix(report.CloseReason, "player_disconnect") {
+				attributeP2PDisconnect(p, report)
+			} else if isP2PFailure(report.CloseReason) {
+				if p.app.startP2PFallback(p.UserID, report, time.Now()) {
+					WebhookPostSimpleText(fmt.Sprintf(":warning: battle_code:%v %v peer_id:%v fallback to relay", report.BattleCode, report.CloseReason, report.PeerId))
+				}
+			}
+		}
+
+		if report.BattleCode != "" {
+			if isP2PReportPeer(p.UserID, report) {
+				err := getDB().SaveP2PReport(newP2PReport(p, report))
+				if err != nil {
+					p.logger.Warn("SaveP2PReport", zap.Error(err))
+				}
+			} else {
+				p.logger.Warn("P2PMatchingReport of another peer",
+					zap.String("battle_code", report.BattleCode),
+					zap.Int32("peer_id", report.PeerId))
 			}
 		}
 
@@ -1787,3 +2005,63 @@ var _ = register(lbsP2PMatchingReport, func(p *LbsPeer, m *LbsMessage) {
 		}
 	}
 })
+
+// isP2PReportPeer reports whether the reporter played the battle as the peer_id of the report.
+// The peer_id is sent by the client, so it is checked against the battle record before the report is saved.
+func isP2PReportPeer(userID string, report *proto.P2PMatchingReport) bool {
+	rec, err := getDB().GetBattleRecordUser(report.BattleCode, userID)
+	return err == nil && rec.Pos == int(report.PeerId)+1
+}
+
+// newP2PReport converts P2PMatchingReport into P2PReport of the reporter.
+func newP2PReport(p *LbsPeer, report *proto.P2PMatchingReport) *P2PReport {
+	r := &P2PReport{
+		BattleCode:         report.BattleCode,
+		PeerID:             int(report.PeerId),
+		UserID:             p.UserID,
+		Flycast:            p.PlatformInfo["flycast"],
+		OS:                 p.PlatformInfo["os"],
+		CloseReason:        report.CloseReason,
+		PlayerCount:        int(report.PlayerCount),
+		FrameCount:         int(report.FrameCount),
+		DisconnectedPeerID: int(report.DisconnectedPeerId),
+		TotalTimesync:      int(report.TotalTimesync),
+		InputBlockCount0:   int(report.InputBlockCount_0),
+		InputBlockCount1:   int(report.InputBlockCount_1),
+		InputBlockCount2:   int(report.InputBlockCount_2),
+	}
+	if 0 < len(report.FpsHistory) {
+		sum := 0.0
+		r.FpsMin = float64(report.FpsHistory[0])
+		for _, fps := range report.FpsHistory {
+			sum += float64(fps)
+			r.FpsMin = min(r.FpsMin, float64(fps))
+		}
+		r.FpsAvg = sum / float64(len(report.FpsHistory))
+	}
+	return r
+}
+
+// decodeP2PMatchingReport decodes zlib compressed P2PMatchingReport.
+func decodeP2PMatchingReport(body []byte) (*proto.P2PMatchingReport, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	buf, err := io.ReadAll(io.LimitReader(zr, maxUnzippedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if maxUnzippedSize < len(buf) {
+		return nil, fmt.Errorf("too large report")
+	}
+
+	var report proto.P2PMatchingReport
+	err = pb.Unmarshal(buf, &report)
+	if err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"compress/zlib"
+	"errors"
 	"math"
 	"testing"
 	"time"
@@ -117,16 +118,13 @@ func Test_isOldFlycastVersion(t *testing.T) {
 		},
 	}
 
-	backup := requiredFlycastVersion
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			requiredFlycastVersion = tt.requiredVersion
-			if got := isOldFlycastVersion(tt.args.userVersion, requiredFlycastVersion); got != tt.want {
+			if got := isOldFlycastVersion(tt.args.userVersion, tt.requiredVersion); got != tt.want {
 				t.Errorf("isOldFlycastVersion() = %v, want %v", got, tt.want)
 			}
 		})
 	}
-	requiredFlycastVersion = backup
 }
 
 func TestLbs_P2PMatchingReport(t *testing.T) {
@@ -154,9 +152,11 @@ func TestLbs_P2PMatchingReport(t *testing.T) {
 	}
 
 	report := &pb.P2PMatchingReport{
-		BattleCode:  battleCode,
-		CloseReason: "game_end",
-		PlayerCount: 2,
+		BattleCode:        battleCode,
+		CloseReason:       "game_end",
+		PlayerCount:       2,
+		FpsHistory:        []float32{60, 58, 53},
+		InputBlockCount_1: 3,
 		RoundData: []*pb.BattleLogRound{
 			{WinTeam: 1, UsedMs: []int32{10, 20}}, // U1 used MS 10, U2 used MS 20
 			{WinTeam: 1, UsedMs: []int32{11, 21}},
@@ -196,6 +196,21 @@ func TestLbs_P2PMatchingReport(t *testing.T) {
 		}
 	}
 
+	// The report is saved for the diagnosis
+	reports, err := getDB().GetP2PReports(battleCode)
+	must(t, err)
+	assertEq(t, 1, len(reports))
+	assertEq(t, "U1", reports[0].UserID)
+	assertEq(t, "game_end", reports[0].CloseReason)
+	assertEq(t, 57.0, reports[0].FpsAvg)
+	assertEq(t, 53.0, reports[0].FpsMin)
+	assertEq(t, 3, reports[0].InputBlockCount1)
+
+	// The peer_id must be the one of the reporter.
+	assertEq(t, true, isP2PReportPeer("U1", &pb.P2PMatchingReport{BattleCode: battleCode, PeerId: 0}))
+	assertEq(t, false, isP2PReportPeer("U1", &pb.P2PMatchingReport{BattleCode: battleCode, PeerId: 1}))
+	assertEq(t, false, isP2PReportPeer("U3", &pb.P2PMatchingReport{BattleCode: battleCode, PeerId: 2}))
+
 	// Verify FindReplay uses RoundWin for scoring
 	q := NewFindReplayQuery()
 	q.BattleCode = battleCode
@@ -206,3 +221,98 @@ func TestLbs_P2PMatchingReport(t *testing.T) {
 	assertEq(t, 0, replays[0].ZeonWin)
 }
 
+func TestLbs_MalformedMessage(t *testing.T) {
+	lbs := NewLbs()
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	user1, cancel1 := prepareLoggedInUser(t, lbs, PlatformConsole, GameDiskDC2, DBUser{
+		UserID: "U1",
+		Name:   "N1",
+	})
+	defer cancel1()
+
+	malformedCount := lbsMsgMalformed.Value()
+
+	// lobby id must be 2 bytes.
+	user1.MustWriteMessage(NewClientQuestion(lbsPlazaEntry).Writer().Write8(2).Msg())
+	AssertMsg(t, &LbsMessage{
+		Command:  lbsPlazaEntry,
+		Category: CategoryAnswer,
+		Status:   StatusError,
+	}, user1.MustReadMessageSkipNoticeUntil(lbsPlazaEntry))
+
+	lbs.Locked(func(lbs *Lbs) {
+		if lbs.FindPeer("U1").Lobby != nil {
+			t.Error("entered lobby with malformed message")
+		}
+	})
+	assertEq(t, malformedCount+1, lbsMsgMalformed.Value())
+
+	user1.MustWriteMessage(NewClientQuestion(lbsPlazaEntry).Writer().Write16(2).Msg())
+	AssertMsg(t, &LbsMessage{
+		Command:  lbsPlazaEntry,
+		Category: CategoryAnswer,
+		Status:   StatusSuccess,
+	}, user1.MustReadMessageSkipNoticeUntil(lbsPlazaEntry))
+}
+
+func Test_parsePlatformInfo(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, err := zw.Write([]byte("cpu=x86/64\nos=Windows\nasia-east1=30\n"))
+	must(t, err)
+	must(t, zw.Close())
+
+	info, loginKey, err := parsePlatformInfo(NewClientCustom(lbsPlatformInfo).Writer().
+		WriteBytes(buf.Bytes()).WriteBytes([]byte("KEY")).Msg())
+	must(t, err)
+	assertEq(t, map[string]string{"cpu": "x86/64", "os": "Windows", "asia-east1": "30"}, info)
+	assertEq(t, []byte("KEY"), loginKey)
+
+	info, loginKey, err = parsePlatformInfo(NewClientCustom(lbsPlatformInfo).Writer().
+		WriteString("flycast=v1.0.0\nbroken line").Msg())
+	must(t, err)
+	assertEq(t, map[string]string{"flycast": "v1.0.0"}, info)
+	assertEq(t, []byte(nil), loginKey)
+
+	// truncated login key
+	_, _, err = parsePlatformInfo(NewClientCustom(lbsPlatformInfo).Writer().
+		WriteString("cpu=x86/64").Write16(10).Msg())
+	if !errors.Is(err, ErrShortMessageBody) {
+		t.Error("want ErrShortMessageBody, got", err)
+	}
+}
+
+func FuzzParsePlatformInfo(f *testing.F) {
+	f.Add(NewClientCustom(lbsPlatformInfo).Writer().WriteString("cpu=x86/64\nos=Linux\n").WriteBytes([]byte("KEY")).Msg().Body)
+	f.Add([]byte{0x00, 0x05, 'a', '=', 'b'})
+	f.Add([]byte{0xff, 0xff})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		info, _, err := parsePlatformInfo(&LbsMessage{Body: body})
+		if err != nil && info != nil {
+			t.Error("info should be nil on error")
+		}
+	})
+}
+
+func FuzzDecodeP2PMatchingReport(f *testing.F) {
+	bin, _ := proto.Marshal(&pb.P2PMatchingReport{
+		BattleCode:  "123",
+		CloseReason: "game_end",
+		PlayerCount: 4,
+		RoundData:   []*pb.BattleLogRound{{WinTeam: 1, UsedMs: []int32{1, 2, 3, 4}}},
+	})
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, _ = zw.Write(bin)
+	_ = zw.Close()
+	f.Add(buf.Bytes())
+	f.Add([]byte{0x78, 0x9c})
+	f.Fuzz(func(t *testing.T, body []byte) {
+		report, err := decodeP2PMatchingReport(body)
+		if err == nil && report == nil {
+			t.Error("report should not be nil")
+		}
+	})
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
 	"fmt"
 	"gdxsv/gdxsv/proto"
 	"hash/fnv"
@@ -48,6 +47,11 @@ type LbsLobby struct {
 	lobbySettingMessages  []*LbsMessage
 	lobbyReminderMessages []*LbsMessage
 	forceStartCountDown   int
+	master                *LobbyMaster
+	retired               bool
+	event                 *LobbyEvent
+	patchList             *proto.GamePatchList
+	announcedEvents       map[string]bool
 }
 
 func NewLobby(app *Lbs, platform, disk string, lobbyID uint16) *LbsLobby {
@@ -65,59 +69,82 @@ func NewLobby(app *Lbs, platform, disk string, lobbyID uint16) *LbsLobby {
 		Description:          "",
 		lobbySettingMessages: nil,
 		forceStartCountDown:  0,
+		announcedEvents:      make(map[string]bool),
 	}
 
-	for i := 1; i <= maxRoomCount; i++ {
-		roomID := uint16(i)
-		lobby.RenpoRooms[roomID] = NewRoom(app, platform, disk, lobby, roomID, TeamRenpo)
-		lobby.ZeonRooms[roomID] = NewRoom(app, platform, disk, lobby, roomID, TeamZeon)
-	}
-
-	err := lobby.LoadLobbySetting()
-	if err != nil {
-		if err != sql.ErrNoRows {
-			logger.Warn("Failed to load lobby setting",
-				zap.Error(err), zap.String("platform", platform),
-				zap.String("disk", disk), zap.Int("lobby_id", int(lobbyID)))
-		}
-	}
+	lobby.applyLobbyMaster(defaultLobbyMaster(platform, disk, lobbyID))
 
 	return lobby
 }
 
-func (l *LbsLobby) LoadLobbySetting() error {
-	setting, err := getDB().GetLobbySetting(l.Platform, l.GameDisk, int(l.ID))
-	if err == sql.ErrNoRows {
-		l.Rule = DefaultRule
-		l.LobbySetting.EnableForceStart = true
-		l.lobbySettingMessages = l.buildLobbySettingMessages()
-		return nil
-	}
+// applyLobbyMaster replaces the lobby setting with the loaded one.
+func (l *LbsLobby) applyLobbyMaster(m *LobbyMaster) {
+	l.master = m
+	l.event = m.findEvent(time.Now())
+	l.applyLobbySetting()
+	l.resizeRooms(m.Setting.RoomCount)
+}
 
-	if err != nil {
-		return err
-	}
+// applyLobbySetting updates the lobby setting with the active event.
+func (l *LbsLobby) applyLobbySetting() {
+	l.LobbySetting = l.master.Setting
+	l.Rule = l.master.Rule
+	l.patchList = l.master.Patches
 
-	var rule *MRule = nil
-	if setting.RuleID != "" {
-		rule, err = getDB().GetRule(setting.RuleID)
-		if err != nil {
-			return err
+	if e := l.event; e != nil {
+		if e.Rule != nil {
+			l.Rule = *e.Rule
+		}
+		if e.PatchNames != "" {
+			l.LobbySetting.PatchNames = e.PatchNames
+			l.patchList = e.Patches
+		}
+		if e.Comment != "" {
+			l.LobbySetting.Comment = e.Comment
 		}
 	}
 
-	if setting != nil {
-		l.LobbySetting = LobbySetting(*setting)
+	l.lobbySettingMessages = l.buildLobbySettingMessages()
+	l.lobbyReminderMessages = reminderChatMessages(l.master.ReminderText)
+}
+
+// resizeRooms creates rooms up to n for each team.
+// Rooms beyond n are removed now if empty, or by removeExtraRoom when they become empty.
+func (l *LbsLobby) resizeRooms(n int) {
+	for i := 1; i <= n; i++ {
+		roomID := uint16(i)
+		if _, ok := l.RenpoRooms[roomID]; !ok {
+			l.RenpoRooms[roomID] = NewRoom(l.app, l.Platform, l.GameDisk, l, roomID, TeamRenpo)
+		}
+		if _, ok := l.ZeonRooms[roomID]; !ok {
+			l.ZeonRooms[roomID] = NewRoom(l.app, l.Platform, l.GameDisk, l, roomID, TeamZeon)
+		}
 	}
 
-	if rule != nil {
-		l.Rule = Rule(*rule)
+	for _, rooms := range []map[uint16]*LbsRoom{l.RenpoRooms, l.ZeonRooms} {
+		for roomID, room := range rooms {
+			if n < int(roomID) && len(room.Users) == 0 {
+				delete(rooms, roomID)
+			}
+		}
 	}
+}
 
-	l.lobbySettingMessages = l.buildLobbySettingMessages()
-	l.lobbyReminderMessages = l.buildLobbyReminderMessages()
+// removeExtraRoom removes the empty room left beyond the room count by resizeRooms.
+func (l *LbsLobby) removeExtraRoom(r *LbsRoom) {
+	if int(r.ID) <= l.LobbySetting.RoomCount || len(r.Users) != 0 {
+		return
+	}
+	for _, rooms := range []map[uint16]*LbsRoom{l.RenpoRooms, l.ZeonRooms} {
+		if rooms[r.ID] == r {
+			delete(rooms, r.ID)
+		}
+	}
+}
 
-	return err
+// IsOpen returns true if users can enter the lobby.
+func (l *LbsLobby) IsOpen() bool {
+	return !l.retired && !l.LobbySetting.Hidden
 }
 
 func chatMsg(userID, name, text string) *LbsMessage {
@@ -142,14 +169,8 @@ func (l *LbsLobby) sendLobbyChat(userID, name, text string) {
 	}
 }
 
-func (l *LbsLobby) buildLobbyReminderMessages() []*LbsMessage {
-	if l.LobbySetting.Reminder == "" {
-		return nil
-	}
-
-	text, err := getDB().GetString(l.LobbySetting.Reminder)
-	if err != nil {
-		logger.Error("failed to get reminder text", zap.Error(err))
+func reminderChatMessages(text string) []*LbsMessage {
+	if text == "" {
 		return nil
 	}
 
@@ -172,6 +193,11 @@ func (l *LbsLobby) buildLobbySettingMessages() []*LbsMessage {
 	var msgs []*LbsMessage
 	msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %v", "LobbyID", l.ID)))
 
+	if l.event != nil {
+		msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %v", "Event", l.event.Name)))
+		msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %v", "Event Ends", l.event.EndAt.Local().Format("01/02 15:04 MST"))))
+	}
+
 	if 0 < l.LobbySetting.PingLimit {
 		msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %vms", "PingLimit", l.LobbySetting.PingLimit)))
 	}
@@ -187,6 +213,9 @@ func (l *LbsLobby) buildLobbySettingMessages() []*LbsMessage {
 	if 0 < l.LobbySetting.TeamShuffle {
 		msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %v", "TeamShuffle", l.LobbySetting.TeamShuffle)))
 	}
+	if l.LobbySetting.RankedQueue {
+		msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %v", "RankedQueue", boolToYesNo(l.LobbySetting.RankedQueue))))
+	}
 	if 0 < l.Rule.AutoRebattle {
 		msgs = append(msgs, chatMsg("", "", fmt.Sprintf("%-12s: %v", "Auto Re Battle", l.Rule.AutoRebattle)))
 	}
@@ -203,7 +232,7 @@ func (l *LbsLobby) buildLobbySettingMessages() []*LbsMessage {
 }
 
 func (l *LbsLobby) buildDescription(ping string) string {
-	locName, ok := gcpLocationName[l.LobbySetting.McsRegion]
+	locName, ok := getRegionCatalog().Name(l.LobbySetting.McsRegion)
 	if !ok {
 		locName = "Default Server"
 	}
@@ -482,46 +511,6 @@ func (l *LbsLobby) GetLobbyMatchEntryUserCount() (uint16, uint16) {
 	return a, b
 }
 
-func (l *LbsLobby) findBestGCPRegion(peers []*LbsPeer) (string, error) {
-	type regionPing struct {
-		Region string `json:"region"`
-		Ping   int    `json:"ping"`
-	}
-
-	var regionPings []regionPing
-
-	for region := range gcpLocationName {
-		maxRtt := 0
-
-		for _, p := range peers {
-			rtt, err := strconv.Atoi(p.PlatformInfo[region])
-			if rtt <= 0 || err != nil {
-				rtt = 999
-			}
-			if maxRtt < rtt {
-				maxRtt = rtt
-			}
-		}
-
-		regionPings = append(regionPings, regionPing{
-			Region: region,
-			Ping:   maxRtt,
-		})
-	}
-
-	sort.SliceStable(regionPings, func(i, j int) bool {
-		return regionPings[i].Ping < regionPings[j].Ping
-	})
-
-	logger.Info("findBestGCPRegion", zap.Any("regionPings", regionPings))
-
-	if len(regionPings) == 0 || regionPings[0].Ping == 0 || regionPings[0].Ping == 999 {
-		return "", fmt.Errorf("no available region")
-	}
-
-	return regionPings[0].Region, nil
-}
-
 func (l *LbsLobby) getNextLobbyBattleParticipants() []*LbsPeer {
 	var peers []*LbsPeer
 
@@ -595,9 +584,10 @@ func teamShuffle(seed int64, peers []*LbsPeer, mode int) []uint16 {
 	if mode == TeamShuffleRegionFriendly {
 		// Special case - Region friendly team
 		// Pair with player in the same region group when the peer regions are like [A, A, B, B].
+		catalog := getRegionCatalog()
 		var groups []string
 		for _, p := range peers {
-			if group, ok := gcpRegionGroup[p.bestRegion]; ok {
+			if group, ok := catalog.Group(p.bestRegion); ok {
 				groups = append(groups, group)
 			}
 		}
@@ -611,7 +601,7 @@ func teamShuffle(seed int64, peers []*LbsPeer, mode int) []uint16 {
 				teamA, teamB = teamB, teamA
 			}
 			for i := 0; i < len(peers); i++ {
-				if gcpRegionGroup[peers[i].bestRegion] == groups[0] {
+				if group, _ := catalog.Group(peers[i].bestRegion); group == groups[0] {
 					teams[i] = uint16(teamA)
 				} else {
 					teams[i] = uint16(teamB)
@@ -644,8 +634,12 @@ func getLastTeamUserID(userID string) string {
 	return ""
 }
 
-func (l *LbsLobby) pickLobbyBattleParticipants() []*LbsPeer {
-	peers := l.getNextLobbyBattleParticipants()
+// assignLobbyBattleTeams decides the teams of the next battle participants and returns the original teams.
+func (l *LbsLobby) assignLobbyBattleTeams(peers []*LbsPeer) map[*LbsPeer]uint16 {
+	origTeams := map[*LbsPeer]uint16{}
+	for _, p := range peers {
+		origTeams[p] = p.Team
+	}
 
 	if 0 < l.LobbySetting.TeamShuffle {
 		teams := teamShuffle(gRand.Int63(), peers, l.LobbySetting.TeamShuffle)
@@ -657,7 +651,10 @@ func (l *LbsLobby) pickLobbyBattleParticipants() []*LbsPeer {
 	sort.SliceStable(peers, func(i, j int) bool {
 		return peers[i].Team < peers[j].Team
 	})
+	return origTeams
+}
 
+func (l *LbsLobby) pickLobbyBattleParticipants(peers []*LbsPeer) []*LbsPeer {
 	for _, p := range peers {
 		l.EntryPicked(p)
 		l.NotifyLobbyEvent("GO BATTLE", fmt.Sprintf("【%v】%v", p.UserID, p.Name))
@@ -671,6 +668,8 @@ func (l *LbsLobby) pickLobbyBattleParticipants() []*LbsPeer {
 
 // Update updates lobby functions, should be called every 1 sec in the event loop.
 func (l *LbsLobby) Update() {
+	l.updateSchedule(time.Now())
+
 	forceStart := false
 
 	if l.LobbySetting.EnableForceStart && 0 < l.forceStartCountDown {
@@ -687,34 +686,48 @@ func (l *LbsLobby) Update() {
 }
 
 func (l *LbsLobby) makePatchList() *proto.GamePatchList {
-	patches := strings.TrimSpace(l.LobbySetting.PatchNames)
-	if patches == "" {
-		return nil
-	}
+	return l.patchList
+}
 
-	patchList := new(proto.GamePatchList)
-	for _, name := range strings.Split(patches, ",") {
-		mPatch, err := getDB().GetPatch(l.Platform, l.GameDisk, name)
-		if err != nil {
-			logger.Warn("failed to load patch", zap.String("name", name), zap.Error(err))
-			continue
-		}
+func (l *LbsLobby) isTrainingLobby() bool {
+	// TODO: Should add a flag in lobby_setting
+	return 4 <= l.Rule.Timer && 1000 <= l.Rule.RenpoVital && 1000 <= l.Rule.ZeonVital
+}
 
-		gamePatch, err := convertGamePatch(mPatch)
-		if err != nil {
-			logger.Warn("failed to convert patch", zap.String("name", name), zap.Error(err))
-			continue
+// p2pCandidateAddrs returns the addresses other peers try to connect to the peer.
+// IPv4-mapped addresses are unmapped and invalid or duplicate ones are dropped.
+// IPv4 addresses come first, followed by IPv6 ones.
+func p2pCandidateAddrs(p *LbsPeer) []*net.UDPAddr {
+	var addrs []*net.UDPAddr
+	seen := map[string]bool{}
+	add := func(ip net.IP, port int) {
+		if ip == nil || port <= 0 || 0xffff < port {
+			return
 		}
-
-		patchList.Patches = append(patchList.Patches, gamePatch)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		if seen[addr.String()] {
+			return
+		}
+		seen[addr.String()] = true
+		addrs = append(addrs, addr)
 	}
 
-	return patchList
-}
+	if port, err := strconv.Atoi(p.PlatformInfo["udp_port"]); err == nil {
+		add(net.IPv4(127, 0, 0, 1), port)
+		add(net.ParseIP(p.IP()), port)
+		add(net.ParseIP(p.PlatformInfo["local_ip"]), port)
+		add(net.ParseIP(p.PlatformInfo["public_ipv4"]), port)
+		add(net.ParseIP(p.PlatformInfo["public_ipv6"]), port)
+	}
+	add(p.udpAddr.IP, p.udpAddr.Port)
 
-func (l *LbsLobby) isTrainingLobby() bool {
-	// TODO: Should add a flag in lobby_setting
-	return 4 <= l.Rule.Timer && 1000 <= l.Rule.RenpoVital && 1000 <= l.Rule.ZeonVital
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return addrs[i].IP.To4() != nil && addrs[j].IP.To4() == nil
+	})
+	return addrs
 }
 
 func (l *LbsLobby) makeP2PMatchingMsg(b *LbsBattle, participants []*LbsPeer) ([]*LbsMessage, error) {
@@ -756,48 +769,12 @@ func (l *LbsLobby) makeP2PMatchingMsg(b *LbsBattle, participants []*LbsPeer) ([]
 	}
 
 	for i, p := range participants {
-		ips := map[string]bool{}
-		ports := map[string]bool{}
-		addrs := map[string]bool{}
-
-		ips["127.0.0.1"] = true
-		ips[p.IP()] = true
-		ips[p.PlatformInfo["local_ip"]] = true
-		ips[p.PlatformInfo["public_ipv4"]] = true
-		ips[p.PlatformInfo["public_ipv6"]] = true
-		ports[p.PlatformInfo["udp_port"]] = true
-
-		for ip := range ips {
-			for port := range ports {
-				if ip == "" || port == "" || port == "0" {
-					continue
-				}
-				addrs[net.JoinHostPort(ip, port)] = true
-			}
-		}
-
-		if p.udpAddr.IP != nil {
-			addrs[p.udpAddr.String()] = true
-		}
-
-		for addr := range addrs {
-			ip, port, err := net.SplitHostPort(addr)
-			if err != nil {
-				logger.Warn("net.SplitHostPort error", zap.Error(err))
-				continue
-			}
-
-			portInt, err := strconv.ParseInt(port, 10, 32)
-			if err != nil {
-				logger.Warn("ParseInt error", zap.Error(err))
-				continue
-			}
-
+		for _, addr := range p2pCandidateAddrs(p) {
 			matching.Candidates = append(matching.Candidates, &proto.PlayerAddress{
 				UserId: p.UserID,
 				PeerId: int32(i),
-				Ip:     ip,
-				Port:   int32(portInt),
+				Ip:     addr.IP.String(),
+				Port:   int32(addr.Port),
 				Team:   int32(p.Team),
 			})
 		}
@@ -822,12 +799,27 @@ func (l *LbsLobby) makeP2PMatchingMsg(b *LbsBattle, participants []*LbsPeer) ([]
 }
 
 func (l *LbsLobby) checkLobbyBattleStart(force bool) {
+	if l.LobbySetting.RankedQueue {
+		// Battles of this lobby are started by the ranked queue.
+		return
+	}
+
 	if !force && !l.canStartBattle() {
 		return
 	}
 
-	mcsRegion, mcsPeer, mcsAddr, startNow, alloc := l.prepareMcs(l.LobbySetting.McsRegion)
+	// Teams are decided first so that the region is selected fairly for the teams.
+	peers := l.getNextLobbyBattleParticipants()
+	origTeams := l.assignLobbyBattleTeams(peers)
+	restore := func() {
+		for p, team := range origTeams {
+			p.Team = team
+		}
+	}
+
+	mcsRegion, mcsPeer, mcsAddr, startNow, alloc, decision := l.prepareMcs(l.LobbySetting.McsRegion, peers)
 	if !startNow {
+		restore()
 		if alloc {
 			l.NotifyLobbyEvent("", "Allocating game server...")
 		}
@@ -836,20 +828,61 @@ func (l *LbsLobby) checkLobbyBattleStart(force bool) {
 
 	l.NotifyLobbyEvent("", "START LOBBY BATTLE")
 
-	b := NewBattle(l.app, l.ID, &l.Rule, mcsRegion, mcsAddr)
+	rule := l.Rule // The lobby rule may be changed by a schedule during the battle.
+	b := NewBattle(l.app, l.ID, &rule, mcsRegion, mcsAddr)
 	if b == nil {
+		restore()
+		return
+	}
+	b.RegionDecision = decision
+
+	participants := l.pickLobbyBattleParticipants(peers)
+	aggregate := !force && l.Rule.NoRanking != 1 && len(participants) == 4
+	if !l.setupBattle(b, participants, mcsPeer, mcsAddr, aggregate) {
 		return
 	}
 
-	participants := l.pickLobbyBattleParticipants()
+	l.app.BroadcastLobbyUserCount(l)
+	l.app.BroadcastLobbyMatchEntryUserCount(l)
+}
 
-	for i, q := range participants {
+// setupBattle records the participants of the battle and sends them to the battle server.
+// The lobby provides the game patches of the battle unless the battle has its own.
+func (l *LbsLobby) setupBattle(b *LbsBattle, participants []*LbsPeer, mcsPeer *LbsPeer, mcsAddr string, aggregate bool) bool {
+	aggregateFlag := 0
+	if aggregate {
+		aggregateFlag = 1
+	}
+
+	mcsRegion := b.McsRegion
+	for _, q := range participants {
 		b.Add(q)
 		q.Battle = b
-		aggregate := 1
-		if force || l.Rule.NoRanking == 1 || len(participants) != 4 {
-			aggregate = 0
+	}
+
+	patchList := b.PatchList
+	if patchList == nil {
+		patchList = l.makePatchList()
+	}
+	patchBin, err := pb.Marshal(patchList)
+	if err != nil {
+		logger.Error("pb.Marshal patch", zap.Error(err))
+		return false
+	}
+	patchMsg := NewServerNotice(lbsGamePatch)
+	patchMsg.Writer().Write(patchBin)
+
+	var p2pMatchingMsgs []*LbsMessage
+	if mcsRegion == "p2p" {
+		p2pMatchingMsgs, err = l.makeP2PMatchingMsg(b, participants)
+		if err != nil {
+			logger.Error("makeP2PMatchingMsg failed", zap.Error(err))
+			return false
 		}
+	}
+
+	// The records are written last so that a battle that could not be set up leaves no records.
+	for i, q := range participants {
 		err := getDB().AddBattleRecord(&BattleRecord{
 			BattleCode: b.BattleCode,
 			UserID:     q.UserID,
@@ -859,31 +892,26 @@ func (l *LbsLobby) checkLobbyBattleStart(force bool) {
 			LobbyID:    int(l.ID),
 			Team:       int(q.Team),
 			Players:    len(participants),
-			Aggregate:  aggregate,
+			Aggregate:  aggregateFlag,
 			Pos:        i + 1,
 		})
 		if err != nil {
 			logger.Error("AddBattleRecord failed", zap.Error(err))
-			return
+			if err := getDB().DeleteBattleRecords(b.BattleCode); err != nil {
+				logger.Error("DeleteBattleRecords failed", zap.Error(err))
+			}
+			return false
 		}
 	}
 
-	patchList := l.makePatchList()
-	patchBin, err := pb.Marshal(patchList)
-	if err != nil {
-		logger.Error("pb.Marshal patch", zap.Error(err))
-		return
+	if b.RegionDecision != nil {
+		logger.Info("battle region selected",
+			zap.String("battle_code", b.BattleCode),
+			zap.Any("decision", b.RegionDecision))
 	}
-	patchMsg := NewServerNotice(lbsGamePatch)
-	patchMsg.Writer().Write(patchBin)
 
-	var p2pMatchingMsgs []*LbsMessage
 	if mcsRegion == "p2p" {
-		p2pMatchingMsgs, err = l.makeP2PMatchingMsg(b, participants)
-		if err != nil {
-			logger.Error("makeP2PMatchingMsg failed", zap.Error(err))
-			return
-		}
+		l.app.p2pBattles[b.BattleCode] = &P2PBattle{Created: time.Now(), Rule: b.Rule, PatchList: patchList}
 	}
 
 	sharedData.ShareMcsGame(&McsGame{
@@ -903,6 +931,11 @@ func (l *LbsLobby) checkLobbyBattleStart(force bool) {
 			logger.Error("failed to encode name", zap.Error(err), zap.String("name", q.Name))
 		}
 
+		var sessionKey []byte
+		if mcsRegion != "p2p" && supportsBattleAuth(q) {
+			sessionKey = genBattleSessionKey()
+		}
+
 		sharedData.ShareMcsUser(&McsUser{
 			BattleCode:  b.BattleCode,
 			McsRegion:   b.McsRegion,
@@ -914,6 +947,7 @@ func (l *LbsLobby) checkLobbyBattleStart(force bool) {
 			Platform:    q.Platform,
 			GameDisk:    q.GameDisk,
 			SessionID:   q.SessionID,
+			SessionKey:  sessionKey,
 			Pos:         i + 1,
 			Team:        q.Team,
 			BattleCount: q.BattleCount,
@@ -927,6 +961,9 @@ func (l *LbsLobby) checkLobbyBattleStart(force bool) {
 
 		NotifyReadyBattle(q)
 		q.SendMessage(patchMsg)
+		if sessionKey != nil {
+			q.SendMessage(NewServerNotice(lbsBattleSessionKey).Writer().WriteBytes(sessionKey).Msg())
+		}
 		if 0 < len(p2pMatchingMsgs) {
 			q.SendMessage(p2pMatchingMsgs[i])
 		}
@@ -936,38 +973,27 @@ func (l *LbsLobby) checkLobbyBattleStart(force bool) {
 		sharedData.NotifyLatestLbsStatus(mcsPeer)
 	}
 
-	l.app.BroadcastLobbyUserCount(l)
-	l.app.BroadcastLobbyMatchEntryUserCount(l)
+	return true
+
 }
 
-func (l *LbsLobby) checkRoomBattleStart() {
-	var (
-		renpoRoom    *LbsRoom
-		zeonRoom     *LbsRoom
-		participants []*LbsPeer
-	)
+type readyRoom struct {
+	room  *LbsRoom
+	peers []*LbsPeer
+}
 
-	for _, room := range l.RenpoRooms {
-		if room.IsReady() {
-			var peers []*LbsPeer
-			allOk := true
-			for _, u := range room.Users {
-				p := l.app.FindPeer(u.UserID)
-				if p == nil {
-					allOk = false
-					break
-				}
-				peers = append(peers, p)
-			}
-			if allOk {
-				renpoRoom = room
-				participants = append(participants, peers...)
-				break
-			}
-		}
+func (r *readyRoom) userIDs() []string {
+	var ids []string
+	for _, p := range r.peers {
+		ids = append(ids, p.UserID)
 	}
+	return ids
+}
 
-	for _, room := range l.ZeonRooms {
+// readyRooms returns the rooms that are ready and all the users are online.
+func (l *LbsLobby) readyRooms(rooms map[uint16]*LbsRoom) []*readyRoom {
+	var ret []*readyRoom
+	for _, room := range rooms {
 		if room.IsReady() {
 			var peers []*LbsPeer
 			allOk := true
@@ -980,18 +1006,41 @@ func (l *LbsLobby) checkRoomBattleStart() {
 				peers = append(peers, p)
 			}
 			if allOk {
-				zeonRoom = room
-				participants = append(participants, peers...)
-				break
+				ret = append(ret, &readyRoom{room: room, peers: peers})
 			}
 		}
 	}
+	return ret
+}
+
+func (l *LbsLobby) checkRoomBattleStart() {
+	var (
+		renpo      *readyRoom
+		zeon       *readyRoom
+		tournament *Tournament
+		match      *TournamentMatch
+		swapped    bool
+	)
+
+	renpoRooms := l.readyRooms(l.RenpoRooms)
+	zeonRooms := l.readyRooms(l.ZeonRooms)
+
+	tournament = l.app.FindTournament(l.Platform, l.GameDisk, l.ID)
+	if tournament != nil {
+		// Only the teams of a ready match can start a battle in the tournament lobby.
+		renpo, zeon, match, swapped = l.app.findTournamentRooms(tournament, renpoRooms, zeonRooms)
+	} else if 0 < len(renpoRooms) && 0 < len(zeonRooms) {
+		renpo, zeon = renpoRooms[0], zeonRooms[0]
+	}
 
-	if renpoRoom == nil || zeonRoom == nil {
+	if renpo == nil || zeon == nil {
 		return
 	}
 
-	mcsRegion, mcsPeer, mcsAddr, startNow, alloc := l.prepareMcs(l.LobbySetting.McsRegion)
+	renpoRoom, zeonRoom := renpo.room, zeon.room
+	participants := append(append([]*LbsPeer{}, renpo.peers...), zeon.peers...)
+
+	mcsRegion, mcsPeer, mcsAddr, startNow, alloc, decision := l.prepareMcs(l.LobbySetting.McsRegion, participants)
 	if !startNow {
 		if alloc {
 			renpoRoom.NotifyRoomEvent("", "Allocating game server...")
@@ -1003,106 +1052,26 @@ func (l *LbsLobby) checkRoomBattleStart() {
 	renpoRoom.NotifyRoomEvent("", "START ROOM BATTLE")
 	zeonRoom.NotifyRoomEvent("", "START ROOM BATTLE")
 
-	b := NewBattle(l.app, l.ID, &l.Rule, mcsRegion, mcsAddr)
+	rule := l.Rule
+	b := NewBattle(l.app, l.ID, &rule, mcsRegion, mcsAddr)
 	if b == nil {
 		return
 	}
+	b.RegionDecision = decision
 
-	for i, q := range participants {
-		b.Add(q)
-		q.Battle = b
-		aggregate := 1
-		if l.Rule.NoRanking == 1 || len(participants) != 4 {
-			aggregate = 0
-		}
-		err := getDB().AddBattleRecord(&BattleRecord{
-			BattleCode: b.BattleCode,
-			UserID:     q.UserID,
-			UserName:   q.Name,
-			PilotName:  q.PilotName,
-			Disk:       l.GameDisk,
-			LobbyID:    int(l.ID),
-			Team:       int(q.Team),
-			Players:    len(participants),
-			Aggregate:  aggregate,
-			Pos:        i + 1,
-		})
-		if err != nil {
-			logger.Error("AddBattleRecord failed", zap.Error(err))
-			return
-		}
-	}
-
-	patchList := l.makePatchList()
-	patchBin, err := pb.Marshal(patchList)
-	if err != nil {
-		logger.Error("pb.Marshal patch", zap.Error(err))
+	aggregate := l.Rule.NoRanking != 1 && len(participants) == 4
+	if !l.setupBattle(b, participants, mcsPeer, mcsAddr, aggregate) {
 		return
 	}
-	patchMsg := NewServerNotice(lbsGamePatch)
-	patchMsg.Writer().Write(patchBin)
-
-	var p2pMatchingMsgs []*LbsMessage
-	if mcsRegion == "p2p" {
-		p2pMatchingMsgs, err = l.makeP2PMatchingMsg(b, participants)
-		if err != nil {
-			logger.Error("makeP2PMatchingMsg failed", zap.Error(err))
-			return
-		}
-	}
-
-	sharedData.ShareMcsGame(&McsGame{
-		BattleCode: b.BattleCode,
-		RuleBin:    SerializeRule(b.Rule),
-		GameDisk:   l.GameDisk,
-		LobbyID:    l.ID,
-		UpdatedAt:  time.Now(),
-		State:      McsGameStateCreated,
-		McsAddr:    mcsAddr,
-		PatchList:  patchList,
-	})
-
-	for i, q := range participants {
-		nameSJIS, err := io.ReadAll(transform.NewReader(strings.NewReader(q.Name), japanese.ShiftJIS.NewEncoder()))
-		if err != nil {
-			logger.Error("failed to encode name", zap.Error(err), zap.String("name", q.Name))
-		}
-
-		sharedData.ShareMcsUser(&McsUser{
-			BattleCode:  b.BattleCode,
-			McsRegion:   b.McsRegion,
-			UserID:      q.UserID,
-			Name:        q.Name,
-			PilotName:   q.PilotName,
-			NameSJIS:    nameSJIS,
-			GameParam:   q.GameParam,
-			Platform:    q.Platform,
-			GameDisk:    q.GameDisk,
-			SessionID:   q.SessionID,
-			Pos:         i + 1,
-			Team:        q.Team,
-			BattleCount: q.BattleCount,
-			WinCount:    q.WinCount,
-			LoseCount:   q.LoseCount,
-			Grade:       int(decideGrade(q.WinCount, q.Rank)),
-
-			UpdatedAt: time.Now(),
-			State:     McsUserStateCreated,
-		})
-
-		NotifyReadyBattle(q)
-		q.SendMessage(patchMsg)
-		if 0 < len(p2pMatchingMsgs) {
-			q.SendMessage(p2pMatchingMsgs[i])
-		}
-	}
 
-	if mcsPeer != nil {
-		sharedData.NotifyLatestLbsStatus(mcsPeer)
+	if match != nil {
+		l.app.startTournamentMatch(tournament, match, b.BattleCode, swapped)
 	}
 }
 
-func (l *LbsLobby) prepareMcs(mcsRegion string) (newMcsRegion string, mcsPeer *LbsPeer, mcsAddr string, canStart bool, alloc bool) {
+// prepareMcs finds the battle server for the participants.
+// The region is selected from the regions that have a live or allocatable mcs if mcsRegion is "best".
+func (l *LbsLobby) prepareMcs(mcsRegion string, participants []*LbsPeer) (newMcsRegion string, mcsPeer *LbsPeer, mcsAddr string, canStart bool, alloc bool, decision *RegionDecision) {
 	if mcsRegion == "p2p" {
 		newMcsRegion = "p2p"
 		mcsPeer = nil
@@ -1112,35 +1081,47 @@ func (l *LbsLobby) prepareMcs(mcsRegion string) (newMcsRegion string, mcsPeer *L
 	}
 
 	if mcsRegion == "best" {
-		bestRegion, err := l.findBestGCPRegion(l.getNextLobbyBattleParticipants())
-		if err != nil {
-			logger.Error("findBestGCPRegion failed", zap.Error(err))
-			mcsRegion = ""
-		} else {
-			logger.Info("findBestGCPRegion", zap.String("best_region", bestRegion))
-			mcsRegion = bestRegion
+		var err error
+		decision, err = decideMcsRegion(l.app.mcsRegionCandidates(), participants, l.regionWeights())
+		logger.Info("mcs region decision",
+			zap.String("platform", l.Platform),
+			zap.String("disk", l.GameDisk),
+			zap.Int("lobby_id", int(l.ID)),
+			zap.Any("decision", decision),
+			zap.Error(err))
+		mcsRegion = decision.Region
+	}
+
+	if mcsRegion != "" {
+		if stat := l.app.FindMcsFor(mcsRegion, participants); stat != nil {
+			if peer := l.app.FindMcsPeer(stat.PublicAddr); peer != nil {
+				delete(l.app.mcsAllocating, mcsRegion)
+				newMcsRegion = mcsRegion
+				mcsPeer = peer
+				mcsAddr = stat.PublicAddr
+				canStart = true
+				return
+			}
+			logger.Info("mcs peer not found")
 		}
-	}
 
-	if McsFuncEnabled() && mcsRegion != "" {
-		stat := l.app.FindMcs(mcsRegion)
-		if stat == nil {
-			alloc = GoMcsFuncAlloc(mcsRegion)
+		// Every mcs in the region is full or no mcs is running.
+		// The battle waits for the allocated mcs, or uses a full mcs if no more mcs can be allocated.
+		if l.app.allocMcs(mcsRegion, time.Now()) {
+			alloc = true
 			return
 		}
 
-		peer := l.app.FindMcsPeer(stat.PublicAddr)
-		if peer == nil {
-			logger.Info("mcs peer not found")
-			alloc = GoMcsFuncAlloc(mcsRegion)
-			return
+		if stat := l.app.findMcsOverCapacity(mcsRegion, participants); stat != nil {
+			if peer := l.app.FindMcsPeer(stat.PublicAddr); peer != nil {
+				logger.Warn("mcs over capacity", zap.String("region", mcsRegion), zap.String("addr", stat.PublicAddr))
+				newMcsRegion = mcsRegion
+				mcsPeer = peer
+				mcsAddr = stat.PublicAddr
+				canStart = true
+				return
+			}
 		}
-
-		newMcsRegion = mcsRegion
-		mcsPeer = peer
-		mcsAddr = stat.PublicAddr
-		canStart = true
-		return
 	}
 
 	// default server fallback
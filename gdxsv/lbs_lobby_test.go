@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"testing"
 
 	"go.uber.org/zap"
@@ -197,7 +198,7 @@ func Test_teamShuffle(t *testing.T) {
 	}
 }
 
-func TestLbsLobby_buildLobbyReminderMessages(t *testing.T) {
+func TestLbsLobby_reminderChatMessages(t *testing.T) {
 	tests := []struct {
 		name    string
 		mstring string
@@ -235,13 +236,9 @@ func TestLbsLobby_buildLobbyReminderMessages(t *testing.T) {
 			if tt.insert {
 				mustInsertMString(reminder, tt.mstring)
 			}
-			l := &LbsLobby{
-				LobbySetting: LobbySetting{
-					Reminder: reminder,
-				},
-			}
+			text, _ := getDB().GetString(reminder)
 			var chats []string
-			for _, msg := range l.buildLobbyReminderMessages() {
+			for _, msg := range reminderChatMessages(text) {
 				AssertMsg(t, &LbsMessage{Command: lbsChatMessage}, msg)
 				r := msg.Reader()
 				r.ReadString() // id
@@ -253,20 +250,28 @@ func TestLbsLobby_buildLobbyReminderMessages(t *testing.T) {
 	}
 }
 
-func TestLbsLobby_findBestGCPRegion(t *testing.T) {
-	// Save and restore gcpLocationName
-	origLocationName := gcpLocationName
-	defer func() { gcpLocationName = origLocationName }()
+func Test_decideMcsRegion(t *testing.T) {
+	// Save and restore the region catalog
+	origCatalog := regionCatalog.Load()
+	defer regionCatalog.Store(origCatalog)
 
 	// Use a small set of regions for testing
-	gcpLocationName = map[string]string{
-		"asia-northeast1": "Tokyo",
-		"us-west1":        "Oregon",
-		"europe-west1":    "Belgium",
+	regionCatalog.Store(NewRegionCatalog([]*MRegion{
+		{ID: "asia-northeast1", Name: "Tokyo", Enabled: true},
+		{ID: "us-west1", Name: "Oregon", Enabled: true},
+		{ID: "europe-west1", Name: "Belgium", Enabled: true},
+	}))
+
+	// All regions are allocatable.
+	findBestRegion := func(peers []*LbsPeer) (string, error) {
+		candidates := map[string]bool{}
+		for _, region := range getRegionCatalog().IDs() {
+			candidates[region] = false
+		}
+		decision, err := decideMcsRegion(candidates, peers, defaultRegionWeights)
+		return decision.Region, err
 	}
 
-	l := &LbsLobby{}
-
 	t.Run("selects region with minimum max RTT", func(t *testing.T) {
 		peers := []*LbsPeer{
 			{PlatformInfo: map[string]string{
@@ -280,7 +285,7 @@ func TestLbsLobby_findBestGCPRegion(t *testing.T) {
 				"europe-west1":    "180",
 			}},
 		}
-		region, err := l.findBestGCPRegion(peers)
+		region, err := findBestRegion(peers)
 		must(t, err)
 		// asia-northeast1: max(50,60)=60, us-west1: max(150,120)=150, europe-west1: max(200,180)=200
 		assertEq(t, "asia-northeast1", region)
@@ -294,7 +299,7 @@ func TestLbsLobby_findBestGCPRegion(t *testing.T) {
 				"europe-west1":    "999",
 			}},
 		}
-		_, err := l.findBestGCPRegion(peers)
+		_, err := findBestRegion(peers)
 		if err == nil {
 			t.Error("expected error when all regions have RTT=999")
 		}
@@ -308,7 +313,7 @@ func TestLbsLobby_findBestGCPRegion(t *testing.T) {
 				"europe-west1":    "200",
 			}},
 		}
-		region, err := l.findBestGCPRegion(peers)
+		region, err := findBestRegion(peers)
 		must(t, err)
 		// asia-northeast1: 0 → 999, us-west1: 100, europe-west1: 200
 		assertEq(t, "us-west1", region)
@@ -322,7 +327,7 @@ func TestLbsLobby_findBestGCPRegion(t *testing.T) {
 				"europe-west1":    "200",
 			}},
 		}
-		region, err := l.findBestGCPRegion(peers)
+		region, err := findBestRegion(peers)
 		must(t, err)
 		assertEq(t, "us-west1", region)
 	})
@@ -333,7 +338,7 @@ func TestLbsLobby_findBestGCPRegion(t *testing.T) {
 				"us-west1": "50",
 			}},
 		}
-		region, err := l.findBestGCPRegion(peers)
+		region, err := findBestRegion(peers)
 		must(t, err)
 		assertEq(t, "us-west1", region)
 	})
@@ -346,18 +351,18 @@ func TestLbsLobby_findBestGCPRegion(t *testing.T) {
 				"europe-west1":    "0",
 			}},
 		}
-		_, err := l.findBestGCPRegion(peers)
+		_, err := findBestRegion(peers)
 		if err == nil {
 			t.Error("expected error when all regions have RTT=0")
 		}
 	})
 
 	t.Run("no regions returns error", func(t *testing.T) {
-		gcpLocationName = map[string]string{}
+		regionCatalog.Store(NewRegionCatalog(nil))
 		peers := []*LbsPeer{
 			{PlatformInfo: map[string]string{}},
 		}
-		_, err := l.findBestGCPRegion(peers)
+		_, err := findBestRegion(peers)
 		if err == nil {
 			t.Error("expected error when no regions available")
 		}
@@ -652,3 +657,52 @@ func TestLbsLobby_canStartBattle(t *testing.T) {
 		})
 	}
 }
+
+func Test_p2pCandidateAddrs(t *testing.T) {
+	svConn, clConn := net.Pipe()
+	defer svConn.Close()
+	defer clConn.Close()
+
+	p := &LbsPeer{
+		conn: svConn,
+		PlatformInfo: map[string]string{
+			"udp_port":    "20001",
+			"local_ip":    "192.168.1.2",
+			"public_ipv4": "::ffff:203.0.113.1",
+			"public_ipv6": "2001:DB8::1",
+		},
+		udpAddr: net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 20002},
+	}
+
+	var got []string
+	for _, addr := range p2pCandidateAddrs(p) {
+		got = append(got, addr.String())
+	}
+	assertEq(t, []string{
+		"127.0.0.1:20001",
+		"192.168.1.2:20001",
+		"203.0.113.1:20001",
+		"203.0.113.1:20002",
+		"[2001:db8::1]:20001",
+	}, got)
+
+	// Invalid addresses are dropped.
+	p.PlatformInfo = map[string]string{"udp_port": "0", "public_ipv6": "invalid"}
+	p.udpAddr = net.UDPAddr{}
+	assertEq(t, 0, len(p2pCandidateAddrs(p)))
+}
+
+func TestLbsLobby_assignLobbyBattleTeams(t *testing.T) {
+	lobby := &LbsLobby{LobbySetting: LobbySetting{TeamShuffle: TeamShuffleDefault}}
+	var peers []*LbsPeer
+	for _, id := range []string{"ALT1", "ALT2", "ALT3", "ALT4"} {
+		peers = append(peers, &LbsPeer{DBUser: DBUser{UserID: id}, Team: TeamRenpo})
+	}
+
+	// The region is decided for the shuffled teams, the original teams are restored if the battle does not start.
+	origTeams := lobby.assignLobbyBattleTeams(peers)
+	assertEq(t, []uint16{TeamRenpo, TeamRenpo, TeamZeon, TeamZeon}, []uint16{peers[0].Team, peers[1].Team, peers[2].Team, peers[3].Team})
+	for _, p := range peers {
+		assertEq(t, uint16(TeamRenpo), origTeams[p])
+	}
+}
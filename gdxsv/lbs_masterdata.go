@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gdxsv/gdxsv/proto"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const maxLobbyMasterHistory = 10
+
+// LobbyMaster is a resolved lobby setting of a lobby.
+// It holds everything loaded from the master tables so that it can be applied again on rollback
+// even after the tables have been overwritten.
+type LobbyMaster struct {
+	Setting       LobbySetting         `json:"setting"`
+	Rule          Rule                 `json:"rule"`
+	Patches       *proto.GamePatchList `json:"patches,omitempty"`
+	ReminderText  string               `json:"reminder_text,omitempty"`
+	Events        []*LobbyEvent        `json:"events,omitempty"`
+	RegionWeights RegionWeights        `json:"region_weights"`
+}
+
+// LobbyMasterData is a set of LobbyMaster for all lobbies that was applied at once.
+type LobbyMasterData struct {
+	Version   int                     `json:"version"`
+	AppliedAt time.Time               `json:"applied_at"`
+	Checksum  string                  `json:"checksum"`
+	Lobbies   map[string]*LobbyMaster `json:"-"`
+	Regions   *RegionCatalog          `json:"-"` // the region catalog the lobby settings were validated with
+}
+
+// LobbySettingError is a validation error of a lobby setting.
+type LobbySettingError struct {
+	Platform string
+	Disk     string
+	No       int
+	Err      error
+}
+
+func (e *LobbySettingError) Error() string {
+	return fmt.Sprintf("%s/%s/%d: %v", e.Platform, e.Disk, e.No, e.Err)
+}
+
+func lobbyMasterKey(platform, disk string, no uint16) string {
+	return fmt.Sprintf("%s|%d", lobbyKey(platform, disk), no)
+}
+
+func defaultLobbyMaster(platform, disk string, no uint16) *LobbyMaster {
+	return &LobbyMaster{
+		Setting: LobbySetting{
+			Platform:         platform,
+			Disk:             disk,
+			No:               int(no),
+			EnableForceStart: true,
+			RoomCount:        defaultRoomCount,
+		},
+		Rule:          DefaultRule,
+		RegionWeights: defaultRegionWeights,
+	}
+}
+
+func isKnownMcsRegion(region string) bool {
+	switch region {
+	case "", "best", "p2p":
+		return true
+	}
+	_, ok := getRegionCatalog().Get(region)
+	return ok
+}
+
+// loadLobbyMaster loads the lobby setting of a lobby and validates it.
+// The returned LobbyMaster is usable even if there are some validation errors,
+// but it is nil when the setting could not be loaded at all.
+func loadLobbyMaster(setting *MLobbySetting) (*LobbyMaster, []error) {
+	platform, disk, no := setting.Platform, setting.Disk, setting.No
+	wrap := func(err error) error {
+		return &LobbySettingError{Platform: platform, Disk: disk, No: no, Err: err}
+	}
+
+	if no < 1 || 0xFFFF < no {
+		return nil, []error{wrap(fmt.Errorf("invalid lobby no"))}
+	}
+
+	m := &LobbyMaster{
+		Setting:       LobbySetting(*setting),
+		Rule:          DefaultRule,
+		RegionWeights: defaultRegionWeights,
+	}
+
+	if setting.RuleID != "" {
+		rule, err := getDB().GetRule(setting.RuleID)
+		if err == sql.ErrNoRows {
+			return nil, []error{wrap(fmt.Errorf("rule %q not found", setting.RuleID))}
+		}
+		if err != nil {
+			return nil, []error{wrap(err)}
+		}
+		m.Rule = Rule(*rule)
+	}
+
+	var errs []error
+
+	if !isKnownMcsRegion(setting.McsRegion) {
+		errs = append(errs, wrap(fmt.Errorf("unknown mcs_region %q", setting.McsRegion)))
+	}
+
+	if setting.RoomCount < 0 {
+		errs = append(errs, wrap(fmt.Errorf("invalid room_count %d", setting.RoomCount)))
+	}
+	if setting.RoomCount <= 0 {
+		m.Setting.RoomCount = defaultRoomCount
+	}
+
+	if setting.PingRegion != "" {
+		if _, ok := getRegionCatalog().Get(setting.PingRegion); !ok {
+			errs = append(errs, wrap(fmt.Errorf("unknown ping_region %q", setting.PingRegion)))
+		}
+	}
+
+	if weights, err := parseRegionWeights(setting.RegionWeights); err != nil {
+		errs = append(errs, wrap(err))
+	} else {
+		m.RegionWeights = weights
+	}
+
+	if setting.PatchNames != "" {
+		var patchErrs []error
+		m.Patches, patchErrs = loadGamePatchList(platform, disk, setting.PatchNames)
+		for _, err := range patchErrs {
+			errs = append(errs, wrap(err))
+		}
+	}
+
+	if setting.Reminder != "" {
+		text, err := getDB().GetString(setting.Reminder)
+		if err != nil {
+			errs = append(errs, wrap(fmt.Errorf("failed to load reminder %q: %w", setting.Reminder, err)))
+		}
+		m.ReminderText = text
+	}
+
+	return m, errs
+}
+
+func loadGamePatchList(platform, disk, patchNames string) (*proto.GamePatchList, []error) {
+	var errs []error
+	patchList := new(proto.GamePatchList)
+	for _, name := range strings.Split(strings.TrimSpace(patchNames), ",") {
+		mPatch, err := getDB().GetPatch(platform, disk, name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to load patch %q: %w", name, err))
+			continue
+		}
+
+		gamePatch, err := convertGamePatch(mPatch)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to convert patch %q: %w", name, err))
+			continue
+		}
+
+		patchList.Patches = append(patchList.Patches, gamePatch)
+	}
+	return patchList, errs
+}
+
+func lobbyMasterChecksum(lobbies map[string]*LobbyMaster) string {
+	keys := make([]string, 0, len(lobbies))
+	for k := range lobbies {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hash := fnv.New64a()
+	enc := json.NewEncoder(hash)
+	for _, k := range keys {
+		_ = enc.Encode(k)
+		_ = enc.Encode(lobbies[k])
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// lobbyListGroup returns a group name of disks that share the lobby list.
+func lobbyListGroup(disk string) string {
+	if disk == GameDiskDC1 || disk == GameDiskDC2 {
+		return "dc"
+	}
+	return disk
+}
+
+// loadLobbyMasterData loads lobby settings of all lobbies.
+// Lobbies of a platform and disk are defined by m_lobby_setting rows.
+// conf.MaxLobbyCount default lobbies are defined when there are no rows for them.
+// It returns all validation errors found.
+func loadLobbyMasterData() (map[string]*LobbyMaster, []error) {
+	settings, err := getDB().GetLobbySettings()
+	if err != nil {
+		return nil, []error{err}
+	}
+
+	var errs []error
+	lobbies := map[string]*LobbyMaster{}
+	defined := map[string]bool{}
+
+	for _, setting := range settings {
+		if !isHostedLobby(setting.Platform, setting.Disk) {
+			continue
+		}
+
+		m, lobbyErrs := loadLobbyMaster(setting)
+		errs = append(errs, lobbyErrs...)
+		if m == nil {
+			if setting.No < 1 || 0xFFFF < setting.No {
+				continue
+			}
+			m = defaultLobbyMaster(setting.Platform, setting.Disk, uint16(setting.No))
+		}
+		lobbies[lobbyMasterKey(setting.Platform, setting.Disk, uint16(setting.No))] = m
+		defined[lobbyKey(setting.Platform, lobbyListGroup(setting.Disk))] = true
+	}
+
+	for _, pf := range hostedPlatforms {
+		for _, disk := range hostedDisks {
+			if defined[lobbyKey(pf, lobbyListGroup(disk))] {
+				continue
+			}
+			for i := 1; i <= conf.MaxLobbyCount; i++ {
+				lobbies[lobbyMasterKey(pf, disk, uint16(i))] = defaultLobbyMaster(pf, disk, uint16(i))
+			}
+		}
+	}
+
+	// DC1 and DC2 share the lobby list, so a lobby exists on both disks.
+	for _, m := range lobbies {
+		pair := ""
+		switch m.Setting.Disk {
+		case GameDiskDC1:
+			pair = GameDiskDC2
+		case GameDiskDC2:
+			pair = GameDiskDC1
+		default:
+			continue
+		}
+		key := lobbyMasterKey(m.Setting.Platform, pair, uint16(m.Setting.No))
+		if _, ok := lobbies[key]; !ok {
+			lobbies[key] = defaultLobbyMaster(m.Setting.Platform, pair, uint16(m.Setting.No))
+		}
+	}
+
+	errs = append(errs, loadLobbyEvents(lobbies)...)
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return lobbies, errs
+}
+
+// applyLobbyMasterData applies lobby settings to lobbies.
+// Lobbies that are newly defined are created, and lobbies that are no longer defined are retired.
+// Users in a retired lobby can stay there until they leave.
+func (lbs *Lbs) applyLobbyMasterData(data *LobbyMasterData) {
+	for _, m := range data.Lobbies {
+		platform, disk, id := m.Setting.Platform, m.Setting.Disk, uint16(m.Setting.No)
+		lobby := lbs.GetLobby(platform, disk, id)
+		if lobby == nil {
+			lobby = NewLobby(lbs, platform, disk, id)
+			lbs.lobbies[lobbyKey(platform, disk)][id] = lobby
+			logger.Debug("lobby created",
+				zap.String("platform", platform), zap.String("disk", disk), zap.Int("lobby_id", int(id)))
+		}
+		if lobby.retired {
+			lobby.retired = false
+			logger.Info("lobby reopened",
+				zap.String("platform", platform), zap.String("disk", disk), zap.Int("lobby_id", int(id)))
+		}
+		lobby.applyLobbyMaster(m)
+	}
+
+	for _, pfLobbies := range lbs.lobbies {
+		for _, lobby := range pfLobbies {
+			_, ok := data.Lobbies[lobbyMasterKey(lobby.Platform, lobby.GameDisk, lobby.ID)]
+			if !ok && !lobby.retired {
+				lobby.retired = true
+				lobby.sendLobbyChat("", "", "This lobby has been closed.")
+				logger.Info("lobby retired",
+					zap.String("platform", lobby.Platform),
+					zap.String("disk", lobby.GameDisk),
+					zap.Int("lobby_id", int(lobby.ID)))
+			}
+		}
+	}
+
+	lbs.removeRetiredLobbies()
+}
+
+// removeRetiredLobbies removes retired lobbies that no one is using.
+func (lbs *Lbs) removeRetiredLobbies() {
+	inUse := func(lobby *LbsLobby) bool {
+		return lobby != nil && 0 < len(lobby.Users)
+	}
+
+	for _, pfLobbies := range lbs.lobbies {
+		for id, lobby := range pfLobbies {
+			if !lobby.retired || inUse(lobby) {
+				continue
+			}
+
+			switch lobby.GameDisk {
+			case GameDiskDC1:
+				if inUse(lbs.GetLobby(lobby.Platform, GameDiskDC2, id)) {
+					continue
+				}
+			case GameDiskDC2:
+				if inUse(lbs.GetLobby(lobby.Platform, GameDiskDC1, id)) {
+					continue
+				}
+			}
+
+			delete(pfLobbies, id)
+		}
+	}
+}
+
+func (lbs *Lbs) pushLobbyMasterData(lobbies map[string]*LobbyMaster) *LobbyMasterData {
+	lbs.masterVersion++
+	data := &LobbyMasterData{
+		Version:   lbs.masterVersion,
+		AppliedAt: time.Now(),
+		Checksum:  lobbyMasterChecksum(lobbies),
+		Lobbies:   lobbies,
+		Regions:   getRegionCatalog(),
+	}
+
+	lbs.masterHistory = append(lbs.masterHistory, data)
+	if maxLobbyMasterHistory < len(lbs.masterHistory) {
+		lbs.masterHistory = lbs.masterHistory[len(lbs.masterHistory)-maxLobbyMasterHistory:]
+	}
+
+	return data
+}
+
+// initLobbyMasterData loads lobby settings at startup.
+// Unlike ReloadLobbySettings, lobby settings are applied even if some of them are invalid.
+func (lbs *Lbs) initLobbyMasterData() {
+	if err := reloadRegionCatalog(); err != nil {
+		logger.Warn("Invalid region catalog", zap.Error(err))
+	}
+
+	lobbies, errs := loadLobbyMasterData()
+	for _, err := range errs {
+		logger.Warn("Invalid lobby setting", zap.Error(err))
+	}
+	lbs.applyLobbyMasterData(lbs.pushLobbyMasterData(lobbies))
+}
+
+// ReloadLobbySettings validates lobby settings of all lobbies and applies them only when all of them are valid.
+// Must be called in the event loop.
+func (lbs *Lbs) ReloadLobbySettings() (*LobbyMasterData, []error) {
+	// Lobby settings are validated with the new region catalog.
+	prevCatalog := getRegionCatalog()
+	if err := reloadRegionCatalog(); err != nil {
+		logger.Warn("lobby setting reload rejected", zap.Error(err))
+		return nil, []error{err}
+	}
+
+	lobbies, errs := loadLobbyMasterData()
+	if 0 < len(errs) {
+		regionCatalog.Store(prevCatalog)
+		logger.Warn("lobby setting reload rejected", zap.Errors("errors", errs))
+		return nil, errs
+	}
+
+	data := lbs.pushLobbyMasterData(lobbies)
+	lbs.applyLobbyMasterData(data)
+	logger.Info("lobby setting reloaded",
+		zap.Int("version", data.Version), zap.String("checksum", data.Checksum))
+	return data, nil
+}
+
+// RollbackLobbySettings applies the previous version of lobby settings with the region catalog of the version.
+// Must be called in the event loop.
+func (lbs *Lbs) RollbackLobbySettings() (*LobbyMasterData, error) {
+	if len(lbs.masterHistory) < 2 {
+		return nil, fmt.Errorf("no previous version")
+	}
+
+	current := lbs.masterHistory[len(lbs.masterHistory)-1]
+	lbs.masterHistory = lbs.masterHistory[:len(lbs.masterHistory)-1]
+	data := lbs.masterHistory[len(lbs.masterHistory)-1]
+	regionCatalog.Store(data.Regions)
+	lbs.applyLobbyMasterData(data)
+	logger.Info("lobby setting rolled back",
+		zap.Int("from_version", current.Version),
+		zap.Int("to_version", data.Version),
+		zap.String("checksum", data.Checksum))
+	return data, nil
+}
+
+// LobbyMasterHistory returns applied versions of lobby settings, the latest one comes last.
+// Must be called in the event loop.
+func (lbs *Lbs) LobbyMasterHistory() []*LobbyMasterData {
+	ret := make([]*LobbyMasterData, len(lbs.masterHistory))
+	copy(ret, lbs.masterHistory)
+	return ret
+}
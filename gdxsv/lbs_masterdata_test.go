@@ -0,0 +1,144 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLbs_ReloadLobbySettings(t *testing.T) {
+	cleanTables(t, "m_lobby_setting", "m_rule")
+	defer cleanTables(t, "m_lobby_setting", "m_rule")
+
+	lbs := NewLbs()
+	lobby := lbs.GetLobby(PlatformConsole, GameDiskDC2, 2)
+	assertEq(t, 1, len(lbs.LobbyMasterHistory()))
+	assertEq(t, DefaultRule, lobby.Rule)
+	assertEq(t, 22, len(lbs.lobbies[lobbyKey(PlatformConsole, GameDiskDC2)]))
+
+	rule := MRule(DefaultRule)
+	rule.ID = "test_rule"
+	rule.Timer = 2
+	mustInsertMRule(rule)
+	mustInsertMLobbySetting(MLobbySetting{
+		Platform:  PlatformConsole,
+		Disk:      GameDiskDC2,
+		No:        2,
+		McsRegion: "best",
+		RuleID:    "test_rule",
+	})
+	mustInsertMLobbySetting(MLobbySetting{
+		Platform:  PlatformConsole,
+		Disk:      GameDiskDC2,
+		No:        30,
+		Hidden:    true,
+		RoomCount: 3,
+		SortOrder: -1,
+	})
+
+	// A user stays in lobby 5 that is going to be retired.
+	lbs.GetLobby(PlatformConsole, GameDiskDC2, 5).Users["TEST01"] = &DBUser{UserID: "TEST01"}
+
+	data, errs := lbs.ReloadLobbySettings()
+	assertEq(t, 0, len(errs))
+	assertEq(t, 2, data.Version)
+	assertEq(t, lobby, lbs.GetLobby(PlatformConsole, GameDiskDC2, 2))
+	assertEq(t, "best", lobby.LobbySetting.McsRegion)
+	assertEq(t, 2, lobby.Rule.Timer)
+
+	t.Run("lobbies are defined by lobby settings", func(t *testing.T) {
+		hidden := lbs.GetLobby(PlatformConsole, GameDiskDC2, 30)
+		assertEq(t, false, hidden.IsOpen())
+		assertEq(t, 3, len(hidden.RenpoRooms))
+		assertEq(t, 3, len(hidden.ZeonRooms))
+
+		// DC1 shares the lobby list with DC2.
+		assertEq(t, true, lbs.GetLobby(PlatformConsole, GameDiskDC1, 30).IsOpen())
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC1, 1))
+		assertEq(t, uint16(2), lbs.PlazaMax(&LbsPeer{Platform: PlatformConsole, GameDisk: GameDiskDC1}))
+
+		// Lobbies are listed by sort_order and no.
+		assertEq(t, []uint16{30, 2}, lbs.plazaLobbyIDs(PlatformConsole, GameDiskDC1))
+		assertEq(t, lbs.GetLobby(PlatformConsole, GameDiskDC1, 30), lbs.GetPlazaLobby(PlatformConsole, GameDiskDC1, 1))
+		assertEq(t, uint16(2), lbs.plazaPos(lobby))
+		assertEq(t, (*LbsLobby)(nil), lbs.GetPlazaLobby(PlatformConsole, GameDiskDC2, 3))
+
+		// Other disks are not affected.
+		assertEq(t, 22, len(lbs.lobbies[lobbyKey(PlatformConsole, GameDiskPS2)]))
+		assertEq(t, uint16(22), lbs.PlazaMax(&LbsPeer{Platform: PlatformConsole, GameDisk: GameDiskPS2}))
+		assertEq(t, uint16(5), lbs.plazaPos(lbs.GetLobby(PlatformConsole, GameDiskPS2, 5)))
+
+		// The retired lobby is kept while the user is there.
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC2, 3))
+		retired := lbs.GetLobby(PlatformConsole, GameDiskDC2, 5)
+		assertEq(t, false, retired.IsOpen())
+		assertEq(t, true, lbs.GetLobby(PlatformConsole, GameDiskDC1, 5) != nil)
+
+		delete(retired.Users, "TEST01")
+		lbs.removeRetiredLobbies()
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC2, 5))
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC1, 5))
+	})
+
+	t.Run("invalid setting is not applied", func(t *testing.T) {
+		mustInsertMLobbySetting(MLobbySetting{
+			Platform:  PlatformConsole,
+			Disk:      GameDiskDC2,
+			No:        3,
+			McsRegion: "asia-northeast1",
+			RuleID:    "no_such_rule",
+		})
+		mustInsertMLobbySetting(MLobbySetting{
+			Platform:  PlatformConsole,
+			Disk:      GameDiskDC2,
+			No:        4,
+			McsRegion: "no-such-region",
+		})
+
+		data, errs := lbs.ReloadLobbySettings()
+		assertEq(t, (*LobbyMasterData)(nil), data)
+		assertEq(t, 2, len(errs))
+		assertEq(t, 2, len(lbs.LobbyMasterHistory()))
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC2, 3))
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC2, 4))
+
+		cleanTables(t, "m_lobby_setting")
+		mustInsertMLobbySetting(MLobbySetting{
+			Platform:  PlatformConsole,
+			Disk:      GameDiskDC2,
+			No:        2,
+			McsRegion: "p2p",
+		})
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		data, errs := lbs.ReloadLobbySettings()
+		assertEq(t, 0, len(errs))
+		assertEq(t, 3, data.Version)
+		assertEq(t, "p2p", lobby.LobbySetting.McsRegion)
+		assertEq(t, DefaultRule, lobby.Rule)
+		assertEq(t, (*LbsLobby)(nil), lbs.GetLobby(PlatformConsole, GameDiskDC2, 30))
+
+		data, err := lbs.RollbackLobbySettings()
+		must(t, err)
+		assertEq(t, 2, data.Version)
+		assertEq(t, "best", lobby.LobbySetting.McsRegion)
+		assertEq(t, 2, lobby.Rule.Timer)
+		assertEq(t, true, lbs.GetLobby(PlatformConsole, GameDiskDC2, 30) != nil)
+
+		data, err = lbs.RollbackLobbySettings()
+		must(t, err)
+		assertEq(t, 1, data.Version)
+		assertEq(t, "", lobby.LobbySetting.McsRegion)
+		assertEq(t, DefaultRule, lobby.Rule)
+		assertEq(t, 22, len(lbs.lobbies[lobbyKey(PlatformConsole, GameDiskDC2)]))
+
+		_, err = lbs.RollbackLobbySettings()
+		if err == nil {
+			t.Fatal("rollback should fail without previous version")
+		}
+
+		// Versions rolled back are never issued again.
+		data, errs = lbs.ReloadLobbySettings()
+		assertEq(t, 0, len(errs))
+		assertEq(t, 4, data.Version)
+	})
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// McsAllocator allocates a battle server (mcs) in a region.
+// An allocated mcs registers itself to the lbs, then the lbs finds it by FindMcs.
+type McsAllocator interface {
+	// Name returns the name of the backend.
+	Name() string
+
+	// Regions returns the regions that a mcs can be allocated.
+	Regions() []string
+
+	// Alloc requests a mcs in the region asynchronously.
+	// It returns McsAllocPending instead of sending another request while the previous one is in progress.
+	Alloc(region string) McsAllocResult
+}
+
+// McsAllocResult is the result of McsAllocator.Alloc.
+type McsAllocResult int
+
+const (
+	McsAllocStarted     McsAllocResult = iota // a new mcs has been requested
+	McsAllocPending                           // the mcs requested before is starting up
+	McsAllocUnavailable                       // no more mcs can be allocated
+)
+
+// mcsAllocTimeout is how long battles wait for the mcs being allocated in a region
+// before they fall back to a full mcs or the default one.
+const mcsAllocTimeout = time.Minute
+
+// newMcsAllocator returns the allocator configured, or nil if mcs allocation is disabled.
+func newMcsAllocator() McsAllocator {
+	if conf.LocalMcsRegions != "" {
+		portRanges, err := parseLocalMcsRegions(conf.LocalMcsRegions)
+		if err != nil {
+			logger.Error("invalid local_mcs_regions", zap.Error(err))
+			return nil
+		}
+		for region := range portRanges {
+			if _, ok := getRegionCatalog().Get(region); !ok {
+				logger.Warn("local mcs region is not in the region catalog", zap.String("region", region))
+			}
+		}
+		return NewLocalMcsAllocator(portRanges)
+	}
+	if McsFuncEnabled() {
+		return gcpFuncAllocator{}
+	}
+	return nil
+}
+
+// mcsAllocatable returns true if a mcs can be allocated in the region.
+func (lbs *Lbs) mcsAllocatable(region string) bool {
+	if lbs.mcsAllocator == nil {
+		return false
+	}
+	for _, r := range lbs.mcsAllocator.Regions() {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// allocMcs requests a mcs in the region and returns true if the battle should wait for it.
+// The wait is given up after mcsAllocTimeout until a mcs of the region is found.
+func (lbs *Lbs) allocMcs(region string, now time.Time) bool {
+	if !lbs.mcsAllocatable(region) {
+		return false
+	}
+	if lbs.mcsAllocator.Alloc(region) == McsAllocUnavailable {
+		return false
+	}
+
+	since, ok := lbs.mcsAllocating[region]
+	if !ok {
+		lbs.mcsAllocating[region] = now
+		return true
+	}
+	if now.Sub(since) < mcsAllocTimeout {
+		return true
+	}
+	logger.Warn("mcs allocation timed out", zap.String("region", region), zap.Time("since", since))
+	return false
+}
+
+type portRange struct {
+	From int
+	To   int
+}
+
+// parseLocalMcsRegions parses port ranges per region such as "asia-northeast1=20010-20019,us-west1=20020-20029".
+func parseLocalMcsRegions(s string) (map[string]portRange, error) {
+	ret := map[string]portRange{}
+	for _, kv := range strings.Split(s, ",") {
+		region, ports, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid local mcs region %q", kv)
+		}
+		if region == "" {
+			return nil, fmt.Errorf("empty region %q", kv)
+		}
+		from, to, ok := strings.Cut(ports, "-")
+		if !ok {
+			to = from
+		}
+		r := portRange{}
+		var err1, err2 error
+		r.From, err1 = strconv.Atoi(from)
+		r.To, err2 = strconv.Atoi(to)
+		if err1 != nil || err2 != nil || r.From <= 0 || r.To < r.From || 0xFFFF < r.To {
+			return nil, fmt.Errorf("invalid port range %q", ports)
+		}
+		for other, o := range ret {
+			if r.From <= o.To && o.From <= r.To {
+				return nil, fmt.Errorf("port range of %s overlaps with %s", region, other)
+			}
+		}
+		ret[region] = r
+	}
+	return ret, nil
+}
+
+// LocalMcsAllocator spawns `gdxsv mcs` subprocesses on this machine.
+// Each region is a pseudo-region that has its own port range,
+// so that multi-region behavior can be run on a single machine.
+type LocalMcsAllocator struct {
+	mtx        sync.Mutex
+	portRanges map[string]portRange
+	procs      map[int]*localMcsProc
+
+	// startProc is replaced in tests.
+	startProc func(region string, port int) (*exec.Cmd, error)
+}
+
+type localMcsProc struct {
+	region    string
+	cmd       *exec.Cmd
+	startedAt time.Time
+}
+
+// An allocated mcs is expected to register itself to the lbs within this duration.
+const localMcsStartTimeout = 10 * time.Second
+
+func NewLocalMcsAllocator(portRanges map[string]portRange) *LocalMcsAllocator {
+	a := &LocalMcsAllocator{
+		portRanges: portRanges,
+		procs:      map[int]*localMcsProc{},
+	}
+	a.startProc = a.startMcsProcess
+	return a
+}
+
+func (a *LocalMcsAllocator) Name() string {
+	return "local"
+}
+
+func (a *LocalMcsAllocator) Regions() []string {
+	var regions []string
+	for region := range a.portRanges {
+		regions = append(regions, region)
+	}
+	sort.Strings(regions)
+	return regions
+}
+
+func (a *LocalMcsAllocator) Alloc(region string) McsAllocResult {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+
+	r, ok := a.portRanges[region]
+	if !ok {
+		return McsAllocUnavailable
+	}
+
+	port := 0
+	for p := r.From; p <= r.To; p++ {
+		proc, ok := a.procs[p]
+		if !ok {
+			if port == 0 {
+				port = p
+			}
+			continue
+		}
+		if time.Since(proc.startedAt) < localMcsStartTimeout {
+			// The previous one is starting up.
+			return McsAllocPending
+		}
+	}
+	if port == 0 {
+		logger.Warn("no port available for local mcs", zap.String("region", region))
+		return McsAllocUnavailable
+	}
+
+	cmd, err := a.startProc(region, port)
+	if err != nil {
+		logger.Error("failed to start local mcs", zap.Error(err), zap.String("region", region), zap.Int("port", port))
+		return McsAllocUnavailable
+	}
+
+	a.procs[port] = &localMcsProc{region: region, cmd: cmd, startedAt: time.Now()}
+	logger.Info("local mcs started", zap.String("region", region), zap.Int("port", port))
+
+	go func() {
+		err := cmd.Wait()
+		logger.Info("local mcs exited", zap.String("region", region), zap.Int("port", port), zap.Error(err))
+		a.mtx.Lock()
+		delete(a.procs, port)
+		a.mtx.Unlock()
+	}()
+
+	return McsAllocStarted
+}
+
+func (a *LocalMcsAllocator) startMcsProcess(region string, port int) (*exec.Cmd, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(conf.BattlePublicAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	publicAddr6 := ""
+	if conf.BattlePublicAddr6 != "" {
+		host6, _, err := net.SplitHostPort(conf.BattlePublicAddr6)
+		if err != nil {
+			return nil, err
+		}
+		publicAddr6 = net.JoinHostPort(host6, strconv.Itoa(port))
+	}
+
+	args := []string{"-v", strconv.Itoa(*loglevel), "-pprof", "0"}
+	if *configPath != "" {
+		args = append(args, "-config", *configPath)
+	}
+	if *mcsimpair != "" {
+		args = append(args, "-mcsimpair", *mcsimpair)
+	}
+	args = append(args, "mcs")
+
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(),
+		"GDXSV_BATTLE_ADDR="+net.JoinHostPort("", strconv.Itoa(port)),
+		"GDXSV_BATTLE_PUBLIC_ADDR="+net.JoinHostPort(host, strconv.Itoa(port)),
+		"GDXSV_BATTLE_PUBLIC_ADDR6="+publicAddr6,
+		"GDXSV_BATTLE_REGION="+region,
+		"GDXSV_LOCAL_MCS_REGIONS=",
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd, cmd.Start()
+}
+
+// Stop kills all subprocesses.
+func (a *LocalMcsAllocator) Stop() {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	for _, proc := range a.procs {
+		_ = proc.cmd.Process.Kill()
+	}
+}
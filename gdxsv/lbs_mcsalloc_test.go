@@ -0,0 +1,77 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func Test_parseLocalMcsRegions(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    map[string]portRange
+		wantErr bool
+	}{
+		{"single", "asia-northeast1=20010-20019", map[string]portRange{"asia-northeast1": {20010, 20019}}, false},
+		{"multi", "asia-northeast1=20010-20019, us-west1=20020", map[string]portRange{"asia-northeast1": {20010, 20019}, "us-west1": {20020, 20020}}, false},
+		{"self-hosted region", "home-1=20010-20019", map[string]portRange{"home-1": {20010, 20019}}, false},
+		{"empty region", "=20010-20019", nil, true},
+		{"no ports", "asia-northeast1", nil, true},
+		{"reversed", "asia-northeast1=20019-20010", nil, true},
+		{"too large", "asia-northeast1=65530-65540", nil, true},
+		{"overlap", "asia-northeast1=20010-20019,us-west1=20015-20029", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLocalMcsRegions(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr {
+				assertEq(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestLocalMcsAllocator_Alloc(t *testing.T) {
+	a := NewLocalMcsAllocator(map[string]portRange{"asia-northeast1": {20010, 20011}})
+	assertEq(t, []string{"asia-northeast1"}, a.Regions())
+
+	var started []int
+	a.startProc = func(region string, port int) (*exec.Cmd, error) {
+		started = append(started, port)
+		// The test binary exits immediately without running tests.
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		return cmd, cmd.Start()
+	}
+
+	assertEq(t, McsAllocUnavailable, a.Alloc("us-west1"))
+	assertEq(t, McsAllocStarted, a.Alloc("asia-northeast1"))
+	assertEq(t, []int{20010}, started)
+
+	// Another one is not started while the previous one is starting up.
+	assertEq(t, McsAllocPending, a.Alloc("asia-northeast1"))
+
+	a.mtx.Lock()
+	a.procs[20010].startedAt = time.Now().Add(-localMcsStartTimeout)
+	a.mtx.Unlock()
+	assertEq(t, McsAllocStarted, a.Alloc("asia-northeast1"))
+	assertEq(t, []int{20010, 20011}, started)
+
+	// The ports are released when the processes exit.
+	for i := 0; i < 100; i++ {
+		a.mtx.Lock()
+		n := len(a.procs)
+		a.mtx.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	a.mtx.Lock()
+	assertEq(t, 0, len(a.procs))
+	a.mtx.Unlock()
+}
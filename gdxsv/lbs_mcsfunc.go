@@ -21,56 +21,6 @@ var (
 	mcsFuncRequestTime   = map[string]time.Time{}
 )
 
-var gcpLocationName = map[string]string{
-	"asia-east1":              "Changhua County, Taiwan",
-	"asia-east2":              "Hong Kong",
-	"asia-northeast1":         "Tokyo, Japan",
-	"asia-northeast2":         "Osaka, Japan",
-	"asia-northeast3":         "Seoul, South Korea",
-	"asia-south1":             "Mumbai, India",
-	"asia-southeast1":         "Jurong West, Singapore",
-	"australia-southeast1":    "Sydney, Australia",
-	"europe-north1":           "Hamina, Finland",
-	"europe-west1":            "St. Ghislain, Belgium",
-	"europe-west2":            "London, England, UK",
-	"europe-west3":            "Frankfurt, Germany",
-	"europe-west4":            "Eemshaven, Netherlands",
-	"europe-west6":            "Zurich, Switzerland",
-	"northamerica-northeast1": "Montreal, Quebec, Canada",
-	"southamerica-east1":      "Osasco (Sao Paulo), Brazil",
-	"us-central1":             "Council Bluffs, Iowa, USA",
-	"us-east1":                "Moncks Corner, South Carolina, USA",
-	"us-east4":                "Ashburn, Northern Virginia, USA",
-	"us-west1":                "The Dalles, Oregon, USA",
-	"us-west2":                "Los Angeles, California, USA",
-	"us-west3":                "Salt Lake City, Utah, USA",
-}
-
-var gcpRegionGroup = map[string]string{
-	"asia-east1":              "asia-east",
-	"asia-east2":              "asia-east",
-	"asia-northeast1":         "asia-northeast",
-	"asia-northeast2":         "asia-northeast",
-	"asia-northeast3":         "asia-northeast",
-	"asia-south1":             "asia-south",
-	"asia-southeast1":         "asia-southeast",
-	"australia-southeast1":    "australia-southeast",
-	"europe-north1":           "europe-north",
-	"europe-west1":            "europe-west",
-	"europe-west2":            "europe-west",
-	"europe-west3":            "europe-west",
-	"europe-west4":            "europe-west",
-	"europe-west6":            "europe-west",
-	"northamerica-northeast1": "northamerica-northeast",
-	"southamerica-east1":      "southamerica-east",
-	"us-central1":             "us-central",
-	"us-east1":                "us-east",
-	"us-east4":                "us-east",
-	"us-west1":                "us-west",
-	"us-west2":                "us-west",
-	"us-west3":                "us-west",
-}
-
 func getMcsFuncClient() (*http.Client, error) {
 	if mcsFuncClientCache != nil && time.Since(mcsFuncClientCreated).Minutes() <= 30.0 {
 		return mcsFuncClientCache, nil
@@ -143,3 +93,22 @@ func GoMcsFuncAlloc(region string) bool {
 
 	return true
 }
+
+// gcpFuncAllocator allocates a mcs on GCP through mcsfunc.
+type gcpFuncAllocator struct{}
+
+func (gcpFuncAllocator) Name() string {
+	return "mcsfunc"
+}
+
+func (gcpFuncAllocator) Regions() []string {
+	return getRegionCatalog().ProviderIDs(RegionProviderGCP)
+}
+
+func (gcpFuncAllocator) Alloc(region string) McsAllocResult {
+	if GoMcsFuncAlloc(region) {
+		return McsAllocStarted
+	}
+	// The request is throttled, the mcs requested before is starting up.
+	return McsAllocPending
+}
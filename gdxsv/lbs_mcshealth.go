@@ -0,0 +1,119 @@
+package main
+
+import (
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// McsHealth is the health of a mcs derived from its status sync.
+type McsHealth string
+
+const (
+	McsHealthy  McsHealth = "healthy"
+	McsDegraded McsHealth = "degraded"
+	McsDead     McsHealth = "dead"
+)
+
+// mcsHealth returns the health of a mcs whose status was last synced at syncedAt.
+func mcsHealth(st *McsStatus, syncedAt time.Time, now time.Time) McsHealth {
+	rconf := getReloadableConfig()
+	since := now.Sub(syncedAt)
+	if rconf.McsDeadTimeout <= since {
+		return McsDead
+	}
+	if rconf.McsDegradedTimeout <= since || rconf.McsDegradedErrors <= st.Errors {
+		return McsDegraded
+	}
+	return McsHealthy
+}
+
+// updateMcsHealth updates the health of the mcs peer.
+// Unopened battles on the mcs are moved to another mcs when it is found dead.
+func (lbs *Lbs) updateMcsHealth(p *LbsPeer, now time.Time) {
+	if p.mcsStatus == nil {
+		return
+	}
+
+	health := mcsHealth(p.mcsStatus, p.mcsSyncedAt, now)
+	if health == p.mcsHealth {
+		return
+	}
+
+	logger.Info("mcs health changed",
+		zap.String("addr", p.mcsStatus.PublicAddr),
+		zap.String("region", p.mcsStatus.Region),
+		zap.String("from", string(p.mcsHealth)),
+		zap.String("to", string(health)),
+		zap.Time("synced_at", p.mcsSyncedAt),
+		zap.Int64("errors", p.mcsStatus.Errors))
+	p.mcsHealth = health
+
+	if health == McsDead {
+		lbs.reassignMcsGames(p.mcsStatus.PublicAddr)
+	}
+}
+
+// checkMcsHealth should be called every 1 sec in the event loop.
+func (lbs *Lbs) checkMcsHealth(now time.Time) {
+	for _, p := range lbs.mcsPeers {
+		lbs.updateMcsHealth(p, now)
+	}
+}
+
+// reassignMcsGames moves the games that have not been opened on the mcs to another mcs in the same region.
+// The default server is used if no healthy mcs is available in the region.
+// It returns the battle codes of the moved games.
+func (lbs *Lbs) reassignMcsGames(mcsAddr string) map[string]bool {
+	battles := map[string]*LbsBattle{}
+	participants := map[string][]*LbsPeer{}
+	for _, p := range lbs.userPeers {
+		if p.Battle != nil {
+			battles[p.Battle.BattleCode] = p.Battle
+			participants[p.Battle.BattleCode] = append(participants[p.Battle.BattleCode], p)
+		}
+	}
+
+	reassigned := map[string]bool{}
+	for _, g := range sharedData.GetMcsGames() {
+		if g.McsAddr != mcsAddr || g.State != McsGameStateCreated {
+			continue
+		}
+
+		region := ""
+		b := battles[g.BattleCode]
+		if b != nil {
+			region = b.McsRegion
+		}
+
+		newAddr := conf.BattlePublicAddr
+		var newPeer *LbsPeer
+		if region != "" {
+			if stat := lbs.FindMcsFor(region, participants[g.BattleCode]); stat != nil && stat.PublicAddr != mcsAddr {
+				newAddr = stat.PublicAddr
+				newPeer = lbs.FindMcsPeer(newAddr)
+			}
+		}
+		if newAddr == mcsAddr {
+			continue
+		}
+
+		if !sharedData.ReassignMcsGame(g.BattleCode, newAddr) {
+			continue
+		}
+		if b != nil {
+			b.SetBattleServer(newAddr)
+		}
+		if newPeer != nil {
+			sharedData.NotifyLatestLbsStatus(newPeer)
+		}
+		reassigned[g.BattleCode] = true
+
+		logger.Warn("battle reassigned",
+			zap.String("battle_code", g.BattleCode),
+			zap.String("region", region),
+			zap.String("from", mcsAddr),
+			zap.String("to", newAddr))
+	}
+	return reassigned
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_mcsHealth(t *testing.T) {
+	rconf := getReloadableConfig()
+	now := time.Now()
+
+	tests := []struct {
+		name     string
+		syncedAt time.Time
+		errors   int64
+		want     McsHealth
+	}{
+		{"fresh", now, 0, McsHealthy},
+		{"few errors", now, rconf.McsDegradedErrors - 1, McsHealthy},
+		{"many errors", now, rconf.McsDegradedErrors, McsDegraded},
+		{"stale", now.Add(-rconf.McsDegradedTimeout), 0, McsDegraded},
+		{"dead", now.Add(-rconf.McsDeadTimeout), 0, McsDead},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assertEq(t, tt.want, mcsHealth(&McsStatus{Errors: tt.errors}, tt.syncedAt, now))
+		})
+	}
+}
+
+func TestLbs_checkMcsHealth_Reassign(t *testing.T) {
+	lbs := NewLbs()
+	lbs.mcsAllocator = nil
+	rconf := getReloadableConfig()
+	now := time.Now()
+
+	addMcs := func(addr string, syncedAt time.Time) *LbsPeer {
+		p := &LbsPeer{
+			mcsStatus:   &McsStatus{Region: "asia-northeast1", PublicAddr: addr},
+			mcsSyncedAt: syncedAt,
+			mcsHealth:   McsHealthy,
+			logger:      zap.NewNop(),
+			chWrite:     make(chan bool, 1),
+		}
+		lbs.mcsPeers[addr] = p
+		return p
+	}
+	addBattle := func(battleCode, addr, userID string, state int) *LbsBattle {
+		b := NewBattle(lbs, 1, &DefaultRule, "asia-northeast1", addr)
+		b.BattleCode = battleCode
+		lbs.userPeers[userID] = &LbsPeer{DBUser: DBUser{UserID: userID}, Battle: b}
+		sharedData.ShareMcsGame(&McsGame{BattleCode: battleCode, McsAddr: addr, State: state, UpdatedAt: now})
+		return b
+	}
+	defer func() {
+		sharedData.Lock()
+		sharedData.mcsGames = map[string]*McsGame{}
+		sharedData.mcsUsers = map[string]*McsUser{}
+		sharedData.Unlock()
+	}()
+
+	stalled := addMcs("192.0.2.1:3334", now)
+	healthy := addMcs("192.0.2.2:3334", now)
+
+	created := addBattle("HEALTH01", "192.0.2.1:3334", "HEALTH01", McsGameStateCreated)
+	opened := addBattle("HEALTH02", "192.0.2.1:3334", "HEALTH02", McsGameStateOpened)
+
+	healthy.mcsSyncedAt = now.Add(rconf.McsDegradedTimeout)
+	lbs.checkMcsHealth(now.Add(rconf.McsDegradedTimeout))
+	assertEq(t, McsDegraded, stalled.mcsHealth)
+	assertEq(t, "192.0.2.2:3334", lbs.FindMcs("asia-northeast1").PublicAddr)
+	g, _ := sharedData.GetBattleGameInfo("HEALTH01")
+	assertEq(t, "192.0.2.1:3334", g.McsAddr)
+
+	healthy.mcsSyncedAt = now.Add(rconf.McsDeadTimeout)
+	lbs.checkMcsHealth(now.Add(rconf.McsDeadTimeout))
+	assertEq(t, McsDead, stalled.mcsHealth)
+
+	// The battle not opened yet is moved to the healthy mcs.
+	g, _ = sharedData.GetBattleGameInfo("HEALTH01")
+	assertEq(t, "192.0.2.2:3334", g.McsAddr)
+	assertEq(t, "192.0.2.2", created.ServerIP.String())
+
+	// The opened battle is left as it is.
+	g, _ = sharedData.GetBattleGameInfo("HEALTH02")
+	assertEq(t, "192.0.2.1:3334", g.McsAddr)
+	assertEq(t, "192.0.2.1", opened.ServerIP.String())
+
+	// The mcs recovers when its status is synced again.
+	stalled.mcsSyncedAt = now.Add(rconf.McsDeadTimeout)
+	lbs.checkMcsHealth(now.Add(rconf.McsDeadTimeout))
+	assertEq(t, McsHealthy, stalled.mcsHealth)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// McsLoad is the load of a mcs used to select the battle server.
+type McsLoad struct {
+	Status   *McsStatus
+	Games    int   // games assigned to the mcs and not closed yet
+	Users    int   // users of the games who have not left
+	ProcSlow int64 // packets that took long to process since the previous status
+}
+
+// Full returns true if the mcs has no room for another game.
+func (m *McsLoad) Full() bool {
+	return 0 < m.Status.Capacity && m.Status.Capacity <= m.Games
+}
+
+// mcsLoads returns the load of every healthy mcs in the region, the least loaded one comes first.
+// Games are counted from the shared data of the lbs so that games just assigned are included
+// before the mcs reports them.
+func (lbs *Lbs) mcsLoads(region string) []*McsLoad {
+	var loads []*McsLoad
+	for _, p := range lbs.mcsPeers {
+		st := p.mcsStatus
+		if st == nil || st.PublicAddr == "" || !strings.HasPrefix(st.Region, region) || p.mcsHealth != McsHealthy {
+			continue
+		}
+		games, users := sharedData.GetMcsLoad(st.PublicAddr)
+		loads = append(loads, &McsLoad{
+			Status:   st,
+			Games:    games,
+			Users:    users,
+			ProcSlow: st.ProcSlow,
+		})
+	}
+
+	sort.Slice(loads, func(i, j int) bool {
+		a, b := loads[i], loads[j]
+		if a.Games != b.Games {
+			return a.Games < b.Games
+		}
+		if a.Users != b.Users {
+			return a.Users < b.Users
+		}
+		if a.ProcSlow != b.ProcSlow {
+			return a.ProcSlow < b.ProcSlow
+		}
+		return a.Status.PublicAddr < b.Status.PublicAddr
+	})
+	return loads
+}
+
+// FindMcs returns the least loaded mcs in the region that has room for another game.
+func (lbs *Lbs) FindMcs(region string) *McsStatus {
+	return lbs.FindMcsFor(region, nil)
+}
+
+// FindMcsFor is like FindMcs but skips the mcs that some of the participants cannot connect to.
+func (lbs *Lbs) FindMcsFor(region string, participants []*LbsPeer) *McsStatus {
+	for _, m := range lbs.mcsLoads(region) {
+		if !m.Full() && mcsReachable(m.Status, participants) {
+			return m.Status
+		}
+	}
+	return nil
+}
+
+// findMcsOverCapacity returns the least loaded mcs in the region even if it is full.
+// The mcs that some of the participants cannot connect to are skipped.
+func (lbs *Lbs) findMcsOverCapacity(region string, participants []*LbsPeer) *McsStatus {
+	for _, m := range lbs.mcsLoads(region) {
+		if mcsReachable(m.Status, participants) {
+			return m.Status
+		}
+	}
+	return nil
+}
+
+// mcsHasIPv4 reports whether the mcs can be reached by legacy clients.
+func mcsHasIPv4(st *McsStatus) bool {
+	host, _, err := net.SplitHostPort(st.PublicAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	// A host name is resolved later, assume it has an IPv4 address.
+	return ip == nil || ip.To4() != nil
+}
+
+// mcsReachable reports whether every participant can connect to the mcs.
+func mcsReachable(st *McsStatus, participants []*LbsPeer) bool {
+	if mcsHasIPv4(st) {
+		return true
+	}
+	for _, p := range participants {
+		if !supportsIPv6(p) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLbs_FindMcs_LeastLoaded(t *testing.T) {
+	lbs := NewLbs()
+	lbs.mcsAllocator = nil
+
+	addMcs := func(addr, region string, capacity int, procSlow int64) {
+		lbs.mcsPeers[addr] = &LbsPeer{
+			mcsStatus: &McsStatus{Region: region, PublicAddr: addr, Capacity: capacity, ProcSlow: procSlow},
+			mcsHealth: McsHealthy,
+		}
+	}
+	addGame := func(battleCode, addr string, users int) {
+		sharedData.ShareMcsGame(&McsGame{BattleCode: battleCode, McsAddr: addr, UpdatedAt: time.Now()})
+		for i := 0; i < users; i++ {
+			sharedData.ShareMcsUser(&McsUser{BattleCode: battleCode, SessionID: battleCode + string(rune('0'+i)), UpdatedAt: time.Now()})
+		}
+	}
+	defer func() {
+		sharedData.Lock()
+		sharedData.mcsGames = map[string]*McsGame{}
+		sharedData.mcsUsers = map[string]*McsUser{}
+		sharedData.Unlock()
+	}()
+
+	addMcs("192.0.2.1:3334", "asia-northeast1", 2, 0)
+	addMcs("192.0.2.2:3334", "asia-northeast1", 2, 5)
+	addMcs("192.0.2.3:3334", "us-west1", 0, 0)
+
+	assertEq(t, "192.0.2.1:3334", lbs.FindMcs("asia-northeast1").PublicAddr)
+
+	// Fewer games are preferred.
+	addGame("LOAD01", "192.0.2.1:3334", 4)
+	assertEq(t, "192.0.2.2:3334", lbs.FindMcs("asia-northeast1").PublicAddr)
+
+	// Fewer users are preferred when the number of games is the same.
+	addGame("LOAD02", "192.0.2.2:3334", 2)
+	assertEq(t, "192.0.2.2:3334", lbs.FindMcs("asia-northeast1").PublicAddr)
+
+	// Closed games are not counted.
+	sharedData.UpdateMcsGameState("LOAD01", McsGameStateClosed)
+	assertEq(t, "192.0.2.1:3334", lbs.FindMcs("asia-northeast1").PublicAddr)
+
+	// Every mcs in the region is full.
+	addGame("LOAD03", "192.0.2.1:3334", 4)
+	addGame("LOAD04", "192.0.2.1:3334", 4)
+	addGame("LOAD05", "192.0.2.2:3334", 4)
+	assertEq(t, (*McsStatus)(nil), lbs.FindMcs("asia-northeast1"))
+	assertEq(t, "192.0.2.2:3334", lbs.findMcsOverCapacity("asia-northeast1", nil).PublicAddr)
+
+	// An extra mcs is allocated.
+	l := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 1)
+	alloc := &fakeMcsAllocator{regions: []string{"asia-northeast1"}}
+	lbs.mcsAllocator = alloc
+	_, _, _, canStart, allocated, _ := l.prepareMcs("asia-northeast1", nil)
+	assertEq(t, false, canStart)
+	assertEq(t, true, allocated)
+	assertEq(t, []string{"asia-northeast1"}, alloc.allocated)
+
+	// The battle keeps waiting while the mcs is starting up.
+	alloc.result = McsAllocPending
+	_, _, _, canStart, allocated, _ = l.prepareMcs("asia-northeast1", nil)
+	assertEq(t, false, canStart)
+	assertEq(t, true, allocated)
+
+	// The full mcs is used if the allocated mcs does not come up in time.
+	lbs.mcsAllocating["asia-northeast1"] = time.Now().Add(-mcsAllocTimeout)
+	_, _, mcsAddr, canStart, allocated, _ := l.prepareMcs("asia-northeast1", nil)
+	assertEq(t, true, canStart)
+	assertEq(t, false, allocated)
+	assertEq(t, "192.0.2.2:3334", mcsAddr)
+
+	// The full mcs is used if no more mcs can be allocated.
+	delete(lbs.mcsAllocating, "asia-northeast1")
+	alloc.result = McsAllocUnavailable
+	_, _, mcsAddr, canStart, allocated, _ = l.prepareMcs("asia-northeast1", nil)
+	assertEq(t, true, canStart)
+	assertEq(t, false, allocated)
+	assertEq(t, "192.0.2.2:3334", mcsAddr)
+	assertEq(t, 0, len(lbs.mcsAllocating))
+
+	// Unlimited capacity.
+	for i := 0; i < 10; i++ {
+		addGame("LOADUS"+string(rune('0'+i)), "192.0.2.3:3334", 4)
+	}
+	assertEq(t, "192.0.2.3:3334", lbs.FindMcs("us-west1").PublicAddr)
+}
+
+type fakeMcsAllocator struct {
+	regions   []string
+	allocated []string
+	result    McsAllocResult
+}
+
+func (a *fakeMcsAllocator) Name() string {
+	return "fake"
+}
+
+func (a *fakeMcsAllocator) Regions() []string {
+	return a.regions
+}
+
+func (a *fakeMcsAllocator) Alloc(region string) McsAllocResult {
+	if a.result == McsAllocStarted {
+		a.allocated = append(a.allocated, region)
+	}
+	return a.result
+}
+
+func TestLbs_FindMcsFor_IPv6Only(t *testing.T) {
+	lbs := NewLbs()
+	lbs.mcsAllocator = nil
+
+	lbs.mcsPeers["[2001:db8::1]:3334"] = &LbsPeer{
+		mcsStatus: &McsStatus{Region: "asia-northeast1", PublicAddr: "[2001:db8::1]:3334"},
+		mcsHealth: McsHealthy,
+	}
+	lbs.mcsPeers["192.0.2.2:3334"] = &LbsPeer{
+		mcsStatus: &McsStatus{Region: "asia-northeast1", PublicAddr: "192.0.2.2:3334", Capacity: 1},
+		mcsHealth: McsHealthy,
+	}
+	sharedData.ShareMcsGame(&McsGame{BattleCode: "LOAD6", McsAddr: "192.0.2.2:3334", UpdatedAt: time.Now()})
+	defer func() {
+		sharedData.Lock()
+		sharedData.mcsGames = map[string]*McsGame{}
+		sharedData.Unlock()
+	}()
+
+	emu6 := &LbsPeer{Platform: PlatformEmuX8664, PlatformInfo: map[string]string{"mcs_ipv6": "1"}}
+	console := &LbsPeer{Platform: PlatformConsole, PlatformInfo: map[string]string{}}
+
+	assertEq(t, "[2001:db8::1]:3334", lbs.FindMcsFor("asia-northeast1", []*LbsPeer{emu6}).PublicAddr)
+	assertEq(t, (*McsStatus)(nil), lbs.FindMcsFor("asia-northeast1", []*LbsPeer{emu6, console}))
+
+	// Legacy clients fall back to the mcs over capacity which has an IPv4 address.
+	l := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 1)
+	_, _, mcsAddr, canStart, _, _ := l.prepareMcs("asia-northeast1", []*LbsPeer{emu6, console})
+	assertEq(t, true, canStart)
+	assertEq(t, "192.0.2.2:3334", mcsAddr)
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"strings"
@@ -89,27 +90,30 @@ func (m *LbsMessage) Serialize() []byte {
 	return w.Bytes()
 }
 
+// Deserialize reads a message from the head of data.
+// It returns zero and no message if the data is not enough.
 func Deserialize(data []byte) (int, *LbsMessage) {
 	if len(data) < HeaderSize {
 		return 0, nil
 	}
 
 	m := LbsMessage{}
-	r := bytes.NewReader(data)
-	_ = binary.Read(r, binary.BigEndian, &m.Direction)
-	_ = binary.Read(r, binary.BigEndian, &m.Category)
-	_ = binary.Read(r, binary.BigEndian, &m.Command)
-	_ = binary.Read(r, binary.BigEndian, &m.BodySize)
-	_ = binary.Read(r, binary.BigEndian, &m.Seq)
-	_ = binary.Read(r, binary.BigEndian, &m.Status)
-
-	if len(data) < HeaderSize+int(m.BodySize) {
+	m.Direction = CmdDirection(data[0])
+	m.Category = CmdCategory(data[1])
+	m.Command = CmdID(binary.BigEndian.Uint16(data[2:]))
+	m.BodySize = binary.BigEndian.Uint16(data[4:])
+	m.Seq = binary.BigEndian.Uint16(data[6:])
+	m.Status = CmdStatus(binary.BigEndian.Uint32(data[8:]))
+
+	n := HeaderSize + int(m.BodySize)
+	if len(data) < n {
 		return 0, nil
 	}
 
-	m.Body = data[HeaderSize : HeaderSize+m.BodySize]
+	// Copy the body not to refer to the receive buffer.
+	m.Body = append([]byte(nil), data[HeaderSize:n]...)
 
-	return int(HeaderSize + m.BodySize), &m
+	return n, &m
 }
 
 func WriteLbsMessage(w io.Writer, m *LbsMessage) error {
@@ -180,16 +184,11 @@ func ReadLbsMessage(r io.Reader, m *LbsMessage) error {
 	}
 
 	m.Body = make([]byte, m.BodySize)
-	n, err := r.Read(m.Body)
-	if err != nil {
-		return err
-	}
-
-	if n != len(m.Body) {
+	_, err = io.ReadFull(r, m.Body)
+	if err == io.ErrUnexpectedEOF {
 		return fmt.Errorf("invalid message body size")
 	}
-
-	return nil
+	return err
 }
 
 func NewServerQuestion(command CmdID) *LbsMessage {
@@ -262,9 +261,15 @@ func NewClientCustom(command CmdID) *LbsMessage {
 	}
 }
 
+// ErrShortMessageBody is the error of MessageBodyReader when the body ends before a value.
+var ErrShortMessageBody = errors.New("message body too short")
+
+// MessageBodyReader reads values from a message body.
+// Once a read fails, the following reads return zero values and Err returns the first error.
 type MessageBodyReader struct {
 	seq uint16
 	r   *bytes.Reader
+	err error
 }
 
 func (m *LbsMessage) Reader() *MessageBodyReader {
@@ -274,37 +279,56 @@ func (m *LbsMessage) Reader() *MessageBodyReader {
 	}
 }
 
+// Err returns the first error that occurred while reading.
+func (m *MessageBodyReader) Err() error {
+	return m.err
+}
+
 func (m *MessageBodyReader) Remaining() int {
 	return m.r.Len()
 }
 
+func (m *MessageBodyReader) read(n int) []byte {
+	if m.err != nil {
+		return nil
+	}
+	if m.r.Len() < n {
+		m.err = fmt.Errorf("%w: %d bytes at offset %d", ErrShortMessageBody, n, m.r.Size()-int64(m.r.Len()))
+		return nil
+	}
+	buf := make([]byte, n)
+	_, _ = m.r.Read(buf)
+	return buf
+}
+
 func (m *MessageBodyReader) Read8() byte {
-	var ret byte
-	_ = binary.Read(m.r, binary.BigEndian, &ret)
-	return ret
+	b := m.read(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
 }
 
 func (m *MessageBodyReader) Read16() uint16 {
-	var ret uint16
-	_ = binary.Read(m.r, binary.BigEndian, &ret)
-	return ret
+	b := m.read(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
 }
 
 func (m *MessageBodyReader) Read32() uint32 {
-	var ret uint32
-	_ = binary.Read(m.r, binary.BigEndian, &ret)
-	return ret
+	b := m.read(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
 }
 
 // ReadBytes reads length-prefixed byte data
 func (m *MessageBodyReader) ReadBytes() []byte {
-	if m.r.Len() == 0 {
-		return nil
-	}
 	size := m.Read16()
-	buf := make([]byte, size)
-	_, _ = m.r.Read(buf)
-	return buf
+	return m.read(int(size))
 }
 
 // ReadString reads length-prefixed string
@@ -313,12 +337,14 @@ func (m *MessageBodyReader) ReadString() string {
 }
 
 func (m *MessageBodyReader) ReadShiftJISString() string {
-	size := m.Read16()
-	buf := make([]byte, size)
-	_, _ = m.r.Read(buf)
-	ret, err := io.ReadAll(transform.NewReader(bytes.NewReader(buf), japanese.ShiftJIS.NewDecoder()))
+	buf := m.ReadBytes()
+	if buf == nil {
+		return ""
+	}
+	ret, err := japanese.ShiftJIS.NewDecoder().Bytes(buf)
 	if err != nil {
-		logger.Error("failed to read sjis string", zap.Error(err), zap.Any("msg", m))
+		m.err = fmt.Errorf("invalid sjis string: %w", err)
+		return ""
 	}
 	return string(bytes.Trim(ret, "\x00"))
 }
@@ -1,6 +1,10 @@
 package main
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
 
 func TestLbsMessage_String(t *testing.T) {
 	type fields struct {
@@ -72,3 +76,89 @@ func TestLbsMessage_String(t *testing.T) {
 		})
 	}
 }
+
+func TestMessageBodyReader_Err(t *testing.T) {
+	msg := NewClientQuestion(lbsPostChatMessage).Writer().Write8(1).Write16(2).WriteString("abc").Msg()
+
+	r := msg.Reader()
+	assertEq(t, byte(1), r.Read8())
+	assertEq(t, uint16(2), r.Read16())
+	assertEq(t, "abc", r.ReadString())
+	must(t, r.Err())
+	assertEq(t, 0, r.Remaining())
+
+	// Reading past the body
+	assertEq(t, uint32(0), r.Read32())
+	if !errors.Is(r.Err(), ErrShortMessageBody) {
+		t.Fatal("want ErrShortMessageBody, got", r.Err())
+	}
+
+	// Truncated string
+	msg.Body = msg.Body[:len(msg.Body)-1]
+	r = msg.Reader()
+	r.Read8()
+	r.Read16()
+	assertEq(t, "", r.ReadString())
+	if !errors.Is(r.Err(), ErrShortMessageBody) {
+		t.Fatal("want ErrShortMessageBody, got", r.Err())
+	}
+
+	// The error is sticky
+	err := r.Err()
+	assertEq(t, byte(0), r.Read8())
+	assertEq(t, err, r.Err())
+}
+
+func FuzzDeserialize(f *testing.F) {
+	f.Add(NewClientQuestion(lbsPostChatMessage).Writer().WriteString("hello").Msg().Serialize())
+	f.Add(NewServerNotice(lbsLoginOk).Serialize())
+	f.Add([]byte{0x81, 0x01, 0x61, 0x01, 0xff, 0xff, 0x00, 0x00, 0x00, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		n, msg := Deserialize(data)
+		if msg == nil {
+			if n != 0 {
+				t.Fatal("n must be zero without message", n)
+			}
+			return
+		}
+		if n != HeaderSize+len(msg.Body) || int(msg.BodySize) != len(msg.Body) || len(data) < n {
+			t.Fatal("invalid size", n, msg.BodySize, len(msg.Body), len(data))
+		}
+		if !bytes.Equal(data[:n], msg.Serialize()) {
+			t.Fatal("serialized message differs")
+		}
+	})
+}
+
+func FuzzMessageBodyReader(f *testing.F) {
+	f.Add([]byte{0x00, 0x03, 'a', 'b', 'c', 0x01}, []byte{4, 0, 1})
+	f.Add([]byte{0x82, 0xa0}, []byte{5, 3})
+	f.Fuzz(func(t *testing.T, body []byte, ops []byte) {
+		r := (&LbsMessage{Body: body}).Reader()
+		for _, op := range ops {
+			failed := r.Err() != nil
+			remaining := r.Remaining()
+			var zero bool
+			switch op % 6 {
+			case 0:
+				zero = r.Read8() == 0
+			case 1:
+				zero = r.Read16() == 0
+			case 2:
+				zero = r.Read32() == 0
+			case 3:
+				zero = len(r.ReadBytes()) == 0
+			case 4:
+				zero = r.ReadString() == ""
+			case 5:
+				zero = r.ReadShiftJISString() == ""
+			}
+			if failed && (!zero || r.Remaining() != remaining) {
+				t.Fatal("read after error")
+			}
+			if remaining < r.Remaining() {
+				t.Fatal("remaining increased")
+			}
+		}
+	})
+}
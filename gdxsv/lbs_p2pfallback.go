@@ -0,0 +1,273 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gdxsv/gdxsv/proto"
+	"go.uber.org/zap"
+)
+
+const (
+	// p2pFallbackTimeout is how long the lbs waits for the players of a failed P2P battle to come back to the lobby.
+	p2pFallbackTimeout = time.Minute
+
+	// p2pFallbackRetention is how long a failed P2P battle is remembered to ignore the reports of the other players.
+	p2pFallbackRetention = 10 * time.Minute
+
+	// p2pFailureReportWindow is how long after the creation a P2P battle can be reported as failed to start.
+	p2pFailureReportWindow = 5 * time.Minute
+)
+
+// isP2PFailure reports whether the close reason of P2PMatchingReport means that the P2P battle could not be started.
+func isP2PFailure(closeReason string) bool {
+	return strings.HasPrefix(closeReason, "unreachable") ||
+		strings.HasPrefix(closeReason, "ggpo_start_failure") ||
+		strings.HasPrefix(closeReason, "ggpo_start_timeout")
+}
+
+// P2PBattle is a recent P2P battle that can be reported as failed to start.
+type P2PBattle struct {
+	Created   time.Time
+	Rule      *Rule
+	PatchList *proto.GamePatchList
+}
+
+// P2PFallback is a P2P battle that failed to start. It is recreated on a relay mcs
+// with the same participants, teams, rule and game patches once all of them are back in the lobby.
+type P2PFallback struct {
+	BattleCode  string
+	CloseReason string
+	Records     []*BattleRecord // sorted by pos
+	Aggregate   bool
+	Rule        *Rule
+	PatchList   *proto.GamePatchList
+	ReportedAt  time.Time
+
+	Recreated string // battle code of the relay battle
+	Expired   bool
+}
+
+// p2pBattlePlayed reports whether the P2P battle is known to have been played,
+// by the frames or the rounds of the report or of the reports saved before.
+func p2pBattlePlayed(report *proto.P2PMatchingReport, records []*BattleRecord, reports []*P2PReport) bool {
+	if 0 < report.FrameCount || 0 < len(report.RoundData) {
+		return true
+	}
+	for _, r := range records {
+		if r.RoundWin != "" {
+			return true
+		}
+	}
+	for _, r := range reports {
+		if 0 < r.FrameCount || r.CloseReason == "game_end" {
+			return true
+		}
+	}
+	return false
+}
+
+// startP2PFallback excludes the failed P2P battle from the results and registers it to be recreated.
+// The reporter must be a participant of a P2P battle created recently.
+// If the battle may have been played, another participant must have reported the failure too,
+// since a single report can't tell a battle that never started from a player who left in the middle.
+// The reports of the same battle from the other players are ignored.
+func (lbs *Lbs) startP2PFallback(reporter string, report *proto.P2PMatchingReport, now time.Time) bool {
+	battleCode, closeReason := report.BattleCode, report.CloseReason
+	if battleCode == "" {
+		return false
+	}
+	if _, ok := lbs.p2pFallbacks[battleCode]; ok {
+		return false
+	}
+	battle, ok := lbs.p2pBattles[battleCode]
+	if !ok || p2pFailureReportWindow < now.Sub(battle.Created) {
+		logger.Warn("p2p fallback: not a recent p2p battle", zap.String("battle_code", battleCode), zap.String("reporter", reporter))
+		return false
+	}
+
+	records, err := getDB().GetBattleRecordsByCode(battleCode)
+	if err != nil || len(records) == 0 {
+		logger.Warn("p2p fallback: battle record not found", zap.String("battle_code", battleCode), zap.Error(err))
+		return false
+	}
+	participant := false
+	for _, r := range records {
+		if r.UserID == reporter {
+			participant = true
+		}
+	}
+	if !participant {
+		logger.Warn("p2p fallback: reporter is not a participant", zap.String("battle_code", battleCode), zap.String("reporter", reporter))
+		return false
+	}
+
+	reports, err := getDB().GetP2PReports(battleCode)
+	if err != nil {
+		logger.Warn("p2p fallback: GetP2PReports failed", zap.String("battle_code", battleCode), zap.Error(err))
+		return false
+	}
+	if p2pBattlePlayed(report, records, reports) {
+		corroborated := false
+		for _, r := range reports {
+			if r.UserID == reporter || !isP2PFailure(r.CloseReason) {
+				continue
+			}
+			for _, rec := range records {
+				if rec.UserID == r.UserID {
+					corroborated = true
+				}
+			}
+		}
+		if !corroborated {
+			logger.Info("p2p fallback: played battle not corroborated yet",
+				zap.String("battle_code", battleCode),
+				zap.String("reporter", reporter),
+				zap.Int32("frame_count", report.FrameCount))
+			return false
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Pos < records[j].Pos
+	})
+
+	sharedData.UpdateMcsGameState(battleCode, McsGameStateClosed)
+
+	aggregate := false
+	for _, r := range records {
+		if r.Aggregate != 0 {
+			aggregate = true
+		}
+	}
+	if aggregate {
+		if err := getDB().DisableBattleAggregate(battleCode); err != nil {
+			logger.Error("DisableBattleAggregate failed", zap.String("battle_code", battleCode), zap.Error(err))
+		}
+	}
+
+	lbs.p2pFallbacks[battleCode] = &P2PFallback{
+		BattleCode:  battleCode,
+		CloseReason: closeReason,
+		Records:     records,
+		Aggregate:   aggregate,
+		Rule:        battle.Rule,
+		PatchList:   battle.PatchList,
+		ReportedAt:  now,
+	}
+	logger.Info("p2p fallback started",
+		zap.String("battle_code", battleCode),
+		zap.String("close_reason", closeReason),
+		zap.String("reporter", reporter),
+		zap.Int("players", len(records)))
+	return true
+}
+
+// updateP2PFallbacks recreates the failed P2P battles whose players are back, should be called every 1 sec in the event loop.
+func (lbs *Lbs) updateP2PFallbacks(now time.Time) {
+	for battleCode, battle := range lbs.p2pBattles {
+		if p2pFailureReportWindow < now.Sub(battle.Created) {
+			delete(lbs.p2pBattles, battleCode)
+		}
+	}
+
+	for battleCode, fb := range lbs.p2pFallbacks {
+		if p2pFallbackRetention < now.Sub(fb.ReportedAt) {
+			delete(lbs.p2pFallbacks, battleCode)
+			continue
+		}
+		if fb.Recreated != "" || fb.Expired {
+			continue
+		}
+		if p2pFallbackTimeout < now.Sub(fb.ReportedAt) {
+			fb.Expired = true
+			lbsP2PFallbackExpired.Add(1)
+			logger.Warn("p2p fallback expired", zap.String("battle_code", battleCode))
+			continue
+		}
+		lbs.recreateP2PBattle(fb)
+	}
+}
+
+// p2pFallbackParticipants returns the players of the failed battle if all of them are waiting in the same lobby.
+func (lbs *Lbs) p2pFallbackParticipants(fb *P2PFallback) (*LbsLobby, []*LbsPeer) {
+	var lobby *LbsLobby
+	var participants []*LbsPeer
+	for _, r := range fb.Records {
+		p := lbs.FindPeer(r.UserID)
+		if p == nil || p.Battle != nil || p.Lobby == nil {
+			return nil, nil
+		}
+		if p.Lobby.ID != uint16(r.LobbyID) || p.Lobby.GameDisk != r.Disk {
+			return nil, nil
+		}
+		if lobby != nil && lobby != p.Lobby {
+			return nil, nil
+		}
+		lobby = p.Lobby
+		participants = append(participants, p)
+	}
+	return lobby, participants
+}
+
+func (lbs *Lbs) recreateP2PBattle(fb *P2PFallback) {
+	lobby, participants := lbs.p2pFallbackParticipants(fb)
+	if lobby == nil {
+		return
+	}
+
+	// Nobody is picked on failure so that the battle is recreated next time.
+	var b *LbsBattle
+	origTeams := map[*LbsPeer]uint16{}
+	restore := func() {
+		for p, team := range origTeams {
+			p.Team = team
+			if b != nil && p.Battle == b {
+				p.Battle = nil
+			}
+		}
+	}
+	for i, p := range participants {
+		origTeams[p] = p.Team
+		p.Team = uint16(fb.Records[i].Team)
+	}
+
+	mcsRegion := lobby.LobbySetting.McsRegion
+	if mcsRegion == "" || mcsRegion == "p2p" {
+		mcsRegion = "best"
+	}
+	mcsRegion, mcsPeer, mcsAddr, canStart, _, decision := lobby.prepareMcs(mcsRegion, participants)
+	if !canStart {
+		// Wait for the allocated mcs.
+		restore()
+		return
+	}
+
+	b = NewBattle(lbs, lobby.ID, fb.Rule, mcsRegion, mcsAddr)
+	if b == nil {
+		restore()
+		return
+	}
+	b.RegionDecision = decision
+	b.PatchList = fb.PatchList
+
+	if !lobby.setupBattle(b, participants, mcsPeer, mcsAddr, fb.Aggregate) {
+		restore()
+		return
+	}
+	for _, p := range participants {
+		lobby.EntryPicked(p)
+	}
+	fb.Recreated = b.BattleCode
+	lbsP2PFallbackRecreated.Add(1)
+
+	lobby.NotifyLobbyEvent("", "P2P FAILED, RETRY ON GAME SERVER")
+	lbs.BroadcastLobbyUserCount(lobby)
+	lbs.BroadcastLobbyMatchEntryUserCount(lobby)
+
+	logger.Info("p2p fallback battle created",
+		zap.String("battle_code", fb.BattleCode),
+		zap.String("new_battle_code", b.BattleCode),
+		zap.String("mcs_region", mcsRegion),
+		zap.String("mcs_addr", mcsAddr))
+}
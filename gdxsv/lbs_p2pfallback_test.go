@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"testing"
+	"time"
+
+	pb "gdxsv/gdxsv/proto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func p2pMatchingReportMsg(t *testing.T, report *pb.P2PMatchingReport) *LbsMessage {
+	t.Helper()
+	bin, err := proto.Marshal(report)
+	must(t, err)
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	_, err = zw.Write(bin)
+	must(t, err)
+	must(t, zw.Close())
+	return &LbsMessage{
+		Command:  lbsP2PMatchingReport,
+		BodySize: uint16(buf.Len()),
+		Body:     buf.Bytes(),
+	}
+}
+
+func Test_isP2PFailure(t *testing.T) {
+	assertEq(t, true, isP2PFailure("unreachable"))
+	assertEq(t, true, isP2PFailure("ggpo_start_failure:3"))
+	assertEq(t, true, isP2PFailure("ggpo_start_timeout"))
+	assertEq(t, false, isP2PFailure("game_end"))
+	assertEq(t, false, isP2PFailure("player_disconnect"))
+}
+
+func TestLbs_P2PFallback(t *testing.T) {
+	lbs := NewLbs()
+	lbs.mcsAllocator = nil
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	const lobbyID = uint16(3)
+	const battleCode = "p2pfallback1"
+
+	var clients []*TestLbsClient
+	for i := 0; i < 4; i++ {
+		cli, cancel := prepareLoggedInUser(t, lbs, PlatformEmuX8664, GameDiskDC2, DBUser{
+			UserID: fmt.Sprintf("FB%d", i),
+			Name:   fmt.Sprintf("FBNAME%d", i),
+		})
+		defer cancel()
+		clients = append(clients, cli)
+
+		must(t, getDB().AddBattleRecord(&BattleRecord{
+			BattleCode: battleCode,
+			UserID:     cli.UserID,
+			Disk:       GameDiskDC2,
+			LobbyID:    int(lobbyID),
+			Players:    4,
+			Aggregate:  1,
+			Pos:        i + 1,
+			Team:       i/2 + 1,
+		}))
+	}
+
+	// The battle was played with a rule and patches that the lobby no longer uses.
+	rule := DefaultRule
+	rule.Timer = 2
+	patchList := &pb.GamePatchList{Patches: []*pb.GamePatch{{Name: "p2pfallback-patch"}}}
+	lbs.Locked(func(lbs *Lbs) {
+		lbs.p2pBattles[battleCode] = &P2PBattle{Created: time.Now(), Rule: &rule, PatchList: patchList}
+	})
+
+	// The first player is back and the others are still on the way.
+	forceEnterLobby(t, lbs, clients[0], lobbyID, TeamZeon)
+	report := &pb.P2PMatchingReport{BattleCode: battleCode, CloseReason: "ggpo_start_timeout", PlayerCount: 4}
+	clients[0].MustWriteMessage(p2pMatchingReportMsg(t, report))
+
+	waitFor(t, 2*time.Second, func() bool {
+		ok := false
+		lbs.Locked(func(lbs *Lbs) {
+			_, ok = lbs.p2pFallbacks[battleCode]
+		})
+		return ok
+	})
+	for _, cli := range clients {
+		rec, err := getDB().GetBattleRecordUser(battleCode, cli.UserID)
+		must(t, err)
+		assertEq(t, 0, rec.Aggregate)
+	}
+
+	// The battle is recreated when all of them are back.
+	for i, cli := range clients[1:] {
+		forceEnterLobby(t, lbs, cli, lobbyID, uint16(2-i%2))
+	}
+	clients[1].MustWriteMessage(p2pMatchingReportMsg(t, report))
+
+	var newBattleCode string
+	waitFor(t, 3*time.Second, func() bool {
+		lbs.Locked(func(lbs *Lbs) {
+			newBattleCode = lbs.p2pFallbacks[battleCode].Recreated
+		})
+		return newBattleCode != ""
+	})
+
+	lbs.Locked(func(lbs *Lbs) {
+		for i, cli := range clients {
+			p := lbs.FindPeer(cli.UserID)
+			assertEq(t, newBattleCode, p.Battle.BattleCode)
+			assertEq(t, uint16(i/2+1), p.Team)
+			assertEq(t, "", p.Battle.McsRegion)
+			assertEq(t, rule, *p.Battle.Rule)
+			assertEq(t, patchList, p.Battle.PatchList)
+		}
+	})
+
+	records, err := getDB().GetBattleRecordsByCode(newBattleCode)
+	must(t, err)
+	assertEq(t, 4, len(records))
+	for _, rec := range records {
+		assertEq(t, fmt.Sprintf("FB%d", rec.Pos-1), rec.UserID)
+		assertEq(t, (rec.Pos-1)/2+1, rec.Team)
+		assertEq(t, 1, rec.Aggregate)
+	}
+}
+
+func TestLbs_startP2PFallback_Invalid(t *testing.T) {
+	lbs := NewLbs()
+	now := time.Now()
+	failure := func(battleCode string) *pb.P2PMatchingReport {
+		return &pb.P2PMatchingReport{BattleCode: battleCode, CloseReason: "unreachable"}
+	}
+
+	for _, battleCode := range []string{"p2pinvalid1", "p2pinvalid2"} {
+		for i := 0; i < 2; i++ {
+			must(t, getDB().AddBattleRecord(&BattleRecord{
+				BattleCode: battleCode,
+				UserID:     fmt.Sprintf("INV%d", i),
+				Disk:       GameDiskDC2,
+				LobbyID:    3,
+				Players:    2,
+				Pos:        i + 1,
+				Team:       i + 1,
+			}))
+		}
+	}
+
+	// Not a P2P battle.
+	assertEq(t, false, lbs.startP2PFallback("INV0", failure("p2pinvalid1"), now))
+
+	// Too old to fail to start.
+	lbs.p2pBattles["p2pinvalid1"] = &P2PBattle{Created: now.Add(-p2pFailureReportWindow - time.Second)}
+	assertEq(t, false, lbs.startP2PFallback("INV0", failure("p2pinvalid1"), now))
+
+	// Reported by a user who did not play the battle.
+	lbs.p2pBattles["p2pinvalid2"] = &P2PBattle{Created: now}
+	assertEq(t, false, lbs.startP2PFallback("INV9", failure("p2pinvalid2"), now))
+
+	assertEq(t, true, lbs.startP2PFallback("INV1", failure("p2pinvalid2"), now))
+	assertEq(t, false, lbs.startP2PFallback("INV0", failure("p2pinvalid2"), now))
+	assertEq(t, 1, len(lbs.p2pFallbacks))
+
+	// Old P2P battles are forgotten.
+	lbs.updateP2PFallbacks(now)
+	_, ok := lbs.p2pBattles["p2pinvalid1"]
+	assertEq(t, false, ok)
+}
+
+func TestLbs_startP2PFallback_Played(t *testing.T) {
+	lbs := NewLbs()
+	now := time.Now()
+
+	for _, battleCode := range []string{"p2pplayed1", "p2pplayed2"} {
+		for i := 0; i < 2; i++ {
+			must(t, getDB().AddBattleRecord(&BattleRecord{
+				BattleCode: battleCode,
+				UserID:     fmt.Sprintf("PLY%d", i),
+				Disk:       GameDiskDC2,
+				LobbyID:    3,
+				Players:    2,
+				Aggregate:  1,
+				Pos:        i + 1,
+				Team:       i + 1,
+			}))
+		}
+		lbs.p2pBattles[battleCode] = &P2PBattle{Created: now}
+	}
+
+	// A report after the real play is rejected and the result is kept.
+	report := &pb.P2PMatchingReport{BattleCode: "p2pplayed1", PeerId: 0, CloseReason: "ggpo_start_failure", FrameCount: 3600}
+	assertEq(t, false, lbs.startP2PFallback("PLY0", report, now))
+	rec, err := getDB().GetBattleRecordUser("p2pplayed1", "PLY0")
+	must(t, err)
+	assertEq(t, 1, rec.Aggregate)
+
+	// The rounds saved by another player also tell that the battle was played.
+	must(t, getDB().SaveBattleRoundWin("p2pplayed2", "1,2"))
+	report = &pb.P2PMatchingReport{BattleCode: "p2pplayed2", PeerId: 0, CloseReason: "unreachable"}
+	assertEq(t, false, lbs.startP2PFallback("PLY0", report, now))
+
+	// The failure is accepted when another participant reported it too.
+	must(t, getDB().SaveP2PReport(&P2PReport{BattleCode: "p2pplayed1", PeerID: 1, UserID: "PLY1", CloseReason: "ggpo_start_timeout"}))
+	report = &pb.P2PMatchingReport{BattleCode: "p2pplayed1", PeerId: 0, CloseReason: "ggpo_start_failure", FrameCount: 3600}
+	assertEq(t, true, lbs.startP2PFallback("PLY0", report, now))
+	rec, err = getDB().GetBattleRecordUser("p2pplayed1", "PLY0")
+	must(t, err)
+	assertEq(t, 0, rec.Aggregate)
+}
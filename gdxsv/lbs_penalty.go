@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"gdxsv/gdxsv/proto"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// disconnectCooldownWindow is the period in which the disconnects increase the matching cooldown.
+	disconnectCooldownWindow = 24 * time.Hour
+
+	// reputationWindow is the period in which the disconnects decrease the reputation.
+	reputationWindow = 30 * 24 * time.Hour
+
+	// reputationPerDisconnect is the reputation lost by a disconnect, the reputation is 100 without disconnects.
+	reputationPerDisconnect = 10
+)
+
+// disconnectCooldowns is the matching cooldown after the last disconnect by the number of disconnects in the cooldown window.
+// The first disconnect is only a warning since anyone can lose the connection by accident.
+// The user is warned about the next cooldown in the lobby chat when entering the matching.
+var disconnectCooldowns = []time.Duration{0, 0, 5 * time.Minute, 15 * time.Minute, time.Hour}
+
+// DisconnectPenalty is the penalty of a user calculated from the attributed disconnects.
+type DisconnectPenalty struct {
+	UserID            string    `json:"user_id"`
+	Reputation        int       `json:"reputation"`
+	Disconnects       int       `json:"disconnects"`        // in the reputation window
+	RecentDisconnects int       `json:"recent_disconnects"` // in the cooldown window
+	CooldownUntil     time.Time `json:"cooldown_until"`
+}
+
+// calcDisconnectPenalty calculates the penalty from the disconnects of the user. Forgiven disconnects are not counted.
+func calcDisconnectPenalty(userID string, disconnects []*UserDisconnect, now time.Time) *DisconnectPenalty {
+	d := &DisconnectPenalty{UserID: userID}
+
+	var last time.Time
+	for _, x := range disconnects {
+		if x.Forgiven || now.Sub(x.Created) > reputationWindow {
+			continue
+		}
+		d.Disconnects++
+		if now.Sub(x.Created) <= disconnectCooldownWindow {
+			d.RecentDisconnects++
+			if last.Before(x.Created) {
+				last = x.Created
+			}
+		}
+	}
+
+	d.Reputation = max(0, 100-reputationPerDisconnect*d.Disconnects)
+	if 0 < d.RecentDisconnects {
+		cooldown := disconnectCooldowns[min(d.RecentDisconnects, len(disconnectCooldowns)-1)]
+		if 0 < cooldown {
+			d.CooldownUntil = last.Add(cooldown)
+		}
+	}
+	return d
+}
+
+// getDisconnectPenalty returns the current penalty of the user.
+func getDisconnectPenalty(userID string, now time.Time) (*DisconnectPenalty, error) {
+	disconnects, err := getDB().GetUserDisconnects(userID, now.Add(-reputationWindow))
+	if err != nil {
+		return nil, err
+	}
+	return calcDisconnectPenalty(userID, disconnects, now), nil
+}
+
+// InCooldown reports whether the user can't enter the matching.
+func (d *DisconnectPenalty) InCooldown(now time.Time) bool {
+	return now.Before(d.CooldownUntil)
+}
+
+// CooldownMessage explains the penalty to the user in the lobby chat.
+func (d *DisconnectPenalty) CooldownMessage(now time.Time) string {
+	remaining := d.CooldownUntil.Sub(now)
+	return fmt.Sprintf("DISCONNECT PENALTY: %d disconnects in 24h, matching is locked for %d min",
+		d.RecentDisconnects, int(remaining.Minutes())+1)
+}
+
+// WarningMessage tells the user who has disconnected recently the cooldown of the next disconnect.
+func (d *DisconnectPenalty) WarningMessage() string {
+	next := disconnectCooldowns[min(d.RecentDisconnects+1, len(disconnectCooldowns)-1)]
+	return fmt.Sprintf("DISCONNECT WARNING: %d disconnects in 24h, the next one locks matching for %d min",
+		d.RecentDisconnects, int(next.Minutes()))
+}
+
+// checkDisconnectPenalty returns false and tells the reason to the user if the user is in the cooldown.
+// The user who has disconnected recently but is not in the cooldown is warned.
+// The user is not blocked when the penalty can't be read.
+func checkDisconnectPenalty(p *LbsPeer) bool {
+	now := time.Now()
+	d, err := getDisconnectPenalty(p.UserID, now)
+	if err != nil {
+		p.logger.Error("getDisconnectPenalty failed", zap.Error(err))
+		return true
+	}
+	if !d.InCooldown(now) {
+		if 0 < d.RecentDisconnects {
+			p.SendMessage(chatMsg("", "", d.WarningMessage()))
+		}
+		return true
+	}
+	lbsMatchingPenalized.Add(1)
+	p.logger.Info("matching entry rejected by disconnect penalty",
+		zap.Int("recent_disconnects", d.RecentDisconnects),
+		zap.Time("cooldown_until", d.CooldownUntil))
+	p.SendMessage(chatMsg("", "", d.CooldownMessage(now)))
+	return false
+}
+
+// checkRoomDisconnectPenalty returns false if any user in the room is in the cooldown.
+// The penalized users are told the reason by checkDisconnectPenalty and the room is notified who they are.
+func checkRoomDisconnectPenalty(p *LbsPeer, r *LbsRoom) bool {
+	ok := true
+	for _, u := range r.Users {
+		q := p.app.FindPeer(u.UserID)
+		if q == nil {
+			continue
+		}
+		if !checkDisconnectPenalty(q) {
+			r.NotifyRoomEvent("", "DISCONNECT PENALTY: "+u.UserID)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// attributeDisconnect saves the disconnect of the user in the battle.
+func attributeDisconnect(d *UserDisconnect) {
+	err := getDB().AddUserDisconnect(d)
+	if err != nil {
+		logger.Error("AddUserDisconnect failed", zap.Error(err), zap.String("battle_code", d.BattleCode), zap.String("user_id", d.UserID))
+		return
+	}
+	lbsDisconnectAttributed.Add(1)
+	logger.Info("disconnect attributed",
+		zap.String("battle_code", d.BattleCode),
+		zap.String("user_id", d.UserID),
+		zap.String("reason", d.Reason),
+		zap.String("source", d.Source),
+		zap.String("reporter", d.Reporter))
+}
+
+// attributeP2PDisconnect attributes the player_disconnect of the P2PMatchingReport to the disconnected peer.
+// The reporter must be another participant of the battle, and another participant must have reported
+// the same peer, since a single report can't tell the disconnected peer from the reporter's own network.
+// So a disconnect in a 2-player P2P battle is never attributed: the only other peer is the disconnected one,
+// and the frame counts of the two reports can't tell who lost the connection either.
+func attributeP2PDisconnect(p *LbsPeer, report *proto.P2PMatchingReport) {
+	if report.BattleCode == "" || !strings.HasPrefix(report.CloseReason, "player_disconnect") {
+		return
+	}
+	if report.PeerId == report.DisconnectedPeerId {
+		return
+	}
+
+	records, err := getDB().GetBattleRecordsByCode(report.BattleCode)
+	if err != nil {
+		p.logger.Warn("GetBattleRecordsByCode for disconnect", zap.Error(err))
+		return
+	}
+
+	participant := func(peerID int, userID string) bool {
+		for _, r := range records {
+			if r.Pos == peerID+1 {
+				return r.UserID == userID
+			}
+		}
+		return false
+	}
+	var disconnected *BattleRecord
+	for _, r := range records {
+		if r.Pos == int(report.DisconnectedPeerId)+1 {
+			disconnected = r
+		}
+	}
+	if !participant(int(report.PeerId), p.UserID) || disconnected == nil || disconnected.UserID == p.UserID {
+		p.logger.Warn("unattributable player_disconnect",
+			zap.String("battle_code", report.BattleCode),
+			zap.Int32("peer_id", report.PeerId),
+			zap.Int32("disconnected_peer_id", report.DisconnectedPeerId))
+		return
+	}
+
+	reports, err := getDB().GetP2PReports(report.BattleCode)
+	if err != nil {
+		p.logger.Warn("GetP2PReports for disconnect", zap.Error(err))
+		return
+	}
+	var corroborator string
+	for _, r := range reports {
+		if r.UserID == p.UserID || r.UserID == disconnected.UserID || !participant(r.PeerID, r.UserID) {
+			continue
+		}
+		if strings.HasPrefix(r.CloseReason, "player_disconnect") && r.DisconnectedPeerID == int(report.DisconnectedPeerId) {
+			corroborator = r.UserID
+			break
+		}
+	}
+	if corroborator == "" {
+		p.logger.Info("player_disconnect not corroborated yet",
+			zap.String("battle_code", report.BattleCode),
+			zap.Int32("disconnected_peer_id", report.DisconnectedPeerId))
+		return
+	}
+
+	attributeDisconnect(&UserDisconnect{
+		BattleCode: report.BattleCode,
+		UserID:     disconnected.UserID,
+		Reason:     report.CloseReason,
+		Source:     "p2p",
+		Reporter:   p.UserID,
+	})
+}
+
+// attributeMcsDisconnect attributes the disconnect to the battle user who stopped sending to the mcs.
+// battleUsers are the users of the battle known to the lbs. When most of them were closed for the same reason,
+// the mcs or its network is more likely to be the cause, so nobody is blamed.
+func attributeMcsDisconnect(u *McsUser, battleUsers []*McsUser) {
+	if u.BattleCode == "" || u.UserID == "" || u.CloseReason != "sv_recv_timeout" {
+		return
+	}
+
+	total, shared := 1, 1
+	for _, x := range battleUsers {
+		if x.SessionID == u.SessionID || x.BattleCode != u.BattleCode {
+			continue
+		}
+		total++
+		if x.CloseReason == u.CloseReason {
+			shared++
+		}
+	}
+	if total < 2*shared {
+		logger.Info("mcs disconnect not attributed",
+			zap.String("battle_code", u.BattleCode),
+			zap.String("user_id", u.UserID),
+			zap.String("reason", u.CloseReason),
+			zap.Int("shared", shared),
+			zap.Int("users", total))
+		return
+	}
+
+	attributeDisconnect(&UserDisconnect{
+		BattleCode: u.BattleCode,
+		UserID:     u.UserID,
+		Reason:     u.CloseReason,
+		Source:     "mcs",
+	})
+}
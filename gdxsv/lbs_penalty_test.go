@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	pb "gdxsv/gdxsv/proto"
+)
+
+func Test_calcDisconnectPenalty(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) time.Time { return now.Add(-d) }
+
+	d := calcDisconnectPenalty("U1", nil, now)
+	assertEq(t, 100, d.Reputation)
+	assertEq(t, false, d.InCooldown(now))
+
+	// The first disconnect is only a warning.
+	d = calcDisconnectPenalty("U1", []*UserDisconnect{
+		{Created: ago(time.Minute)},
+		{Created: ago(48 * time.Hour)},
+	}, now)
+	assertEq(t, 80, d.Reputation)
+	assertEq(t, 1, d.RecentDisconnects)
+	assertEq(t, false, d.InCooldown(now))
+
+	// The cooldown starts from the last disconnect.
+	d = calcDisconnectPenalty("U1", []*UserDisconnect{
+		{Created: ago(time.Minute)},
+		{Created: ago(time.Hour)},
+		{Created: ago(2 * time.Hour), Forgiven: true},
+		{Created: ago(31 * 24 * time.Hour)},
+	}, now)
+	assertEq(t, 80, d.Reputation)
+	assertEq(t, 2, d.RecentDisconnects)
+	assertEq(t, now.Add(4*time.Minute), d.CooldownUntil)
+	assertEq(t, true, d.InCooldown(now))
+	assertEq(t, false, d.InCooldown(now.Add(5*time.Minute)))
+
+	// The cooldown doesn't grow after the max.
+	var many []*UserDisconnect
+	for i := 0; i < 12; i++ {
+		many = append(many, &UserDisconnect{Created: ago(time.Duration(i) * time.Minute)})
+	}
+	d = calcDisconnectPenalty("U1", many, now)
+	assertEq(t, 0, d.Reputation)
+	assertEq(t, now.Add(time.Hour), d.CooldownUntil)
+}
+
+func TestLbs_DisconnectPenalty(t *testing.T) {
+	cleanTables(t, "user_disconnect", "p2p_report")
+
+	lbs := NewLbs()
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	const lobbyID = uint16(2)
+	const battleCode = "penalty1"
+
+	cli1, cancel1 := prepareLoggedInUser(t, lbs, PlatformEmuX8664, GameDiskDC2, DBUser{UserID: "PEN1", Name: "PENNAME1"})
+	defer cancel1()
+	cli2, cancel2 := prepareLoggedInUser(t, lbs, PlatformEmuX8664, GameDiskDC2, DBUser{UserID: "PEN2", Name: "PENNAME2"})
+	defer cancel2()
+	cli3, cancel3 := prepareLoggedInUser(t, lbs, PlatformEmuX8664, GameDiskDC2, DBUser{UserID: "PEN3", Name: "PENNAME3"})
+	defer cancel3()
+	for i, cli := range []*TestLbsClient{cli1, cli2, cli3} {
+		must(t, getDB().AddBattleRecord(&BattleRecord{
+			BattleCode: battleCode,
+			UserID:     cli.UserID,
+			Disk:       GameDiskDC2,
+			Players:    3,
+			Aggregate:  1,
+			Pos:        i + 1,
+			Team:       i%2 + 1,
+		}))
+	}
+	waitForP2PReport := func(userID string, disconnectedPeerID int) {
+		waitFor(t, 2*time.Second, func() bool {
+			reports, err := getDB().GetP2PReports(battleCode)
+			must(t, err)
+			for _, r := range reports {
+				if r.UserID == userID && r.DisconnectedPeerID == disconnectedPeerID {
+					return true
+				}
+			}
+			return false
+		})
+	}
+	assertDisconnects := func(userID string, expected int) {
+		disconnects, err := getDB().GetUserDisconnects(userID, time.Now().Add(-time.Hour))
+		must(t, err)
+		assertEq(t, expected, len(disconnects))
+	}
+
+	// The reporter can't pretend to be another peer.
+	cli1.MustWriteMessage(p2pMatchingReportMsg(t, &pb.P2PMatchingReport{
+		BattleCode: battleCode, CloseReason: "player_disconnect", PlayerCount: 3, PeerId: 1, DisconnectedPeerId: 0,
+	}))
+	cli3.MustWriteMessage(p2pMatchingReportMsg(t, &pb.P2PMatchingReport{
+		BattleCode: battleCode, CloseReason: "player_disconnect", PlayerCount: 3, PeerId: 2, DisconnectedPeerId: 0,
+	}))
+	waitForP2PReport("PEN3", 0)
+	assertDisconnects("PEN1", 0)
+
+	// A single report is not enough.
+	cli1.MustWriteMessage(p2pMatchingReportMsg(t, &pb.P2PMatchingReport{
+		BattleCode: battleCode, CloseReason: "player_disconnect", PlayerCount: 3, PeerId: 0, DisconnectedPeerId: 1,
+	}))
+	waitForP2PReport("PEN1", 1)
+	assertDisconnects("PEN2", 0)
+
+	// The disconnect is attributed to the peer of disconnected_peer_id when another peer agrees.
+	cli3.MustWriteMessage(p2pMatchingReportMsg(t, &pb.P2PMatchingReport{
+		BattleCode: battleCode, CloseReason: "player_disconnect", PlayerCount: 3, PeerId: 2, DisconnectedPeerId: 1,
+	}))
+	waitFor(t, 2*time.Second, func() bool {
+		disconnects, err := getDB().GetUserDisconnects("PEN2", time.Now().Add(-time.Hour))
+		must(t, err)
+		return len(disconnects) == 1
+	})
+	assertDisconnects("PEN1", 0)
+	assertDisconnects("PEN3", 0)
+
+	// Nobody is blamed when most users of the battle timed out together.
+	timeout := func(sessionID, userID string) *McsUser {
+		return &McsUser{BattleCode: "penalty3", SessionID: sessionID, UserID: userID, CloseReason: "sv_recv_timeout"}
+	}
+	battleUsers := []*McsUser{timeout("s1", "PEN1"), timeout("s2", "PEN2"), timeout("s3", "PEN3")}
+	for _, u := range battleUsers {
+		attributeMcsDisconnect(u, battleUsers)
+	}
+	assertDisconnects("PEN1", 0)
+	assertDisconnects("PEN2", 1)
+
+	// The second disconnect starts the cooldown.
+	attributeMcsDisconnect(&McsUser{BattleCode: "penalty2", SessionID: "s2", UserID: "PEN2", CloseReason: "sv_recv_timeout"}, []*McsUser{
+		{BattleCode: "penalty2", SessionID: "s1", UserID: "PEN1", CloseReason: "cl_hard_quit"},
+		{BattleCode: "penalty2", SessionID: "s3", UserID: "PEN3"},
+	})
+	attributeMcsDisconnect(&McsUser{BattleCode: "penalty2", SessionID: "s1", UserID: "PEN1", CloseReason: "cl_hard_quit"}, nil)
+	assertDisconnects("PEN1", 0)
+	assertDisconnects("PEN2", 2)
+
+	forceEnterLobby(t, lbs, cli2, lobbyID, TeamZeon)
+	entry := &LbsMessage{Command: lbsLobbyMatchingEntry, Direction: ClientToServer, Category: CategoryQuestion, BodySize: 1, Body: hexbytes("01")}
+	cli2.MustWriteMessage(entry)
+	chat := cli2.MustReadMessageSkipNoticeUntil(lbsChatMessage)
+	assertEq(t, true, bytes.Contains(chat.Body, []byte("DISCONNECT PENALTY")))
+	AssertMsg(t,
+		&LbsMessage{Command: lbsLobbyMatchingEntry, Direction: ServerToClient, Category: CategoryAnswer, Status: StatusError},
+		cli2.MustReadMessageSkipNotice())
+	lbs.Locked(func(lbs *Lbs) {
+		assertEq(t, 0, len(lbs.FindPeer("PEN2").Lobby.EntryUsers))
+	})
+
+	// The penalized user can't enter a room, and a room with the penalized user can't be ready.
+	forceEnterLobby(t, lbs, cli1, lobbyID, TeamZeon)
+	forceEnterRoom(t, lbs, cli1, 1)
+	cli2.MustWriteMessage(&LbsMessage{Command: lbsRoomEntry, Direction: ClientToServer, Category: CategoryQuestion, BodySize: 4, Body: hexbytes("00010000")})
+	AssertMsg(t,
+		&LbsMessage{Command: lbsRoomEntry, Direction: ServerToClient, Category: CategoryAnswer, Status: StatusError},
+		cli2.MustReadMessageSkipNotice())
+	forceEnterRoom(t, lbs, cli2, 1)
+	cli1.MustWriteMessage(&LbsMessage{Command: lbsMatchingEntry, Direction: ClientToServer, Category: CategoryQuestion, BodySize: 1, Body: hexbytes("01")})
+	AssertMsg(t,
+		&LbsMessage{Command: lbsMatchingEntry, Direction: ServerToClient, Category: CategoryAnswer, Status: StatusError},
+		cli1.MustReadMessageSkipNotice())
+	lbs.Locked(func(lbs *Lbs) {
+		assertEq(t, false, lbs.FindPeer("PEN1").Room.IsReady())
+	})
+
+	// Ops can forgive a false positive.
+	n, err := getDB().ForgiveUserDisconnects("PEN2", "penalty2")
+	must(t, err)
+	assertEq(t, int64(1), n)
+	cli2.MustWriteMessage(entry)
+
+	// The remaining disconnect is only a warning. The penalty told by the room checks above comes first.
+	for !bytes.Contains(chat.Body, []byte("DISCONNECT WARNING")) {
+		chat = cli2.MustReadMessageSkipNoticeUntil(lbsChatMessage)
+	}
+	AssertMsg(t,
+		&LbsMessage{Command: lbsLobbyMatchingEntry, Direction: ServerToClient, Category: CategoryAnswer, Status: StatusSuccess},
+		cli2.MustReadMessageSkipNotice())
+	lbs.Locked(func(lbs *Lbs) {
+		assertEq(t, []string{"PEN2"}, lbs.FindPeer("PEN2").Lobby.EntryUsers)
+	})
+}
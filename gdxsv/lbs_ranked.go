@@ -0,0 +1,338 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const rankedPlayers = 4
+
+// RankedQueue matches players who entered lobby battle in ranked lobbies of a platform and a disk.
+// Unlike normal lobbies, the players are picked across lobbies so that a battle can start
+// even when the players are split across lobbies.
+type RankedQueue struct {
+	platform  string
+	disk      string
+	enteredAt map[string]time.Time
+}
+
+type rankedEntry struct {
+	peer      *LbsPeer
+	lobby     *LbsLobby
+	enteredAt time.Time
+	rating    int
+}
+
+func NewRankedQueue(platform, disk string) *RankedQueue {
+	return &RankedQueue{
+		platform:  platform,
+		disk:      disk,
+		enteredAt: make(map[string]time.Time),
+	}
+}
+
+// rankedRating returns the rating of the user used for matchmaking.
+// The win rate is smoothed so that a few battles do not make an extreme rating.
+func rankedRating(u *DBUser) int {
+	return 1000 * (u.WinCount + 10) / (u.WinCount + u.LoseCount + 20)
+}
+
+// rankedWiden returns the value widened by the wait time.
+func rankedWiden(initial, max int, wait time.Duration) int {
+	rconf := getReloadableConfig()
+	v := initial * (1 + int(wait/rconf.RankedWidenInterval))
+	if max < v {
+		v = max
+	}
+	return v
+}
+
+// rankedCommonRegion returns a region whose RTT is within the limit from every peer.
+// Peers without RTT information are considered to be compatible with any region.
+func rankedCommonRegion(peers []*LbsPeer, rttLimit int) (string, bool) {
+	known := false
+	bestRegion := ""
+	bestRtt := 0
+
+	for _, region := range getRegionCatalog().IDs() {
+		maxRtt := 0
+		ok := true
+		for _, p := range peers {
+			rtt, err := strconv.Atoi(p.PlatformInfo[region])
+			if err != nil || rtt <= 0 {
+				continue
+			}
+			known = true
+			if rttLimit < rtt {
+				ok = false
+				break
+			}
+			if maxRtt < rtt {
+				maxRtt = rtt
+			}
+		}
+		if ok && 0 < maxRtt && (bestRegion == "" || maxRtt < bestRtt || (maxRtt == bestRtt && region < bestRegion)) {
+			bestRegion = region
+			bestRtt = maxRtt
+		}
+	}
+
+	return bestRegion, !known || bestRegion != ""
+}
+
+// rankedTeams returns teams of the peers that minimize the rating difference between the teams.
+func rankedTeams(entries []*rankedEntry) []uint16 {
+	var best []uint16
+	bestDiff := -1
+	// The first player is always Renpo, the partner is one of the others.
+	for partner := 1; partner < len(entries); partner++ {
+		teams := make([]uint16, len(entries))
+		diff := 0
+		for i, e := range entries {
+			if i == 0 || i == partner {
+				teams[i] = TeamRenpo
+				diff += e.rating
+			} else {
+				teams[i] = TeamZeon
+				diff -= e.rating
+			}
+		}
+		if diff < 0 {
+			diff = -diff
+		}
+		if bestDiff < 0 || diff < bestDiff {
+			best, bestDiff = teams, diff
+		}
+	}
+	return best
+}
+
+// collect returns the entries of the queue, the longest waiting entry comes first.
+func (q *RankedQueue) collect(lbs *Lbs, now time.Time) []*rankedEntry {
+	var entries []*rankedEntry
+	queued := map[string]bool{}
+
+	for _, lobby := range lbs.lobbies[lobbyKey(q.platform, q.disk)] {
+		if lobby.retired || !lobby.LobbySetting.RankedQueue {
+			continue
+		}
+		for _, userID := range lobby.EntryUsers {
+			p := lbs.FindPeer(userID)
+			if p == nil || p.Battle != nil {
+				continue
+			}
+			if _, ok := q.enteredAt[userID]; !ok {
+				q.enteredAt[userID] = now
+			}
+			queued[userID] = true
+			entries = append(entries, &rankedEntry{
+				peer:      p,
+				lobby:     lobby,
+				enteredAt: q.enteredAt[userID],
+				rating:    rankedRating(&p.DBUser),
+			})
+		}
+	}
+
+	for userID := range q.enteredAt {
+		if !queued[userID] {
+			delete(q.enteredAt, userID)
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].enteredAt.Equal(entries[j].enteredAt) {
+			return entries[i].peer.UserID < entries[j].peer.UserID
+		}
+		return entries[i].enteredAt.Before(entries[j].enteredAt)
+	})
+	return entries
+}
+
+// rankedCompatible returns true if the players of the lobbies can play in the same battle.
+// The battle is played with the rule and the patches of the host lobby, so they must be the same.
+func rankedCompatible(a, b *LbsLobby) bool {
+	return a.Rule == b.Rule &&
+		a.LobbySetting.PatchNames == b.LobbySetting.PatchNames &&
+		a.LobbySetting.McsRegion == b.LobbySetting.McsRegion
+}
+
+// findGroup finds players who can play with the anchor, the longest waiting player.
+func findGroup(anchor *rankedEntry, candidates []*rankedEntry, now time.Time) []*rankedEntry {
+	rconf := getReloadableConfig()
+	wait := now.Sub(anchor.enteredAt)
+	band := rankedWiden(rconf.RankedRatingBand, rconf.RankedRatingBandMax, wait)
+	rttLimit := rankedWiden(rconf.RankedRttLimit, rconf.RankedRttLimitMax, wait)
+
+	// The battle is hosted in the lobby of the anchor, so everyone must support p2p in a p2p lobby.
+	p2p := anchor.lobby.LobbySetting.McsRegion == "p2p"
+	if p2p && !supportsP2P(anchor.peer) {
+		return nil
+	}
+
+	distance := func(e *rankedEntry) int {
+		if e.rating < anchor.rating {
+			return anchor.rating - e.rating
+		}
+		return e.rating - anchor.rating
+	}
+
+	var sorted []*rankedEntry
+	for _, e := range candidates {
+		if e == anchor {
+			continue
+		}
+		if band < distance(e) {
+			continue
+		}
+		if !rankedCompatible(anchor.lobby, e.lobby) {
+			continue
+		}
+		if p2p && !supportsP2P(e.peer) {
+			continue
+		}
+		sorted = append(sorted, e)
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return distance(sorted[i]) < distance(sorted[j])
+	})
+
+	group := []*rankedEntry{anchor}
+	peers := []*LbsPeer{anchor.peer}
+	for _, e := range sorted {
+		if _, ok := rankedCommonRegion(append(peers, e.peer), rttLimit); !ok {
+			continue
+		}
+		group = append(group, e)
+		peers = append(peers, e.peer)
+		if len(group) == rankedPlayers {
+			return group
+		}
+	}
+	return nil
+}
+
+// Update starts battles for the players that can be matched, should be called every 1 sec in the event loop.
+func (q *RankedQueue) Update(lbs *Lbs, now time.Time) {
+	entries := q.collect(lbs, now)
+
+	for rankedPlayers <= len(entries) {
+		var group []*rankedEntry
+		for _, anchor := range entries {
+			if group = findGroup(anchor, entries, now); group != nil {
+				break
+			}
+		}
+		if group == nil {
+			return
+		}
+
+		if !q.startBattle(group, now) {
+			return
+		}
+
+		picked := map[*rankedEntry]bool{}
+		for _, e := range group {
+			picked[e] = true
+			delete(q.enteredAt, e.peer.UserID)
+		}
+		var rest []*rankedEntry
+		for _, e := range entries {
+			if !picked[e] {
+				rest = append(rest, e)
+			}
+		}
+		entries = rest
+	}
+}
+
+// startBattle starts a battle in the lobby of the longest waiting player.
+func (q *RankedQueue) startBattle(group []*rankedEntry, now time.Time) bool {
+	host := group[0].lobby
+
+	// Teams are decided first so that the region is selected fairly for the teams.
+	lobbies := map[*LbsLobby]bool{}
+	origTeams := map[*LbsPeer]uint16{}
+	teams := rankedTeams(group)
+	for i, e := range group {
+		lobbies[e.lobby] = true
+		origTeams[e.peer] = e.peer.Team
+		e.peer.Team = teams[i]
+	}
+	sort.SliceStable(group, func(i, j int) bool {
+		return group[i].peer.Team < group[j].peer.Team
+	})
+
+	var peers []*LbsPeer
+	for _, e := range group {
+		peers = append(peers, e.peer)
+	}
+
+	// Nobody is picked on failure so that the group is reconsidered next time.
+	var b *LbsBattle
+	restore := func() {
+		for p, team := range origTeams {
+			p.Team = team
+			if b != nil && p.Battle == b {
+				p.Battle = nil
+			}
+		}
+	}
+
+	mcsRegion, mcsPeer, mcsAddr, startNow, alloc, decision := host.prepareMcs(host.LobbySetting.McsRegion, peers)
+	if !startNow {
+		restore()
+		if alloc {
+			for l := range lobbies {
+				l.NotifyLobbyEvent("", "Allocating game server...")
+			}
+		}
+		return false
+	}
+
+	rule := host.Rule
+	b = NewBattle(host.app, host.ID, &rule, mcsRegion, mcsAddr)
+	if b == nil {
+		restore()
+		return false
+	}
+	b.RegionDecision = decision
+
+	if !host.setupBattle(b, peers, mcsPeer, mcsAddr, host.Rule.NoRanking != 1) {
+		restore()
+		return false
+	}
+
+	var waits []string
+	for _, e := range group {
+		waits = append(waits, fmt.Sprintf("%s:%d:%v", e.peer.UserID, e.rating, now.Sub(e.enteredAt).Truncate(time.Second)))
+		e.lobby.EntryPicked(e.peer)
+		e.lobby.NotifyLobbyEvent("GO BATTLE", fmt.Sprintf("【%v】%v", e.peer.UserID, e.peer.Name))
+		// The team is decided by the ratings, so tell the player if it is not the chosen one.
+		if origTeams[e.peer] != e.peer.Team {
+			team := "Renpo"
+			if e.peer.Team == TeamZeon {
+				team = "Zeon"
+			}
+			e.peer.SendMessage(chatMsg("", "", "RANKED MATCH: You play as "+team+" in this battle"))
+		}
+	}
+
+	logger.Info("ranked match",
+		zap.String("platform", q.platform),
+		zap.String("disk", q.disk),
+		zap.String("battle_code", b.BattleCode),
+		zap.Int("lobby_id", int(host.ID)),
+		zap.String("mcs_region", mcsRegion),
+		zap.Strings("players", waits))
+
+	for l := range lobbies {
+		l.app.BroadcastLobbyUserCount(l)
+		l.app.BroadcastLobbyMatchEntryUserCount(l)
+	}
+	return true
+}
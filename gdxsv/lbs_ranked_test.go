@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_rankedTeams(t *testing.T) {
+	entries := []*rankedEntry{{rating: 700}, {rating: 650}, {rating: 400}, {rating: 300}}
+	// 700+300 vs 650+400
+	assertEq(t, []uint16{TeamRenpo, TeamZeon, TeamZeon, TeamRenpo}, rankedTeams(entries))
+}
+
+func Test_rankedCommonRegion(t *testing.T) {
+	origCatalog := regionCatalog.Load()
+	defer regionCatalog.Store(origCatalog)
+	regionCatalog.Store(NewRegionCatalog([]*MRegion{
+		{ID: "asia-northeast1", Name: "Tokyo", Enabled: true},
+		{ID: "us-west1", Name: "Oregon", Enabled: true},
+	}))
+
+	tokyo := &LbsPeer{PlatformInfo: map[string]string{"asia-northeast1": "20", "us-west1": "120"}}
+	oregon := &LbsPeer{PlatformInfo: map[string]string{"asia-northeast1": "110", "us-west1": "30"}}
+	unknown := &LbsPeer{PlatformInfo: map[string]string{}}
+
+	tests := []struct {
+		name       string
+		peers      []*LbsPeer
+		rttLimit   int
+		wantRegion string
+		wantOk     bool
+	}{
+		{"same region", []*LbsPeer{tokyo, tokyo}, 80, "asia-northeast1", true},
+		{"far regions", []*LbsPeer{tokyo, oregon}, 80, "", false},
+		{"widened limit", []*LbsPeer{tokyo, oregon}, 120, "asia-northeast1", true},
+		{"unknown rtt", []*LbsPeer{oregon, unknown}, 80, "us-west1", true},
+		{"all unknown", []*LbsPeer{unknown, unknown}, 80, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			region, ok := rankedCommonRegion(tt.peers, tt.rttLimit)
+			assertEq(t, tt.wantRegion, region)
+			assertEq(t, tt.wantOk, ok)
+		})
+	}
+}
+
+func enterRankedQueue(lbs *Lbs, lobby *LbsLobby, userID string, win, lose int) *LbsPeer {
+	p := &LbsPeer{
+		DBUser:       DBUser{UserID: userID, Name: userID, WinCount: win, LoseCount: lose},
+		app:          lbs,
+		Platform:     lobby.Platform,
+		GameDisk:     lobby.GameDisk,
+		Team:         TeamRenpo,
+		Lobby:        lobby,
+		PlatformInfo: map[string]string{},
+		logger:       zap.NewNop(),
+		chWrite:      make(chan bool, 1),
+	}
+	lbs.userPeers[userID] = p
+	lobby.Users[userID] = &p.DBUser
+	lobby.EntryUsers = append(lobby.EntryUsers, userID)
+	return p
+}
+
+func TestRankedQueue_Update(t *testing.T) {
+	lbs := NewLbs()
+	rconf := getReloadableConfig()
+
+	lobby1 := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 1)
+	lobby2 := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 2)
+	lobby1.LobbySetting.RankedQueue = true
+	lobby2.LobbySetting.RankedQueue = true
+
+	enter := func(lobby *LbsLobby, userID string, win, lose int) *LbsPeer {
+		return enterRankedQueue(lbs, lobby, userID, win, lose)
+	}
+	defer func() {
+		for userID := range lbs.userPeers {
+			delete(lbs.userPeers, userID)
+		}
+	}()
+
+	q := lbs.rankedQueues[lobbyKey(PlatformEmuX8664, GameDiskPS2)]
+	now := time.Now()
+
+	// 3 players of similar rating are split across lobbies, 1 player is much stronger.
+	p1 := enter(lobby1, "RANKED01", 50, 50)
+	p2 := enter(lobby2, "RANKED02", 55, 50)
+	p3 := enter(lobby2, "RANKED03", 45, 50)
+	p4 := enter(lobby1, "RANKED04", 250, 20)
+
+	q.Update(lbs, now)
+	assertEq(t, 4, len(q.enteredAt))
+	assertEq(t, (*LbsBattle)(nil), p1.Battle)
+
+	// The rating band is widened while waiting.
+	q.Update(lbs, now.Add(rconf.RankedWidenInterval*3))
+	assertEq(t, 0, len(q.enteredAt))
+	for _, p := range []*LbsPeer{p1, p2, p3, p4} {
+		if p.Battle == nil {
+			t.Fatal("battle not started", p.UserID)
+		}
+		assertEq(t, p1.Battle, p.Battle)
+	}
+	assertEq(t, lobby1.ID, p1.Battle.LobbyID)
+	assertEq(t, 0, len(lobby1.EntryUsers))
+	assertEq(t, 0, len(lobby2.EntryUsers))
+
+	// The strongest player and the weakest player are teamed up.
+	assertEq(t, p4.Team, p3.Team)
+	assertEq(t, p1.Team, p2.Team)
+	if p1.Team == p4.Team {
+		t.Fatal("teams are not balanced")
+	}
+
+	// The players moved to Zeon are told.
+	for _, p := range []*LbsPeer{p1, p2, p3, p4} {
+		assertEq(t, p.Team == TeamZeon, bytes.Contains(p.outbuf, []byte("RANKED MATCH")))
+	}
+}
+
+func TestRankedQueue_LobbySettings(t *testing.T) {
+	lbs := NewLbs()
+	defer func() {
+		for userID := range lbs.userPeers {
+			delete(lbs.userPeers, userID)
+		}
+	}()
+
+	lobby1 := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 1)
+	lobby2 := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 2)
+	lobby1.LobbySetting.RankedQueue = true
+	lobby2.LobbySetting.RankedQueue = true
+	lobby2.Rule.Timer = 2
+
+	var peers []*LbsPeer
+	for i, lobby := range []*LbsLobby{lobby1, lobby1, lobby2, lobby2} {
+		peers = append(peers, enterRankedQueue(lbs, lobby, fmt.Sprintf("RANKEDL%d", i), 50, 50))
+	}
+
+	// Players of lobbies with different rules are not matched with each other.
+	q := lbs.rankedQueues[lobbyKey(PlatformEmuX8664, GameDiskPS2)]
+	now := time.Now()
+	q.Update(lbs, now)
+	for _, p := range peers {
+		assertEq(t, (*LbsBattle)(nil), p.Battle)
+	}
+
+	lobby2.Rule = lobby1.Rule
+	q.Update(lbs, now)
+	for _, p := range peers {
+		if p.Battle == nil {
+			t.Fatal("battle not started", p.UserID)
+		}
+	}
+}
+
+func TestRankedQueue_PlatformAndP2P(t *testing.T) {
+	lbs := NewLbs()
+	defer func() {
+		for userID := range lbs.userPeers {
+			delete(lbs.userPeers, userID)
+		}
+	}()
+
+	console := lbs.GetLobby(PlatformConsole, GameDiskPS2, 1)
+	emu := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 1)
+	console.LobbySetting.RankedQueue = true
+	emu.LobbySetting.RankedQueue = true
+	emu.LobbySetting.McsRegion = "p2p"
+
+	// Players of different platforms are not matched with each other.
+	var peers []*LbsPeer
+	peers = append(peers, enterRankedQueue(lbs, console, "RANKEDC1", 50, 50))
+	peers = append(peers, enterRankedQueue(lbs, console, "RANKEDC2", 50, 50))
+	for _, id := range []string{"RANKEDE1", "RANKEDE2", "RANKEDE3"} {
+		p := enterRankedQueue(lbs, emu, id, 50, 50)
+		p.udpAddr = net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 20010}
+		peers = append(peers, p)
+	}
+
+	// The player without p2p address can not join the p2p battle.
+	noAddr := enterRankedQueue(lbs, emu, "RANKEDE4", 50, 50)
+
+	now := time.Now()
+	for _, q := range lbs.rankedQueues {
+		q.Update(lbs, now)
+	}
+	for _, p := range append(peers, noAddr) {
+		assertEq(t, (*LbsBattle)(nil), p.Battle)
+	}
+
+	noAddr.udpAddr = net.UDPAddr{IP: net.IPv4(192, 0, 2, 4), Port: 20010}
+	for _, q := range lbs.rankedQueues {
+		q.Update(lbs, now)
+	}
+	assertEq(t, (*LbsBattle)(nil), peers[0].Battle)
+	assertEq(t, (*LbsBattle)(nil), peers[1].Battle)
+	for _, p := range append(peers[2:], noAddr) {
+		if p.Battle == nil {
+			t.Fatal("battle not started", p.UserID)
+		}
+		assertEq(t, "p2p", p.Battle.McsRegion)
+	}
+}
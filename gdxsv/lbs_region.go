@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const unreachableRtt = 999
+
+// RegionWeights are the weights of each factor to score a battle server region.
+// A region with lower score is preferred.
+type RegionWeights struct {
+	MaxRtt     float64 `json:"max_rtt"`     // per millisecond of the worst player's RTT
+	TeamSpread float64 `json:"team_spread"` // per millisecond of the difference of average RTT between the teams
+	Alloc      float64 `json:"alloc"`       // added when no mcs is running in the region
+}
+
+var defaultRegionWeights = RegionWeights{
+	MaxRtt:     1.0,
+	TeamSpread: 0.5,
+	Alloc:      20,
+}
+
+// parseRegionWeights parses weights such as "max_rtt=1,team_spread=0.5,alloc=20".
+// Omitted weights are the default value.
+func parseRegionWeights(s string) (RegionWeights, error) {
+	w := defaultRegionWeights
+	if strings.TrimSpace(s) == "" {
+		return w, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return w, fmt.Errorf("invalid region weight %q", kv)
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 {
+			return w, fmt.Errorf("invalid region weight %q", kv)
+		}
+		switch k {
+		case "max_rtt":
+			w.MaxRtt = f
+		case "team_spread":
+			w.TeamSpread = f
+		case "alloc":
+			w.Alloc = f
+		default:
+			return w, fmt.Errorf("unknown region weight %q", k)
+		}
+	}
+	return w, nil
+}
+
+// RegionScore is the evaluation of a candidate region.
+type RegionScore struct {
+	Region     string  `json:"region"`
+	Live       bool    `json:"live"`
+	MaxRtt     int     `json:"max_rtt"`
+	TeamSpread int     `json:"team_spread"`
+	Score      float64 `json:"score"`
+}
+
+// RegionDecision is the result of the battle server region selection.
+type RegionDecision struct {
+	Region     string         `json:"region"`
+	Weights    RegionWeights  `json:"weights"`
+	Candidates []*RegionScore `json:"candidates"`
+	DecidedAt  time.Time      `json:"decided_at"`
+}
+
+// mcsRegionCandidates returns regions that a battle can be hosted.
+// The value is true if a mcs is running in the region, false if a mcs can be allocated.
+func (lbs *Lbs) mcsRegionCandidates() map[string]bool {
+	candidates := map[string]bool{}
+	for _, region := range getRegionCatalog().IDs() {
+		if lbs.FindMcs(region) != nil {
+			candidates[region] = true
+		} else if lbs.mcsAllocatable(region) {
+			candidates[region] = false
+		} else if lbs.findMcsOverCapacity(region, nil) != nil {
+			candidates[region] = true
+		}
+	}
+	return candidates
+}
+
+func peerRtt(p *LbsPeer, region string) int {
+	rtt, err := strconv.Atoi(p.PlatformInfo[region])
+	if rtt <= 0 || err != nil {
+		return unreachableRtt
+	}
+	return rtt
+}
+
+// decideMcsRegion scores the candidates by the worst RTT and the RTT difference between the teams.
+// Regions that are unreachable from any of the peers are not selected.
+// The peers must be in the teams of the battle, and unknown RTTs are not counted in the difference.
+func decideMcsRegion(candidates map[string]bool, peers []*LbsPeer, w RegionWeights) (*RegionDecision, error) {
+	decision := &RegionDecision{
+		Weights:   w,
+		DecidedAt: time.Now(),
+	}
+
+	for region, live := range candidates {
+		s := &RegionScore{Region: region, Live: live}
+
+		sum := map[uint16]int{}
+		cnt := map[uint16]int{}
+		for _, p := range peers {
+			rtt := peerRtt(p, region)
+			if s.MaxRtt < rtt {
+				s.MaxRtt = rtt
+			}
+			if rtt < unreachableRtt {
+				sum[p.Team] += rtt
+				cnt[p.Team]++
+			}
+		}
+
+		if 0 < cnt[TeamRenpo] && 0 < cnt[TeamZeon] {
+			s.TeamSpread = sum[TeamRenpo]/cnt[TeamRenpo] - sum[TeamZeon]/cnt[TeamZeon]
+			if s.TeamSpread < 0 {
+				s.TeamSpread = -s.TeamSpread
+			}
+		}
+
+		s.Score = w.MaxRtt*float64(s.MaxRtt) + w.TeamSpread*float64(s.TeamSpread)
+		if !live {
+			s.Score += w.Alloc
+		}
+		decision.Candidates = append(decision.Candidates, s)
+	}
+
+	sort.Slice(decision.Candidates, func(i, j int) bool {
+		a, b := decision.Candidates[i], decision.Candidates[j]
+		if a.Score != b.Score {
+			return a.Score < b.Score
+		}
+		return a.Region < b.Region
+	})
+
+	for _, s := range decision.Candidates {
+		if s.MaxRtt < unreachableRtt {
+			decision.Region = s.Region
+			return decision, nil
+		}
+	}
+
+	return decision, fmt.Errorf("no available region")
+}
+
+func (l *LbsLobby) regionWeights() RegionWeights {
+	if l.master == nil {
+		return defaultRegionWeights
+	}
+	return l.master.RegionWeights
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"testing"
+)
+
+func Test_parseRegionWeights(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    RegionWeights
+		wantErr bool
+	}{
+		{"empty", "", defaultRegionWeights, false},
+		{"partial", "team_spread=2", RegionWeights{MaxRtt: 1, TeamSpread: 2, Alloc: 20}, false},
+		{"all", "max_rtt=0.5, team_spread=1, alloc=0", RegionWeights{MaxRtt: 0.5, TeamSpread: 1, Alloc: 0}, false},
+		{"unknown key", "foo=1", defaultRegionWeights, true},
+		{"negative", "alloc=-1", defaultRegionWeights, true},
+		{"not a number", "alloc=a", defaultRegionWeights, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRegionWeights(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr {
+				assertEq(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func Test_decideMcsRegion_Fairness(t *testing.T) {
+	// Renpo players are close to Tokyo, Zeon players are close to Osaka.
+	peers := []*LbsPeer{
+		{Team: TeamRenpo, PlatformInfo: map[string]string{"asia-northeast1": "10", "asia-northeast2": "40", "asia-east1": "55"}},
+		{Team: TeamRenpo, PlatformInfo: map[string]string{"asia-northeast1": "10", "asia-northeast2": "40", "asia-east1": "55"}},
+		{Team: TeamZeon, PlatformInfo: map[string]string{"asia-northeast1": "50", "asia-northeast2": "15", "asia-east1": "50"}},
+		{Team: TeamZeon, PlatformInfo: map[string]string{"asia-northeast1": "50", "asia-northeast2": "15", "asia-east1": "50"}},
+	}
+	allocatable := map[string]bool{"asia-northeast1": false, "asia-northeast2": false, "asia-east1": false}
+
+	tests := []struct {
+		name       string
+		candidates map[string]bool
+		weights    RegionWeights
+		want       string
+	}{
+		{"worst rtt only", allocatable, RegionWeights{MaxRtt: 1}, "asia-northeast2"},
+		// asia-northeast1: 50+0.5*40=70, asia-northeast2: 40+0.5*25=52.5, asia-east1: 55+0.5*5=57.5
+		{"default weights", allocatable, defaultRegionWeights, "asia-northeast2"},
+		// asia-east1: 55+2*5=65, asia-northeast2: 40+2*25=90
+		{"fairness first", allocatable, RegionWeights{MaxRtt: 1, TeamSpread: 2}, "asia-east1"},
+		{"live mcs only", map[string]bool{"asia-northeast1": true}, defaultRegionWeights, "asia-northeast1"},
+		// asia-northeast1 has a live mcs: 70 vs asia-northeast2: 52.5+20
+		{"live mcs is preferred", map[string]bool{"asia-northeast1": true, "asia-northeast2": false}, defaultRegionWeights, "asia-northeast1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision, err := decideMcsRegion(tt.candidates, peers, tt.weights)
+			must(t, err)
+			assertEq(t, tt.want, decision.Region)
+			assertEq(t, len(tt.candidates), len(decision.Candidates))
+			assertEq(t, tt.want, decision.Candidates[0].Region)
+		})
+	}
+
+	t.Run("unknown rtt", func(t *testing.T) {
+		unknown := []*LbsPeer{peers[0], peers[1], peers[2], {Team: TeamZeon, PlatformInfo: map[string]string{"asia-northeast1": "50"}}}
+		decision, err := decideMcsRegion(allocatable, unknown, defaultRegionWeights)
+		must(t, err)
+		assertEq(t, "asia-northeast1", decision.Region)
+		for _, c := range decision.Candidates {
+			if c.Region == "asia-east1" {
+				// The unknown RTT is not counted in the difference between the teams.
+				assertEq(t, unreachableRtt, c.MaxRtt)
+				assertEq(t, 5, c.TeamSpread)
+			}
+		}
+	})
+
+	t.Run("no candidates", func(t *testing.T) {
+		decision, err := decideMcsRegion(map[string]bool{}, peers, defaultRegionWeights)
+		if err == nil {
+			t.Fatal("error expected")
+		}
+		assertEq(t, "", decision.Region)
+	})
+}
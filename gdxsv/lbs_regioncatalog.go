@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"go.uber.org/zap"
+)
+
+const RegionProviderGCP = "gcp"
+
+// builtinRegions is the region catalog used when m_region has no rows.
+var builtinRegions = []*MRegion{
+	{ID: "asia-east1", Name: "Changhua County, Taiwan", Group: "asia-east", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "asia-east2", Name: "Hong Kong", Group: "asia-east", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "asia-northeast1", Name: "Tokyo, Japan", Group: "asia-northeast", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "asia-northeast2", Name: "Osaka, Japan", Group: "asia-northeast", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "asia-northeast3", Name: "Seoul, South Korea", Group: "asia-northeast", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "asia-south1", Name: "Mumbai, India", Group: "asia-south", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "asia-southeast1", Name: "Jurong West, Singapore", Group: "asia-southeast", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "australia-southeast1", Name: "Sydney, Australia", Group: "australia-southeast", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "europe-north1", Name: "Hamina, Finland", Group: "europe-north", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "europe-west1", Name: "St. Ghislain, Belgium", Group: "europe-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "europe-west2", Name: "London, England, UK", Group: "europe-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "europe-west3", Name: "Frankfurt, Germany", Group: "europe-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "europe-west4", Name: "Eemshaven, Netherlands", Group: "europe-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "europe-west6", Name: "Zurich, Switzerland", Group: "europe-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "northamerica-northeast1", Name: "Montreal, Quebec, Canada", Group: "northamerica-northeast", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "southamerica-east1", Name: "Osasco (Sao Paulo), Brazil", Group: "southamerica-east", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "us-central1", Name: "Council Bluffs, Iowa, USA", Group: "us-central", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "us-east1", Name: "Moncks Corner, South Carolina, USA", Group: "us-east", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "us-east4", Name: "Ashburn, Northern Virginia, USA", Group: "us-east", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "us-west1", Name: "The Dalles, Oregon, USA", Group: "us-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "us-west2", Name: "Los Angeles, California, USA", Group: "us-west", Provider: RegionProviderGCP, Enabled: true},
+	{ID: "us-west3", Name: "Salt Lake City, Utah, USA", Group: "us-west", Provider: RegionProviderGCP, Enabled: true},
+}
+
+var builtinRegionCatalog = NewRegionCatalog(builtinRegions)
+
+// RegionCatalog is the set of enabled battle server regions.
+// A region id is also the key of the RTT in the PlatformInfo sent by clients.
+type RegionCatalog struct {
+	regions map[string]*MRegion
+	ids     []string
+}
+
+func NewRegionCatalog(regions []*MRegion) *RegionCatalog {
+	c := &RegionCatalog{regions: map[string]*MRegion{}}
+	for _, r := range regions {
+		if !r.Enabled {
+			continue
+		}
+		c.regions[r.ID] = r
+		c.ids = append(c.ids, r.ID)
+	}
+	sort.Strings(c.ids)
+	return c
+}
+
+// Get returns the region if it is enabled.
+func (c *RegionCatalog) Get(id string) (*MRegion, bool) {
+	r, ok := c.regions[id]
+	return r, ok
+}
+
+// IDs returns ids of the enabled regions in sorted order.
+func (c *RegionCatalog) IDs() []string {
+	return c.ids
+}
+
+// ProviderIDs returns ids of the enabled regions of the provider in sorted order.
+func (c *RegionCatalog) ProviderIDs(provider string) []string {
+	var ids []string
+	for _, id := range c.ids {
+		if c.regions[id].Provider == provider {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Name returns the display name of the region.
+func (c *RegionCatalog) Name(id string) (string, bool) {
+	if r, ok := c.regions[id]; ok {
+		return r.Name, true
+	}
+	return "", false
+}
+
+// Group returns the group of the region that is used to pair players in near regions.
+func (c *RegionCatalog) Group(id string) (string, bool) {
+	if r, ok := c.regions[id]; ok && r.Group != "" {
+		return r.Group, true
+	}
+	return "", false
+}
+
+var regionCatalog atomic.Pointer[RegionCatalog]
+
+// getRegionCatalog returns the region catalog, the built-in one is returned until the catalog is loaded.
+func getRegionCatalog() *RegionCatalog {
+	if c := regionCatalog.Load(); c != nil {
+		return c
+	}
+	return builtinRegionCatalog
+}
+
+// loadRegionCatalog loads the region catalog from m_region.
+// The built-in catalog is used when m_region has no rows.
+func loadRegionCatalog() (*RegionCatalog, error) {
+	regions, err := getDB().GetRegions()
+	if err != nil {
+		return nil, err
+	}
+	if len(regions) == 0 {
+		return builtinRegionCatalog, nil
+	}
+	for _, r := range regions {
+		switch r.ID {
+		case "", "best", "p2p":
+			return nil, fmt.Errorf("invalid region id %q", r.ID)
+		}
+	}
+	return NewRegionCatalog(regions), nil
+}
+
+// reloadRegionCatalog loads the region catalog and applies it.
+func reloadRegionCatalog() error {
+	c, err := loadRegionCatalog()
+	if err != nil {
+		return err
+	}
+	regionCatalog.Store(c)
+	logger.Info("region catalog loaded", zap.Strings("regions", c.IDs()))
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLbs_ReloadLobbySettings_RegionCatalog(t *testing.T) {
+	cleanTables(t, "m_lobby_setting", "m_region")
+	defer cleanTables(t, "m_lobby_setting", "m_region")
+	defer regionCatalog.Store(regionCatalog.Load())
+
+	lbs := NewLbs()
+	assertEq(t, builtinRegionCatalog, getRegionCatalog())
+	assertEq(t, len(builtinRegions), len(getRegionCatalog().ProviderIDs(RegionProviderGCP)))
+
+	mustInsertMRegion(MRegion{ID: "asia-northeast1", Name: "Tokyo, Japan", Group: "asia-northeast", Provider: RegionProviderGCP, Enabled: true})
+	mustInsertMRegion(MRegion{ID: "home-osaka", Name: "Osaka Home Server", Group: "asia-northeast", Provider: "self", Enabled: true})
+	mustInsertMRegion(MRegion{ID: "us-west1", Name: "The Dalles, Oregon, USA", Group: "us-west", Provider: RegionProviderGCP, Enabled: false})
+	mustInsertMLobbySetting(MLobbySetting{
+		Platform:  PlatformConsole,
+		Disk:      GameDiskDC2,
+		No:        2,
+		McsRegion: "home-osaka",
+	})
+
+	_, errs := lbs.ReloadLobbySettings()
+	assertEq(t, 0, len(errs))
+
+	catalog := getRegionCatalog()
+	assertEq(t, []string{"asia-northeast1", "home-osaka"}, catalog.IDs())
+	assertEq(t, []string{"asia-northeast1"}, catalog.ProviderIDs(RegionProviderGCP))
+	name, _ := catalog.Name("home-osaka")
+	assertEq(t, "Osaka Home Server", name)
+	group, _ := catalog.Group("home-osaka")
+	assertEq(t, "asia-northeast", group)
+	_, ok := catalog.Get("us-west1")
+	assertEq(t, false, ok)
+
+	t.Run("disabled region is rejected", func(t *testing.T) {
+		mustInsertMLobbySetting(MLobbySetting{
+			Platform:  PlatformConsole,
+			Disk:      GameDiskDC2,
+			No:        3,
+			McsRegion: "us-west1",
+		})
+		_, errs := lbs.ReloadLobbySettings()
+		assertEq(t, 1, len(errs))
+		// The previous catalog is kept.
+		assertEq(t, catalog, getRegionCatalog())
+	})
+
+	t.Run("rollback restores the previous catalog", func(t *testing.T) {
+		cleanTables(t, "m_lobby_setting", "m_region")
+		mustInsertMRegion(MRegion{ID: "home-kyoto", Name: "Kyoto Home Server", Group: "asia-northeast", Provider: "self", Enabled: true})
+		_, errs := lbs.ReloadLobbySettings()
+		assertEq(t, 0, len(errs))
+		assertEq(t, []string{"home-kyoto"}, getRegionCatalog().IDs())
+
+		_, err := lbs.RollbackLobbySettings()
+		must(t, err)
+		assertEq(t, catalog, getRegionCatalog())
+		assertEq(t, "home-osaka", lbs.GetLobby(PlatformConsole, GameDiskDC2, 2).LobbySetting.McsRegion)
+	})
+}
@@ -113,6 +113,7 @@ func (r *LbsRoom) Remove() {
 		}
 	}
 	*r = *NewRoom(r.app, r.Platform, r.GameDisk, r.lobby, r.ID, r.Team)
+	r.lobby.removeExtraRoom(r)
 }
 
 func (r *LbsRoom) Ready(u *LbsPeer, enable uint8) {
@@ -122,3 +122,39 @@ func TestLbsRoom_Remove(t *testing.T) {
 	assertEq(t, "", room.Owner)
 	assertEq(t, "", room.Name)
 }
+
+func TestLbsRoom_RemoveExtraRoom(t *testing.T) {
+	lbs := NewLbs()
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	lobby := &LbsLobby{
+		app:        lbs,
+		Users:      make(map[string]*DBUser),
+		RenpoRooms: make(map[uint16]*LbsRoom),
+		ZeonRooms:  make(map[uint16]*LbsRoom),
+		EntryUsers: make([]string, 0),
+	}
+	lobby.LobbySetting.RoomCount = 5
+	lobby.resizeRooms(5)
+	room := lobby.FindRoom(TeamRenpo, 5)
+	room.Enter(&DBUser{UserID: "U1", Name: "User1"})
+
+	// The occupied room is kept by the reload.
+	lobby.LobbySetting.RoomCount = 3
+	lobby.resizeRooms(3)
+	assertEq(t, 4, len(lobby.RenpoRooms))
+	assertEq(t, 3, len(lobby.ZeonRooms))
+	assertEq(t, room, lobby.FindRoom(TeamRenpo, 5))
+
+	// It is removed when it becomes empty.
+	room.Exit("U1")
+	assertEq(t, 3, len(lobby.RenpoRooms))
+	assertEq(t, (*LbsRoom)(nil), lobby.FindRoom(TeamRenpo, 5))
+
+	// Rooms within the room count are kept.
+	room = lobby.FindRoom(TeamRenpo, 3)
+	room.Enter(&DBUser{UserID: "U1", Name: "User1"})
+	room.Exit("U1")
+	assertEq(t, room, lobby.FindRoom(TeamRenpo, 3))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"gdxsv/gdxsv/proto"
+	"math"
+	"sort"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Users in the lobby are notified when the remaining time to an event switch gets shorter than these.
+var lobbyEventAnnounceTimings = []time.Duration{
+	30 * time.Minute,
+	10 * time.Minute,
+	5 * time.Minute,
+	1 * time.Minute,
+}
+
+// LobbyEvent is a scheduled lobby setting that overrides the lobby setting while it is active.
+type LobbyEvent struct {
+	ID         string               `json:"id"`
+	Name       string               `json:"name"`
+	StartAt    time.Time            `json:"start_at"`
+	EndAt      time.Time            `json:"end_at"`
+	Rule       *Rule                `json:"rule,omitempty"`
+	PatchNames string               `json:"patch_names,omitempty"`
+	Patches    *proto.GamePatchList `json:"patches,omitempty"`
+	Comment    string               `json:"comment,omitempty"`
+}
+
+func (e *LobbyEvent) IsActive(now time.Time) bool {
+	return !now.Before(e.StartAt) && now.Before(e.EndAt)
+}
+
+func loadLobbyEvent(s *MLobbySchedule) (*LobbyEvent, []error) {
+	wrap := func(err error) error {
+		return &LobbySettingError{Platform: s.Platform, Disk: s.Disk, No: s.No, Err: fmt.Errorf("schedule %q: %w", s.ID, err)}
+	}
+
+	e := &LobbyEvent{
+		ID:         s.ID,
+		Name:       s.Name,
+		StartAt:    s.StartAt,
+		EndAt:      s.EndAt,
+		PatchNames: s.PatchNames,
+		Comment:    s.Comment,
+	}
+
+	var errs []error
+
+	if s.ID == "" || s.Name == "" {
+		errs = append(errs, wrap(fmt.Errorf("id and name are required")))
+	}
+
+	if !s.StartAt.Before(s.EndAt) {
+		errs = append(errs, wrap(fmt.Errorf("start_at must be before end_at")))
+	}
+
+	if s.RuleID != "" {
+		rule, err := getDB().GetRule(s.RuleID)
+		if err == sql.ErrNoRows {
+			errs = append(errs, wrap(fmt.Errorf("rule %q not found", s.RuleID)))
+		} else if err != nil {
+			errs = append(errs, wrap(err))
+		} else {
+			e.Rule = (*Rule)(rule)
+		}
+	}
+
+	if s.PatchNames != "" {
+		var patchErrs []error
+		e.Patches, patchErrs = loadGamePatchList(s.Platform, s.Disk, s.PatchNames)
+		for _, err := range patchErrs {
+			errs = append(errs, wrap(err))
+		}
+	}
+
+	return e, errs
+}
+
+// loadLobbyEvents loads lobby schedules that have not ended yet into the lobbies.
+func loadLobbyEvents(lobbies map[string]*LobbyMaster) []error {
+	schedules, err := getDB().GetLobbySchedules()
+	if err != nil {
+		return []error{err}
+	}
+
+	var errs []error
+	now := time.Now()
+
+	for _, s := range schedules {
+		if !isHostedLobby(s.Platform, s.Disk) || !now.Before(s.EndAt) {
+			continue
+		}
+
+		e, eventErrs := loadLobbyEvent(s)
+		errs = append(errs, eventErrs...)
+
+		m, ok := lobbies[lobbyMasterKey(s.Platform, s.Disk, uint16(s.No))]
+		if !ok {
+			errs = append(errs, &LobbySettingError{Platform: s.Platform, Disk: s.Disk, No: s.No,
+				Err: fmt.Errorf("schedule %q: lobby is not defined", s.ID)})
+			continue
+		}
+		m.Events = append(m.Events, e)
+	}
+
+	for _, m := range lobbies {
+		sort.Slice(m.Events, func(i, j int) bool {
+			return m.Events[i].StartAt.Before(m.Events[j].StartAt)
+		})
+		for i := 1; i < len(m.Events); i++ {
+			if m.Events[i].StartAt.Before(m.Events[i-1].EndAt) {
+				errs = append(errs, &LobbySettingError{Platform: m.Setting.Platform, Disk: m.Setting.Disk, No: m.Setting.No,
+					Err: fmt.Errorf("schedule %q overlaps with %q", m.Events[i].ID, m.Events[i-1].ID)})
+			}
+		}
+	}
+
+	return errs
+}
+
+func (m *LobbyMaster) findEvent(now time.Time) *LobbyEvent {
+	for _, e := range m.Events {
+		if e.IsActive(now) {
+			return e
+		}
+	}
+	return nil
+}
+
+// updateSchedule switches the lobby setting to the active event and announces upcoming switches.
+func (l *LbsLobby) updateSchedule(now time.Time) {
+	if l.master == nil {
+		return
+	}
+
+	for _, e := range l.master.Events {
+		l.announceEventSwitch(e.ID+"/start", fmt.Sprintf("Event %s starts", e.Name), e.StartAt.Sub(now))
+		l.announceEventSwitch(e.ID+"/end", fmt.Sprintf("Event %s ends", e.Name), e.EndAt.Sub(now))
+	}
+
+	event := l.master.findEvent(now)
+	if event == l.event {
+		return
+	}
+
+	prev := l.event
+	l.event = event
+	l.applyLobbySetting()
+
+	if prev != nil {
+		l.NotifyLobbyEvent("", fmt.Sprintf("Event %s has ended", prev.Name))
+	}
+	if event != nil {
+		l.NotifyLobbyEvent("", fmt.Sprintf("Event %s has started", event.Name))
+	}
+	for userID := range l.Users {
+		if p := l.app.FindPeer(userID); p != nil && p.Room == nil {
+			l.printLobbySetting(p)
+		}
+	}
+
+	logger.Info("lobby event switched",
+		zap.String("platform", l.Platform),
+		zap.String("disk", l.GameDisk),
+		zap.Int("lobby_id", int(l.ID)),
+		zap.Any("prev", prev),
+		zap.Any("next", event))
+}
+
+func (l *LbsLobby) announceEventSwitch(key, text string, remaining time.Duration) {
+	if remaining <= 0 {
+		// The switch has passed, forget its announcements.
+		for _, t := range lobbyEventAnnounceTimings {
+			delete(l.announcedEvents, fmt.Sprintf("%s/%v", key, t))
+		}
+		return
+	}
+
+	for i := len(lobbyEventAnnounceTimings) - 1; 0 <= i; i-- {
+		timing := lobbyEventAnnounceTimings[i]
+		if timing < remaining {
+			continue
+		}
+
+		announced := fmt.Sprintf("%s/%v", key, timing)
+		if l.announcedEvents[announced] {
+			return
+		}
+
+		// Skip longer timings too, so that a user is not notified twice at once.
+		for _, t := range lobbyEventAnnounceTimings[:i+1] {
+			l.announcedEvents[fmt.Sprintf("%s/%v", key, t)] = true
+		}
+		l.NotifyLobbyEvent("", fmt.Sprintf("%s in %d min", text, int(math.Ceil(remaining.Minutes()))))
+		return
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLbsLobby_updateSchedule(t *testing.T) {
+	lbs := NewLbs()
+	lobby := lbs.GetLobby(PlatformEmuX8664, GameDiskPS2, 3)
+
+	eventRule := DefaultRule
+	eventRule.Timer = 2
+
+	startAt := time.Now().Add(time.Hour)
+	master := defaultLobbyMaster(PlatformEmuX8664, GameDiskPS2, 3)
+	master.Events = []*LobbyEvent{{
+		ID:      "weekend",
+		Name:    "Weekend Cup",
+		StartAt: startAt,
+		EndAt:   startAt.Add(2 * time.Hour),
+		Rule:    &eventRule,
+		Comment: "Weekend Cup",
+	}}
+	lobby.applyLobbyMaster(master)
+	assertEq(t, (*LobbyEvent)(nil), lobby.event)
+	baseMessageCount := len(lobby.lobbySettingMessages)
+
+	lobby.updateSchedule(startAt.Add(-20 * time.Minute))
+	assertEq(t, map[string]bool{"weekend/start/30m0s": true}, lobby.announcedEvents)
+
+	lobby.updateSchedule(startAt.Add(-3 * time.Minute))
+	assertEq(t, map[string]bool{
+		"weekend/start/30m0s": true,
+		"weekend/start/10m0s": true,
+		"weekend/start/5m0s":  true,
+	}, lobby.announcedEvents)
+	assertEq(t, DefaultRule, lobby.Rule)
+
+	lobby.updateSchedule(startAt)
+	assertEq(t, map[string]bool{}, lobby.announcedEvents)
+	assertEq(t, master.Events[0], lobby.event)
+	assertEq(t, 2, lobby.Rule.Timer)
+	assertEq(t, "Weekend Cup", lobby.LobbySetting.Comment)
+	assertEq(t, baseMessageCount+2, len(lobby.lobbySettingMessages))
+
+	// The event is kept while the lobby setting is reloaded.
+	lobby.applyLobbyMaster(master)
+	lobby.updateSchedule(startAt.Add(time.Minute))
+	assertEq(t, master.Events[0], lobby.event)
+
+	lobby.updateSchedule(startAt.Add(2*time.Hour - 3*time.Minute))
+	assertEq(t, 3, len(lobby.announcedEvents))
+
+	lobby.updateSchedule(startAt.Add(2 * time.Hour))
+	assertEq(t, map[string]bool{}, lobby.announcedEvents)
+	assertEq(t, (*LobbyEvent)(nil), lobby.event)
+	assertEq(t, DefaultRule, lobby.Rule)
+	assertEq(t, "", lobby.LobbySetting.Comment)
+	assertEq(t, baseMessageCount, len(lobby.lobbySettingMessages))
+}
+
+func TestLoadLobbyEvents(t *testing.T) {
+	cleanTables(t, "m_lobby_schedule", "m_rule")
+	defer cleanTables(t, "m_lobby_schedule", "m_rule")
+
+	rule := MRule(DefaultRule)
+	rule.ID = "event_rule"
+	mustInsertMRule(rule)
+
+	startAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	mustInsertMLobbySchedule(MLobbySchedule{
+		ID:       "ev1",
+		Platform: PlatformConsole,
+		Disk:     GameDiskPS2,
+		No:       1,
+		Name:     "Event1",
+		StartAt:  startAt,
+		EndAt:    startAt.Add(time.Hour),
+		RuleID:   "event_rule",
+	})
+	mustInsertMLobbySchedule(MLobbySchedule{
+		ID:       "ended",
+		Platform: PlatformConsole,
+		Disk:     GameDiskPS2,
+		No:       1,
+		Name:     "Ended",
+		StartAt:  startAt.Add(-3 * time.Hour),
+		EndAt:    startAt.Add(-2 * time.Hour),
+		RuleID:   "no_such_rule",
+	})
+
+	lobbies, errs := loadLobbyMasterData()
+	assertEq(t, 0, len(errs))
+	m := lobbies[lobbyMasterKey(PlatformConsole, GameDiskPS2, 1)]
+	assertEq(t, 1, len(m.Events))
+	assertEq(t, "ev1", m.Events[0].ID)
+	assertEq(t, startAt, m.Events[0].StartAt.UTC())
+	assertEq(t, "event_rule", m.Events[0].Rule.ID)
+
+	mustInsertMLobbySchedule(MLobbySchedule{
+		ID:       "overlap",
+		Platform: PlatformConsole,
+		Disk:     GameDiskPS2,
+		No:       1,
+		Name:     "Overlap",
+		StartAt:  startAt.Add(30 * time.Minute),
+		EndAt:    startAt.Add(2 * time.Hour),
+	})
+	mustInsertMLobbySchedule(MLobbySchedule{
+		ID:       "undefined",
+		Platform: PlatformConsole,
+		Disk:     GameDiskPS2,
+		No:       100,
+		Name:     "Undefined",
+		StartAt:  startAt,
+		EndAt:    startAt.Add(time.Hour),
+	})
+
+	_, errs = loadLobbyMasterData()
+	assertEq(t, 2, len(errs))
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -9,6 +10,8 @@ import (
 	"testing"
 	"time"
 
+	"gdxsv/gdxsv/lbsclient"
+
 	"go.uber.org/zap"
 )
 
@@ -295,6 +298,21 @@ func prepareLoggedInUser(t *testing.T, lbs *Lbs, platform, disk string, user DBU
 	}
 }
 
+// prepareLbsClient connects a lbsclient to the lbs with an in-memory pipe, then logins.
+func prepareLbsClient(t *testing.T, lbs *Lbs, cfg lbsclient.Config) *lbsclient.Client {
+	t.Helper()
+	svConn, clConn := net.Pipe()
+	go lbs.NewPeer(svConn).serve()
+
+	cli := lbsclient.New(clConn, cfg)
+	t.Cleanup(func() { _ = cli.Close() })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	must(t, cli.Login(ctx))
+	return cli
+}
+
 func forceEnterLobby(t *testing.T, lbs *Lbs, cli *TestLbsClient, lobbyID uint16, team uint16) {
 	lbs.Locked(func(*Lbs) {
 		p := lbs.FindPeer(cli.UserID)
@@ -1027,7 +1045,7 @@ func TestLbs_RoomEnterFlow(t *testing.T) {
 			defer cancel2()
 
 			lobbyID := uint16(2)
-			roomCount := fmt.Sprintf("%04d", maxRoomCount)
+			roomCount := fmt.Sprintf("%04d", defaultRoomCount)
 
 			forceEnterLobby(t, lbs, user1, lobbyID, TeamRenpo)
 			forceEnterLobby(t, lbs, user2, lobbyID, TeamRenpo)
@@ -1042,7 +1060,7 @@ func TestLbs_RoomEnterFlow(t *testing.T) {
 					&LbsMessage{Command: lbsRoomMax, Direction: ServerToClient, Category: CategoryAnswer, Seq: 0, Status: StatusSuccess, BodySize: 2, Body: hexbytes(roomCount)},
 					cli.MustReadMessageSkipNotice())
 
-				for i := 0; i < maxRoomCount; i++ {
+				for i := 0; i < defaultRoomCount; i++ {
 					roomID := fmt.Sprintf("%04d", i+1)
 					roomStatus := fmt.Sprintf("%02d", RoomStateEmpty)
 
@@ -1098,7 +1116,7 @@ func TestLbs_RoomEnterFlow(t *testing.T) {
 					&LbsMessage{Command: lbsRoomMax, Direction: ServerToClient, Category: CategoryAnswer, Seq: 0, Status: StatusSuccess, BodySize: 2, Body: hexbytes(roomCount)},
 					cli.MustReadMessageSkipNotice())
 
-				for i := 0; i < maxRoomCount; i++ {
+				for i := 0; i < defaultRoomCount; i++ {
 					roomID := fmt.Sprintf("%04d", i+1)
 					roomStatus := fmt.Sprintf("%02d", RoomStateEmpty)
 					roomName := "0000"
@@ -1515,3 +1533,101 @@ func TestBroadcastLobbyMatchEntryUserCount_NilLobby(t *testing.T) {
 		lbs.BroadcastLobbyMatchEntryUserCount(nil)
 	}()
 }
+
+func TestLbs_ClientLibraryFlow(t *testing.T) {
+	conf.BattlePublicAddr = "192.168.1.10:9877"
+	conf.BattlePublicAddr6 = "[2001:db8::10]:9877"
+	defer func() { conf.BattlePublicAddr6 = "" }()
+	lobbyID := uint16(2)
+
+	lbs := NewLbs()
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var clients []*lbsclient.Client
+	for i := 0; i < 4; i++ {
+		platformInfo := map[string]string{"cpu": "x86/64"}
+		if i%2 == 1 {
+			platformInfo["udp_hmac"] = "1"
+		}
+		if 2 <= i {
+			platformInfo["public_ipv6"] = fmt.Sprintf("2001:db8::%d", i)
+			platformInfo["mcs_ipv6"] = "1"
+		}
+		cli := prepareLbsClient(t, lbs, lbsclient.Config{
+			LoginKey:     fmt.Sprintf("CLIENTLIB%d", i),
+			Name:         fmt.Sprintf("CLI%d", i),
+			PlatformInfo: platformInfo,
+		})
+		if cli.UserID() == "" || cli.SessionID() == "" {
+			t.Fatal("not logged in")
+		}
+		must(t, cli.PostGameParameter(ctx, "PILOT"))
+		must(t, cli.StartLobby(ctx))
+		must(t, cli.EnterPlaza(ctx, lobbyID))
+		must(t, cli.EnterLobby(ctx, uint16(i%2+1)))
+		clients = append(clients, cli)
+	}
+
+	lbs.Locked(func(*Lbs) {
+		assertEq(t, "PILOT", lbs.FindPeer(clients[0].UserID()).PilotName)
+		lobby := lbs.GetLobby(PlatformEmuX8664, GameDiskDC2, lobbyID)
+		lobby.LobbySetting.TeamShuffle = 0
+	})
+
+	must(t, clients[0].Chat("HELLO"))
+	for {
+		// Skip the messages of entering the lobby.
+		msg, err := clients[1].WaitFor(ctx, lbsclient.CmdChatMessage)
+		must(t, err)
+		r := msg.Reader()
+		userID, name, text := r.ReadString(), r.ReadString(), r.ReadShiftJISString()
+		if text == "HELLO" {
+			assertEq(t, clients[0].UserID(), userID)
+			assertEq(t, "CLI0", name)
+			break
+		}
+	}
+
+	for _, cli := range clients {
+		must(t, cli.LobbyMatchEntry(ctx, true))
+	}
+
+	battleCode := ""
+	positions := map[byte]bool{}
+	for i, cli := range clients {
+		must(t, cli.WaitReadyBattle(ctx))
+		info, err := cli.BattleInfo(ctx)
+		must(t, err)
+		u, ok := sharedData.GetBattleUserInfo(cli.SessionID())
+		assertEq(t, true, ok)
+		assertEq(t, u.SessionKey, info.SessionKey)
+		if i%2 == 1 {
+			assertEq(t, 32, len(info.SessionKey))
+		} else {
+			assertEq(t, 0, len(info.SessionKey))
+		}
+		assertEq(t, 4, len(info.Players))
+		assertEq(t, cli.UserID(), info.Players[info.Position-1].UserID)
+		if 2 <= i {
+			assertEq(t, conf.BattlePublicAddr6, info.McsAddr)
+		} else {
+			assertEq(t, conf.BattlePublicAddr, info.McsAddr)
+		}
+		if battleCode == "" {
+			battleCode = info.BattleCode
+		}
+		assertEq(t, battleCode, info.BattleCode)
+		positions[info.Position] = true
+	}
+	assertEq(t, 4, len(positions))
+
+	// Back from the battle server.
+	userID, sessionID := clients[0].UserID(), clients[0].SessionID()
+	_ = clients[0].Close()
+	cli := prepareLbsClient(t, lbs, lbsclient.Config{LoginKey: "CLIENTLIB0", LastSessionID: sessionID})
+	assertEq(t, userID, cli.UserID())
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// tournamentAbortGrace is how long a closed battle of a playing match waits for the battle result.
+const tournamentAbortGrace = time.Minute
+
+func (lbs *Lbs) loadTournaments() {
+	tournaments, err := getDB().GetTournaments(TournamentStateRunning)
+	if err != nil {
+		logger.Error("failed to load tournaments", zap.Error(err))
+		return
+	}
+
+	for _, t := range tournaments {
+		t, err := getDB().GetTournament(t.ID)
+		if err != nil {
+			logger.Error("failed to load tournament", zap.Error(err), zap.String("tournament_id", t.ID))
+			continue
+		}
+		lbs.tournaments[t.ID] = t
+	}
+}
+
+// CreateTournament saves new tournament and starts it.
+func (lbs *Lbs) CreateTournament(t *Tournament) error {
+	if !isHostedLobby(t.Platform, t.Disk) {
+		return fmt.Errorf("unknown lobby %s %s", t.Platform, t.Disk)
+	}
+	if lbs.GetLobby(t.Platform, t.Disk, uint16(t.LobbyID)) == nil {
+		return fmt.Errorf("lobby %d not found", t.LobbyID)
+	}
+	if lbs.FindTournament(t.Platform, t.Disk, uint16(t.LobbyID)) != nil {
+		return fmt.Errorf("another tournament is running in lobby %d", t.LobbyID)
+	}
+
+	err := getDB().AddTournament(t)
+	if err != nil {
+		return err
+	}
+
+	lbs.tournaments[t.ID] = t
+	lbs.notifyTournament(t, fmt.Sprintf("Tournament %s has started", t.Name))
+	return nil
+}
+
+// GetTournament returns the running tournament, or loads finished one from the database.
+func (lbs *Lbs) GetTournament(id string) (*Tournament, error) {
+	if t, ok := lbs.tournaments[id]; ok {
+		return t, nil
+	}
+	return getDB().GetTournament(id)
+}
+
+// FindTournament returns the running tournament that is played in the lobby.
+func (lbs *Lbs) FindTournament(platform, disk string, lobbyID uint16) *Tournament {
+	for _, t := range lbs.tournaments {
+		if t.Platform == platform && t.Disk == disk && t.LobbyID == int(lobbyID) {
+			return t
+		}
+	}
+	return nil
+}
+
+func (lbs *Lbs) saveTournament(t *Tournament) error {
+	err := getDB().UpdateTournament(t)
+	if err != nil {
+		logger.Error("failed to save tournament", zap.Error(err), zap.String("tournament_id", t.ID))
+		return err
+	}
+
+	if t.State == TournamentStateFinished {
+		delete(lbs.tournaments, t.ID)
+	}
+	return nil
+}
+
+func (lbs *Lbs) notifyTournament(t *Tournament, text string) {
+	lobby := lbs.GetLobby(t.Platform, t.Disk, uint16(t.LobbyID))
+	if lobby != nil {
+		lobby.NotifyLobbyEvent("", text)
+	}
+}
+
+// ScheduleTournamentMatch sets the time that the match can start.
+func (lbs *Lbs) ScheduleTournamentMatch(t *Tournament, matchNo int, at time.Time) error {
+	m := t.Match(matchNo)
+	if m == nil {
+		return fmt.Errorf("match %d not found", matchNo)
+	}
+	if m.State == MatchStateDone || m.State == MatchStatePlaying {
+		return fmt.Errorf("match %d is %s", matchNo, m.State)
+	}
+
+	m.ScheduledAt = at
+	m.Updated = time.Now()
+	return lbs.saveTournament(t)
+}
+
+// SetTournamentResult decides the winner of the match and advances the bracket.
+// The match goes back to ready if winner is 0.
+func (lbs *Lbs) SetTournamentResult(t *Tournament, matchNo, winner int) error {
+	var err error
+	if winner == 0 {
+		err = t.ResetMatch(matchNo)
+	} else {
+		err = t.SetResult(matchNo, winner)
+	}
+	if err != nil {
+		return err
+	}
+
+	if winner != 0 {
+		lbs.notifyTournamentResult(t, t.Match(matchNo))
+	}
+	return lbs.saveTournament(t)
+}
+
+func (lbs *Lbs) notifyTournamentResult(t *Tournament, m *TournamentMatch) {
+	loser := m.Entry1
+	if m.Winner == m.Entry1 {
+		loser = m.Entry2
+	}
+	if w, l := t.Entry(m.Winner), t.Entry(loser); w != nil && l != nil {
+		lbs.notifyTournament(t, fmt.Sprintf("%s won against %s", w.Name, l.Name))
+	}
+	if t.State == TournamentStateFinished {
+		if c := t.Entry(t.Champion); c != nil {
+			lbs.notifyTournament(t, fmt.Sprintf("%s won the tournament %s!", c.Name, t.Name))
+		}
+	}
+}
+
+// findTournamentRooms finds a pair of ready rooms whose teams are going to play a ready match.
+// swapped is true when Entry1 of the match is in the zeon room.
+func (lbs *Lbs) findTournamentRooms(t *Tournament, renpoRooms, zeonRooms []*readyRoom) (*readyRoom, *readyRoom, *TournamentMatch, bool) {
+	now := time.Now()
+	for _, renpo := range renpoRooms {
+		for _, zeon := range zeonRooms {
+			if m, swapped := t.FindReadyMatch(renpo.userIDs(), zeon.userIDs(), now); m != nil {
+				return renpo, zeon, m, swapped
+			}
+		}
+	}
+	return nil, nil, nil, false
+}
+
+func (lbs *Lbs) startTournamentMatch(t *Tournament, m *TournamentMatch, battleCode string, swapped bool) {
+	m.State = MatchStatePlaying
+	m.BattleCode = battleCode
+	m.Swapped = swapped
+	m.Updated = time.Now()
+	_ = lbs.saveTournament(t)
+
+	e1, e2 := t.Entry(m.Entry1), t.Entry(m.Entry2)
+	lbs.notifyTournament(t, fmt.Sprintf("Match %d %s vs %s has started", m.MatchNo, e1.Name, e2.Name))
+}
+
+// updateTournamentResult reads the result of the battle and advances the tournament if it was a tournament match.
+func (lbs *Lbs) updateTournamentResult(battleCode string) {
+	for _, t := range lbs.tournaments {
+		m := t.FindMatchByBattleCode(battleCode)
+		if m == nil {
+			continue
+		}
+
+		records, err := getDB().GetBattleRecordsByCode(battleCode)
+		if err != nil {
+			logger.Error("failed to load battle records", zap.Error(err), zap.String("battle_code", battleCode))
+			return
+		}
+
+		winner := tournamentMatchWinner(m, records)
+		if winner == 0 {
+			logger.Info("tournament match draw", zap.String("tournament_id", t.ID), zap.Int("match_no", m.MatchNo))
+			lbs.notifyTournament(t, fmt.Sprintf("Match %d was a draw. Please play again.", m.MatchNo))
+			_ = t.ResetMatch(m.MatchNo)
+			_ = lbs.saveTournament(t)
+			return
+		}
+
+		err = t.SetResult(m.MatchNo, winner)
+		if err != nil {
+			logger.Error("failed to set tournament result", zap.Error(err), zap.String("tournament_id", t.ID))
+			return
+		}
+
+		logger.Info("tournament match finished",
+			zap.String("tournament_id", t.ID),
+			zap.Int("match_no", m.MatchNo),
+			zap.Int("winner", winner))
+		lbs.notifyTournamentResult(t, m)
+		_ = lbs.saveTournament(t)
+		return
+	}
+}
+
+// updateTournamentMatches makes the playing matches ready again if their battles have been closed without the result,
+// should be called every 1 sec in the event loop. A battle that has never been shared is regarded as closed
+// after tournamentAbortGrace since the match started.
+func (lbs *Lbs) updateTournamentMatches(now time.Time) {
+	for _, t := range lbs.tournaments {
+		for _, m := range t.Matches {
+			if m.State != MatchStatePlaying {
+				continue
+			}
+			g, ok := sharedData.GetBattleGameInfo(m.BattleCode)
+			if ok && g.State != McsGameStateClosed {
+				m.gameSeen = true
+				m.closedAt = time.Time{}
+				continue
+			}
+			// The battle may not have been shared to the mcs yet.
+			if !ok && !m.gameSeen && now.Sub(m.Updated) < tournamentAbortGrace {
+				continue
+			}
+			if m.closedAt.IsZero() {
+				m.closedAt = now
+				continue
+			}
+			if now.Sub(m.closedAt) < tournamentAbortGrace {
+				continue
+			}
+
+			logger.Info("tournament match aborted",
+				zap.String("tournament_id", t.ID),
+				zap.Int("match_no", m.MatchNo),
+				zap.String("battle_code", m.BattleCode))
+			lbs.notifyTournament(t, fmt.Sprintf("Match %d was aborted. Please play again.", m.MatchNo))
+			_ = t.ResetMatch(m.MatchNo)
+			_ = lbs.saveTournament(t)
+		}
+	}
+}
+
+// tournamentMatchWinner returns the seed of the winner entry, or 0 if the winner is not decided.
+func tournamentMatchWinner(m *TournamentMatch, records []*BattleRecord) int {
+	winnerTeam := TeamNone
+	for _, r := range records {
+		if r.System == 0 {
+			continue
+		}
+		if r.Lose < r.Win {
+			winnerTeam = r.Team
+		} else if r.Win < r.Lose {
+			winnerTeam = TeamRenpo + TeamZeon - r.Team
+		}
+		if winnerTeam != TeamNone {
+			break
+		}
+	}
+	if winnerTeam == TeamNone {
+		return 0
+	}
+
+	renpo, zeon := m.Entry1, m.Entry2
+	if m.Swapped {
+		renpo, zeon = zeon, renpo
+	}
+	if winnerTeam == TeamRenpo {
+		return renpo
+	}
+	return zeon
+}
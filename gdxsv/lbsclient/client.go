@@ -0,0 +1,541 @@
+package lbsclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrClosed   = errors.New("connection closed")
+	ErrShutDown = errors.New("shutdown by lbs")
+	ErrStatus   = errors.New("error status")
+	ErrTimeout  = errors.New("timeout")
+)
+
+const (
+	TeamRenpo uint16 = 1
+	TeamZeon  uint16 = 2
+)
+
+// Config is the identity of the client.
+type Config struct {
+	LoginKey      string            // identifies the account, a new account is registered for an unknown key
+	UserID        string            // user to login, the first user of the account if empty
+	Name          string            // handle name of a new user
+	GameDisk      string            // "dc1", "dc2" or "ps2", "dc2" if empty
+	PlatformInfo  map[string]string // e.g. cpu=x86/64 to be an emulator
+	LastSessionID string            // session id before the battle, to login as a user back from the battle server
+	Timeout       time.Duration     // timeout of a request, 10 seconds if zero
+}
+
+// Client is a lbs client on a connection.
+// Answers are returned by Request, other messages from the lbs are returned by Next.
+// Line checks from the lbs are answered automatically.
+type Client struct {
+	cfg    Config
+	conn   net.Conn
+	events chan *Message
+	done   chan struct{}
+
+	wmtx sync.Mutex
+
+	mtx        sync.Mutex
+	pending    map[CmdID]chan *Message
+	sessionID  string
+	userID     string
+	sessionKey []byte
+	ready      bool
+	shutdown   bool
+	dropped    int
+}
+
+// New starts a client on the connection. The connection may be a net.Pipe.
+func New(conn net.Conn, cfg Config) *Client {
+	if cfg.GameDisk == "" {
+		cfg.GameDisk = "dc2"
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	c := &Client{
+		cfg:     cfg,
+		conn:    conn,
+		events:  make(chan *Message, 256),
+		done:    make(chan struct{}),
+		pending: map[CmdID]chan *Message{},
+	}
+	go c.readLoop()
+	return c
+}
+
+// Dial connects to the lbs.
+func Dial(addr string, cfg Config) (*Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return New(conn, cfg), nil
+}
+
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Done is closed when the connection is closed.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// SessionID returns the session id given by the lbs, which is also used to join the battle server.
+func (c *Client) SessionID() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.sessionID
+}
+
+func (c *Client) UserID() string {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.userID
+}
+
+// Dropped returns the number of messages dropped because Next was not called.
+func (c *Client) Dropped() int {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.dropped
+}
+
+func (c *Client) readLoop() {
+	defer close(c.done)
+	for {
+		m, err := ReadMessage(c.conn)
+		if err != nil {
+			return
+		}
+
+		if m.Category == CategoryQuestion && m.Command == CmdLineCheck {
+			_ = c.Send(NewAnswer(m))
+			continue
+		}
+
+		c.mtx.Lock()
+		switch m.Command {
+		case CmdReadyBattle:
+			c.ready = true
+		case CmdShutDown:
+			c.shutdown = true
+		case CmdBattleSessionKey:
+			c.sessionKey = m.Reader().ReadBytes()
+		}
+		if ch, ok := c.pending[m.Command]; ok && m.Category == CategoryAnswer {
+			delete(c.pending, m.Command)
+			c.mtx.Unlock()
+			ch <- m
+			continue
+		}
+		select {
+		case c.events <- m:
+		default:
+			c.dropped++
+		}
+		c.mtx.Unlock()
+	}
+}
+
+// Send sends the message without waiting for the answer.
+func (c *Client) Send(m *Message) error {
+	c.wmtx.Lock()
+	defer c.wmtx.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(c.cfg.Timeout))
+	return WriteMessage(c.conn, m)
+}
+
+// Request sends the question and waits for the answer.
+// An answer with the error status is returned with ErrStatus.
+func (c *Client) Request(ctx context.Context, q *Message) (*Message, error) {
+	ch := make(chan *Message, 1)
+	c.mtx.Lock()
+	c.pending[q.Command] = ch
+	c.mtx.Unlock()
+	defer func() {
+		c.mtx.Lock()
+		if c.pending[q.Command] == ch {
+			delete(c.pending, q.Command)
+		}
+		c.mtx.Unlock()
+	}()
+
+	if err := c.Send(q); err != nil {
+		return nil, err
+	}
+
+	select {
+	case a := <-ch:
+		if a.Status == StatusError {
+			return a, fmt.Errorf("0x%04x: %w", uint16(q.Command), ErrStatus)
+		}
+		return a, nil
+	case <-c.done:
+		if c.isShutdown() {
+			return nil, ErrShutDown
+		}
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(c.cfg.Timeout):
+		return nil, fmt.Errorf("0x%04x: %w", uint16(q.Command), ErrTimeout)
+	}
+}
+
+func (c *Client) isShutdown() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.shutdown
+}
+
+// Next returns the next message that is not an answer to a request.
+func (c *Client) Next(ctx context.Context) (*Message, error) {
+	select {
+	case m := <-c.events:
+		if m.Command == CmdShutDown {
+			return m, ErrShutDown
+		}
+		return m, nil
+	case <-c.done:
+		select {
+		case m := <-c.events:
+			return m, nil
+		default:
+		}
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WaitFor skips messages until the command comes.
+func (c *Client) WaitFor(ctx context.Context, cmd CmdID) (*Message, error) {
+	for {
+		m, err := c.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if m.Command == cmd {
+			return m, nil
+		}
+	}
+}
+
+func (c *Client) platformInfo() []byte {
+	var keys []string
+	for k := range c.cfg.PlatformInfo {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, k := range keys {
+		b = append(b, k+"="+c.cfg.PlatformInfo[k]+"\n"...)
+	}
+	return b
+}
+
+// Login follows the login flow driven by the questions from the lbs until LoginOk.
+// The platform info and the login key are sent first as the patched game does.
+func (c *Client) Login(ctx context.Context) error {
+	if err := c.Send(NewCustom(CmdPlatformInfo).Writer().
+		WriteBytes(c.platformInfo()).
+		WriteBytes([]byte(c.cfg.LoginKey)).Msg()); err != nil {
+		return err
+	}
+
+	for {
+		m, err := c.Next(ctx)
+		if err != nil {
+			return fmt.Errorf("login: %w", err)
+		}
+
+		var reply *Message
+		switch m.Command {
+		case CmdAskConnectionID:
+			reply = NewAnswer(m).Writer().WriteString(c.cfg.LastSessionID).Msg()
+		case CmdConnectionID:
+			c.mtx.Lock()
+			c.sessionID = m.Reader().ReadString()
+			c.mtx.Unlock()
+			reply = NewAnswer(m)
+		case CmdWarningMessage:
+			reply = NewQuestion(CmdRegulationHeader)
+		case CmdLoginType:
+			loginType := byte(0)
+			if c.cfg.LastSessionID != "" {
+				loginType = 3 // back from the battle server
+			}
+			reply = NewAnswer(m).Writer().Write8(loginType).Msg()
+		case CmdUserHandle:
+			userID := c.cfg.UserID
+			r := m.Reader()
+			if n := r.Read8(); userID == "" && 0 < n {
+				userID = r.ReadString()
+			}
+			if userID != "" {
+				reply = NewQuestion(CmdUserDecide).Writer().WriteString(userID).Msg()
+			} else {
+				reply = NewQuestion(CmdUserRegist).Writer().WriteString("******").WriteShiftJISString(c.cfg.Name).Msg()
+			}
+		case CmdUserRegist:
+			if m.Category == CategoryAnswer {
+				reply = NewQuestion(CmdUserDecide).Writer().WriteString(m.Reader().ReadString()).Msg()
+			}
+		case CmdUserDecide:
+			if m.Category == CategoryAnswer {
+				c.mtx.Lock()
+				c.userID = m.Reader().ReadString()
+				c.mtx.Unlock()
+			}
+		case CmdAskGameCode:
+			switch c.cfg.GameDisk {
+			case "ps2":
+				reply = NewAnswer(m).Writer().Write8(0x02).Msg()
+			case "dc1":
+				reply = NewAnswer(m).Writer().Write16(0x0300).Msg()
+			default:
+				reply = NewAnswer(m).Writer().Write16(0x0301).Msg()
+			}
+		case CmdAskBattleResult:
+			// No battle result.
+			w := NewAnswer(m).Writer().WriteString("")
+			for i := 0; i < 6; i++ {
+				w.Write8(0)
+			}
+			w.Write32(0)
+			for i := 0; i < 4; i++ {
+				w.Write8(0)
+			}
+			for i := 0; i < 16; i++ {
+				w.Write16(0)
+			}
+			reply = w.Msg()
+		case CmdLoginOk:
+			return nil
+		}
+
+		if reply != nil {
+			if err := c.Send(reply); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// PostGameParameter sends the key config and the pilot name.
+func (c *Client) PostGameParameter(ctx context.Context, pilotName string) error {
+	param := make([]byte, 640)
+	copy(param[16:32], pilotName)
+	_, err := c.Request(ctx, NewQuestion(CmdPostGameParameter).Writer().WriteBytes(param).Msg())
+	return err
+}
+
+func (c *Client) StartLobby(ctx context.Context) error {
+	_, err := c.Request(ctx, NewQuestion(CmdStartLobby))
+	return err
+}
+
+// EnterPlaza selects a lobby.
+func (c *Client) EnterPlaza(ctx context.Context, lobbyID uint16) error {
+	_, err := c.Request(ctx, NewQuestion(CmdPlazaEntry).Writer().Write16(lobbyID).Msg())
+	return err
+}
+
+func (c *Client) ExitPlaza(ctx context.Context) error {
+	_, err := c.Request(ctx, NewQuestion(CmdPlazaExit))
+	return err
+}
+
+// EnterLobby selects a team and enters the lobby chat.
+func (c *Client) EnterLobby(ctx context.Context, team uint16) error {
+	_, err := c.Request(ctx, NewQuestion(CmdLobbyEntry).Writer().Write16(team).Msg())
+	return err
+}
+
+// ExitLobby goes back to the team select.
+func (c *Client) ExitLobby(ctx context.Context) error {
+	_, err := c.Request(ctx, NewQuestion(CmdLobbyExit))
+	return err
+}
+
+// LobbyMatchEntry enters or cancels the lobby matching.
+func (c *Client) LobbyMatchEntry(ctx context.Context, enable bool) error {
+	_, err := c.Request(ctx, NewQuestion(CmdLobbyMatchingEntry).Writer().Write8(b2u8(enable)).Msg())
+	return err
+}
+
+// CreateRoom creates a room and enters it as the owner.
+func (c *Client) CreateRoom(ctx context.Context, roomID uint16, name string) error {
+	for _, q := range []*Message{
+		NewQuestion(CmdRoomCreate).Writer().Write16(roomID).Msg(),
+		NewQuestion(CmdPutRoomName).Writer().WriteShiftJISString(name).Msg(),
+		NewQuestion(CmdEndRoomCreate),
+	} {
+		if _, err := c.Request(ctx, q); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) EnterRoom(ctx context.Context, roomID uint16) error {
+	_, err := c.Request(ctx, NewQuestion(CmdRoomEntry).Writer().Write16(roomID).Write16(0).Msg())
+	return err
+}
+
+func (c *Client) ExitRoom(ctx context.Context) error {
+	_, err := c.Request(ctx, NewQuestion(CmdRoomExit))
+	return err
+}
+
+// RoomMatchEntry starts the room matching if the client is the owner.
+// Otherwise disabling it leaves the room.
+func (c *Client) RoomMatchEntry(ctx context.Context, enable bool) error {
+	_, err := c.Request(ctx, NewQuestion(CmdMatchingEntry).Writer().Write8(b2u8(enable)).Msg())
+	return err
+}
+
+// Chat posts a chat message to the lobby or the room.
+func (c *Client) Chat(text string) error {
+	return c.Send(NewNotice(CmdPostChatMessage).Writer().WriteShiftJISString(text).Msg())
+}
+
+// GoToTop leaves the lobby and the room.
+func (c *Client) GoToTop(ctx context.Context) error {
+	_, err := c.Request(ctx, NewQuestion(CmdGoToTop))
+	return err
+}
+
+func (c *Client) Logout() error {
+	return c.Send(NewNotice(CmdLogout))
+}
+
+// ReadyBattle returns true if the lbs notified that the battle is ready.
+func (c *Client) ReadyBattle() bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.ready
+}
+
+// WaitReadyBattle waits for the matching. Other messages are discarded.
+func (c *Client) WaitReadyBattle(ctx context.Context) error {
+	for !c.ReadyBattle() {
+		if _, err := c.Next(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Player is a participant of the battle.
+type Player struct {
+	Pos    byte
+	UserID string
+	Name   string
+	Team   uint16
+}
+
+// BattleInfo is what the game asks after the matching.
+type BattleInfo struct {
+	BattleCode string
+	McsAddr    string // empty for a p2p battle
+	SessionKey []byte // signs battle udp packets, nil unless udp_hmac=1 is in the platform info
+	Position   byte
+	Players    []Player
+	RuleBin    []byte
+}
+
+// BattleInfo asks the battle information as the game does after ReadyBattle.
+func (c *Client) BattleInfo(ctx context.Context) (*BattleInfo, error) {
+	info := &BattleInfo{}
+
+	a, err := c.Request(ctx, NewQuestion(CmdAskMatchingJoin))
+	if err != nil {
+		return nil, err
+	}
+	n := a.Reader().Read8()
+
+	if a, err = c.Request(ctx, NewQuestion(CmdAskPlayerSide)); err != nil {
+		return nil, err
+	}
+	info.Position = a.Reader().Read8()
+
+	for pos := byte(1); pos <= n; pos++ {
+		a, err := c.Request(ctx, NewQuestion(CmdAskPlayerInfo).Writer().Write8(pos).Msg())
+		if err != nil {
+			return nil, err
+		}
+		r := a.Reader()
+		p := Player{Pos: r.Read8(), UserID: r.ReadString(), Name: r.ReadString()}
+		r.ReadBytes() // game param
+		for i := 0; i < 6; i++ {
+			r.Read16() // grade, win, lose, draw, invalid, unknown
+		}
+		p.Team = r.Read16()
+		if err := r.Err(); err != nil {
+			return nil, fmt.Errorf("player info: %w", err)
+		}
+		info.Players = append(info.Players, p)
+	}
+
+	if a, err = c.Request(ctx, NewQuestion(CmdAskRuleData)); err != nil {
+		return nil, err
+	}
+	r := a.Reader()
+	info.RuleBin = r.read(int(r.Read16()))
+
+	if a, err = c.Request(ctx, NewQuestion(CmdAskBattleCode)); err != nil {
+		return nil, err
+	}
+	info.BattleCode = a.Reader().ReadString()
+
+	if _, err = c.Request(ctx, NewQuestion(CmdAskMcsVersion)); err != nil {
+		return nil, err
+	}
+
+	a, err = c.Request(ctx, NewQuestion(CmdAskMcsAddress))
+	if errors.Is(err, ErrStatus) {
+		// The battle is not on a battle server.
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	r = a.Reader()
+	// 4 octets for IPv4 and 16 octets for IPv6.
+	ip := net.IP(r.ReadBytes())
+	r.Read16()
+	port := r.Read16()
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("mcs address: %w", err)
+	}
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("mcs address: invalid ip length %d", len(ip))
+	}
+	info.McsAddr = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+
+	// The key is notified with ReadyBattle, so it has been read before the answers.
+	c.mtx.Lock()
+	info.SessionKey = c.sessionKey
+	c.mtx.Unlock()
+	return info, nil
+}
+
+func b2u8(b bool) byte {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,53 @@
+package lbsclient
+
+// Commands used by the client. See lbs_handler.go of gdxsv for the server side.
+const (
+	CmdLineCheck          CmdID = 0x6001
+	CmdLogout             CmdID = 0x6002
+	CmdShutDown           CmdID = 0x6003
+	CmdLoginType          CmdID = 0x6110
+	CmdConnectionID       CmdID = 0x6101
+	CmdAskConnectionID    CmdID = 0x6102
+	CmdWarningMessage     CmdID = 0x6103
+	CmdUserHandle         CmdID = 0x6111
+	CmdUserRegist         CmdID = 0x6112
+	CmdUserDecide         CmdID = 0x6113
+	CmdAskGameCode        CmdID = 0x6116
+	CmdLoginOk            CmdID = 0x6118
+	CmdAskBattleResult    CmdID = 0x6120
+	CmdStartLobby         CmdID = 0x6141
+	CmdPostGameParameter  CmdID = 0x6143
+	CmdRegulationHeader   CmdID = 0x6820
+	CmdPlazaMax           CmdID = 0x6203
+	CmdPlazaJoin          CmdID = 0x6205
+	CmdPlazaStatus        CmdID = 0x6206
+	CmdPlazaEntry         CmdID = 0x6207
+	CmdGoToTop            CmdID = 0x6208
+	CmdPlazaExit          CmdID = 0x6306
+	CmdLobbyJoin          CmdID = 0x6303
+	CmdLobbyEntry         CmdID = 0x6305
+	CmdLobbyExit          CmdID = 0x6408
+	CmdLobbyMatchingEntry CmdID = 0x640E
+	CmdRoomMax            CmdID = 0x6401
+	CmdRoomStatus         CmdID = 0x6404
+	CmdRoomEntry          CmdID = 0x6406
+	CmdRoomCreate         CmdID = 0x6407
+	CmdPutRoomName        CmdID = 0x6609
+	CmdEndRoomCreate      CmdID = 0x660C
+	CmdRoomExit           CmdID = 0x6501
+	CmdMatchingEntry      CmdID = 0x6504
+	CmdRoomRemove         CmdID = 0x6505
+	CmdPostChatMessage    CmdID = 0x6701
+	CmdChatMessage        CmdID = 0x6702
+	CmdReadyBattle        CmdID = 0x6910
+	CmdAskMatchingJoin    CmdID = 0x6911
+	CmdAskPlayerSide      CmdID = 0x6912
+	CmdAskPlayerInfo      CmdID = 0x6913
+	CmdAskRuleData        CmdID = 0x6914
+	CmdAskBattleCode      CmdID = 0x6915
+	CmdAskMcsAddress      CmdID = 0x6916
+	CmdAskMcsVersion      CmdID = 0x6917
+	CmdPlatformInfo       CmdID = 0x9950
+	CmdP2PMatching        CmdID = 0x9961
+	CmdBattleSessionKey   CmdID = 0x9966
+)
@@ -0,0 +1,225 @@
+// Package lbsclient implements the client side of the lobby server (lbs) protocol.
+// It is used by tests, bots and the load tester to act as a game client.
+package lbsclient
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/text/encoding/japanese"
+)
+
+type CmdID uint16
+type CmdDirection byte
+type CmdCategory byte
+type CmdStatus uint32
+
+const (
+	HeaderSize                    = 12
+	ServerToClient   CmdDirection = 0x18
+	ClientToServer   CmdDirection = 0x81
+	CategoryQuestion CmdCategory  = 0x01
+	CategoryAnswer   CmdCategory  = 0x02
+	CategoryNotice   CmdCategory  = 0x10
+	CategoryCustom   CmdCategory  = 0xFF
+	StatusError      CmdStatus    = 0xFFFFFFFF
+	StatusSuccess    CmdStatus    = 0x00FFFFFF
+)
+
+// Message is a message of the lbs protocol.
+type Message struct {
+	Direction CmdDirection
+	Category  CmdCategory
+	Command   CmdID
+	Seq       uint16
+	Status    CmdStatus
+	Body      []byte
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf("Message{Command: 0x%04x, Direction: 0x%02x, Category: 0x%02x, Seq: %v, Status: 0x%08x, Body: %x}",
+		uint16(m.Command), m.Direction, m.Category, m.Seq, m.Status, m.Body)
+}
+
+func NewQuestion(command CmdID) *Message {
+	return &Message{Direction: ClientToServer, Category: CategoryQuestion, Command: command, Status: StatusSuccess}
+}
+
+// NewAnswer returns an answer to the question from the lbs.
+func NewAnswer(question *Message) *Message {
+	return &Message{Direction: ClientToServer, Category: CategoryCustom, Command: question.Command, Status: StatusSuccess}
+}
+
+func NewNotice(command CmdID) *Message {
+	return &Message{Direction: ClientToServer, Category: CategoryNotice, Command: command, Status: StatusSuccess}
+}
+
+func NewCustom(command CmdID) *Message {
+	return &Message{Direction: ClientToServer, Category: CategoryCustom, Command: command, Status: StatusSuccess}
+}
+
+// WriteMessage writes the message to w.
+func WriteMessage(w io.Writer, m *Message) error {
+	if 0xFFFF < len(m.Body) {
+		return fmt.Errorf("message body too large: %d", len(m.Body))
+	}
+	buf := make([]byte, HeaderSize, HeaderSize+len(m.Body))
+	buf[0] = byte(m.Direction)
+	buf[1] = byte(m.Category)
+	binary.BigEndian.PutUint16(buf[2:], uint16(m.Command))
+	binary.BigEndian.PutUint16(buf[4:], uint16(len(m.Body)))
+	binary.BigEndian.PutUint16(buf[6:], m.Seq)
+	binary.BigEndian.PutUint32(buf[8:], uint32(m.Status))
+	buf = append(buf, m.Body...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadMessage reads a message from r.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var header [HeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	m := &Message{
+		Direction: CmdDirection(header[0]),
+		Category:  CmdCategory(header[1]),
+		Command:   CmdID(binary.BigEndian.Uint16(header[2:])),
+		Seq:       binary.BigEndian.Uint16(header[6:]),
+		Status:    CmdStatus(binary.BigEndian.Uint32(header[8:])),
+	}
+	if size := binary.BigEndian.Uint16(header[4:]); 0 < size {
+		m.Body = make([]byte, size)
+		if _, err := io.ReadFull(r, m.Body); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+var ErrShortBody = errors.New("message body too short")
+
+// BodyReader reads the message body.
+// Once a read fails, the following reads return zero values and Err returns the error.
+type BodyReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (m *Message) Reader() *BodyReader {
+	return &BodyReader{r: bytes.NewReader(m.Body)}
+}
+
+func (r *BodyReader) Err() error {
+	return r.err
+}
+
+func (r *BodyReader) Remaining() int {
+	return r.r.Len()
+}
+
+func (r *BodyReader) read(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if r.r.Len() < n {
+		r.err = ErrShortBody
+		return nil
+	}
+	buf := make([]byte, n)
+	_, _ = r.r.Read(buf)
+	return buf
+}
+
+func (r *BodyReader) Read8() byte {
+	if b := r.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *BodyReader) Read16() uint16 {
+	if b := r.read(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *BodyReader) Read32() uint32 {
+	if b := r.read(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// ReadBytes reads length-prefixed byte data.
+func (r *BodyReader) ReadBytes() []byte {
+	return r.read(int(r.Read16()))
+}
+
+// ReadString reads length-prefixed string.
+func (r *BodyReader) ReadString() string {
+	return string(bytes.Trim(r.ReadBytes(), "\x00"))
+}
+
+// ReadShiftJISString reads length-prefixed shift-jis string.
+func (r *BodyReader) ReadShiftJISString() string {
+	b, err := japanese.ShiftJIS.NewDecoder().Bytes(r.ReadBytes())
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	return string(bytes.Trim(b, "\x00"))
+}
+
+// BodyWriter writes the message body.
+type BodyWriter struct {
+	msg *Message
+}
+
+func (m *Message) Writer() *BodyWriter {
+	return &BodyWriter{msg: m}
+}
+
+func (w *BodyWriter) Write(v []byte) *BodyWriter {
+	w.msg.Body = append(w.msg.Body, v...)
+	return w
+}
+
+func (w *BodyWriter) Write8(v byte) *BodyWriter {
+	return w.Write([]byte{v})
+}
+
+func (w *BodyWriter) Write16(v uint16) *BodyWriter {
+	return w.Write(binary.BigEndian.AppendUint16(nil, v))
+}
+
+func (w *BodyWriter) Write32(v uint32) *BodyWriter {
+	return w.Write(binary.BigEndian.AppendUint32(nil, v))
+}
+
+// WriteBytes writes length-prefixed byte data.
+func (w *BodyWriter) WriteBytes(v []byte) *BodyWriter {
+	return w.Write16(uint16(len(v))).Write(v)
+}
+
+// WriteString writes length-prefixed string.
+func (w *BodyWriter) WriteString(v string) *BodyWriter {
+	return w.WriteBytes([]byte(v))
+}
+
+// WriteShiftJISString writes length-prefixed shift-jis string.
+// The string is written as is if it can not be encoded.
+func (w *BodyWriter) WriteShiftJISString(v string) *BodyWriter {
+	b, err := japanese.ShiftJIS.NewEncoder().Bytes([]byte(v))
+	if err != nil {
+		b = []byte(v)
+	}
+	return w.WriteBytes(b)
+}
+
+func (w *BodyWriter) Msg() *Message {
+	return w.msg
+}
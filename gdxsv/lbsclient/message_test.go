@@ -0,0 +1,80 @@
+package lbsclient
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	m := NewQuestion(CmdPlazaEntry).Writer().Write16(3).WriteString("abc").WriteShiftJISString("テスト").Msg()
+	m.Seq = 7
+
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteMessage(&buf, NewNotice(CmdLogout)); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(m, got) {
+		t.Fatalf("expected %v, got %v", m, got)
+	}
+
+	r := got.Reader()
+	if v := r.Read16(); v != 3 {
+		t.Error("Read16", v)
+	}
+	if v := r.ReadString(); v != "abc" {
+		t.Error("ReadString", v)
+	}
+	if v := r.ReadShiftJISString(); v != "テスト" {
+		t.Error("ReadShiftJISString", v)
+	}
+	if r.Err() != nil || r.Remaining() != 0 {
+		t.Error("unexpected state", r.Err(), r.Remaining())
+	}
+
+	got, err = ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Command != CmdLogout || got.Body != nil {
+		t.Error("unexpected message", got)
+	}
+
+	if _, err := ReadMessage(&buf); err != io.EOF {
+		t.Error("expected EOF", err)
+	}
+}
+
+func TestReadMessageShortBody(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, NewQuestion(CmdPlazaEntry).Writer().Write32(1).Msg()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()[:buf.Len()-1]
+	if _, err := ReadMessage(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Error("expected ErrUnexpectedEOF", err)
+	}
+}
+
+func TestBodyReaderStickyError(t *testing.T) {
+	r := (&Message{Body: []byte{0, 5, 'a'}}).Reader()
+	if v := r.ReadString(); v != "" {
+		t.Error("ReadString", v)
+	}
+	if !errors.Is(r.Err(), ErrShortBody) {
+		t.Error("expected ErrShortBody", r.Err())
+	}
+	if v := r.Read8(); v != 0 {
+		t.Error("read after error", v)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gdxsv/gdxsv/lbsclient"
+	"gdxsv/gdxsv/proto"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// LoadTestOptions are options of the load test.
+type LoadTestOptions struct {
+	LobbyAddr    string        // address of the lbs
+	Users        int           // number of lobby clients
+	Battles      int           // number of 4-player battles, played by the first 4*Battles users
+	Duration     time.Duration // how long the load test runs
+	BattleTime   time.Duration // how long a battle lasts
+	ChatInterval time.Duration // interval of chat messages in the lobby
+	LobbyID      uint16
+	MetricsURLs  []string // expvar endpoints of the lbs and the mcs, e.g. http://localhost:26061/debug/vars
+}
+
+// LatencySummary is percentiles of the latency in milliseconds.
+type LatencySummary struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50"`
+	P90   float64 `json:"p90"`
+	P99   float64 `json:"p99"`
+	Max   float64 `json:"max"`
+}
+
+// LoadTestReport is the result of the load test.
+type LoadTestReport struct {
+	Users       int                         `json:"users"`
+	Battles     int                         `json:"battles"`
+	Logins      int                         `json:"logins"`       // completed login flows
+	BattleCodes int                         `json:"battle_codes"` // battles started
+	Chats       int                         `json:"chats"`
+	BattleRecv  int                         `json:"battle_recv"` // battle messages relayed to the clients
+	Latency     map[string]LatencySummary   `json:"latency"`
+	Errors      map[string]int              `json:"errors,omitempty"`
+	Server      map[string]map[string]int64 `json:"server,omitempty"` // increase of the server metrics
+}
+
+// loadTestStats is shared by all clients of a load test.
+type loadTestStats struct {
+	mtx         sync.Mutex
+	latency     map[string][]time.Duration
+	errors      map[string]int
+	logins      int
+	chats       int
+	battleRecv  int
+	battleCodes map[string]bool
+}
+
+func newLoadTestStats() *loadTestStats {
+	return &loadTestStats{
+		latency:     map[string][]time.Duration{},
+		errors:      map[string]int{},
+		battleCodes: map[string]bool{},
+	}
+}
+
+func (s *loadTestStats) observe(name string, d time.Duration) {
+	s.mtx.Lock()
+	s.latency[name] = append(s.latency[name], d)
+	s.mtx.Unlock()
+}
+
+func (s *loadTestStats) error(err error) {
+	s.mtx.Lock()
+	s.errors[err.Error()]++
+	s.mtx.Unlock()
+}
+
+func (s *loadTestStats) count(f func(s *loadTestStats)) {
+	s.mtx.Lock()
+	f(s)
+	s.mtx.Unlock()
+}
+
+func summarizeLatency(samples []time.Duration) LatencySummary {
+	if len(samples) == 0 {
+		return LatencySummary{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	pct := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return float64(sorted[i].Microseconds()) / 1000
+	}
+	return LatencySummary{
+		Count: len(sorted),
+		P50:   pct(0.5),
+		P90:   pct(0.9),
+		P99:   pct(0.99),
+		Max:   pct(1),
+	}
+}
+
+// RunLoadTest runs lobby clients and battle clients against the lbs and the mcs.
+// Latencies are measured on the client side: "login" is the whole login flow,
+// "lbs_request" is the round trip of a request to the lbs
+// and "mcs_relay" is the delay of a battle message relayed by the mcs.
+// Handler queue delay and mcs proc time are taken from the expvar of the servers.
+func RunLoadTest(ctx context.Context, opts LoadTestOptions) *LoadTestReport {
+	if opts.Users < 4*opts.Battles {
+		opts.Users = 4 * opts.Battles
+	}
+
+	stats := newLoadTestStats()
+	before := scrapeServerMetrics(opts.MetricsURLs)
+
+	ctx, cancel := context.WithTimeout(ctx, opts.Duration)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Users; i++ {
+		// Half of the clients sign battle packets, the others are in the compatibility mode.
+		platformInfo := map[string]string{"cpu": "x86/64", "os": "loadtest"}
+		if i%2 == 1 {
+			platformInfo["udp_hmac"] = "1"
+		}
+		c := &loadClient{
+			opts:  opts,
+			stats: stats,
+			index: i,
+			cfg: lbsclient.Config{
+				LoginKey:     fmt.Sprintf("loadtest%06d", i),
+				Name:         fmt.Sprintf("LOAD%04d", i),
+				PlatformInfo: platformInfo,
+			},
+			team:   uint16(i%2 + 1),
+			battle: i < 4*opts.Battles,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.run(ctx)
+		}()
+		// Avoid a burst of login.
+		time.Sleep(10 * time.Millisecond)
+	}
+	wg.Wait()
+
+	report := &LoadTestReport{
+		Users:   opts.Users,
+		Battles: opts.Battles,
+		Latency: map[string]LatencySummary{},
+		Errors:  map[string]int{},
+	}
+	stats.count(func(s *loadTestStats) {
+		report.Logins = s.logins
+		report.Chats = s.chats
+		report.BattleRecv = s.battleRecv
+		report.BattleCodes = len(s.battleCodes)
+		for name, samples := range s.latency {
+			report.Latency[name] = summarizeLatency(samples)
+		}
+		for err, n := range s.errors {
+			report.Errors[err] = n
+		}
+	})
+	report.Server = diffServerMetrics(before, scrapeServerMetrics(opts.MetricsURLs))
+	return report
+}
+
+// scrapeServerMetrics reads gdxsv-lbs and gdxsv-mcs counters from expvar endpoints.
+func scrapeServerMetrics(urls []string) map[string]map[string]int64 {
+	ret := map[string]map[string]int64{}
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, url := range urls {
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		var vars map[string]json.RawMessage
+		err = json.NewDecoder(resp.Body).Decode(&vars)
+		resp.Body.Close()
+		if err != nil {
+			continue
+		}
+		for _, key := range []string{"gdxsv-lbs", "gdxsv-mcs"} {
+			var m map[string]int64
+			if json.Unmarshal(vars[key], &m) != nil || len(m) == 0 {
+				continue
+			}
+			ret[url+" "+key] = m
+		}
+	}
+	return ret
+}
+
+// diffServerMetrics returns the increase of the counters. Max values are returned as is.
+func diffServerMetrics(before, after map[string]map[string]int64) map[string]map[string]int64 {
+	ret := map[string]map[string]int64{}
+	for key, m := range after {
+		d := map[string]int64{}
+		for name, v := range m {
+			if strings.HasSuffix(name, "maxms") {
+				d[name] = v
+			} else {
+				d[name] = v - before[key][name]
+			}
+		}
+		ret[key] = d
+	}
+	return ret
+}
+
+// loadClient is a simulated game client.
+type loadClient struct {
+	opts   LoadTestOptions
+	stats  *loadTestStats
+	index  int
+	cfg    lbsclient.Config
+	team   uint16
+	battle bool
+	cli    *lbsclient.Client
+}
+
+func (c *loadClient) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		err := c.session(ctx)
+		if err != nil && ctx.Err() == nil {
+			c.stats.error(err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}
+}
+
+// timed records the latency of a request to the lbs.
+func (c *loadClient) timed(err error, start time.Time) error {
+	if err == nil {
+		c.stats.observe("lbs_request", time.Since(start))
+	}
+	return err
+}
+
+// session logins to the lbs, then stays in the lobby or plays a battle.
+func (c *loadClient) session(ctx context.Context) error {
+	cli, err := lbsclient.Dial(c.opts.LobbyAddr, c.cfg)
+	if err != nil {
+		return fmt.Errorf("dial lbs: %w", err)
+	}
+	c.cli = cli
+	defer cli.Close()
+
+	start := time.Now()
+	if err := cli.Login(ctx); err != nil {
+		return err
+	}
+	c.stats.observe("login", time.Since(start))
+	c.stats.count(func(s *loadTestStats) { s.logins++ })
+
+	if err := c.timed(cli.PostGameParameter(ctx, c.cfg.Name), time.Now()); err != nil {
+		return err
+	}
+	if err := c.timed(cli.StartLobby(ctx), time.Now()); err != nil {
+		return err
+	}
+	if err := c.timed(cli.EnterPlaza(ctx, c.opts.LobbyID), time.Now()); err != nil {
+		return err
+	}
+	if err := c.timed(cli.EnterLobby(ctx, c.team), time.Now()); err != nil {
+		return err
+	}
+
+	if !c.battle {
+		return c.chatUntil(ctx, func() bool { return false })
+	}
+
+	if err := c.timed(cli.LobbyMatchEntry(ctx, true), time.Now()); err != nil {
+		return err
+	}
+	if err := c.chatUntil(ctx, cli.ReadyBattle); err != nil || !cli.ReadyBattle() {
+		return err
+	}
+
+	start = time.Now()
+	info, err := cli.BattleInfo(ctx)
+	if err != nil {
+		return err
+	}
+	c.stats.observe("battle_info", time.Since(start))
+	c.stats.count(func(s *loadTestStats) { s.battleCodes[info.BattleCode] = true })
+	if info.McsAddr == "" {
+		return fmt.Errorf("not a mcs battle")
+	}
+
+	// The game client leaves the lbs during a battle.
+	_ = cli.Close()
+	c.cfg.LastSessionID = cli.SessionID()
+	return c.playBattle(ctx, cli.SessionID(), cli.UserID(), info)
+}
+
+// chatUntil posts chat messages periodically until the context is done or done returns true.
+func (c *loadClient) chatUntil(ctx context.Context, done func() bool) error {
+	interval := c.opts.ChatInterval
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	// Spread chat messages of the clients.
+	next := time.Now().Add(time.Duration(c.index%100) * interval / 100)
+
+	for !done() {
+		wait := time.Until(next)
+		if wait <= 0 {
+			if err := c.cli.Chat("hello"); err != nil {
+				return err
+			}
+			c.stats.count(func(s *loadTestStats) { s.chats++ })
+			next = next.Add(interval)
+			continue
+		}
+
+		waitCtx, cancel := context.WithTimeout(ctx, wait)
+		_, err := c.cli.Next(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && err != context.DeadlineExceeded {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadBattleHz is the rate of battle packets, same as the game.
+const loadBattleHz = 60
+
+// playBattle sends battle messages to the mcs and receives the messages of the other players.
+// Each message has the send time so that the relay delay is measured.
+func (c *loadClient) playBattle(ctx context.Context, sessionID, userID string, info *lbsclient.BattleInfo) error {
+	addr, err := net.ResolveUDPAddr("udp", info.McsAddr)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return fmt.Errorf("dial mcs: %w", err)
+	}
+	defer conn.Close()
+
+	write := func(pkt *proto.Packet) error {
+		data, err := pb.Marshal(pkt)
+		if err != nil {
+			return err
+		}
+		if info.SessionKey != nil {
+			data = proto.SignPacket(data, info.SessionKey)
+		}
+		_, err = conn.Write(data)
+		return err
+	}
+
+	var others []string
+	for _, p := range info.Players {
+		if p.UserID != userID {
+			others = append(others, p.UserID)
+		}
+	}
+	rudp := proto.NewBattleBuffer(userID)
+	filter := proto.NewMessageFilter(others)
+	chHello := make(chan struct{}, 1)
+	chFin := make(chan struct{})
+
+	go func() {
+		defer close(chFin)
+		buf := make([]byte, 4096)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			pkt := new(proto.Packet)
+			if pb.Unmarshal(buf[:n], pkt) != nil {
+				continue
+			}
+			if info.SessionKey != nil && !proto.VerifyPacket(buf[:n], info.SessionKey) {
+				continue
+			}
+			switch pkt.GetType() {
+			case proto.MessageType_HelloServer:
+				if pkt.GetHelloServerData().GetOk() {
+					select {
+					case chHello <- struct{}{}:
+					default:
+					}
+				}
+			case proto.MessageType_Battle:
+				rudp.ApplySeqAck(pkt.GetSeq(), pkt.GetAck())
+				now := time.Now()
+				recv := 0
+				for _, msg := range pkt.GetBattleData() {
+					if !filter.Filter(msg) || len(msg.GetBody()) < 8 {
+						continue
+					}
+					sent := time.Unix(0, int64(binary.BigEndian.Uint64(msg.GetBody())))
+					c.stats.observe("mcs_relay", now.Sub(sent))
+					recv++
+				}
+				c.stats.count(func(s *loadTestStats) { s.battleRecv += recv })
+			case proto.MessageType_Fin:
+				return
+			}
+		}
+	}()
+
+	// Hello until the mcs accepts the session.
+	joined := false
+	for i := 0; i < 50 && !joined; i++ {
+		if err := write(&proto.Packet{Type: proto.MessageType_HelloServer, SessionId: sessionID}); err != nil {
+			return err
+		}
+		select {
+		case <-chHello:
+			joined = true
+		case <-chFin:
+			return fmt.Errorf("mcs closed")
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	if !joined {
+		return fmt.Errorf("mcs hello timeout")
+	}
+
+	tick := time.NewTicker(time.Second / loadBattleHz)
+	defer tick.Stop()
+	end := time.After(c.opts.BattleTime)
+	body := make([]byte, 16)
+	for {
+		select {
+		case <-ctx.Done():
+		case <-end:
+		case <-chFin:
+			return nil
+		case <-tick.C:
+			binary.BigEndian.PutUint64(body, uint64(time.Now().UnixNano()))
+			if err := rudp.PushBattleMessage(filter.GenerateMessage(userID, append([]byte(nil), body...))); err != nil {
+				return err
+			}
+			data, seq, ack := rudp.GetSendData()
+			if err := write(&proto.Packet{
+				Type:       proto.MessageType_Battle,
+				Seq:        seq,
+				Ack:        ack,
+				SessionId:  sessionID,
+				BattleData: data,
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		break
+	}
+
+	return write(&proto.Packet{
+		Type:      proto.MessageType_Fin,
+		SessionId: sessionID,
+		FinData:   &proto.FinMessage{Detail: "loadtest_end"},
+	})
+}
+
+func mainLoadTest(args []string) int {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	addr := fs.String("addr", conf.LobbyPublicAddr, "lbs address")
+	users := fs.Int("users", 100, "number of lobby clients")
+	battles := fs.Int("battles", 10, "number of 4-player battles")
+	duration := fs.Duration("duration", time.Minute, "duration of the load test")
+	battleTime := fs.Duration("battletime", 30*time.Second, "duration of a battle")
+	chat := fs.Duration("chat", 10*time.Second, "chat interval of a lobby client, 0 to disable")
+	lobbyID := fs.Uint("lobby", 1, "lobby id to enter")
+	metrics := fs.String("metrics", "", "comma separated expvar urls of the lbs and the mcs e.g. http://localhost:26061/debug/vars")
+	_ = fs.Parse(args)
+
+	opts := LoadTestOptions{
+		LobbyAddr:    *addr,
+		Users:        *users,
+		Battles:      *battles,
+		Duration:     *duration,
+		BattleTime:   *battleTime,
+		ChatInterval: *chat,
+		LobbyID:      uint16(*lobbyID),
+	}
+	for _, url := range strings.Split(*metrics, ",") {
+		if url != "" {
+			opts.MetricsURLs = append(opts.MetricsURLs, url)
+		}
+	}
+
+	report := RunLoadTest(context.Background(), opts)
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+	return 0
+}
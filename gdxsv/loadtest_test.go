@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_summarizeLatency(t *testing.T) {
+	assertEq(t, LatencySummary{}, summarizeLatency(nil))
+
+	var samples []time.Duration
+	for i := 100; 1 <= i; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	assertEq(t, LatencySummary{Count: 100, P50: 50, P90: 90, P99: 99, Max: 100}, summarizeLatency(samples))
+	assertEq(t, time.Duration(100)*time.Millisecond, samples[0]) // not sorted in place
+}
+
+func Test_diffServerMetrics(t *testing.T) {
+	before := map[string]map[string]int64{"lbs": {"msg-handled": 10, "queue-maxms": 5}}
+	after := map[string]map[string]int64{
+		"lbs": {"msg-handled": 15, "queue-maxms": 7},
+		"mcs": {"msg-recv": 3},
+	}
+	assertEq(t, map[string]map[string]int64{
+		"lbs": {"msg-handled": 5, "queue-maxms": 7},
+		"mcs": {"msg-recv": 3},
+	}, diffServerMetrics(before, after))
+}
+
+func TestRunLoadTest(t *testing.T) {
+	defer func(path, addr string) {
+		conf.BattleLogPath = path
+		conf.BattlePublicAddr = addr
+	}(conf.BattleLogPath, conf.BattlePublicAddr)
+	conf.BattleLogPath = t.TempDir()
+
+	lbs := NewLbs()
+	defer lbs.Quit()
+	go lbs.eventLoop()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	must(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go lbs.NewPeer(conn).serve()
+		}
+	}()
+
+	sv := NewUDPServer(NewMcs(0))
+	must(t, sv.Listen("127.0.0.1:0"))
+	defer sv.Close()
+	go sv.readLoop()
+	conf.BattlePublicAddr = sv.conn.LocalAddr().String()
+
+	report := RunLoadTest(context.Background(), LoadTestOptions{
+		LobbyAddr:    ln.Addr().String(),
+		Users:        6,
+		Battles:      1,
+		Duration:     4 * time.Second,
+		BattleTime:   time.Second,
+		ChatInterval: 200 * time.Millisecond,
+		LobbyID:      1,
+	})
+
+	assertEq(t, map[string]int{}, report.Errors)
+	if report.Logins < 6 {
+		t.Error("logins", report.Logins)
+	}
+	if report.BattleCodes < 1 {
+		t.Error("no battle started")
+	}
+	if report.Chats == 0 {
+		t.Error("no chat")
+	}
+	if report.BattleRecv == 0 || report.Latency["mcs_relay"].Count == 0 {
+		t.Error("no battle message relayed")
+	}
+	if report.Latency["lbs_request"].Count == 0 || report.Latency["login"].Count == 0 {
+		t.Error("no lbs latency", report.Latency)
+	}
+}
@@ -18,7 +18,6 @@ import (
 	"time"
 
 	"cloud.google.com/go/profiler"
-	"github.com/caarlos0/env"
 	"github.com/jmoiron/sqlx"
 	stackdriver "github.com/tommy351/zap-stackdriver"
 	"go.uber.org/zap"
@@ -30,17 +29,6 @@ var (
 	gdxsvVersion  string
 	gdxsvRevision string
 
-	// Minimum required flycast version.
-	requiredFlycastVersion = "v1.6.2"
-
-	// Released but broken flycast versions.
-	bannedFlycastVersions = map[string]bool{
-		"v1.7.0": true,
-		"v1.7.1": true,
-		"v1.7.2": true,
-		"v1.8.0": true,
-	}
-
 	// Global random
 	gRand = rand.New(rand.NewSource(time.Now().UnixNano()))
 )
@@ -48,35 +36,22 @@ var (
 var (
 	conf Config
 
-	cpu      = flag.Int("cpu", 2, "setting GOMAXPROCS")
-	pprof    = flag.Int("pprof", 1, "0: disable pprof, 1: enable http pprof, 2: enable blocking profile")
-	cprof    = flag.Int("cprof", 0, "0: disable cloud profiler, 1: enable cloud profiler, 2: also enable mtx profile")
-	prodlog  = flag.Bool("prodlog", false, "use production logging mode")
-	loglevel = flag.Int("v", 2, "logging level. 1:error, 2:info, 3:debug")
-	mcsdelay = flag.Duration("mcsdelay", 0, "mcs room delay for network lag emulation")
+	configPath = flag.String("config", "", "path to yaml config file")
+	cpu        = flag.Int("cpu", 2, "setting GOMAXPROCS")
+	pprof      = flag.Int("pprof", 1, "0: disable pprof, 1: enable http pprof, 2: enable blocking profile")
+	cprof      = flag.Int("cprof", 0, "0: disable cloud profiler, 1: enable cloud profiler, 2: also enable mtx profile")
+	prodlog    = flag.Bool("prodlog", false, "use production logging mode")
+	loglevel   = flag.Int("v", 2, "logging level. 1:error, 2:info, 3:debug")
+	mcsdelay   = flag.Duration("mcsdelay", 0, "mcs room delay for network lag emulation")
+	mcsimpair  = flag.String("mcsimpair", "", "mcs udp network impairment for all peers e.g. latency=50ms,jitter=10ms,loss=0.05,dup=0.01,reorder=0.02")
+	mcsops     = flag.Int("mcsops", 0, "0: disable, otherwise the port to serve the mcs ops api on 127.0.0.1")
+	mcstrace   = flag.String("mcstrace", "", "record inbound mcs udp packets to the trace file for mcsreplay")
 )
 
 var (
 	logger *zap.Logger
 )
 
-type Config struct {
-	LobbyAddr        string `env:"GDXSV_LOBBY_ADDR" envDefault:"localhost:3333"`
-	LobbyPublicAddr  string `env:"GDXSV_LOBBY_PUBLIC_ADDR" envDefault:"127.0.0.1:3333"`
-	LobbyHttpAddr    string `env:"GDXSV_LOBBY_HTTP_ADDR" envDefault:":3380"`
-	BattleAddr       string `env:"GDXSV_BATTLE_ADDR" envDefault:"localhost:3334"`
-	BattlePublicAddr string `env:"GDXSV_BATTLE_PUBLIC_ADDR" envDefault:"127.0.0.1:3334"`
-	BattleRegion     string `env:"GDXSV_BATTLE_REGION" envDefault:""`
-	BattleLogPath    string `env:"GDXSV_BATTLE_LOG_PATH" envDefault:"./battlelog"`
-
-	GCPProjectID string `env:"GDXSV_GCP_PROJECT_ID" envDefault:""`
-	GCPKeyPath   string `env:"GDXSV_GCP_KEY_PATH" envDefault:""`
-	McsFuncURL   string `env:"GDXSV_MCSFUNC_URL" envDefault:""`
-	WebhookUrl   string `env:"GDXSV_WEBHOOK_URL" envDefault:""`
-
-	DBName string `env:"GDXSV_DB_NAME" envDefault:"gdxsv.db"`
-}
-
 func printHeader() {
 	fmt.Println("   ========================================================================")
 	fmt.Println("    gdxsv - Mobile Suit Gundam: Federation vs. Zeon&DX Private Game Server.")
@@ -86,7 +61,7 @@ func printHeader() {
 
 func printUsage() {
 	fmt.Print(`
-Usage: gdxsv <Flags...> [lbs, mcs, initdb, migratedb]
+Usage: gdxsv <Flags...> [lbs, mcs, initdb, migratedb, config check, mcsreplay, loadtest, dump]
 
   lbs: Serve lobby server and default battle server.
     A lbs hosts PS2, DC1 and DC2 version, but their lobbies are separated internally.
@@ -104,22 +79,28 @@ Usage: gdxsv <Flags...> [lbs, mcs, initdb, migratedb]
     It is supposed to run this command before you run updated gdxsv.
 
   update_replay_url: Update battle_record.replay_url in database from 'gsutil ls' result.
+
+  config check: Print the effective configuration and validate it.
+    The configuration is loaded from the -config file and GDXSV_* environment variables.
+    Send SIGHUP to lbs or mcs to reload the 'reloadable' section of the configuration.
+
+  mcsreplay [-speed 1] [-grace 1s] <trace file>: Replay a trace recorded by -mcstrace.
+    The packets are sent to a local mcs as simulated peers,
+    then the order and the sequence of relayed messages are verified.
+
+  loadtest [-users 100] [-battles 10] [-duration 1m] ...: Run simulated clients against a lbs and its mcs.
+    Lobby clients login, enter a lobby and chat, and 4*battles of them enter matching and play battles.
+    Latency percentiles and the increase of the server metrics are printed as JSON.
+
+  dump [-json] <capture file>: Decode lobby messages captured by the /ops/capture API.
+    Each message is printed with its command name, direction and known body fields.
+
 Flags:
 
 `)
 	flag.PrintDefaults()
 }
 
-func loadConfig() {
-	var c Config
-	if err := env.Parse(&c); err != nil {
-		logger.Fatal("config load failed", zap.Error(err))
-	}
-
-	logger.Info("config loaded", zap.Any("config", c))
-	conf = c
-}
-
 func pprofPort(mode string) int {
 	switch mode {
 	case "lbs":
@@ -192,11 +173,15 @@ func mainLbs() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	defer stop()
 
+	go watchConfigReload(ctx)
+
 	lbs := NewLbs()
 	go lbs.ListenAndServe(stripHost(conf.LobbyAddr))
 
 	mcs := NewMcs(*mcsdelay)
+	setupMcsTrace(mcs)
 	go mcs.ListenAndServe(stripHost(conf.BattleAddr))
+	setupMcsImpairment(mcs)
 
 	if conf.LobbyHttpAddr != "" {
 		lbs.RegisterHTTPHandlers()
@@ -219,24 +204,80 @@ func mainLbs() {
 	logger.Info("Shutdown")
 	lbs.Quit()
 	mcs.Quit()
+	if a, ok := lbs.mcsAllocator.(*LocalMcsAllocator); ok {
+		a.Stop()
+	}
 	time.Sleep(100 * time.Millisecond) // Grace to send Shutdown packet
 	logger.Info("Bye")
 }
 
 func mainMcs() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+
+	go watchConfigReload(ctx)
+
 	mcs := NewMcs(*mcsdelay)
+	setupMcsTrace(mcs)
 	go mcs.ListenAndServe(stripHost(conf.BattleAddr))
 	defer mcs.Quit()
+	setupMcsImpairment(mcs)
+
+	synced := make(chan struct{})
+	go func() {
+		defer close(synced)
+		for i := 0; i < 10; i++ {
+			err := mcs.DialAndSyncWithLbs(conf.LobbyPublicAddr, conf.BattlePublicAddr, conf.BattleRegion)
+			if err == nil || err == ErrMcsExit {
+				break
+			}
 
-	for i := 0; i < 10; i++ {
-		err := mcs.DialAndSyncWithLbs(conf.LobbyPublicAddr, conf.BattlePublicAddr, conf.BattleRegion)
-		if err == nil || err == ErrMcsExit {
-			break
+			logger.Error("failed to dial lbs", zap.Error(err))
+			logger.Info("Retry to connect to lbs in 30 seconds")
+			time.Sleep(30 * time.Second)
 		}
+	}()
 
-		logger.Error("failed to dial lbs", zap.Error(err))
-		logger.Info("Retry to connect to lbs in 30 seconds")
-		time.Sleep(30 * time.Second)
+	// NotifyContext disables the default termination by the signals, so the mcs must quit here.
+	select {
+	case <-synced:
+	case <-ctx.Done():
+		stop()
+		logger.Info("Shutdown")
+	}
+}
+
+// setupMcsImpairment applies -mcsimpair and enables the ops endpoints of the mcs if -mcsops is given.
+// The endpoints are served only on 127.0.0.1, apart from the lobby http server and the pprof server.
+func setupMcsImpairment(mcs *Mcs) {
+	m, err := parseImpairment(*mcsimpair)
+	if err != nil {
+		logger.Fatal("invalid mcsimpair", zap.Error(err))
+	}
+	if !m.IsZero() {
+		logger.Warn("mcs network impairment enabled", zap.Any("impairment", m))
+	}
+	mcsImpairments.Set("", "", m)
+
+	if *mcsops <= 0 {
+		return
+	}
+	mux := http.NewServeMux()
+	RegisterMcsHTTPHandlers(mux, mcs)
+	go func() {
+		addr := fmt.Sprintf("127.0.0.1:%v", *mcsops)
+		err := http.ListenAndServe(addr, mux)
+		logger.Error("http.ListenAndServe error", zap.Error(err), zap.String("addr", addr))
+	}()
+}
+
+// setupMcsTrace enables recording of -mcstrace.
+func setupMcsTrace(mcs *Mcs) {
+	if *mcstrace == "" {
+		return
+	}
+	if err := mcs.EnableTrace(*mcstrace); err != nil {
+		logger.Fatal("failed to open mcs trace", zap.Error(err))
 	}
 }
 
@@ -295,9 +336,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	command := args[0]
+	if command == "config" {
+		os.Exit(mainConfig(args[1:]))
+	}
+
 	loadConfig()
 
-	command := args[0]
 	prepareOption(command)
 
 	switch command {
@@ -306,6 +351,12 @@ func main() {
 		mainLbs()
 	case "mcs":
 		mainMcs()
+	case "mcsreplay":
+		os.Exit(mainMcsReplay(args[1:]))
+	case "loadtest":
+		os.Exit(mainLoadTest(args[1:]))
+	case "dump":
+		os.Exit(mainDump(args[1:]))
 	case "initdb":
 		_ = os.Remove(conf.DBName)
 		prepareDB()
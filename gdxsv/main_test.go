@@ -50,6 +50,7 @@ func TestMain(m *testing.M) {
 	*loglevel = 2
 
 	prepareLogger()
+	loadConfig()
 	prepareTestDB()
 
 	mustInsertDBAccount(DBAccount{LoginKey: "0000000000"})
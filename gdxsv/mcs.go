@@ -9,7 +9,9 @@ import (
 	"gdxsv/gdxsv/proto"
 	"go.uber.org/zap"
 	"net"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -33,6 +35,7 @@ type McsPeer interface {
 	GetCloseReason() string
 	SetCloseReason(string)
 	Logger() *zap.Logger
+	ConnStats() *McsConnStats
 }
 
 type BaseMcsPeer struct {
@@ -40,8 +43,45 @@ type BaseMcsPeer struct {
 	userID      string
 	roomID      string
 	position    int
-	closeReason string
+	closeReason atomic.Pointer[string]
 	logger      *zap.Logger
+	counter     mcsConnCounter
+}
+
+// mcsConnCounter counts the traffic of a peer. It is safe for concurrent use.
+type mcsConnCounter struct {
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+	lastRecv atomic.Int64 // unix nano
+	maxGap   atomic.Int64 // nano
+}
+
+func (c *mcsConnCounter) countRecv(n int, at time.Time) {
+	c.bytesIn.Add(int64(n))
+	now := at.UnixNano()
+	last := c.lastRecv.Swap(now)
+	if last == 0 {
+		return
+	}
+	for gap := now - last; ; {
+		cur := c.maxGap.Load()
+		if gap <= cur || c.maxGap.CompareAndSwap(cur, gap) {
+			return
+		}
+	}
+}
+
+func (c *mcsConnCounter) countSent(n int) {
+	c.bytesOut.Add(int64(n))
+}
+
+func (c *mcsConnCounter) stats(proto string) *McsConnStats {
+	return &McsConnStats{
+		Proto:    proto,
+		MaxGapMs: time.Duration(c.maxGap.Load()).Milliseconds(),
+		BytesIn:  c.bytesIn.Load(),
+		BytesOut: c.bytesOut.Load(),
+	}
 }
 
 func (p *BaseMcsPeer) SetUserID(userID string) {
@@ -76,15 +116,16 @@ func (p *BaseMcsPeer) McsRoomID() string {
 	return p.roomID
 }
 
+// SetCloseReason sets the reason only once, it may be called from the read and write goroutines.
 func (p *BaseMcsPeer) SetCloseReason(reason string) {
-	if p.closeReason == "" {
-		p.closeReason = reason
+	if reason != "" {
+		p.closeReason.CompareAndSwap(nil, &reason)
 	}
 }
 
 func (p *BaseMcsPeer) GetCloseReason() string {
-	if p.closeReason != "" {
-		return p.closeReason
+	if reason := p.closeReason.Load(); reason != nil {
+		return *reason
 	}
 	return "unknown"
 }
@@ -98,6 +139,7 @@ type Mcs struct {
 	updated time.Time
 	rooms   map[string]*McsRoom
 	delay   time.Duration
+	trace   *McsTraceRecorder
 }
 
 func NewMcs(delay time.Duration) *Mcs {
@@ -129,19 +171,23 @@ func (mcs *Mcs) ListenAndServe(addr string) {
 }
 
 func (mcs *Mcs) DialAndSyncWithLbs(lobbyAddr string, battlePublicAddr string, battleRegion string) error {
-	conn, err := net.Dial("tcp4", lobbyAddr)
+	conn, err := net.Dial("tcp", lobbyAddr)
 	if err != nil {
 		return err
 	}
 	defer conn.Close()
 
 	status := McsStatus{
-		PublicAddr: battlePublicAddr,
-		Region:     battleRegion,
-		UpdatedAt:  time.Now(),
-		Users:      []*McsUser{},
-		Games:      []*McsGame{},
+		PublicAddr:  battlePublicAddr,
+		PublicAddr6: conf.BattlePublicAddr6,
+		Region:      battleRegion,
+		UpdatedAt:   time.Now(),
+		Users:       []*McsUser{},
+		Games:       []*McsGame{},
+		Capacity:    conf.McsMaxGames,
 	}
+	procSlow := mcsProcOver10Ms.Value()
+	errs := mcsErrors.Value()
 
 	var sendStatusBuf bytes.Buffer
 	sendMcsStatus := func() error {
@@ -215,7 +261,12 @@ func (mcs *Mcs) DialAndSyncWithLbs(lobbyAddr string, battlePublicAddr string, ba
 				if msg != nil {
 					switch msg.Command {
 					case lbsExtSyncSharedData:
-						body := msg.Reader().ReadBytes()
+						r := msg.Reader()
+						body := r.ReadBytes()
+						if r.Err() != nil {
+							logger.Error("malformed lbs status", zap.Error(r.Err()))
+							continue
+						}
 						gr, err := gzip.NewReader(bytes.NewReader(body))
 						if err != nil {
 							logger.Error("gzip.NewReader", zap.Error(err), zap.Binary("body", body))
@@ -247,8 +298,13 @@ func (mcs *Mcs) DialAndSyncWithLbs(lobbyAddr string, battlePublicAddr string, ba
 			return ctx.Err()
 		case <-ticker.C:
 			status.UpdatedAt = mcs.LastUpdated()
+			mcs.shareConnStats()
 			status.Users = sharedData.GetMcsUsers()
 			status.Games = sharedData.GetMcsGames()
+			status.ProcSlow = mcsProcOver10Ms.Value() - procSlow
+			procSlow += status.ProcSlow
+			status.Errors = mcsErrors.Value() - errs
+			errs += status.Errors
 			err = sendMcsStatus()
 			if err != nil {
 				logger.Warn("failed to send mcsStatus", zap.Error(err))
@@ -257,7 +313,7 @@ func (mcs *Mcs) DialAndSyncWithLbs(lobbyAddr string, battlePublicAddr string, ba
 
 			sharedData.RemoveStaleData()
 
-			if 15 <= time.Since(status.UpdatedAt).Minutes() && len(status.Users) == 0 {
+			if getReloadableConfig().McsIdleExitTimeout <= time.Since(status.UpdatedAt) && len(status.Users) == 0 {
 				logger.Info("mcs exit", zap.String("mcs-metrics", mcsMetrics.String()))
 				return ErrMcsExit
 			}
@@ -265,8 +321,21 @@ func (mcs *Mcs) DialAndSyncWithLbs(lobbyAddr string, battlePublicAddr string, ba
 	}
 }
 
+// EnableTrace starts recording inbound udp packets to the trace file.
+func (mcs *Mcs) EnableTrace(path string) error {
+	t, err := NewMcsTraceRecorder(path)
+	if err != nil {
+		return err
+	}
+	mcs.trace = t
+	logger.Info("mcs trace enabled", zap.String("path", path))
+	return nil
+}
+
 func (mcs *Mcs) Quit() {
-	// TODO impl
+	if mcs.trace != nil {
+		_ = mcs.trace.Close()
+	}
 }
 
 func (mcs *Mcs) LastUpdated() time.Time {
@@ -276,6 +345,23 @@ func (mcs *Mcs) LastUpdated() time.Time {
 	return t
 }
 
+// RoomStats returns the delivery stats of the rooms.
+func (mcs *Mcs) RoomStats() []*McsRoomStats {
+	mcs.mtx.Lock()
+	rooms := make([]*McsRoom, 0, len(mcs.rooms))
+	for _, room := range mcs.rooms {
+		rooms = append(rooms, room)
+	}
+	mcs.mtx.Unlock()
+
+	ret := make([]*McsRoomStats, 0, len(rooms))
+	for _, room := range rooms {
+		ret = append(ret, room.Stats())
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].BattleCode < ret[j].BattleCode })
+	return ret
+}
+
 func (mcs *Mcs) Join(p McsPeer, sessionID string) *McsRoom {
 	user, ok := sharedData.GetBattleUserInfo(sessionID)
 	if !ok {
@@ -313,9 +399,28 @@ func (mcs *Mcs) Join(p McsPeer, sessionID string) *McsRoom {
 	return room
 }
 
-func (mcs *Mcs) OnUserLeft(room *McsRoom, sessionID string, closeReason string) {
+// shareConnStats updates the connection stats of the users in the rooms to be sent to the lbs.
+func (mcs *Mcs) shareConnStats() {
+	mcs.mtx.Lock()
+	rooms := make([]*McsRoom, 0, len(mcs.rooms))
+	for _, room := range mcs.rooms {
+		rooms = append(rooms, room)
+	}
+	mcs.mtx.Unlock()
+
+	for _, room := range rooms {
+		for sessionID, stats := range room.ConnStats() {
+			sharedData.SetMcsUserConnStats(sessionID, stats)
+		}
+	}
+}
+
+func (mcs *Mcs) OnUserLeft(room *McsRoom, sessionID string, closeReason string, stats *McsConnStats) {
+	// The final stats are set last since the lbs in the same process takes the user when they are set.
 	sharedData.SetMcsUserCloseReason(sessionID, closeReason)
 	sharedData.UpdateMcsUserState(sessionID, McsUserStateLeft)
+	stats.Final = true
+	sharedData.SetMcsUserConnStats(sessionID, stats)
 }
 
 func (mcs *Mcs) OnMcsRoomClose(room *McsRoom) {
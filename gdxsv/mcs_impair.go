@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Impairment is a network impairment emulated for battle packets of mcs udp peers.
+// It is applied to each of the send path and the receive path,
+// so the round trip time increases by twice the latency.
+type Impairment struct {
+	Latency   time.Duration `json:"latency"`
+	Jitter    time.Duration `json:"jitter"`
+	Loss      float64       `json:"loss"`      // probability of dropping a packet
+	Duplicate float64       `json:"duplicate"` // probability of delivering a packet twice
+	Reorder   float64       `json:"reorder"`   // probability of delivering a packet without the latency
+}
+
+func (m Impairment) IsZero() bool {
+	return m == Impairment{}
+}
+
+// parseImpairment parses an impairment such as "latency=50ms,jitter=10ms,loss=0.05,dup=0.01,reorder=0.02".
+func parseImpairment(s string) (Impairment, error) {
+	var m Impairment
+	if strings.TrimSpace(s) == "" {
+		return m, nil
+	}
+
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return m, fmt.Errorf("invalid impairment %q", kv)
+		}
+		switch k {
+		case "latency", "jitter":
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				return m, fmt.Errorf("invalid impairment %q", kv)
+			}
+			if k == "latency" {
+				m.Latency = d
+			} else {
+				m.Jitter = d
+			}
+		case "loss", "dup", "reorder":
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil || f < 0 || 1 < f {
+				return m, fmt.Errorf("invalid impairment %q", kv)
+			}
+			switch k {
+			case "loss":
+				m.Loss = f
+			case "dup":
+				m.Duplicate = f
+			case "reorder":
+				m.Reorder = f
+			}
+		default:
+			return m, fmt.Errorf("unknown impairment %q", k)
+		}
+	}
+	return m, nil
+}
+
+// delays returns when the packet is delivered, it is empty if the packet is dropped.
+func (m Impairment) delays(rnd *rand.Rand) []time.Duration {
+	if m.Loss != 0 && rnd.Float64() < m.Loss {
+		return nil
+	}
+
+	n := 1
+	if m.Duplicate != 0 && rnd.Float64() < m.Duplicate {
+		n = 2
+	}
+
+	ret := make([]time.Duration, 0, n)
+	for i := 0; i < n; i++ {
+		if m.Reorder != 0 && rnd.Float64() < m.Reorder {
+			ret = append(ret, 0)
+			continue
+		}
+		d := m.Latency
+		if 0 < m.Jitter {
+			d += time.Duration(rnd.Int63n(int64(2*m.Jitter+1))) - m.Jitter
+		}
+		if d < 0 {
+			d = 0
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// McsImpairments holds impairments for all peers, rooms and users.
+// A user impairment has priority over a room impairment, and a room impairment over the default.
+type McsImpairments struct {
+	mtx   sync.Mutex
+	rnd   *rand.Rand
+	def   Impairment
+	rooms map[string]Impairment // battle_code -> impairment
+	users map[string]Impairment // user_id -> impairment
+}
+
+var mcsImpairments = NewMcsImpairments()
+
+func NewMcsImpairments() *McsImpairments {
+	return &McsImpairments{
+		rnd:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		rooms: map[string]Impairment{},
+		users: map[string]Impairment{},
+	}
+}
+
+// Set sets the impairment of the user, the room or the default if both are empty.
+// A zero impairment removes the setting.
+func (s *McsImpairments) Set(userID, battleCode string, m Impairment) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	switch {
+	case userID != "":
+		if m.IsZero() {
+			delete(s.users, userID)
+		} else {
+			s.users[userID] = m
+		}
+	case battleCode != "":
+		if m.IsZero() {
+			delete(s.rooms, battleCode)
+		} else {
+			s.rooms[battleCode] = m
+		}
+	default:
+		s.def = m
+	}
+}
+
+// Get returns the impairment for the peer.
+func (s *McsImpairments) Get(userID, battleCode string) Impairment {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if m, ok := s.users[userID]; ok {
+		return m
+	}
+	if m, ok := s.rooms[battleCode]; ok {
+		return m
+	}
+	return s.def
+}
+
+// Schedule calls deliver as a packet goes through the impaired network.
+// deliver may be called zero, one or two times, and later from another goroutine.
+func (s *McsImpairments) Schedule(m Impairment, deliver func()) {
+	s.mtx.Lock()
+	delays := m.delays(s.rnd)
+	s.mtx.Unlock()
+
+	for _, d := range delays {
+		if d == 0 {
+			deliver()
+		} else {
+			time.AfterFunc(d, deliver)
+		}
+	}
+}
+
+func (s *McsImpairments) MarshalJSON() ([]byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return json.Marshal(struct {
+		Default Impairment            `json:"default"`
+		Rooms   map[string]Impairment `json:"rooms"`
+		Users   map[string]Impairment `json:"users"`
+	}{s.def, s.rooms, s.users})
+}
+
+// RegisterMcsHTTPHandlers registers the ops endpoints to change network impairments and to show room stats of the mcs.
+func RegisterMcsHTTPHandlers(mux *http.ServeMux, mcs *Mcs) {
+	mux.HandleFunc("/ops/mcs/impair", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Emulates a bad network for battle packets of udp peers.
+		// GET shows the current settings.
+		// POST ?user_id=&battle_code=&spec=latency=50ms,jitter=10ms,loss=0.05,dup=0.01,reorder=0.02
+		// sets the impairment of the user, the room or the default. Empty spec removes it.
+		if r.Method == http.MethodPost {
+			m, err := parseImpairment(r.FormValue("spec"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			mcsImpairments.Set(r.FormValue("user_id"), r.FormValue("battle_code"), m)
+			logger.Info("mcs impairment updated",
+				zap.String("user_id", r.FormValue("user_id")),
+				zap.String("battle_code", r.FormValue("battle_code")),
+				zap.Any("impairment", m))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(mcsImpairments); err != nil {
+			logger.Error("Write response failed", zap.Error(err))
+		}
+	})
+
+	mux.HandleFunc("/ops/mcs/rooms", func(w http.ResponseWriter, r *http.Request) {
+		// Private API: Shows rtt, loss and resend/drop counters of battle messages per room.
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(mcs.RoomStats()); err != nil {
+			logger.Error("Write response failed", zap.Error(err))
+		}
+	})
+}
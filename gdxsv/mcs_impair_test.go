@@ -0,0 +1,83 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func Test_parseImpairment(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		want    Impairment
+		wantErr bool
+	}{
+		{"empty", "", Impairment{}, false},
+		{"all", "latency=50ms, jitter=10ms, loss=0.05, dup=0.01, reorder=0.02",
+			Impairment{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.05, Duplicate: 0.01, Reorder: 0.02}, false},
+		{"unknown key", "delay=50ms", Impairment{}, true},
+		{"negative latency", "latency=-1ms", Impairment{}, true},
+		{"probability over 1", "loss=1.5", Impairment{}, true},
+		{"not a duration", "jitter=10", Impairment{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseImpairment(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+			if !tt.wantErr {
+				assertEq(t, tt.want, got)
+			}
+		})
+	}
+}
+
+func TestImpairment_delays(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	assertEq(t, []time.Duration{0}, Impairment{}.delays(rnd))
+	assertEq(t, 0, len(Impairment{Loss: 1}.delays(rnd)))
+	assertEq(t, []time.Duration{time.Millisecond, time.Millisecond}, Impairment{Latency: time.Millisecond, Duplicate: 1}.delays(rnd))
+	assertEq(t, []time.Duration{0}, Impairment{Latency: time.Millisecond, Reorder: 1}.delays(rnd))
+
+	m := Impairment{Latency: 50 * time.Millisecond, Jitter: 10 * time.Millisecond}
+	for i := 0; i < 100; i++ {
+		d := m.delays(rnd)
+		assertEq(t, 1, len(d))
+		if d[0] < 40*time.Millisecond || 60*time.Millisecond < d[0] {
+			t.Fatal("delay out of range", d[0])
+		}
+	}
+}
+
+func TestMcsImpairments(t *testing.T) {
+	s := NewMcsImpairments()
+	def := Impairment{Latency: 10 * time.Millisecond}
+	room := Impairment{Latency: 20 * time.Millisecond}
+	user := Impairment{Loss: 0.5}
+
+	s.Set("", "", def)
+	s.Set("", "BATTLE01", room)
+	s.Set("USER01", "", user)
+
+	assertEq(t, user, s.Get("USER01", "BATTLE01"))
+	assertEq(t, room, s.Get("USER02", "BATTLE01"))
+	assertEq(t, def, s.Get("USER02", "BATTLE02"))
+
+	// A zero impairment removes the setting.
+	s.Set("USER01", "", Impairment{})
+	assertEq(t, room, s.Get("USER01", "BATTLE01"))
+
+	delivered := make(chan time.Duration, 2)
+	start := time.Now()
+	s.Schedule(Impairment{Latency: 30 * time.Millisecond, Duplicate: 1}, func() {
+		delivered <- time.Since(start)
+	})
+	for i := 0; i < 2; i++ {
+		if d := <-delivered; d < 30*time.Millisecond {
+			t.Fatal("delivered too early", d)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"gdxsv/gdxsv/proto"
+	pb "google.golang.org/protobuf/proto"
+)
+
+// McsReplayOptions are options to replay a mcs trace.
+type McsReplayOptions struct {
+	Speed float64       // replay speed, 2 replays twice as fast
+	Grace time.Duration // wait for relayed messages after the last packet
+}
+
+// McsReplayResult is the result of a replay.
+type McsReplayResult struct {
+	Peers  []*McsReplayPeerResult `json:"peers"`
+	Errors []string               `json:"errors,omitempty"`
+}
+
+type McsReplayPeerResult struct {
+	Peer       string         `json:"peer"`
+	UserID     string         `json:"user_id"`
+	BattleCode string         `json:"battle_code"`
+	Sent       int            `json:"sent"`     // messages the mcs accepts from the peer
+	Received   map[string]int `json:"received"` // user_id -> messages relayed from the user
+}
+
+// replayPeer is a simulated client that sends recorded packets of a peer.
+type replayPeer struct {
+	addr   string
+	user   *McsUser
+	conn   *net.UDPConn
+	filter *proto.MessageFilter
+	sent   []*proto.BattleMessage
+
+	mtx      sync.Mutex
+	ack      uint32
+	received []*proto.BattleMessage
+	echoed   int
+}
+
+func (p *replayPeer) userID() string {
+	if p.user == nil {
+		return ""
+	}
+	return p.user.UserID
+}
+
+func (p *replayPeer) battleCode() string {
+	if p.user == nil {
+		return ""
+	}
+	return p.user.BattleCode
+}
+
+func (p *replayPeer) readLoop() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := p.conn.Read(buf)
+		if err != nil {
+			return
+		}
+		pkt := new(proto.Packet)
+		if err := pb.Unmarshal(buf[:n], pkt); err != nil || pkt.GetType() != proto.MessageType_Battle {
+			continue
+		}
+
+		p.mtx.Lock()
+		p.ack = pkt.GetSeq()
+		for _, msg := range pkt.GetBattleData() {
+			if msg.GetUserId() == p.userID() {
+				p.echoed++
+			}
+			if p.filter.Filter(msg) {
+				p.received = append(p.received, msg)
+			}
+		}
+		p.mtx.Unlock()
+	}
+}
+
+// sign signs the packet with the session key of the recorded user, if any.
+func (p *replayPeer) sign(data []byte) []byte {
+	if p.user == nil || p.user.SessionKey == nil {
+		return data
+	}
+	return proto.SignPacket(data, p.user.SessionKey)
+}
+
+// send sends the recorded packet, the ack is replaced with the one of this replay.
+// The packet is signed again since the recorded hmac does not match the new ack.
+func (p *replayPeer) send(data []byte) error {
+	pkt := new(proto.Packet)
+	if err := pb.Unmarshal(data, pkt); err != nil {
+		return err
+	}
+	if pkt.GetType() == proto.MessageType_Battle {
+		p.mtx.Lock()
+		pkt.Ack = p.ack
+		p.mtx.Unlock()
+		pkt.Hmac = nil
+		var err error
+		if data, err = pb.Marshal(pkt); err != nil {
+			return err
+		}
+		data = p.sign(data)
+	}
+	_, err := p.conn.Write(data)
+	return err
+}
+
+// expectedMessages returns messages that the mcs accepts from the peer in order.
+func expectedMessages(userID string, records []*McsTraceRecord, addr string) []*proto.BattleMessage {
+	filter := proto.NewMessageFilter([]string{userID})
+	var ret []*proto.BattleMessage
+	for _, rec := range records {
+		if rec.Peer != addr || rec.Data == nil {
+			continue
+		}
+		pkt := new(proto.Packet)
+		if err := pb.Unmarshal(rec.Data, pkt); err != nil || pkt.GetType() != proto.MessageType_Battle {
+			continue
+		}
+		for _, msg := range pkt.GetBattleData() {
+			if filter.Filter(msg) {
+				ret = append(ret, msg)
+			}
+		}
+	}
+	return ret
+}
+
+// verifyRelay checks that received messages are a contiguous run of the sent messages in order.
+func verifyRelay(sent, received []*proto.BattleMessage) error {
+	if len(received) == 0 {
+		return nil
+	}
+	start := -1
+	for i, msg := range sent {
+		if msg.GetSeq() == received[0].GetSeq() {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return fmt.Errorf("seq %d was never sent", received[0].GetSeq())
+	}
+	for i, msg := range received {
+		if len(sent) <= start+i {
+			return fmt.Errorf("seq %d was never sent", msg.GetSeq())
+		}
+		want := sent[start+i]
+		if msg.GetSeq() != want.GetSeq() {
+			return fmt.Errorf("seq %d received, want %d", msg.GetSeq(), want.GetSeq())
+		}
+		if !bytes.Equal(msg.GetBody(), want.GetBody()) {
+			return fmt.Errorf("body of seq %d differs", msg.GetSeq())
+		}
+	}
+	return nil
+}
+
+// ReplayMcsTrace replays the trace against a mcs on localhost as simulated peers,
+// and verifies the order and the sequence of the relayed messages.
+func ReplayMcsTrace(records []*McsTraceRecord, opts McsReplayOptions) (*McsReplayResult, error) {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Time < records[j].Time
+	})
+
+	peers := map[string]*replayPeer{}
+	var order []string
+	for _, rec := range records {
+		p, ok := peers[rec.Peer]
+		if !ok {
+			p = &replayPeer{addr: rec.Peer}
+			peers[rec.Peer] = p
+			order = append(order, rec.Peer)
+		}
+		if rec.User != nil && rec.Game != nil {
+			user, game := *rec.User, *rec.Game
+			user.State, user.UpdatedAt = McsUserStateCreated, time.Now()
+			game.State, game.UpdatedAt = McsGameStateCreated, time.Now()
+			sharedData.ShareMcsGame(&game)
+			sharedData.ShareMcsUser(&user)
+			p.user = &user
+		}
+	}
+
+	mcs := NewMcs(0)
+	sv := NewUDPServer(mcs)
+	if err := sv.Listen("127.0.0.1:0"); err != nil {
+		return nil, err
+	}
+	defer sv.Close()
+	go sv.readLoop()
+
+	svAddr := sv.conn.LocalAddr().(*net.UDPAddr)
+	for _, addr := range order {
+		p := peers[addr]
+		var others []string
+		for _, q := range peers {
+			if q != p && q.user != nil && q.battleCode() == p.battleCode() {
+				others = append(others, q.userID())
+			}
+		}
+		p.filter = proto.NewMessageFilter(others)
+		p.sent = expectedMessages(p.userID(), records, addr)
+
+		conn, err := net.DialUDP("udp", nil, svAddr)
+		if err != nil {
+			return nil, err
+		}
+		defer conn.Close()
+		p.conn = conn
+		go p.readLoop()
+	}
+
+	var t0 int64
+	start := time.Now()
+	for _, rec := range records {
+		if rec.Data == nil {
+			continue
+		}
+		if t0 == 0 {
+			t0 = rec.Time
+		}
+		at := start.Add(time.Duration(float64(rec.Time-t0) / opts.Speed))
+		time.Sleep(time.Until(at))
+		if err := peers[rec.Peer].send(rec.Data); err != nil {
+			return nil, err
+		}
+	}
+	time.Sleep(opts.Grace)
+
+	for _, p := range peers {
+		if p.user == nil {
+			continue
+		}
+		fin, _ := pb.Marshal(&proto.Packet{
+			Type:      proto.MessageType_Fin,
+			SessionId: p.user.SessionID,
+			FinData:   &proto.FinMessage{Detail: "replay_end"},
+		})
+		_, _ = p.conn.Write(p.sign(fin))
+	}
+
+	result := &McsReplayResult{}
+	for _, addr := range order {
+		p := peers[addr]
+		p.mtx.Lock()
+		r := &McsReplayPeerResult{
+			Peer:       addr,
+			UserID:     p.userID(),
+			BattleCode: p.battleCode(),
+			Sent:       len(p.sent),
+			Received:   map[string]int{},
+		}
+		if 0 < p.echoed {
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %d own messages relayed back", r.UserID, p.echoed))
+		}
+		bySender := map[string][]*proto.BattleMessage{}
+		for _, msg := range p.received {
+			bySender[msg.GetUserId()] = append(bySender[msg.GetUserId()], msg)
+		}
+		p.mtx.Unlock()
+
+		for _, q := range peers {
+			if q == p || q.user == nil {
+				continue
+			}
+			received := bySender[q.userID()]
+			if len(received) == 0 && q.battleCode() != p.battleCode() {
+				continue
+			}
+			r.Received[q.userID()] = len(received)
+			if err := verifyRelay(q.sent, received); err != nil {
+				result.Errors = append(result.Errors, fmt.Sprintf("%s from %s: %v", r.UserID, q.userID(), err))
+			}
+		}
+		result.Peers = append(result.Peers, r)
+	}
+	sort.Strings(result.Errors)
+	return result, nil
+}
+
+func mainMcsReplay(args []string) int {
+	fs := flag.NewFlagSet("mcsreplay", flag.ExitOnError)
+	speed := fs.Float64("speed", 1, "replay speed")
+	grace := fs.Duration("grace", time.Second, "wait for relayed messages after the last packet")
+	_ = fs.Parse(args)
+	if fs.NArg() < 1 {
+		fmt.Fprintln(os.Stderr, "usage: gdxsv mcsreplay [-speed 1] [-grace 1s] <trace file>")
+		return 1
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	records, err := ReadMcsTrace(f)
+	f.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	// Battle logs of the replay are not kept.
+	dir, err := os.MkdirTemp("", "gdxsv-mcsreplay")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	conf.BattleLogPath = dir
+
+	result, err := ReplayMcsTrace(records, McsReplayOptions{Speed: *speed, Grace: *grace})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return 1
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(result)
+	if 0 < len(result.Errors) {
+		return 1
+	}
+	return 0
+}
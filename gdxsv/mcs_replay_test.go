@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"gdxsv/gdxsv/proto"
+	pb "google.golang.org/protobuf/proto"
+)
+
+func Test_verifyRelay(t *testing.T) {
+	msg := func(seq uint32, body string) *proto.BattleMessage {
+		return &proto.BattleMessage{UserId: "USER01", Seq: seq, Body: []byte(body)}
+	}
+	sent := []*proto.BattleMessage{msg(1, "a"), msg(2, "b"), msg(3, "c")}
+
+	tests := []struct {
+		name     string
+		received []*proto.BattleMessage
+		wantErr  bool
+	}{
+		{"nothing", nil, false},
+		{"all", []*proto.BattleMessage{msg(1, "a"), msg(2, "b"), msg(3, "c")}, false},
+		{"joined late", []*proto.BattleMessage{msg(2, "b"), msg(3, "c")}, false},
+		{"left early", []*proto.BattleMessage{msg(1, "a"), msg(2, "b")}, false},
+		{"skipped", []*proto.BattleMessage{msg(1, "a"), msg(3, "c")}, true},
+		{"reordered", []*proto.BattleMessage{msg(2, "b"), msg(1, "a")}, true},
+		{"duplicated", []*proto.BattleMessage{msg(1, "a"), msg(1, "a")}, true},
+		{"body differs", []*proto.BattleMessage{msg(1, "x")}, true},
+		{"never sent", []*proto.BattleMessage{msg(4, "d")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyRelay(sent, tt.received)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("wantErr %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestReplayMcsTrace(t *testing.T) {
+	t.Run("unsigned", func(t *testing.T) {
+		testReplayMcsTrace(t, nil)
+	})
+	t.Run("signed", func(t *testing.T) {
+		// The acks are rewritten by the replay, so the packets must be signed again.
+		testReplayMcsTrace(t, genBattleSessionKey())
+	})
+}
+
+func testReplayMcsTrace(t *testing.T, sessionKey []byte) {
+	defer func(path string) { conf.BattleLogPath = path }(conf.BattleLogPath)
+	conf.BattleLogPath = t.TempDir()
+	defer func() {
+		sharedData.Lock()
+		sharedData.mcsGames = map[string]*McsGame{}
+		sharedData.mcsUsers = map[string]*McsUser{}
+		sharedData.Unlock()
+	}()
+
+	game := &McsGame{BattleCode: "REPLAY01"}
+	userA := &McsUser{BattleCode: "REPLAY01", UserID: "USERAA", SessionID: "SESSIONA", Pos: 1, SessionKey: sessionKey}
+	userB := &McsUser{BattleCode: "REPLAY01", UserID: "USERBB", SessionID: "SESSIONB", Pos: 2, SessionKey: sessionKey}
+
+	packet := func(pkt *proto.Packet) []byte {
+		data, err := pb.Marshal(pkt)
+		must(t, err)
+		if sessionKey != nil {
+			data = proto.SignPacket(data, sessionKey)
+		}
+		return data
+	}
+	hello := func(sessionID string) []byte {
+		return packet(&proto.Packet{Type: proto.MessageType_HelloServer, SessionId: sessionID})
+	}
+	battle := func(u *McsUser, seqs ...uint32) []byte {
+		pkt := &proto.Packet{Type: proto.MessageType_Battle, SessionId: u.SessionID}
+		for _, seq := range seqs {
+			pkt.BattleData = append(pkt.BattleData, &proto.BattleMessage{UserId: u.UserID, Seq: seq, Body: []byte{byte(seq)}})
+		}
+		return packet(pkt)
+	}
+
+	ms := int64(time.Millisecond)
+	records := []*McsTraceRecord{
+		{Time: 0, Peer: "A", User: userA, Game: game},
+		{Time: 0, Peer: "B", User: userB, Game: game},
+		{Time: 1 * ms, Peer: "A", Data: hello(userA.SessionID)},
+		{Time: 2 * ms, Peer: "B", Data: hello(userB.SessionID)},
+		{Time: 50 * ms, Peer: "A", Data: battle(userA, 1, 2)},
+		{Time: 60 * ms, Peer: "B", Data: battle(userB, 1)},
+		// Resent messages are filtered by the mcs.
+		{Time: 70 * ms, Peer: "A", Data: battle(userA, 1, 2, 3)},
+		{Time: 80 * ms, Peer: "B", Data: battle(userB, 1, 2)},
+		{Time: 90 * ms, Peer: "A", Data: battle(userA, 3, 4)},
+	}
+
+	result, err := ReplayMcsTrace(records, McsReplayOptions{Speed: 1, Grace: 300 * time.Millisecond})
+	must(t, err)
+
+	assertEq(t, 0, len(result.Errors))
+	assertEq(t, 2, len(result.Peers))
+	assertEq(t, "USERAA", result.Peers[0].UserID)
+	assertEq(t, 4, result.Peers[0].Sent)
+	assertEq(t, map[string]int{"USERBB": 2}, result.Peers[0].Received)
+	assertEq(t, "USERBB", result.Peers[1].UserID)
+	assertEq(t, 2, result.Peers[1].Sent)
+	assertEq(t, map[string]int{"USERAA": 4}, result.Peers[1].Received)
+}
@@ -20,11 +20,33 @@ type McsRoom struct {
 	mcs   *Mcs
 	game  *McsGame
 	peers []McsPeer
+	left  []*McsPeerStats // stats of the peers that left
 
 	logMtx    sync.RWMutex
 	battleLog *proto.BattleLogFile
 }
 
+// battleStatsPeer is a peer that sends battle messages through a proto.BattleBuffer.
+type battleStatsPeer interface {
+	BattleStats() proto.BattleBufferStats
+}
+
+// McsPeerStats is the delivery stats of battle messages sent to a peer.
+type McsPeerStats struct {
+	UserID string `json:"user_id"`
+	Pos    int    `json:"pos"`
+	Left   bool   `json:"left"`
+	proto.BattleBufferStats
+}
+
+// McsRoomStats is the delivery stats of battle messages in a room.
+type McsRoomStats struct {
+	BattleCode string          `json:"battle_code"`
+	Resent     int64           `json:"resent"`
+	Dropped    int64           `json:"dropped"`
+	Peers      []*McsPeerStats `json:"peers"`
+}
+
 func newMcsRoom(mcs *Mcs, gameInfo *McsGame) *McsRoom {
 	room := &McsRoom{
 		mcs:  mcs,
@@ -91,6 +113,49 @@ func (r *McsRoom) SendMessage(peer McsPeer, msg *proto.BattleMessage) {
 	r.logMtx.Unlock()
 }
 
+// Stats returns the delivery stats of the peers in the room including the peers that left.
+func (r *McsRoom) Stats() *McsRoomStats {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	return r.statsLocked()
+}
+
+func (r *McsRoom) statsLocked() *McsRoomStats {
+	st := &McsRoomStats{BattleCode: r.game.BattleCode, Peers: []*McsPeerStats{}}
+	st.Peers = append(st.Peers, r.left...)
+	for _, p := range r.peers {
+		if ps := peerStats(p); ps != nil {
+			st.Peers = append(st.Peers, ps)
+		}
+	}
+	sort.Slice(st.Peers, func(i, j int) bool { return st.Peers[i].Pos < st.Peers[j].Pos })
+	for _, ps := range st.Peers {
+		st.Resent += ps.Resent
+		st.Dropped += ps.Dropped
+	}
+	return st
+}
+
+// ConnStats returns the connection stats of the peers in the room by session id.
+func (r *McsRoom) ConnStats() map[string]*McsConnStats {
+	r.mtx.RLock()
+	defer r.mtx.RUnlock()
+	ret := map[string]*McsConnStats{}
+	for _, p := range r.peers {
+		if p != nil {
+			ret[p.SessionID()] = p.ConnStats()
+		}
+	}
+	return ret
+}
+
+func peerStats(p McsPeer) *McsPeerStats {
+	if sp, ok := p.(battleStatsPeer); ok {
+		return &McsPeerStats{UserID: p.UserID(), Pos: p.Position(), BattleBufferStats: sp.BattleStats()}
+	}
+	return nil
+}
+
 func (r *McsRoom) saveBattleLogLocked(path string) error {
 	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0644)
 	if err != nil {
@@ -125,10 +190,12 @@ func (r *McsRoom) Finalize() {
 		return r.battleLog.Users[i].Pos < r.battleLog.Users[j].Pos
 	})
 	r.battleLog.EndAt = time.Now().UnixNano()
+	logger.Info("mcs room stats", zap.Any("stats", r.statsLocked()))
 	fileName := fmt.Sprintf("disk%v-%v.pb", r.battleLog.GameDisk, r.battleLog.BattleCode)
 	err := r.saveBattleLogLocked(path.Join(conf.BattleLogPath, fileName))
 	if err != nil {
 		logger.Error("Failed to save battle log", zap.Error(err))
+		mcsErrors.Add(1)
 	}
 	mcs := r.mcs
 	r.mcs = nil
@@ -165,10 +232,23 @@ func (r *McsRoom) Leave(p McsPeer) {
 	pos := p.Position()
 	sessionID := p.SessionID()
 
+	ps := peerStats(p)
+	if ps != nil {
+		ps.Left = true
+		mcsBattleResent.Add(ps.Resent)
+		mcsBattleDropped.Add(ps.Dropped)
+		if ps.Overflow {
+			mcsBattleOverflow.Add(1)
+		}
+	}
+
 	r.mtx.Lock()
 	if pos < len(r.peers) {
 		r.peers[pos] = nil
 	}
+	if ps != nil {
+		r.left = append(r.left, ps)
+	}
 	empty := true
 	for i := 0; i < len(r.peers); i++ {
 		if r.peers[i] != nil {
@@ -178,7 +258,7 @@ func (r *McsRoom) Leave(p McsPeer) {
 	}
 	r.mtx.Unlock()
 
-	r.mcs.OnUserLeft(r, sessionID, p.GetCloseReason())
+	r.mcs.OnUserLeft(r, sessionID, p.GetCloseReason(), p.ConnStats())
 
 	if empty {
 		go r.Finalize()
@@ -1,16 +1,36 @@
 package main
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"go.uber.org/zap"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"gdxsv/gdxsv/proto"
 )
 
+const (
+	// The first frame from a console has the session id at the end.
+	// e.g. 14 30 00 00 00 08 99 88 00 ff ff ff 35 39 31 32 39 32 36 39
+	mcsTCPHelloSize = 20
+
+	// A frame of the console relay format starts with its size including the size byte.
+	// The body must follow the size byte.
+	mcsTCPMinFrameSize = 2
+
+	// A slow console is disconnected if the data queued for it exceeds this.
+	mcsTCPMaxOutbuf = 64 * 1024
+
+	mcsTCPReadTimeout  = 30 * time.Second
+	mcsTCPWriteTimeout = 5 * time.Second
+)
+
 type McsTCPServer struct {
 	mcs *Mcs
 }
@@ -43,16 +63,23 @@ var _ McsPeer = (*McsTCPPeer)(nil)
 type McsTCPPeer struct {
 	BaseMcsPeer
 
-	sendMtx sync.Mutex
-	conn    *net.TCPConn
-	room    *McsRoom
-	seq     uint32
+	conn   net.Conn
+	room   *McsRoom
+	seq    uint32
+	closed atomic.Bool
+
+	// Data to the peer is queued and written by writeLoop
+	// so that a slow peer does not block the others in the room.
+	mOutbuf sync.Mutex
+	outbuf  []byte
+	chWrite chan bool
 }
 
-func NewTCPPeer(conn *net.TCPConn) *McsTCPPeer {
+func NewTCPPeer(conn net.Conn) *McsTCPPeer {
 	p := &McsTCPPeer{
-		conn: conn,
-		seq:  1,
+		conn:    conn,
+		seq:     1,
+		chWrite: make(chan bool, 1),
 	}
 	p.logger = logger.With(
 		zap.String("proto", "tcp"),
@@ -62,12 +89,17 @@ func NewTCPPeer(conn *net.TCPConn) *McsTCPPeer {
 }
 
 func (u *McsTCPPeer) Close() error {
+	u.closed.Store(true)
 	return u.conn.Close()
 }
 
 func (u *McsTCPPeer) Serve(mcs *Mcs) {
 	u.logger.Info("Serve Start")
 	defer u.logger.Info("Serve End")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go u.writeLoop(ctx)
+
 	// c.f. ps2 symbol ReflectMsg
 	// 6X := category?
 	// 1031 := request connection ID
@@ -75,42 +107,111 @@ func (u *McsTCPPeer) Serve(mcs *Mcs) {
 	data, _ := hex.DecodeString("0e610022103166778899aabbccdd")
 	u.AddSendData(data)
 	u.readLoop(mcs)
+	cancel()
 	if u.room != nil {
 		u.room.Leave(u)
 		u.room = nil
 	}
-	u.conn.Close()
+	_ = u.Close()
 }
 
 func (u *McsTCPPeer) AddSendMessage(msg *proto.BattleMessage) {
 	u.AddSendData(msg.GetBody())
 }
 
+// AddSendData queues the data to the peer. The peer is closed if too much data is queued.
 func (u *McsTCPPeer) AddSendData(data []byte) {
-	u.sendMtx.Lock()
-	defer u.sendMtx.Unlock()
-	for sum := 0; sum < len(data); {
-		n, err := u.conn.Write(data[sum:])
+	if u.closed.Load() {
+		return
+	}
+
+	u.mOutbuf.Lock()
+	size := len(u.outbuf) + len(data)
+	overflow := mcsTCPMaxOutbuf < size
+	if !overflow {
+		u.outbuf = append(u.outbuf, data...)
+	}
+	u.mOutbuf.Unlock()
+
+	if overflow {
+		u.logger.Warn("send buffer overflow", zap.Int("size", size))
+		mcsBattleOverflow.Add(1)
+		u.SetCloseReason("sv_buffer_overflow")
+		_ = u.Close()
+		return
+	}
+
+	select {
+	case u.chWrite <- true:
+	default:
+	}
+}
+
+func (u *McsTCPPeer) writeLoop(ctx context.Context) {
+	buf := make([]byte, 0, 1024)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-u.chWrite:
+		}
+
+		u.mOutbuf.Lock()
+		buf = append(buf[:0], u.outbuf...)
+		u.outbuf = u.outbuf[:0]
+		u.mOutbuf.Unlock()
+		if len(buf) == 0 {
+			continue
+		}
+
+		err := u.conn.SetWriteDeadline(time.Now().Add(mcsTCPWriteTimeout))
 		if err != nil {
-			u.logger.Warn("write error", zap.Error(err))
-			break
+			u.logger.Warn("SetWriteDeadline failed", zap.Error(err))
+		}
+
+		n, err := u.conn.Write(buf)
+		u.counter.countSent(n)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				u.SetCloseReason("sv_write_timeout")
+			} else {
+				u.SetCloseReason("sv_write_error")
+			}
+			if !u.closed.Load() {
+				u.logger.Warn("write error", zap.Error(err))
+			}
+			_ = u.Close()
+			return
 		}
-		sum += n
 	}
 }
 
+func (u *McsTCPPeer) ConnStats() *McsConnStats {
+	return u.counter.stats("tcp")
+}
+
 func (u *McsTCPPeer) Address() string {
 	return u.conn.RemoteAddr().String()
 }
 
+// isMcsSessionID reports whether the session id is generated by genSessionID.
+func isMcsSessionID(b []byte) bool {
+	for _, c := range b {
+		if c < '0' || '9' < c {
+			return false
+		}
+	}
+	return 0 < len(b)
+}
+
 func (u *McsTCPPeer) readLoop(mcs *Mcs) {
-	buf := make([]byte, 128)
-	inbuf := make([]byte, 0, 128)
+	buf := make([]byte, 4096)
+	inbuf := make([]byte, 0, 4096)
 
 	for {
-		err := u.conn.SetReadDeadline(time.Now().Add(time.Second * 30))
+		err := u.conn.SetReadDeadline(time.Now().Add(mcsTCPReadTimeout))
 		if err != nil {
-			logger.Warn("SetReadDeadline failed", zap.Error(err))
+			u.logger.Warn("SetReadDeadline failed", zap.Error(err))
 		}
 
 		n, err := u.conn.Read(buf)
@@ -121,48 +222,71 @@ func (u *McsTCPPeer) readLoop(mcs *Mcs) {
 		}
 
 		if err != nil {
-			if err != io.EOF {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				u.SetCloseReason("sv_recv_timeout")
+			} else if err != io.EOF && !u.closed.Load() {
 				u.logger.Error("read failed", zap.Error(err))
 			}
 			return
 		}
+		u.counter.countRecv(n, time.Now())
 		inbuf = append(inbuf, buf[:n]...)
+		if len(inbuf) == 0 {
+			continue
+		}
 
 		if u.room == nil {
-			if len(inbuf) < 20 {
+			if int(inbuf[0]) != mcsTCPHelloSize {
+				u.logger.Warn("invalid first message", zap.Binary("first_data", inbuf))
+				u.SetCloseReason("sv_bad_hello")
+				return
+			}
+			if len(inbuf) < mcsTCPHelloSize {
 				continue
 			}
-			// 14 30 00 00 00 08 99 88 00 ff ff ff 35 39 31 32 39 32 36 39
-			sessionID := string(inbuf[12:20])
-			inbuf = inbuf[:0]
-			u.logger.Info("recv first message", zap.String("session_id", sessionID), zap.Binary("first_data", inbuf[:20]))
-			u.room = mcs.Join(u, sessionID)
+			hello := inbuf[:mcsTCPHelloSize]
+			sessionID := hello[12:mcsTCPHelloSize]
+			if !isMcsSessionID(sessionID) {
+				u.logger.Warn("invalid first message", zap.Binary("first_data", hello))
+				u.SetCloseReason("sv_bad_hello")
+				return
+			}
+			u.logger.Info("recv first message", zap.String("session_id", string(sessionID)), zap.Binary("first_data", hello))
+			u.room = mcs.Join(u, string(sessionID))
 			if u.room == nil {
 				u.logger.Error("failed to join room")
-				u.conn.Close()
-				break
+				u.SetCloseReason("sv_no_room")
+				return
 			}
 			u.logger.Info("entered a room")
-		} else {
-			var tmp []byte
-			for 0 < len(inbuf) {
-				size := int(inbuf[0])
-				if size <= len(inbuf) {
-					tmp = append(tmp, inbuf[:size]...)
-					inbuf = inbuf[size:]
-				} else {
-					break
-				}
+			inbuf = append(inbuf[:0], inbuf[mcsTCPHelloSize:]...)
+		}
+
+		var tmp []byte
+		off := 0
+		for off < len(inbuf) {
+			size := int(inbuf[off])
+			if size < mcsTCPMinFrameSize {
+				u.logger.Warn("invalid frame size", zap.Binary("data", inbuf[off:]))
+				u.SetCloseReason("sv_bad_frame")
+				return
 			}
-			if 0 < len(tmp) {
-				msg := proto.GetBattleMessage()
-				msg.Body = tmp
-				msg.UserId = u.UserID()
-				msg.Seq = u.seq
-				u.seq++
-				u.room.SendMessage(u, msg)
-				proto.PutBattleMessage(msg)
+			if len(inbuf)-off < size {
+				break
 			}
+			tmp = append(tmp, inbuf[off:off+size]...)
+			off += size
+		}
+		inbuf = append(inbuf[:0], inbuf[off:]...)
+		if 0 < len(tmp) {
+			// The message is not put back to the pool since the battle log
+			// and the send buffers of the other peers keep it.
+			msg := proto.GetBattleMessage()
+			msg.Body = tmp
+			msg.UserId = u.UserID()
+			msg.Seq = u.seq
+			u.seq++
+			u.room.SendMessage(u, msg)
 		}
 	}
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func tcpHello(sessionID string) []byte {
+	return append([]byte{0x14, 0x30, 0x00, 0x00, 0x00, 0x08, 0x99, 0x88, 0x00, 0xff, 0xff, 0xff}, sessionID...)
+}
+
+func serveTestTCPPeer(t *testing.T, mcs *Mcs) (*McsTCPPeer, net.Conn) {
+	t.Helper()
+	svConn, clConn := net.Pipe()
+	t.Cleanup(func() { _ = clConn.Close() })
+
+	p := NewTCPPeer(svConn)
+	go p.Serve(mcs)
+
+	// The server requests the connection id first.
+	assertEq(t, []byte{0x0e, 0x61, 0x00, 0x22, 0x10, 0x31, 0x66, 0x77, 0x88, 0x99, 0xaa, 0xbb, 0xcc, 0xdd}, readTCP(t, clConn, 14))
+	return p, clConn
+}
+
+func readTCP(t *testing.T, conn net.Conn, n int) []byte {
+	t.Helper()
+	buf := make([]byte, n)
+	must(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, err := io.ReadFull(conn, buf)
+	must(t, err)
+	return buf
+}
+
+func writeTCP(t *testing.T, conn net.Conn, data []byte) {
+	t.Helper()
+	must(t, conn.SetWriteDeadline(time.Now().Add(time.Second)))
+	_, err := conn.Write(data)
+	must(t, err)
+}
+
+func TestMcsTCPPeer_Relay(t *testing.T) {
+	sharedData.ShareMcsGame(&McsGame{BattleCode: "tcptest0", GameDisk: GameDiskDC2, UpdatedAt: time.Now()})
+	sharedData.ShareMcsUser(&McsUser{BattleCode: "tcptest0", UserID: "TCP01", SessionID: "11110001", UpdatedAt: time.Now()})
+	sharedData.ShareMcsUser(&McsUser{BattleCode: "tcptest0", UserID: "TCP02", SessionID: "11110002", UpdatedAt: time.Now()})
+	defer sharedData.UpdateMcsGameState("tcptest0", McsGameStateClosed)
+
+	mcs := NewMcs(0)
+	_, cl1 := serveTestTCPPeer(t, mcs)
+	_, cl2 := serveTestTCPPeer(t, mcs)
+
+	// The hello may be split and followed by a frame.
+	writeTCP(t, cl1, tcpHello("11110001")[:10])
+	writeTCP(t, cl1, tcpHello("11110001")[10:])
+	writeTCP(t, cl2, append(tcpHello("11110002"), 0x03, 0x0a, 0x0b))
+
+	waitFor(t, time.Second, func() bool {
+		mcs.mtx.Lock()
+		room := mcs.rooms["tcptest0"]
+		mcs.mtx.Unlock()
+		if room == nil {
+			return false
+		}
+		room.mtx.RLock()
+		defer room.mtx.RUnlock()
+		return len(room.peers) == 2
+	})
+
+	// Frames are relayed only when they are complete.
+	writeTCP(t, cl1, []byte{0x04, 0x01, 0x02})
+	writeTCP(t, cl1, []byte{0x03, 0x03, 0x09, 0x09})
+	assertEq(t, []byte{0x04, 0x01, 0x02, 0x03, 0x03, 0x09, 0x09}, readTCP(t, cl2, 7))
+}
+
+func TestMcsTCPPeer_BadFrame(t *testing.T) {
+	sharedData.ShareMcsGame(&McsGame{BattleCode: "tcptest1", GameDisk: GameDiskDC2, UpdatedAt: time.Now()})
+	sharedData.ShareMcsUser(&McsUser{BattleCode: "tcptest1", UserID: "TCP11", SessionID: "11110011", UpdatedAt: time.Now()})
+	defer sharedData.UpdateMcsGameState("tcptest1", McsGameStateClosed)
+
+	mcs := NewMcs(0)
+
+	// The first message must be the hello.
+	p, cl := serveTestTCPPeer(t, mcs)
+	writeTCP(t, cl, []byte{0x05, 0x01, 0x02, 0x03, 0x04})
+	waitFor(t, time.Second, p.closed.Load)
+	assertEq(t, "sv_bad_hello", p.GetCloseReason())
+
+	// The session id must be digits.
+	p, cl = serveTestTCPPeer(t, mcs)
+	writeTCP(t, cl, tcpHello("1111001x"))
+	waitFor(t, time.Second, p.closed.Load)
+	assertEq(t, "sv_bad_hello", p.GetCloseReason())
+
+	// A frame without body would never be consumed.
+	p, cl = serveTestTCPPeer(t, mcs)
+	writeTCP(t, cl, append(tcpHello("11110011"), 0x00))
+	waitFor(t, time.Second, p.closed.Load)
+	assertEq(t, "sv_bad_frame", p.GetCloseReason())
+}
+
+func TestMcsTCPPeer_SlowPeer(t *testing.T) {
+	mcs := NewMcs(0)
+	p, _ := serveTestTCPPeer(t, mcs)
+
+	// The console doesn't read anything, but the sender is not blocked.
+	start := time.Now()
+	data := make([]byte, 1024)
+	for i := 0; i < mcsTCPMaxOutbuf/len(data)+2; i++ {
+		p.AddSendData(data)
+	}
+	if time.Second < time.Since(start) {
+		t.Error("AddSendData blocked", time.Since(start))
+	}
+
+	waitFor(t, time.Second, p.closed.Load)
+	assertEq(t, "sv_buffer_overflow", p.GetCloseReason())
+}
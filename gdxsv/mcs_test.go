@@ -0,0 +1,25 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMcsConnCounter(t *testing.T) {
+	var c mcsConnCounter
+	at := time.Unix(1600000000, 0)
+
+	c.countRecv(10, at)
+	c.countRecv(20, at.Add(16*time.Millisecond))
+	c.countRecv(30, at.Add(116*time.Millisecond))
+	c.countRecv(40, at.Add(132*time.Millisecond))
+	c.countSent(5)
+	c.countSent(6)
+
+	assertEq(t, &McsConnStats{
+		Proto:    "udp",
+		MaxGapMs: 100,
+		BytesIn:  100,
+		BytesOut: 11,
+	}, c.stats("udp"))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// McsTraceRecord is a line of a mcs trace file.
+// A record has either an inbound udp packet or the user and the game of a peer that joined.
+type McsTraceRecord struct {
+	Time int64    `json:"t"`    // unix nano
+	Peer string   `json:"peer"` // remote address of the peer
+	Data []byte   `json:"data,omitempty"`
+	User *McsUser `json:"user,omitempty"`
+	Game *McsGame `json:"game,omitempty"`
+}
+
+// McsTraceRecorder writes inbound udp packets of the mcs to a trace file as json lines.
+type McsTraceRecorder struct {
+	mtx sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+func NewMcsTraceRecorder(path string) (*McsTraceRecorder, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &McsTraceRecorder{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (t *McsTraceRecorder) write(rec *McsTraceRecord) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	if t.enc == nil {
+		return
+	}
+	if err := t.enc.Encode(rec); err != nil {
+		logger.Error("failed to write mcs trace", zap.Error(err))
+	}
+}
+
+// RecordPacket records a raw packet received from the peer.
+func (t *McsTraceRecorder) RecordPacket(addr net.Addr, data []byte, at time.Time) {
+	t.write(&McsTraceRecord{
+		Time: at.UnixNano(),
+		Peer: addr.String(),
+		Data: append([]byte(nil), data...),
+	})
+}
+
+// RecordJoin records the user and the game so that the peer can join again on replay.
+func (t *McsTraceRecorder) RecordJoin(addr net.Addr, sessionID string) {
+	user, ok := sharedData.GetBattleUserInfo(sessionID)
+	if !ok {
+		return
+	}
+	game, ok := sharedData.GetBattleGameInfo(user.BattleCode)
+	if !ok {
+		return
+	}
+	t.write(&McsTraceRecord{
+		Time: time.Now().UnixNano(),
+		Peer: addr.String(),
+		User: user,
+		Game: game,
+	})
+}
+
+func (t *McsTraceRecorder) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.enc = nil
+	return t.f.Close()
+}
+
+// ReadMcsTrace reads all records of a trace file.
+func ReadMcsTrace(r io.Reader) ([]*McsTraceRecord, error) {
+	var records []*McsTraceRecord
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+		rec := new(McsTraceRecord)
+		if err := json.Unmarshal(sc.Bytes(), rec); err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+	}
+	return records, sc.Err()
+}
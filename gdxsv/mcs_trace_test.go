@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMcsTraceRecorder(t *testing.T) {
+	sharedData.ShareMcsGame(&McsGame{BattleCode: "TRACE01", UpdatedAt: time.Now()})
+	sharedData.ShareMcsUser(&McsUser{BattleCode: "TRACE01", UserID: "USER01", SessionID: "SESSION01", UpdatedAt: time.Now()})
+	defer func() {
+		sharedData.Lock()
+		sharedData.mcsGames = map[string]*McsGame{}
+		sharedData.mcsUsers = map[string]*McsUser{}
+		sharedData.Unlock()
+	}()
+
+	path := filepath.Join(t.TempDir(), "trace.jsonl")
+	rec, err := NewMcsTraceRecorder(path)
+	must(t, err)
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000}
+	at := time.Unix(1, 0)
+	rec.RecordPacket(addr, []byte{1, 2, 3}, at)
+	rec.RecordJoin(addr, "SESSION01")
+	rec.RecordJoin(addr, "UNKNOWN")
+	must(t, rec.Close())
+
+	// Records after Close are ignored.
+	rec.RecordPacket(addr, []byte{4}, at)
+
+	f, err := os.Open(path)
+	must(t, err)
+	defer f.Close()
+	records, err := ReadMcsTrace(f)
+	must(t, err)
+
+	assertEq(t, 2, len(records))
+	assertEq(t, at.UnixNano(), records[0].Time)
+	assertEq(t, "127.0.0.1:10000", records[0].Peer)
+	assertEq(t, []byte{1, 2, 3}, records[0].Data)
+	assertEq(t, "USER01", records[1].User.UserID)
+	assertEq(t, "TRACE01", records[1].Game.BattleCode)
+}
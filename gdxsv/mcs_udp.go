@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"gdxsv/gdxsv/proto"
 	"go.uber.org/zap"
 	pb "google.golang.org/protobuf/proto"
@@ -27,6 +28,14 @@ func NewUDPServer(mcs *Mcs) *McsUDPServer {
 }
 
 func (s *McsUDPServer) ListenAndServe(addr string) error {
+	if err := s.Listen(addr); err != nil {
+		return err
+	}
+	return s.readLoop()
+}
+
+// Listen opens the udp socket, then packets are served by readLoop until Close is called.
+func (s *McsUDPServer) Listen(addr string) error {
 	udpAddr, err := net.ResolveUDPAddr("udp", addr)
 	if err != nil {
 		return err
@@ -54,7 +63,11 @@ func (s *McsUDPServer) ListenAndServe(addr string) error {
 		return err
 	}
 
-	return s.readLoop()
+	return nil
+}
+
+func (s *McsUDPServer) Close() error {
+	return s.conn.Close()
 }
 
 func (s *McsUDPServer) readLoop() error {
@@ -67,13 +80,20 @@ func (s *McsUDPServer) readLoop() error {
 		n, addr, err := s.conn.ReadFromUDP(buf)
 		mcsMessageRecv.Add(1)
 		recvTime := time.Now()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
 		if err != nil {
 			logger.Error("ReadFromUDP", zap.Error(err))
+			mcsErrors.Add(1)
 			continue
 		}
 		if n == 0 {
 			continue
 		}
+		if s.mcs.trace != nil {
+			s.mcs.trace.RecordPacket(addr, buf[:n], recvTime)
+		}
 
 		pkt.Reset()
 		if err := pb.Unmarshal(buf[:n], pkt); err != nil {
@@ -86,6 +106,19 @@ func (s *McsUDPServer) readLoop() error {
 		peer, found := s.peers[key]
 		s.mtx.Unlock()
 
+		var sessionKey []byte
+		if found {
+			sessionKey = peer.sessionKey
+		} else if u, ok := sharedData.GetBattleUserInfo(pkt.GetSessionId()); ok {
+			sessionKey = u.SessionKey
+		}
+		if sessionKey != nil && pkt.GetType() != proto.MessageType_Ping && !proto.VerifyPacket(buf[:n], sessionKey) {
+			// Packets of a session that has the key must be signed, otherwise it may be spoofed.
+			logger.Warn("unauthenticated packet", zap.Stringer("type", pkt.GetType()), zap.Any("key", key))
+			mcsAuthFailed.Add(1)
+			continue
+		}
+
 		fin := false
 		switch pkt.GetType() {
 		case proto.MessageType_Ping:
@@ -101,6 +134,7 @@ func (s *McsUDPServer) readLoop() error {
 				_, err := s.conn.WriteToUDP(data, addr)
 				if err != nil {
 					logger.Error("WriteToUDP", zap.Error(err))
+					mcsErrors.Add(1)
 				}
 				mcsMessageSent.Add(1)
 			}
@@ -111,9 +145,13 @@ func (s *McsUDPServer) readLoop() error {
 
 			if !found && sessionID != "" {
 				peer := NewMcsUDPPeer(s.conn, addr)
+				peer.sessionKey = sessionKey
 				peer.room = s.mcs.Join(peer, sessionID)
 				if peer.room != nil {
 					peer.logger.Info("join udp peer", zap.Any("key", key))
+					if s.mcs.trace != nil {
+						s.mcs.trace.RecordJoin(addr, sessionID)
+					}
 					ok = true
 					userID = peer.UserID()
 
@@ -151,15 +189,20 @@ func (s *McsUDPServer) readLoop() error {
 			if data, err := pb.Marshal(pkt); err != nil {
 				logger.Error("pb.Marshal", zap.Error(err))
 			} else {
+				if sessionKey != nil {
+					data = proto.SignPacket(data, sessionKey)
+				}
 				_, err := s.conn.WriteToUDP(data, addr)
 				if err != nil {
 					logger.Error("WriteToUDP", zap.Error(err))
+					mcsErrors.Add(1)
 				}
 				mcsMessageSent.Add(1)
 			}
 		case proto.MessageType_Battle:
 			if found {
-				peer.OnReceive(pkt)
+				peer.counter.countRecv(n, recvTime)
+				peer.receive(pkt)
 			} else {
 				logger.Error("battle data received but peer not found", zap.Any("pkt", pkt), zap.Any("key", key))
 				fin = true
@@ -187,9 +230,13 @@ func (s *McsUDPServer) readLoop() error {
 			if data, err := pb.Marshal(pkt); err != nil {
 				logger.Error("pb.Marshal", zap.Error(err))
 			} else {
+				if sessionKey != nil {
+					data = proto.SignPacket(data, sessionKey)
+				}
 				_, err := s.conn.WriteToUDP(data, addr)
 				if err != nil {
 					logger.Error("WriteToUDP", zap.Error(err))
+					mcsErrors.Add(1)
 				}
 				mcsMessageSent.Add(1)
 			}
@@ -219,13 +266,14 @@ var _ McsPeer = (*McsUDPPeer)(nil)
 type McsUDPPeer struct {
 	BaseMcsPeer
 
-	room    *McsRoom
-	addr    *net.UDPAddr
-	conn    *net.UDPConn
-	rudp    *proto.BattleBuffer
-	filter  *proto.MessageFilter
-	chFlush chan struct{}
-	chRecv  chan struct{}
+	room       *McsRoom
+	addr       *net.UDPAddr
+	conn       *net.UDPConn
+	sessionKey []byte // signs and verifies packets if the client supports it
+	rudp       *proto.BattleBuffer
+	filter     *proto.MessageFilter
+	chFlush    chan struct{}
+	chRecv     chan struct{}
 
 	readingMtx sync.Mutex
 	reading    []*proto.BattleMessage
@@ -326,13 +374,15 @@ func (u *McsUDPPeer) Serve(mcs *Mcs) {
 				u.SetCloseReason("sv_marshal_error")
 				return
 			}
-			_, err = u.conn.WriteTo(pbBuf, u.addr)
-			if err != nil {
-				u.logger.Error("WriteTo", zap.Error(err))
-				// Should be returned ?
-				// return
+			if u.sessionKey != nil {
+				pbBuf = proto.SignPacket(pbBuf, u.sessionKey)
+			}
+			if m := mcsImpairments.Get(u.UserID(), u.McsRoomID()); m.IsZero() {
+				u.write(pbBuf)
+			} else {
+				data := append([]byte(nil), pbBuf...)
+				mcsImpairments.Schedule(m, func() { u.write(data) })
 			}
-			mcsMessageSent.Add(1)
 		case <-u.chRecv:
 			lastRecv = time.Now()
 			u.readingMtx.Lock()
@@ -356,6 +406,29 @@ func (u *McsUDPPeer) Serve(mcs *Mcs) {
 	}
 }
 
+func (u *McsUDPPeer) write(data []byte) {
+	n, err := u.conn.WriteTo(data, u.addr)
+	if err != nil {
+		u.logger.Error("WriteTo", zap.Error(err))
+		mcsErrors.Add(1)
+		// Should be returned ?
+		// return
+	}
+	u.counter.countSent(n)
+	mcsMessageSent.Add(1)
+}
+
+// receive passes the packet to OnReceive through the emulated network if an impairment is set.
+func (u *McsUDPPeer) receive(pkt *proto.Packet) {
+	m := mcsImpairments.Get(u.UserID(), u.McsRoomID())
+	if m.IsZero() {
+		u.OnReceive(pkt)
+		return
+	}
+	cloned := pb.Clone(pkt).(*proto.Packet)
+	mcsImpairments.Schedule(m, func() { u.OnReceive(cloned) })
+}
+
 func (u *McsUDPPeer) OnReceive(pkt *proto.Packet) {
 	u.rudp.ApplySeqAck(pkt.GetSeq(), pkt.GetAck())
 
@@ -386,5 +459,24 @@ func (u *McsUDPPeer) AddSendData(data []byte) {
 }
 
 func (u *McsUDPPeer) AddSendMessage(msg *proto.BattleMessage) {
-	u.rudp.PushBattleMessage(msg)
+	if err := u.rudp.PushBattleMessage(msg); err != nil {
+		// The peer has not acked for a long time, the battle can't continue without the dropped message.
+		u.logger.Warn("AddSendMessage", zap.Error(err), zap.Any("stats", u.rudp.Stats()))
+		u.SetCloseReason("sv_buffer_overflow")
+		_ = u.Close()
+	}
+}
+
+func (u *McsUDPPeer) BattleStats() proto.BattleBufferStats {
+	return u.rudp.Stats()
+}
+
+func (u *McsUDPPeer) ConnStats() *McsConnStats {
+	stats := u.counter.stats("udp")
+	st := u.rudp.Stats()
+	stats.RTTMs = st.RTT.Milliseconds()
+	stats.Loss = st.Loss
+	stats.Resent = st.Resent
+	stats.Dropped = st.Dropped
+	return stats
 }
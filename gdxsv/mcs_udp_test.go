@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gdxsv/gdxsv/proto"
+	pb "google.golang.org/protobuf/proto"
+)
+
+func TestMcsUDPServer_Auth(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sharedData.ShareMcsGame(&McsGame{BattleCode: "authtest0", GameDisk: GameDiskDC2, UpdatedAt: time.Now()})
+	sharedData.ShareMcsUser(&McsUser{BattleCode: "authtest0", UserID: "AUTH01", SessionID: "AUTHSS01", SessionKey: key, UpdatedAt: time.Now()})
+	sharedData.ShareMcsUser(&McsUser{BattleCode: "authtest0", UserID: "AUTH02", SessionID: "AUTHSS02", UpdatedAt: time.Now()})
+	defer sharedData.UpdateMcsGameState("authtest0", McsGameStateClosed)
+
+	sv := NewUDPServer(NewMcs(0))
+	must(t, sv.Listen("127.0.0.1:0"))
+	defer sv.Close()
+	go sv.readLoop()
+
+	dial := func() *net.UDPConn {
+		conn, err := net.DialUDP("udp", nil, sv.conn.LocalAddr().(*net.UDPAddr))
+		must(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	send := func(conn *net.UDPConn, pkt *proto.Packet, key []byte) {
+		data, err := pb.Marshal(pkt)
+		must(t, err)
+		if key != nil {
+			data = proto.SignPacket(data, key)
+		}
+		_, err = conn.Write(data)
+		must(t, err)
+	}
+	recv := func(conn *net.UDPConn) []byte {
+		buf := make([]byte, 4096)
+		must(t, conn.SetReadDeadline(time.Now().Add(300*time.Millisecond)))
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil
+		}
+		return buf[:n]
+	}
+	hello := func(sessionID string) *proto.Packet {
+		return &proto.Packet{Type: proto.MessageType_HelloServer, SessionId: sessionID}
+	}
+
+	failed := mcsAuthFailed.Value()
+
+	// An unsigned packet of the session that has the key is dropped.
+	conn1 := dial()
+	send(conn1, hello("AUTHSS01"), nil)
+	assertEq(t, []byte(nil), recv(conn1))
+	send(conn1, hello("AUTHSS01"), []byte("wrong key"))
+	assertEq(t, []byte(nil), recv(conn1))
+	assertEq(t, failed+2, mcsAuthFailed.Value())
+
+	// A signed packet is accepted and the reply is signed.
+	send(conn1, hello("AUTHSS01"), key)
+	data := recv(conn1)
+	if !proto.VerifyPacket(data, key) {
+		t.Fatal("reply should be signed")
+	}
+	var pkt proto.Packet
+	must(t, pb.Unmarshal(data, &pkt))
+	assertEq(t, true, pkt.GetHelloServerData().GetOk())
+	assertEq(t, "AUTH01", pkt.GetHelloServerData().GetUserId())
+
+	// A spoofed fin does not close the peer.
+	peerCount := func() int {
+		sv.mtx.Lock()
+		defer sv.mtx.Unlock()
+		return len(sv.peers)
+	}
+	assertEq(t, 1, peerCount())
+	send(conn1, &proto.Packet{Type: proto.MessageType_Fin, SessionId: "AUTHSS01", FinData: &proto.FinMessage{Detail: "spoofed"}}, nil)
+	waitFor(t, time.Second, func() bool { return failed+3 == mcsAuthFailed.Value() })
+	time.Sleep(100 * time.Millisecond)
+	assertEq(t, 1, peerCount())
+
+	// A session without the key works in the compatibility mode.
+	conn2 := dial()
+	send(conn2, hello("AUTHSS02"), nil)
+	data = recv(conn2)
+	if proto.VerifyPacket(data, key) {
+		t.Fatal("reply should not be signed")
+	}
+	must(t, pb.Unmarshal(data, &pkt))
+	assertEq(t, true, pkt.GetHelloServerData().GetOk())
+
+	assertEq(t, 2, peerCount())
+
+	send(conn1, &proto.Packet{Type: proto.MessageType_Fin, SessionId: "AUTHSS01", FinData: &proto.FinMessage{Detail: "end"}}, key)
+	send(conn2, &proto.Packet{Type: proto.MessageType_Fin, SessionId: "AUTHSS02", FinData: &proto.FinMessage{Detail: "end"}}, nil)
+	waitFor(t, time.Second, func() bool { return peerCount() == 0 })
+}
@@ -1,6 +1,9 @@
 package main
 
-import "expvar"
+import (
+	"expvar"
+	"time"
+)
 
 var (
 	mcsMetrics      = expvar.NewMap("gdxsv-mcs")
@@ -12,6 +15,28 @@ var (
 	mcsProcOver15Ms = new(expvar.Int)
 	mcsProcOver20Ms = new(expvar.Int)
 	mcsProcMaxMs    = new(expvar.Int)
+	mcsErrors       = new(expvar.Int)
+
+	mcsBattleResent   = new(expvar.Int)
+	mcsBattleDropped  = new(expvar.Int)
+	mcsBattleOverflow = new(expvar.Int)
+	mcsAuthFailed     = new(expvar.Int)
+
+	lbsMetrics         = expvar.NewMap("gdxsv-lbs")
+	lbsMessageHandled  = new(expvar.Int)
+	lbsQueueOver10Ms   = new(expvar.Int)
+	lbsQueueOver50Ms   = new(expvar.Int)
+	lbsQueueOver100Ms  = new(expvar.Int)
+	lbsQueueMaxMs      = new(expvar.Int)
+	lbsQueueTotalMicro = new(expvar.Int)
+	lbsMsgMalformed    = new(expvar.Int)
+	lbsMcsAddrIPv6     = new(expvar.Int)
+	lbsMcsAddrNoIPv4   = new(expvar.Int)
+
+	lbsP2PFallbackRecreated = new(expvar.Int)
+	lbsP2PFallbackExpired   = new(expvar.Int)
+	lbsDisconnectAttributed = new(expvar.Int)
+	lbsMatchingPenalized    = new(expvar.Int)
 )
 
 func init() {
@@ -23,4 +48,41 @@ func init() {
 	mcsMetrics.Set("proc-15ms", mcsProcOver15Ms)
 	mcsMetrics.Set("proc-20ms", mcsProcOver20Ms)
 	mcsMetrics.Set("proc-maxms", mcsProcMaxMs)
+	mcsMetrics.Set("errors", mcsErrors)
+	mcsMetrics.Set("battle-resent", mcsBattleResent)
+	mcsMetrics.Set("battle-dropped", mcsBattleDropped)
+	mcsMetrics.Set("battle-overflow", mcsBattleOverflow)
+	mcsMetrics.Set("auth-failed", mcsAuthFailed)
+
+	lbsMetrics.Set("msg-handled", lbsMessageHandled)
+	lbsMetrics.Set("queue-10ms", lbsQueueOver10Ms)
+	lbsMetrics.Set("queue-50ms", lbsQueueOver50Ms)
+	lbsMetrics.Set("queue-100ms", lbsQueueOver100Ms)
+	lbsMetrics.Set("queue-maxms", lbsQueueMaxMs)
+	lbsMetrics.Set("queue-total-us", lbsQueueTotalMicro)
+	lbsMetrics.Set("msg-malformed", lbsMsgMalformed)
+	lbsMetrics.Set("mcs-addr-ipv6", lbsMcsAddrIPv6)
+	lbsMetrics.Set("mcs-addr-no-ipv4", lbsMcsAddrNoIPv4)
+	lbsMetrics.Set("p2p-fallback-recreated", lbsP2PFallbackRecreated)
+	lbsMetrics.Set("p2p-fallback-expired", lbsP2PFallbackExpired)
+	lbsMetrics.Set("disconnect-attributed", lbsDisconnectAttributed)
+	lbsMetrics.Set("matching-penalized", lbsMatchingPenalized)
+}
+
+// recordLbsQueueDelay records how long a message waited for the event loop.
+func recordLbsQueueDelay(d time.Duration) {
+	lbsMessageHandled.Add(1)
+	lbsQueueTotalMicro.Add(d.Microseconds())
+
+	ms := d.Milliseconds()
+	if lbsQueueMaxMs.Value() < ms {
+		lbsQueueMaxMs.Set(ms)
+	}
+	if 100 <= ms {
+		lbsQueueOver100Ms.Add(1)
+	} else if 50 <= ms {
+		lbsQueueOver50Ms.Add(1)
+	} else if 10 <= ms {
+		lbsQueueOver10Ms.Add(1)
+	}
 }
@@ -99,3 +99,20 @@ func Test_convertGamePatch(t *testing.T) {
 		})
 	}
 }
+
+func FuzzConvertGamePatch(f *testing.F) {
+	f.Add("8,0,0,0\n32,0xffffffff,1,2")
+	f.Add("# comment\n16, 0x8c500000,   0x0000, 0x911f \n\n16,8c500002,0,0x314c,")
+	f.Add("64,0,0,0")
+	f.Fuzz(func(t *testing.T, codes string) {
+		p, err := convertGamePatch(&MPatch{Disk: GameDiskDC2, Name: "fuzz", Codes: codes})
+		if err != nil {
+			return
+		}
+		for _, c := range p.Codes {
+			if c.Size != 8 && c.Size != 16 && c.Size != 32 {
+				t.Fatal("invalid size", c.Size)
+			}
+		}
+	})
+}
@@ -0,0 +1,32 @@
+package proto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const (
+	hmacFieldTag = 6<<3 | 2 // Packet.hmac, length-delimited
+	hmacFieldLen = 2 + sha256.Size
+)
+
+// SignPacket appends the hmac field to the serialized packet.
+// The hmac is computed over the serialized packet without the field,
+// so it is always the last field of the datagram.
+func SignPacket(data []byte, key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	data = append(data, hmacFieldTag, sha256.Size)
+	return mac.Sum(data)
+}
+
+// VerifyPacket reports whether the serialized packet ends with the hmac field signed by the key.
+func VerifyPacket(data []byte, key []byte) bool {
+	n := len(data) - hmacFieldLen
+	if n < 0 || data[n] != hmacFieldTag || data[n+1] != sha256.Size {
+		return false
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data[:n])
+	return hmac.Equal(mac.Sum(nil), data[n+2:])
+}
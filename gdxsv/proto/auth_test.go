@@ -0,0 +1,31 @@
+package proto
+
+import (
+	"bytes"
+	"testing"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+func TestSignPacket(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	pkt := &Packet{Type: MessageType_Battle, Seq: 10, Ack: 5, SessionId: "SESSION1"}
+	data, err := pb.Marshal(pkt)
+	assertT(t, err == nil, "marshal should succeed")
+
+	signed := SignPacket(append([]byte(nil), data...), key)
+	assertT(t, VerifyPacket(signed, key), "signed packet should be verified")
+	assertT(t, !VerifyPacket(signed, []byte("another key")), "packet should not be verified by another key")
+	assertT(t, !VerifyPacket(data, key), "unsigned packet should not be verified")
+	assertT(t, !VerifyPacket(nil, key), "empty packet should not be verified")
+
+	tampered := append([]byte(nil), signed...)
+	tampered[3] ^= 1
+	assertT(t, !VerifyPacket(tampered, key), "tampered packet should not be verified")
+
+	// The signed packet is still a valid packet with the hmac field.
+	var got Packet
+	assertT(t, pb.Unmarshal(signed, &got) == nil, "unmarshal should succeed")
+	assertT(t, got.GetSessionId() == "SESSION1", "session id should be kept")
+	assertT(t, bytes.Equal(got.GetHmac(), signed[len(signed)-32:]), "hmac field should be decoded")
+}
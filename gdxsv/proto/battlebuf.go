@@ -1,11 +1,42 @@
 package proto
 
 import (
+	"errors"
 	"sync"
+	"time"
 )
 
 const ringSize = 1024
 
+const (
+	sendWindow    = 50  // initial max messages in a packet
+	minSendWindow = 8   // the window is not shrunk below this on timeouts
+	maxSendWindow = 256 // the window is not grown above this for high latency peers
+
+	flushInterval = 16 * time.Millisecond
+	initialRTO    = 200 * time.Millisecond
+	minRTO        = 2 * flushInterval
+	maxRTO        = 2 * time.Second
+)
+
+// ErrBufferOverflow is returned when the ring buffer is full of messages the peer has not acked.
+var ErrBufferOverflow = errors.New("battle buffer overflow")
+
+// BattleBufferStats is a snapshot of the delivery state of a BattleBuffer.
+type BattleBufferStats struct {
+	RTT      time.Duration `json:"rtt"`     // smoothed round trip time
+	RTTVar   time.Duration `json:"rtt_var"` // round trip time variation
+	RTO      time.Duration `json:"rto"`     // an unacked message older than this is regarded as lost
+	Loss     float64       `json:"loss"`    // ratio of messages that were in flight when the rto expired
+	Window   int           `json:"window"`  // max messages in a packet
+	InFlight int           `json:"in_flight"`
+	Sent     int64         `json:"sent"`     // messages sent for the first time
+	Resent   int64         `json:"resent"`   // messages retransmitted because they were not acked within the rto
+	Dropped  int64         `json:"dropped"`  // messages dropped by the overflow
+	Timeouts int64         `json:"timeouts"` // times the oldest unacked message exceeded the rto
+	Overflow bool          `json:"overflow"`
+}
+
 type BattleBuffer struct {
 	mtx   sync.Mutex
 	id    string
@@ -13,15 +44,38 @@ type BattleBuffer struct {
 	begin uint32           //まだ相手の応答がない開始のシーケンス番号
 	end   uint32           //次に割り振るシーケンス番号
 	rbuf  []*BattleMessage //リングバッファ
+
+	sentEnd  uint32      //まだ一度も送信していない開始のシーケンス番号
+	sentAt   []time.Time //初回送信時刻
+	resentAt []time.Time //最後に再送とみなした時刻
+	now      func() time.Time
+
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	loss     float64
+	window   uint32 //1パケットに載せる最大メッセージ数
+	recover  uint32 //この番号までのメッセージが応答されるまでタイムアウトを数えない
+	sent     int64
+	resent   int64
+	dropped  int64
+	timeouts int64
+	overflow bool
 }
 
 func NewBattleBuffer(id string) *BattleBuffer {
 	return &BattleBuffer{
-		id:    id,
-		ack:   0,
-		begin: 1,
-		end:   1,
-		rbuf:  make([]*BattleMessage, ringSize),
+		id:       id,
+		ack:      0,
+		begin:    1,
+		end:      1,
+		rbuf:     make([]*BattleMessage, ringSize),
+		sentEnd:  1,
+		sentAt:   make([]time.Time, ringSize),
+		resentAt: make([]time.Time, ringSize),
+		now:      time.Now,
+		rto:      initialRTO,
+		window:   sendWindow,
 	}
 }
 
@@ -37,22 +91,61 @@ func (b *BattleBuffer) GetID() string {
 	return b.id
 }
 
-func (b *BattleBuffer) PushBattleMessage(msg *BattleMessage) {
+// PushBattleMessage appends the message to be sent.
+// The message is dropped and ErrBufferOverflow is returned
+// if the peer has not acked ringSize messages, since it would overwrite an unacked one.
+func (b *BattleBuffer) PushBattleMessage(msg *BattleMessage) error {
 	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if ringSize <= b.end-b.begin {
+		b.dropped++
+		b.overflow = true
+		return ErrBufferOverflow
+	}
 	index := b.end
 	b.rbuf[index%ringSize] = msg
 	b.end++
-	b.mtx.Unlock()
+	return nil
 }
 
+// GetSendData returns the unacked messages to be sent, the last seq of them and the ack for the peer.
+// Every packet carries all the unacked messages up to the send window, so that a lost packet is
+// recovered by the next one. A message is counted as resent only when it is not acked within the rto.
+// The window is halved when the rto expires and grows while the peer acks in time,
+// so a lossy peer gets smaller packets and a high latency peer gets enough messages in flight.
 func (b *BattleBuffer) GetSendData() ([]*BattleMessage, uint32, uint32) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
+	now := b.now()
+
+	for s := b.begin; s < b.sentEnd; s++ {
+		if b.rto < now.Sub(b.resentAt[s%ringSize]) {
+			b.resent++
+			b.resentAt[s%ringSize] = now
+		}
+	}
+
+	if b.begin < b.sentEnd && b.recover <= b.begin && b.rto < now.Sub(b.sentAt[b.begin%ringSize]) {
+		b.timeouts++
+		b.rto = min(maxRTO, 2*b.rto)
+		b.recover = b.sentEnd
+		b.window = max(minSendWindow, b.window/2)
+	}
+
 	l := b.begin % ringSize
 	e := b.end
-	if b.begin+50 < e {
-		e = b.begin + 50
+	if b.begin+b.window < e {
+		e = b.begin + b.window
+	}
+	for s := b.sentEnd; s < e; s++ {
+		b.sentAt[s%ringSize] = now
+		b.resentAt[s%ringSize] = now
 	}
+	if b.sentEnd < e {
+		b.sent += int64(e - b.sentEnd)
+		b.sentEnd = e
+	}
+
 	r := e % ringSize
 	if l <= r {
 		return b.rbuf[l:r], e - 1, b.ack
@@ -64,11 +157,73 @@ func (b *BattleBuffer) GetSendData() ([]*BattleMessage, uint32, uint32) {
 	}
 }
 
+// ApplySeqAck applies the seq and the ack received from the peer.
+// The ack updates the rtt and loss estimation. Stale or invalid values are ignored.
 func (b *BattleBuffer) ApplySeqAck(seq, ack uint32) {
 	b.mtx.Lock()
 	defer b.mtx.Unlock()
+	if b.ack < seq {
+		b.ack = seq
+	}
+	if ack < b.begin || b.sentEnd <= ack {
+		return
+	}
+
+	now := b.now()
+	if b.recover <= b.begin && b.begin+b.window < b.end {
+		// The messages are acked in time but queued by the window.
+		b.window = min(maxSendWindow, b.window+1)
+	}
+	for s := b.begin; s <= ack; s++ {
+		late := 0.0
+		if s < b.recover {
+			late = 1.0 // it was in flight when the rto expired
+		}
+		b.loss += (late - b.loss) / 16
+	}
+	b.updateRTT(now.Sub(b.sentAt[ack%ringSize]))
 	b.begin = ack + 1
-	b.ack = seq
+}
+
+// updateRTT updates the rtt estimation with the sample as RFC 6298.
+func (b *BattleBuffer) updateRTT(sample time.Duration) {
+	if b.srtt == 0 {
+		b.srtt = sample
+		b.rttvar = sample / 2
+	} else {
+		diff := b.srtt - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		b.rttvar = (3*b.rttvar + diff) / 4
+		b.srtt = (7*b.srtt + sample) / 8
+	}
+	b.rto = min(maxRTO, max(minRTO, b.srtt+max(flushInterval, 4*b.rttvar)))
+}
+
+// Overflowed reports whether a message has been dropped by the overflow.
+func (b *BattleBuffer) Overflowed() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.overflow
+}
+
+func (b *BattleBuffer) Stats() BattleBufferStats {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return BattleBufferStats{
+		RTT:      b.srtt,
+		RTTVar:   b.rttvar,
+		RTO:      b.rto,
+		Loss:     b.loss,
+		Window:   int(b.window),
+		InFlight: int(b.sentEnd - b.begin),
+		Sent:     b.sent,
+		Resent:   b.resent,
+		Dropped:  b.dropped,
+		Timeouts: b.timeouts,
+		Overflow: b.overflow,
+	}
 }
 
 type MessageFilter struct {
@@ -2,7 +2,9 @@ package proto
 
 import (
 	"bytes"
+	"math/rand"
 	"testing"
+	"time"
 )
 
 func assertT(t *testing.T, f bool, msg string) {
@@ -114,3 +116,204 @@ func TestProtoRUDP(t *testing.T) {
 	assertT(t, bytes.Equal(buf, []byte("hogepiyo")), "buf should be hogepiyo")
 	assertT(t, a.ack == 2, "a.ack should be 2")
 }
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+func newTestBattleBuffer(id string) (*BattleBuffer, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1600000000, 0)}
+	b := NewBattleBuffer(id)
+	b.now = clock.now
+	return b, clock
+}
+
+func TestBattleBuffer_Overflow(t *testing.T) {
+	b, _ := newTestBattleBuffer("a")
+	f := NewMessageFilter([]string{"b"})
+
+	for i := 0; i < ringSize; i++ {
+		assertT(t, b.PushBattleMessage(f.GenerateMessage("a", []byte("x"))) == nil, "push should succeed")
+	}
+	assertT(t, !b.Overflowed(), "should not overflow yet")
+
+	err := b.PushBattleMessage(f.GenerateMessage("a", []byte("y")))
+	assertT(t, err == ErrBufferOverflow, "push should fail with ErrBufferOverflow")
+	assertT(t, b.Overflowed(), "should overflow")
+	assertT(t, b.Stats().Dropped == 1, "dropped should be 1")
+
+	// The oldest message is not overwritten.
+	data, seq, _ := b.GetSendData()
+	assertT(t, data[0].GetSeq() == 1, "first message should be kept")
+	assertT(t, seq == sendWindow, "seq should be the end of the window")
+
+	b.ApplySeqAck(0, seq)
+	assertT(t, b.PushBattleMessage(f.GenerateMessage("a", []byte("z"))) == nil, "push should succeed after ack")
+}
+
+func TestBattleBuffer_RTT(t *testing.T) {
+	b, clock := newTestBattleBuffer("a")
+	f := NewMessageFilter([]string{"b"})
+
+	for i := 0; i < 10; i++ {
+		b.PushBattleMessage(f.GenerateMessage("a", []byte("x")))
+		_, seq, _ := b.GetSendData()
+		clock.advance(40 * time.Millisecond)
+		b.ApplySeqAck(0, seq)
+	}
+
+	st := b.Stats()
+	assertT(t, st.RTT == 40*time.Millisecond, "rtt should be 40ms")
+	assertT(t, st.InFlight == 0, "all messages should be acked")
+	assertT(t, st.Sent == 10, "sent should be 10")
+	assertT(t, st.Resent == 0, "resent should be 0")
+	assertT(t, st.Loss == 0, "loss should be 0")
+	assertT(t, minRTO <= st.RTO && st.RTO < 100*time.Millisecond, "rto should follow the rtt")
+
+	// Stale and unknown acks are ignored.
+	b.ApplySeqAck(0, 3)
+	b.ApplySeqAck(0, 100)
+	assertT(t, b.begin == 11, "begin should not move")
+}
+
+func TestBattleBuffer_Timeout(t *testing.T) {
+	b, clock := newTestBattleBuffer("a")
+	f := NewMessageFilter([]string{"b"})
+
+	for i := 0; i < 100; i++ {
+		b.PushBattleMessage(f.GenerateMessage("a", []byte("x")))
+	}
+	data, _, _ := b.GetSendData()
+	assertT(t, len(data) == sendWindow, "messages should be limited by the window")
+
+	// Unacked messages are sent on every flush, but they are not retransmits until the rto expires.
+	clock.advance(flushInterval)
+	b.GetSendData()
+	assertT(t, b.Stats().Resent == 0, "redundant copies should not be counted")
+
+	// The peer does not ack, the messages are retransmitted after the rto.
+	clock.advance(initialRTO)
+	data, _, _ = b.GetSendData()
+	assertT(t, len(data) == sendWindow/2, "window should shrink")
+	st := b.Stats()
+	assertT(t, st.Window == sendWindow/2, "window should be halved")
+	assertT(t, st.Timeouts == 1, "timeouts should be 1")
+	assertT(t, st.Resent == sendWindow, "retransmitted messages should be counted")
+	assertT(t, st.RTO == 2*initialRTO, "rto should back off")
+
+	// The timeout is not counted again until the messages sent before the timeout are acked.
+	clock.advance(time.Millisecond)
+	b.GetSendData()
+	st = b.Stats()
+	assertT(t, st.Timeouts == 1, "timeouts should not be counted twice")
+	assertT(t, st.Resent == sendWindow, "messages should not be counted twice")
+
+	// The late ack is counted as loss.
+	_, seq, _ := b.GetSendData()
+	b.ApplySeqAck(0, seq)
+	assertT(t, 0 < b.Stats().Loss, "loss should be estimated")
+
+	// Another timeout shrinks the window again, but not below the min.
+	for i := 0; i < 100; i++ {
+		b.PushBattleMessage(f.GenerateMessage("a", []byte("x")))
+	}
+	for i := 0; i < 5; i++ {
+		_, seq, _ = b.GetSendData()
+		clock.advance(maxRTO + flushInterval)
+		b.GetSendData()
+		b.ApplySeqAck(0, seq)
+	}
+	data, _, _ = b.GetSendData()
+	assertT(t, b.Stats().Window == minSendWindow, "window should not be shrunk below the min")
+	assertT(t, len(data) == minSendWindow, "messages should be limited by the shrunk window")
+}
+
+func TestBattleBuffer_WindowGrows(t *testing.T) {
+	b, clock := newTestBattleBuffer("a")
+	f := NewMessageFilter([]string{"b"})
+
+	const (
+		rtt      = 400 * time.Millisecond
+		perFlush = 3 // 75 messages are in flight in a rtt
+	)
+
+	type ackEvent struct {
+		at  time.Time
+		ack uint32
+	}
+	var acks []ackEvent
+
+	for i := 0; i < int(10*time.Second/flushInterval); i++ {
+		for j := 0; j < perFlush; j++ {
+			assertT(t, b.PushBattleMessage(f.GenerateMessage("a", []byte("x"))) == nil, "push should succeed")
+		}
+		_, seq, _ := b.GetSendData()
+		acks = append(acks, ackEvent{at: clock.t.Add(rtt), ack: seq})
+
+		clock.advance(flushInterval)
+		for 0 < len(acks) && !acks[0].at.After(clock.t) {
+			b.ApplySeqAck(0, acks[0].ack)
+			acks = acks[1:]
+		}
+	}
+
+	st := b.Stats()
+	t.Logf("%+v", st)
+	assertT(t, sendWindow < st.Window && st.Window <= maxSendWindow, "window should grow for the high latency peer")
+	assertT(t, st.InFlight < st.Window, "messages should not be queued")
+	assertT(t, sendWindow < st.InFlight, "messages more than the initial window should be in flight")
+}
+
+func TestBattleBuffer_HighLatencyLossyPeer(t *testing.T) {
+	b, clock := newTestBattleBuffer("a")
+	f := NewMessageFilter([]string{"b"})
+	rng := rand.New(rand.NewSource(1))
+
+	const (
+		rtt      = 200 * time.Millisecond
+		loss     = 0.05
+		perFlush = 3 // messages of 3 other players
+	)
+
+	type ackEvent struct {
+		at  time.Time
+		ack uint32
+	}
+	var acks []ackEvent
+	peerAck := uint32(0)
+
+	for i := 0; i < int(time.Minute/flushInterval); i++ {
+		for j := 0; j < perFlush; j++ {
+			assertT(t, b.PushBattleMessage(f.GenerateMessage("a", []byte("x"))) == nil, "push should succeed")
+		}
+
+		// Every packet begins with the oldest unacked message, so the peer receives them in order.
+		_, seq, _ := b.GetSendData()
+		if loss <= rng.Float64() && peerAck < seq {
+			peerAck = seq
+		}
+		if loss <= rng.Float64() {
+			acks = append(acks, ackEvent{at: clock.t.Add(rtt), ack: peerAck})
+		}
+
+		clock.advance(flushInterval)
+		for 0 < len(acks) && !acks[0].at.After(clock.t) {
+			b.ApplySeqAck(0, acks[0].ack)
+			acks = acks[1:]
+		}
+	}
+
+	st := b.Stats()
+	t.Logf("%+v", st)
+	assertT(t, !st.Overflow, "should not overflow")
+	assertT(t, st.InFlight < sendWindow, "messages should not be queued")
+	assertT(t, st.Resent < st.Sent/10, "only lost messages should be retransmitted")
+}
@@ -43,6 +43,7 @@ type McsUser struct {
 	Platform    string `json:"platform"`
 	GameDisk    string `json:"game_disk"`
 	SessionID   string `json:"session_id,omitempty"`
+	SessionKey  []byte `json:"session_key,omitempty"` // hmac key of battle udp packets, nil if the client does not support it
 	Pos         int    `json:"pos,omitempty"`
 	Team        uint16 `json:"team,omitempty"`
 	BattleCount int    `json:"battle_count,omitempty"`
@@ -50,9 +51,25 @@ type McsUser struct {
 	LoseCount   int    `json:"lose_count,omitempty"`
 	Grade       int    `json:"grade,omitempty"`
 
-	State       int       `json:"state,omitempty"`
-	CloseReason string    `json:"close_reason,omitempty"`
-	UpdatedAt   time.Time `json:"updated_at,omitempty"`
+	State       int           `json:"state,omitempty"`
+	CloseReason string        `json:"close_reason,omitempty"`
+	ConnStats   *McsConnStats `json:"conn_stats,omitempty"`
+	UpdatedAt   time.Time     `json:"updated_at,omitempty"`
+
+	leftTaken bool // the final stats have been taken by TakeLeftMcsUsers
+}
+
+// McsConnStats is the connection quality of a battle user measured by the mcs.
+type McsConnStats struct {
+	Proto    string  `json:"proto"`
+	RTTMs    int64   `json:"rtt_ms,omitempty"`  // smoothed round trip time of battle messages, udp only
+	Loss     float64 `json:"loss,omitempty"`    // ratio of battle messages regarded as lost, udp only
+	Resent   int64   `json:"resent,omitempty"`  // battle messages sent again, udp only
+	Dropped  int64   `json:"dropped,omitempty"` // battle messages dropped by the buffer overflow, udp only
+	MaxGapMs int64   `json:"max_gap_ms"`        // max interval between received packets
+	BytesIn  int64   `json:"bytes_in"`
+	BytesOut int64   `json:"bytes_out"`
+	Final    bool    `json:"final,omitempty"` // the user has left and the stats are not updated anymore
 }
 
 type McsGame struct {
@@ -68,11 +85,15 @@ type McsGame struct {
 }
 
 type McsStatus struct {
-	Region     string     `json:"region,omitempty"`
-	PublicAddr string     `json:"public_addr,omitempty"`
-	Users      []*McsUser `json:"users,omitempty"`
-	Games      []*McsGame `json:"games,omitempty"`
-	UpdatedAt  time.Time  `json:"updated_at,omitempty"`
+	Region      string     `json:"region,omitempty"`
+	PublicAddr  string     `json:"public_addr,omitempty"`
+	PublicAddr6 string     `json:"public_addr6,omitempty"` // empty if the mcs has no ipv6 address
+	Users       []*McsUser `json:"users,omitempty"`
+	Games       []*McsGame `json:"games,omitempty"`
+	UpdatedAt   time.Time  `json:"updated_at,omitempty"`
+	Capacity    int        `json:"capacity,omitempty"`  // max games, 0 means unlimited
+	ProcSlow    int64      `json:"proc_slow,omitempty"` // packets that took over 10ms since the previous status
+	Errors      int64      `json:"errors,omitempty"`    // errors occurred since the previous status
 }
 
 type LbsStatus struct {
@@ -97,8 +118,9 @@ func (s *SharedData) SyncMcsToLbs(status *McsStatus) {
 	defer s.Unlock()
 
 	for _, u := range status.Users {
-		_, ok := s.mcsUsers[u.SessionID]
+		prev, ok := s.mcsUsers[u.SessionID]
 		if ok {
+			u.leftTaken = prev.leftTaken
 			s.mcsUsers[u.SessionID] = u
 		}
 	}
@@ -111,6 +133,23 @@ func (s *SharedData) SyncMcsToLbs(status *McsStatus) {
 	}
 }
 
+// TakeLeftMcsUsers returns copies of the users whose final connection stats have arrived since the previous call.
+// The stats are set by the mcs in the same process or synced from a remote mcs.
+func (s *SharedData) TakeLeftMcsUsers() []*McsUser {
+	s.Lock()
+	defer s.Unlock()
+
+	var ret []*McsUser
+	for _, u := range s.mcsUsers {
+		if !u.leftTaken && u.ConnStats != nil && u.ConnStats.Final {
+			u.leftTaken = true
+			c := *u
+			ret = append(ret, &c)
+		}
+	}
+	return ret
+}
+
 func (s *SharedData) SyncLbsToMcs(status *LbsStatus) {
 	s.Lock()
 	defer s.Unlock()
@@ -158,6 +197,41 @@ func (s *SharedData) GetMcsUserCount() int {
 	return len(s.mcsUsers)
 }
 
+// ReassignMcsGame moves the game to another mcs if it has not been opened yet.
+func (s *SharedData) ReassignMcsGame(battleCode string, mcsAddr string) bool {
+	s.Lock()
+	defer s.Unlock()
+	g, ok := s.mcsGames[battleCode]
+	if !ok || g.State != McsGameStateCreated {
+		return false
+	}
+	g.McsAddr = mcsAddr
+	g.UpdatedAt = time.Now()
+	return true
+}
+
+// GetMcsLoad returns the number of games not closed and their users not left on the mcs.
+func (s *SharedData) GetMcsLoad(mcsAddr string) (games int, users int) {
+	s.Lock()
+	defer s.Unlock()
+
+	battleCodes := map[string]bool{}
+	for _, g := range s.mcsGames {
+		if g.McsAddr == mcsAddr && g.State != McsGameStateClosed {
+			battleCodes[g.BattleCode] = true
+			games++
+		}
+	}
+
+	for _, u := range s.mcsUsers {
+		if battleCodes[u.BattleCode] && u.State != McsUserStateLeft {
+			users++
+		}
+	}
+
+	return
+}
+
 func (s *SharedData) GetMcsUsers() []*McsUser {
 	s.Lock()
 	defer s.Unlock()
@@ -172,6 +246,21 @@ func (s *SharedData) GetMcsUsers() []*McsUser {
 	return ret
 }
 
+// GetMcsBattleUsers returns copies of the users of the battle.
+func (s *SharedData) GetMcsBattleUsers(battleCode string) []*McsUser {
+	s.Lock()
+	defer s.Unlock()
+
+	var ret []*McsUser
+	for _, u := range s.mcsUsers {
+		if u.BattleCode == battleCode {
+			v := *u
+			ret = append(ret, &v)
+		}
+	}
+	return ret
+}
+
 func (s *SharedData) GetMcsGames() []*McsGame {
 	s.Lock()
 	defer s.Unlock()
@@ -293,6 +382,17 @@ func (s *SharedData) SetMcsUserCloseReason(sessionID string, closeReason string)
 	}
 }
 
+// SetMcsUserConnStats updates the connection stats of the user unless the final stats are already set.
+func (s *SharedData) SetMcsUserConnStats(sessionID string, stats *McsConnStats) {
+	s.Lock()
+	defer s.Unlock()
+	if u, ok := s.mcsUsers[sessionID]; ok {
+		if u.ConnStats == nil || !u.ConnStats.Final {
+			u.ConnStats = stats
+		}
+	}
+}
+
 func (s *SharedData) RemoveStaleData() {
 	s.Lock()
 	defer s.Unlock()
@@ -128,3 +128,59 @@ func TestSharedData_Sync(t *testing.T) {
 		t.Error("McsUser should be removed")
 	}
 }
+
+func TestSharedData_TakeLeftMcsUsers(t *testing.T) {
+	sd := SharedData{
+		mcsUsers: map[string]*McsUser{},
+		mcsGames: map[string]*McsGame{},
+	}
+	sd.ShareMcsUser(&McsUser{BattleCode: "012345", UserID: "USER01", SessionID: "SESSION01", State: McsUserStateJoined})
+	sd.ShareMcsUser(&McsUser{BattleCode: "012345", UserID: "USER02", SessionID: "SESSION02", State: McsUserStateJoined})
+
+	// Synced from a remote mcs.
+	status := &McsStatus{Users: []*McsUser{
+		{BattleCode: "012345", UserID: "USER01", SessionID: "SESSION01", State: McsUserStateJoined,
+			ConnStats: &McsConnStats{Proto: "udp", RTTMs: 30}},
+		{BattleCode: "012345", UserID: "USER02", SessionID: "SESSION02", State: McsUserStateJoined},
+	}}
+	sd.SyncMcsToLbs(status)
+	assertEq(t, 0, len(sd.TakeLeftMcsUsers()))
+
+	status.Users[0] = &McsUser{BattleCode: "012345", UserID: "USER01", SessionID: "SESSION01", State: McsUserStateLeft,
+		CloseReason: "cl_hard_quit", ConnStats: &McsConnStats{Proto: "udp", RTTMs: 40, Final: true}}
+	sd.SyncMcsToLbs(status)
+	left := sd.TakeLeftMcsUsers()
+	assertEq(t, 1, len(left))
+	assertEq(t, "USER01", left[0].UserID)
+	assertEq(t, int64(40), left[0].ConnStats.RTTMs)
+
+	// The final stats are returned only once even if the same status is synced again.
+	sd.SyncMcsToLbs(status)
+	assertEq(t, 0, len(sd.TakeLeftMcsUsers()))
+
+	// Set by the mcs in the same process.
+	sd.SetMcsUserConnStats("SESSION02", &McsConnStats{Proto: "tcp", Final: true})
+	sd.SetMcsUserCloseReason("SESSION02", "sv_recv_timeout")
+	left = sd.TakeLeftMcsUsers()
+	assertEq(t, 1, len(left))
+	assertEq(t, "USER02", left[0].UserID)
+	assertEq(t, "sv_recv_timeout", left[0].CloseReason)
+	assertEq(t, 0, len(sd.TakeLeftMcsUsers()))
+}
+
+func TestSharedData_SetMcsUserConnStats(t *testing.T) {
+	sd := SharedData{
+		mcsUsers: map[string]*McsUser{},
+		mcsGames: map[string]*McsGame{},
+	}
+	sd.ShareMcsUser(&McsUser{UserID: "USER01", SessionID: "SESSION01"})
+
+	sd.SetMcsUserConnStats("SESSION01", &McsConnStats{Proto: "udp", BytesIn: 1})
+	sd.SetMcsUserConnStats("SESSION01", &McsConnStats{Proto: "udp", BytesIn: 2, Final: true})
+	sd.SetMcsUserConnStats("SESSION01", &McsConnStats{Proto: "udp", BytesIn: 3})
+	sd.SetMcsUserConnStats("UNKNOWN", &McsConnStats{Proto: "udp", BytesIn: 4})
+
+	users := sd.GetMcsUsers()
+	assertEq(t, 1, len(users))
+	assertEq(t, &McsConnStats{Proto: "udp", BytesIn: 2, Final: true}, users[0].ConnStats)
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	TournamentFormatSingle = "single" // Single elimination
+	TournamentFormatDouble = "double" // Double elimination
+
+	TournamentStateRunning  = "running"
+	TournamentStateFinished = "finished"
+
+	TournamentBracketWinners = "winners"
+	TournamentBracketLosers  = "losers"
+	TournamentBracketFinal   = "final"
+
+	MatchStatePending = "pending" // Waiting for the previous matches
+	MatchStateReady   = "ready"   // Both entries are decided
+	MatchStatePlaying = "playing" // The battle has started
+	MatchStateDone    = "done"
+
+	// TournamentBye is used as an entry of a match slot that will never be filled.
+	TournamentBye = -1
+)
+
+// Tournament is a bracket of 2-player team entries that is played in a lobby.
+type Tournament struct {
+	ID       string    `db:"id" json:"id"`
+	Name     string    `db:"name" json:"name"`
+	Format   string    `db:"format" json:"format"`
+	Platform string    `db:"platform" json:"platform"`
+	Disk     string    `db:"disk" json:"disk"`
+	LobbyID  int       `db:"lobby_id" json:"lobby_id"`
+	State    string    `db:"state" json:"state"`
+	Champion int       `db:"champion" json:"champion,omitempty"`
+	Created  time.Time `db:"created" json:"created"`
+
+	Entries []*TournamentEntry `db:"-" json:"entries,omitempty"`
+	Matches []*TournamentMatch `db:"-" json:"matches,omitempty"`
+}
+
+// TournamentEntry is a team of a tournament. It is identified by the seed.
+type TournamentEntry struct {
+	TournamentID string `db:"tournament_id" json:"-"`
+	Seed         int    `db:"seed" json:"seed"`
+	Name         string `db:"name" json:"name"`
+	UserID1      string `db:"user_id1" json:"user_id1"`
+	UserID2      string `db:"user_id2" json:"user_id2"`
+}
+
+// TournamentMatch is a match of a tournament.
+// Entry1 and Entry2 are seeds of the entries, 0 means undecided.
+// The winner and the loser advance to the slot of WinnerTo and LoserTo match.
+// Swapped is true when Entry1 plays as Zeon.
+type TournamentMatch struct {
+	TournamentID string    `db:"tournament_id" json:"-"`
+	MatchNo      int       `db:"match_no" json:"match_no"`
+	Bracket      string    `db:"bracket" json:"bracket"`
+	Round        int       `db:"round" json:"round"`
+	Entry1       int       `db:"entry1" json:"entry1"`
+	Entry2       int       `db:"entry2" json:"entry2"`
+	WinnerTo     int       `db:"winner_to" json:"winner_to,omitempty"`
+	WinnerSlot   int       `db:"winner_slot" json:"winner_slot,omitempty"`
+	LoserTo      int       `db:"loser_to" json:"loser_to,omitempty"`
+	LoserSlot    int       `db:"loser_slot" json:"loser_slot,omitempty"`
+	ScheduledAt  time.Time `db:"scheduled_at" json:"scheduled_at"`
+	BattleCode   string    `db:"battle_code" json:"battle_code,omitempty"`
+	Swapped      bool      `db:"swapped" json:"swapped,omitempty"`
+	Winner       int       `db:"winner" json:"winner,omitempty"`
+	State        string    `db:"state" json:"state"`
+	Updated      time.Time `db:"updated" json:"updated"`
+
+	gameSeen bool      // the battle has been shared to the mcs
+	closedAt time.Time // when the battle was found closed without the result
+}
+
+func (e *TournamentEntry) HasUsers(userIDs []string) bool {
+	if len(userIDs) != 2 {
+		return false
+	}
+	return (e.UserID1 == userIDs[0] && e.UserID2 == userIDs[1]) ||
+		(e.UserID1 == userIDs[1] && e.UserID2 == userIDs[0])
+}
+
+func (e *TournamentEntry) HasUser(userID string) bool {
+	return e.UserID1 == userID || e.UserID2 == userID
+}
+
+// NewTournament creates a tournament and its bracket.
+// The entries are seeded in the given order.
+func NewTournament(name, format, platform, disk string, lobbyID int, entries []*TournamentEntry) (*Tournament, error) {
+	if format != TournamentFormatSingle && format != TournamentFormatDouble {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	if len(entries) < 2 {
+		return nil, fmt.Errorf("at least 2 entries are required")
+	}
+	if format == TournamentFormatDouble && len(entries) < 3 {
+		return nil, fmt.Errorf("at least 3 entries are required for double elimination")
+	}
+
+	users := map[string]bool{}
+	for _, e := range entries {
+		if e.UserID1 == "" || e.UserID2 == "" || e.UserID1 == e.UserID2 {
+			return nil, fmt.Errorf("entry %q must have 2 users", e.Name)
+		}
+		for _, u := range []string{e.UserID1, e.UserID2} {
+			if users[u] {
+				return nil, fmt.Errorf("user %s is in multiple entries", u)
+			}
+			users[u] = true
+		}
+	}
+
+	t := &Tournament{
+		ID:       genBattleCode(),
+		Name:     name,
+		Format:   format,
+		Platform: platform,
+		Disk:     disk,
+		LobbyID:  lobbyID,
+		State:    TournamentStateRunning,
+		Created:  time.Now(),
+	}
+
+	for i, e := range entries {
+		t.Entries = append(t.Entries, &TournamentEntry{
+			TournamentID: t.ID,
+			Seed:         i + 1,
+			Name:         e.Name,
+			UserID1:      e.UserID1,
+			UserID2:      e.UserID2,
+		})
+	}
+
+	t.buildBracket()
+	t.advance()
+	return t, nil
+}
+
+// seedOrder returns seeds of the first round in bracket order,
+// so that higher seeds do not meet each other until later rounds.
+func seedOrder(size int) []int {
+	order := []int{1, 2}
+	for len(order) < size {
+		n := len(order) * 2
+		next := make([]int, 0, n)
+		for _, s := range order {
+			next = append(next, s, n+1-s)
+		}
+		order = next
+	}
+	return order
+}
+
+func (t *Tournament) buildBracket() {
+	size := 2
+	rounds := 1
+	for size < len(t.Entries) {
+		size *= 2
+		rounds++
+	}
+
+	newMatch := func(bracket string, round int) *TournamentMatch {
+		m := &TournamentMatch{
+			TournamentID: t.ID,
+			MatchNo:      len(t.Matches) + 1,
+			Bracket:      bracket,
+			Round:        round,
+			State:        MatchStatePending,
+		}
+		t.Matches = append(t.Matches, m)
+		return m
+	}
+	winnerTo := func(from, to *TournamentMatch, slot int) {
+		from.WinnerTo, from.WinnerSlot = to.MatchNo, slot
+	}
+	loserTo := func(from, to *TournamentMatch, slot int) {
+		from.LoserTo, from.LoserSlot = to.MatchNo, slot
+	}
+
+	wb := make([][]*TournamentMatch, rounds+1)
+	for r := 1; r <= rounds; r++ {
+		for i := 0; i < size>>r; i++ {
+			wb[r] = append(wb[r], newMatch(TournamentBracketWinners, r))
+		}
+	}
+
+	seedOrBye := func(seed int) int {
+		if len(t.Entries) < seed {
+			return TournamentBye
+		}
+		return seed
+	}
+	order := seedOrder(size)
+	for i, m := range wb[1] {
+		m.Entry1 = seedOrBye(order[2*i])
+		m.Entry2 = seedOrBye(order[2*i+1])
+	}
+
+	for r := 1; r < rounds; r++ {
+		for i, m := range wb[r] {
+			winnerTo(m, wb[r+1][i/2], i%2+1)
+		}
+	}
+
+	if t.Format != TournamentFormatDouble {
+		return
+	}
+
+	// Losers bracket has 2 rounds for each winners bracket round except the first one.
+	// The odd rounds are played between the losers bracket survivors,
+	// and the even rounds are played against the losers of the winners bracket.
+	lb := make([][]*TournamentMatch, 2*(rounds-1)+1)
+	for i := 0; i < size>>2; i++ {
+		m := newMatch(TournamentBracketLosers, 1)
+		lb[1] = append(lb[1], m)
+		loserTo(wb[1][2*i], m, 1)
+		loserTo(wb[1][2*i+1], m, 2)
+	}
+
+	for r := 1; r < rounds; r++ {
+		even := 2 * r
+		n := size >> (r + 1)
+		for i := 0; i < n; i++ {
+			m := newMatch(TournamentBracketLosers, even)
+			lb[even] = append(lb[even], m)
+			winnerTo(lb[even-1][i], m, 1)
+			// Cross over to avoid rematches as much as possible.
+			loserTo(wb[r+1][n-1-i], m, 2)
+		}
+
+		if r == rounds-1 {
+			break
+		}
+
+		odd := 2*r + 1
+		for i := 0; i < n/2; i++ {
+			m := newMatch(TournamentBracketLosers, odd)
+			lb[odd] = append(lb[odd], m)
+			winnerTo(lb[even][2*i], m, 1)
+			winnerTo(lb[even][2*i+1], m, 2)
+		}
+	}
+
+	final := newMatch(TournamentBracketFinal, 1)
+	winnerTo(wb[rounds][0], final, 1)
+	winnerTo(lb[2*(rounds-1)][0], final, 2)
+
+	// The bracket reset is played only when the winners bracket champion loses the grand final,
+	// so that the champion is also eliminated by the second loss.
+	reset := newMatch(TournamentBracketFinal, 2)
+	winnerTo(final, reset, 1)
+	loserTo(final, reset, 2)
+}
+
+func (t *Tournament) Match(matchNo int) *TournamentMatch {
+	if matchNo < 1 || len(t.Matches) < matchNo {
+		return nil
+	}
+	return t.Matches[matchNo-1]
+}
+
+func (t *Tournament) Entry(seed int) *TournamentEntry {
+	if seed < 1 || len(t.Entries) < seed {
+		return nil
+	}
+	return t.Entries[seed-1]
+}
+
+func (t *Tournament) setSlot(matchNo, slot, entry int) {
+	m := t.Match(matchNo)
+	if m == nil {
+		return
+	}
+	if slot == 1 {
+		m.Entry1 = entry
+	} else {
+		m.Entry2 = entry
+	}
+	m.Updated = time.Now()
+}
+
+func (t *Tournament) finishMatch(m *TournamentMatch, winner int) {
+	loser := m.Entry1
+	if winner == m.Entry1 {
+		loser = m.Entry2
+	}
+	if winner == TournamentBye {
+		loser = TournamentBye
+	}
+
+	m.Winner = winner
+	m.State = MatchStateDone
+	m.Updated = time.Now()
+
+	if m.Bracket == TournamentBracketFinal && m.WinnerTo != 0 && winner == m.Entry1 {
+		// The winners bracket champion has won the grand final, the bracket reset is not played.
+		if reset := t.Match(m.WinnerTo); reset != nil {
+			reset.Entry1, reset.Entry2, reset.Winner = TournamentBye, TournamentBye, TournamentBye
+			reset.State = MatchStateDone
+			reset.Updated = time.Now()
+		}
+		t.State = TournamentStateFinished
+		t.Champion = winner
+		return
+	}
+
+	if m.WinnerTo != 0 {
+		t.setSlot(m.WinnerTo, m.WinnerSlot, winner)
+	} else {
+		t.State = TournamentStateFinished
+		t.Champion = winner
+	}
+	if m.LoserTo != 0 {
+		t.setSlot(m.LoserTo, m.LoserSlot, loser)
+	}
+}
+
+// advance resolves matches that have a bye and makes matches ready when both entries are decided.
+func (t *Tournament) advance() {
+	for changed := true; changed; {
+		changed = false
+		for _, m := range t.Matches {
+			if m.State != MatchStatePending || m.Entry1 == 0 || m.Entry2 == 0 {
+				continue
+			}
+
+			if m.Entry1 == TournamentBye || m.Entry2 == TournamentBye {
+				winner := m.Entry1
+				if winner == TournamentBye {
+					winner = m.Entry2
+				}
+				t.finishMatch(m, winner)
+				changed = true
+				continue
+			}
+
+			m.State = MatchStateReady
+			m.Updated = time.Now()
+		}
+	}
+}
+
+// SetResult decides the winner of the match and advances the bracket.
+func (t *Tournament) SetResult(matchNo, winner int) error {
+	m := t.Match(matchNo)
+	if m == nil {
+		return fmt.Errorf("match %d not found", matchNo)
+	}
+	if m.State != MatchStateReady && m.State != MatchStatePlaying {
+		return fmt.Errorf("match %d is %s", matchNo, m.State)
+	}
+	if winner != m.Entry1 && winner != m.Entry2 {
+		return fmt.Errorf("entry %d is not in match %d", winner, matchNo)
+	}
+
+	t.finishMatch(m, winner)
+	t.advance()
+	return nil
+}
+
+// ResetMatch makes the playing match ready again, e.g. the battle has been aborted.
+func (t *Tournament) ResetMatch(matchNo int) error {
+	m := t.Match(matchNo)
+	if m == nil {
+		return fmt.Errorf("match %d not found", matchNo)
+	}
+	if m.State != MatchStatePlaying {
+		return fmt.Errorf("match %d is %s", matchNo, m.State)
+	}
+
+	m.State = MatchStateReady
+	m.BattleCode = ""
+	m.Swapped = false
+	m.gameSeen = false
+	m.closedAt = time.Time{}
+	m.Updated = time.Now()
+	return nil
+}
+
+// FindReadyMatch returns a ready match between the teams.
+// swapped is true when team1 is Entry2 of the match.
+func (t *Tournament) FindReadyMatch(team1, team2 []string, now time.Time) (m *TournamentMatch, swapped bool) {
+	for _, m := range t.Matches {
+		if m.State != MatchStateReady || now.Before(m.ScheduledAt) {
+			continue
+		}
+		e1, e2 := t.Entry(m.Entry1), t.Entry(m.Entry2)
+		if e1.HasUsers(team1) && e2.HasUsers(team2) {
+			return m, false
+		}
+		if e2.HasUsers(team1) && e1.HasUsers(team2) {
+			return m, true
+		}
+	}
+	return nil, false
+}
+
+func (t *Tournament) FindMatchByBattleCode(battleCode string) *TournamentMatch {
+	for _, m := range t.Matches {
+		if m.BattleCode == battleCode && m.State == MatchStatePlaying {
+			return m
+		}
+	}
+	return nil
+}
+
+// Standings returns seeds of the entries that have been eliminated, the champion comes first.
+func (t *Tournament) Standings() []int {
+	lastLost := map[int]int{}
+	for _, m := range t.Matches {
+		if m.State != MatchStateDone || m.Winner == TournamentBye {
+			continue
+		}
+		loser := m.Entry1
+		if m.Winner == m.Entry1 {
+			loser = m.Entry2
+		}
+		if loser != TournamentBye {
+			lastLost[loser] = m.MatchNo
+		}
+	}
+
+	var ret []int
+	if 0 < t.Champion {
+		ret = append(ret, t.Champion)
+	}
+	var eliminated []int
+	for seed := range lastLost {
+		if seed != t.Champion {
+			eliminated = append(eliminated, seed)
+		}
+	}
+	sort.Slice(eliminated, func(i, j int) bool {
+		return lastLost[eliminated[i]] > lastLost[eliminated[j]]
+	})
+	return append(ret, eliminated...)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func testTournamentEntries(n int) []*TournamentEntry {
+	var entries []*TournamentEntry
+	for i := 1; i <= n; i++ {
+		entries = append(entries, &TournamentEntry{
+			Name:    string(rune('A' + i - 1)),
+			UserID1: string(rune('A'+i-1)) + "1",
+			UserID2: string(rune('A'+i-1)) + "2",
+		})
+	}
+	return entries
+}
+
+func Test_seedOrder(t *testing.T) {
+	assertEq(t, []int{1, 2}, seedOrder(2))
+	assertEq(t, []int{1, 4, 2, 3}, seedOrder(4))
+	assertEq(t, []int{1, 8, 4, 5, 2, 7, 3, 6}, seedOrder(8))
+}
+
+func TestNewTournament_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		entries []*TournamentEntry
+	}{
+		{"unknown format", "league", testTournamentEntries(4)},
+		{"too few entries", TournamentFormatSingle, testTournamentEntries(1)},
+		{"too few entries for double", TournamentFormatDouble, testTournamentEntries(2)},
+		{"missing user", TournamentFormatSingle, append(testTournamentEntries(2), &TournamentEntry{Name: "X", UserID1: "X1"})},
+		{"duplicated user", TournamentFormatSingle, append(testTournamentEntries(2), &TournamentEntry{Name: "X", UserID1: "X1", UserID2: "A1"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTournament("test", tt.format, PlatformConsole, GameDiskPS2, 1, tt.entries)
+			if err == nil {
+				t.Fatal("error expected")
+			}
+		})
+	}
+}
+
+func TestTournament_SingleElimination(t *testing.T) {
+	tr, err := NewTournament("test", TournamentFormatSingle, PlatformConsole, GameDiskPS2, 1, testTournamentEntries(5))
+	must(t, err)
+
+	// 8 slots: 4 + 2 + 1 matches
+	assertEq(t, 7, len(tr.Matches))
+
+	// Seed 1, 2 and 3 advance without playing.
+	assertEq(t, 1, tr.Match(1).Winner)
+	assertEq(t, MatchStateReady, tr.Match(2).State)
+	assertEq(t, 4, tr.Match(2).Entry1)
+	assertEq(t, 5, tr.Match(2).Entry2)
+	assertEq(t, 2, tr.Match(3).Winner)
+	assertEq(t, 3, tr.Match(4).Winner)
+	assertEq(t, MatchStatePending, tr.Match(5).State)
+	assertEq(t, MatchStateReady, tr.Match(6).State)
+	assertEq(t, 2, tr.Match(6).Entry1)
+	assertEq(t, 3, tr.Match(6).Entry2)
+
+	if err := tr.SetResult(2, 1); err == nil {
+		t.Fatal("entry 1 is not in match 2")
+	}
+	if err := tr.SetResult(5, 1); err == nil {
+		t.Fatal("match 5 is not ready")
+	}
+
+	must(t, tr.SetResult(2, 5))
+	assertEq(t, MatchStateReady, tr.Match(5).State)
+	assertEq(t, 5, tr.Match(5).Entry2)
+
+	must(t, tr.SetResult(5, 5))
+	must(t, tr.SetResult(6, 3))
+	assertEq(t, TournamentStateRunning, tr.State)
+	must(t, tr.SetResult(7, 3))
+	assertEq(t, TournamentStateFinished, tr.State)
+	assertEq(t, 3, tr.Champion)
+	assertEq(t, []int{3, 5, 2, 1, 4}, tr.Standings())
+}
+
+func TestTournament_DoubleElimination(t *testing.T) {
+	tr, err := NewTournament("test", TournamentFormatDouble, PlatformConsole, GameDiskPS2, 1, testTournamentEntries(4))
+	must(t, err)
+
+	// WB: 2 + 1, LB: 1 + 1, GF: 1 + bracket reset
+	assertEq(t, 7, len(tr.Matches))
+	assertEq(t, TournamentBracketLosers, tr.Match(4).Bracket)
+	assertEq(t, TournamentBracketFinal, tr.Match(6).Bracket)
+	assertEq(t, TournamentBracketFinal, tr.Match(7).Bracket)
+
+	must(t, tr.SetResult(1, 1)) // 1 vs 4
+	must(t, tr.SetResult(2, 3)) // 2 vs 3
+	assertEq(t, MatchStateReady, tr.Match(4).State)
+	assertEq(t, 4, tr.Match(4).Entry1)
+	assertEq(t, 2, tr.Match(4).Entry2)
+
+	must(t, tr.SetResult(3, 1)) // WB final
+	must(t, tr.SetResult(4, 2))
+	assertEq(t, 3, tr.Match(5).Entry2)
+	assertEq(t, 2, tr.Match(5).Entry1)
+
+	must(t, tr.SetResult(5, 3)) // LB final
+	assertEq(t, 1, tr.Match(6).Entry1)
+	assertEq(t, 3, tr.Match(6).Entry2)
+
+	must(t, tr.SetResult(6, 3))
+	assertEq(t, TournamentStateRunning, tr.State)
+	assertEq(t, MatchStateReady, tr.Match(7).State)
+	assertEq(t, 3, tr.Match(7).Entry1)
+	assertEq(t, 1, tr.Match(7).Entry2)
+
+	must(t, tr.SetResult(7, 3)) // bracket reset
+	assertEq(t, TournamentStateFinished, tr.State)
+	assertEq(t, 3, tr.Champion)
+	assertEq(t, []int{3, 1, 2, 4}, tr.Standings())
+}
+
+func TestTournament_DoubleEliminationNoReset(t *testing.T) {
+	tr, err := NewTournament("test", TournamentFormatDouble, PlatformConsole, GameDiskPS2, 1, testTournamentEntries(4))
+	must(t, err)
+
+	must(t, tr.SetResult(1, 1))
+	must(t, tr.SetResult(2, 3))
+	must(t, tr.SetResult(3, 1))
+	must(t, tr.SetResult(4, 2))
+	must(t, tr.SetResult(5, 3))
+
+	// The bracket reset is not played if the winners bracket champion wins the grand final.
+	must(t, tr.SetResult(6, 1))
+	assertEq(t, TournamentStateFinished, tr.State)
+	assertEq(t, 1, tr.Champion)
+	assertEq(t, MatchStateDone, tr.Match(7).State)
+	assertEq(t, TournamentBye, tr.Match(7).Winner)
+	assertEq(t, []int{1, 3, 2, 4}, tr.Standings())
+}
+
+func TestTournament_DoubleEliminationBye(t *testing.T) {
+	tr, err := NewTournament("test", TournamentFormatDouble, PlatformConsole, GameDiskPS2, 1, testTournamentEntries(5))
+	must(t, err)
+
+	// WB: 4 + 2 + 1, LB: 2 + 2 + 1 + 1, GF: 1 + bracket reset
+	assertEq(t, 15, len(tr.Matches))
+
+	// Only match 2 (4 vs 5) is played in the first round,
+	// so the loser advances to LB round 2 without playing LB round 1.
+	assertEq(t, MatchStatePending, tr.Match(8).State)
+	assertEq(t, MatchStateDone, tr.Match(9).State)
+	assertEq(t, TournamentBye, tr.Match(9).Winner)
+
+	must(t, tr.SetResult(2, 4))
+	assertEq(t, 5, tr.Match(8).Winner)
+	must(t, tr.SetResult(6, 2))
+	for tr.State != TournamentStateFinished {
+		played := false
+		for _, m := range tr.Matches {
+			if m.State == MatchStateReady {
+				must(t, tr.SetResult(m.MatchNo, m.Entry1))
+				played = true
+				break
+			}
+		}
+		if !played {
+			t.Fatal("no ready match")
+		}
+	}
+
+	// Everyone except the champion loses twice.
+	assertEq(t, 5, len(tr.Standings()))
+}
+
+func TestTournament_FindReadyMatch(t *testing.T) {
+	tr, err := NewTournament("test", TournamentFormatSingle, PlatformConsole, GameDiskPS2, 1, testTournamentEntries(4))
+	must(t, err)
+
+	now := time.Now()
+	m, swapped := tr.FindReadyMatch([]string{"A1", "A2"}, []string{"D2", "D1"}, now)
+	assertEq(t, 1, m.MatchNo)
+	assertEq(t, false, swapped)
+
+	m, swapped = tr.FindReadyMatch([]string{"C1", "C2"}, []string{"B1", "B2"}, now)
+	assertEq(t, 2, m.MatchNo)
+	assertEq(t, true, swapped)
+
+	m, _ = tr.FindReadyMatch([]string{"A1", "A2"}, []string{"B1", "B2"}, now)
+	assertEq(t, (*TournamentMatch)(nil), m)
+
+	tr.Match(1).ScheduledAt = now.Add(time.Hour)
+	m, _ = tr.FindReadyMatch([]string{"A1", "A2"}, []string{"D1", "D2"}, now)
+	assertEq(t, (*TournamentMatch)(nil), m)
+}
+
+func TestLbs_Tournament(t *testing.T) {
+	cleanTables(t, "tournament", "tournament_entry", "tournament_match")
+	defer cleanTables(t, "tournament", "tournament_entry", "tournament_match")
+
+	lbs := NewLbs()
+	tr, err := NewTournament("test", TournamentFormatSingle, PlatformConsole, GameDiskPS2, 3, testTournamentEntries(4))
+	must(t, err)
+	must(t, lbs.CreateTournament(tr))
+	assertEq(t, tr, lbs.FindTournament(PlatformConsole, GameDiskPS2, 3))
+
+	another, err := NewTournament("another", TournamentFormatSingle, PlatformConsole, GameDiskPS2, 3, testTournamentEntries(2))
+	must(t, err)
+	if err := lbs.CreateTournament(another); err == nil {
+		t.Fatal("a lobby can not have two tournaments")
+	}
+
+	room := func(userIDs ...string) *readyRoom {
+		r := &readyRoom{}
+		for _, id := range userIDs {
+			r.peers = append(r.peers, &LbsPeer{DBUser: DBUser{UserID: id}})
+		}
+		return r
+	}
+	renpoRooms := []*readyRoom{room("A1", "A2"), room("B1", "B2")}
+	zeonRooms := []*readyRoom{room("C1", "C2")}
+	renpo, zeon, m, swapped := lbs.findTournamentRooms(tr, renpoRooms, zeonRooms)
+	assertEq(t, renpoRooms[1], renpo)
+	assertEq(t, zeonRooms[0], zeon)
+	assertEq(t, 2, m.MatchNo)
+	assertEq(t, false, swapped)
+
+	// The battle is not regarded as closed before it is shared to the mcs.
+	lbs.startTournamentMatch(tr, m, "aborted_battle", swapped)
+	now := time.Now()
+	lbs.updateTournamentMatches(now)
+	lbs.updateTournamentMatches(now.Add(tournamentAbortGrace / 2))
+	assertEq(t, MatchStatePlaying, m.State)
+
+	// The battle closed without the result, the match gets ready after the grace.
+	sharedData.ShareMcsGame(&McsGame{BattleCode: "aborted_battle", UpdatedAt: now})
+	defer sharedData.RemoveStaleData()
+	lbs.updateTournamentMatches(now)
+	sharedData.UpdateMcsGameState("aborted_battle", McsGameStateClosed)
+	lbs.updateTournamentMatches(now)
+	assertEq(t, MatchStatePlaying, m.State)
+	lbs.updateTournamentMatches(now.Add(tournamentAbortGrace))
+	assertEq(t, MatchStateReady, m.State)
+	assertEq(t, "", m.BattleCode)
+
+	// Entry1 (B) plays as Zeon.
+	renpo, zeon, m, swapped = lbs.findTournamentRooms(tr, []*readyRoom{room("C1", "C2")}, []*readyRoom{room("B1", "B2")})
+	assertEq(t, 2, m.MatchNo)
+	assertEq(t, true, swapped)
+
+	lbs.startTournamentMatch(tr, m, "tournament_battle", swapped)
+	for _, r := range []BattleRecord{
+		{UserID: "B1", Team: TeamZeon, Win: 1, Lose: 2, System: 1},
+		{UserID: "B2", Team: TeamZeon},
+		{UserID: "C1", Team: TeamRenpo},
+		{UserID: "C2", Team: TeamRenpo},
+	} {
+		r.BattleCode = "tournament_battle"
+		r.Players = 4
+		mustInsertBattleRecord(r)
+	}
+	lbs.updateTournamentResult("tournament_battle")
+	assertEq(t, 3, m.Winner)
+	assertEq(t, 3, tr.Match(3).Entry2)
+
+	t.Run("persisted", func(t *testing.T) {
+		loaded, err := getDB().GetTournament(tr.ID)
+		must(t, err)
+		assertEq(t, 4, len(loaded.Entries))
+		assertEq(t, "C2", loaded.Entry(3).UserID2)
+		assertEq(t, MatchStateDone, loaded.Match(2).State)
+		assertEq(t, "tournament_battle", loaded.Match(2).BattleCode)
+		assertEq(t, true, loaded.Match(2).Swapped)
+		assertEq(t, 3, loaded.Match(3).Entry2)
+
+		// Running tournaments are restored on startup.
+		assertEq(t, tr.ID, NewLbs().FindTournament(PlatformConsole, GameDiskPS2, 3).ID)
+	})
+
+	t.Run("override result", func(t *testing.T) {
+		must(t, lbs.SetTournamentResult(tr, 1, 4))
+		must(t, lbs.SetTournamentResult(tr, 3, 3))
+		assertEq(t, TournamentStateFinished, tr.State)
+		assertEq(t, (*Tournament)(nil), lbs.FindTournament(PlatformConsole, GameDiskPS2, 3))
+
+		loaded, err := lbs.GetTournament(tr.ID)
+		must(t, err)
+		assertEq(t, TournamentStateFinished, loaded.State)
+		assertEq(t, 3, loaded.Champion)
+	})
+}
@@ -17,6 +17,7 @@ require (
 	golang.org/x/text v0.32.0
 	google.golang.org/api v0.258.0
 	google.golang.org/protobuf v1.36.11
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (